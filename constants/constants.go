@@ -3,4 +3,96 @@ package constants
 const (
 	ASSET_TYPE_MODEL = "model"
 	ASSET_TYPE_DATASET = "dataset"
-)
\ No newline at end of file
+)
+
+// Outcome of an inference request, stored alongside its inference record.
+// Only successful inferences are settled, the others are kept for auditing.
+const (
+	INFERENCE_STATUS_SUCCESS       = "success"
+	INFERENCE_STATUS_BACKEND_ERROR = "backend_error"
+	INFERENCE_STATUS_CLIENT_ABORT  = "client_abort"
+	INFERENCE_STATUS_TIMEOUT       = "timeout"
+	INFERENCE_STATUS_PARTIAL       = "partial"
+)
+
+// Policies for extracting the query stored in an inference record from the conversation
+const (
+	QUERY_POLICY_LAST_USER       = "last_user"
+	QUERY_POLICY_ALL_USER        = "all_user"
+	QUERY_POLICY_TRANSCRIPT_HASH = "transcript_hash"
+)
+
+// Roles accepted in inference conversation messages
+const (
+	MESSAGE_ROLE_SYSTEM    = "system"
+	MESSAGE_ROLE_USER      = "user"
+	MESSAGE_ROLE_ASSISTANT = "assistant"
+	MESSAGE_ROLE_TOOL      = "tool"
+)
+
+// Units an asset price is charged in
+const (
+	PRICING_UNIT_PER_CALL      = "per_call"
+	PRICING_UNIT_PER_1K_TOKENS = "per_1k_tokens"
+	PRICING_UNIT_PER_DOWNLOAD  = "per_download"
+)
+
+// Model runtimes an asset can be served by
+const (
+	RUNTIME_OLLAMA   = "ollama"
+	RUNTIME_LLAMACPP = "llamacpp"
+	RUNTIME_OPENAI   = "openai"
+)
+
+// Status of a batch inference job
+const (
+	BATCH_STATUS_QUEUED    = "queued"
+	BATCH_STATUS_RUNNING   = "running"
+	BATCH_STATUS_COMPLETED = "completed"
+	BATCH_STATUS_CANCELLED = "cancelled"
+)
+
+// Status of a single request of a batch inference job. Processed items take the
+// INFERENCE_STATUS_* outcome of their inference.
+const (
+	BATCH_ITEM_STATUS_PENDING   = "pending"
+	BATCH_ITEM_STATUS_RUNNING   = "running"
+	BATCH_ITEM_STATUS_CANCELLED = "cancelled"
+)
+
+// Events webhook subscriptions can be notified of
+const (
+	WEBHOOK_EVENT_INFERENCE_COMPLETED = "inference.completed"
+	WEBHOOK_EVENT_BATCH_COMPLETED     = "batch.completed"
+	WEBHOOK_EVENT_BATCH_CANCELLED     = "batch.cancelled"
+	WEBHOOK_EVENT_ASSET_UPLOADED      = "asset.uploaded"
+	WEBHOOK_EVENT_MODEL_LAUNCH_FAILED = "model.launch_failed"
+	WEBHOOK_EVENT_SETTLEMENT_EXECUTED = "settlement.executed"
+	WEBHOOK_EVENT_SETTLEMENT_FAILED   = "settlement.failed"
+)
+
+// Status of a webhook delivery, pending deliveries are retried with backoff
+const (
+	WEBHOOK_DELIVERY_STATUS_PENDING   = "pending"
+	WEBHOOK_DELIVERY_STATUS_DELIVERED = "delivered"
+	WEBHOOK_DELIVERY_STATUS_FAILED    = "failed"
+)
+
+// Status of a resumable upload
+const (
+	UPLOAD_STATUS_PENDING   = "pending"
+	UPLOAD_STATUS_COMPLETED = "completed"
+)
+
+// Status of an asset import job. Jobs go through the stages in this order, imports by URL
+// start with downloading and uploaded files with hashing.
+const (
+	IMPORT_STATUS_QUEUED      = "queued"
+	IMPORT_STATUS_DOWNLOADING = "downloading"
+	IMPORT_STATUS_HASHING     = "hashing"
+	IMPORT_STATUS_MINTING     = "minting"
+	IMPORT_STATUS_LAUNCHING   = "launching"
+	IMPORT_STATUS_DONE        = "done"
+	IMPORT_STATUS_FAILED      = "failed"
+	IMPORT_STATUS_CANCELLED   = "cancelled"
+)
@@ -1,9 +1,29 @@
 package db
 
 import (
+	"database/sql"
 	"fmt"
 )
 
+type Asset struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	ModelTag string `json:"model_tag"`
+	// Runtime is the inference backend serving a model asset, one of constants.RUNTIME_*
+	Runtime string `json:"runtime"`
+	// Projector is the file name of the vision projector of a multimodal model, empty
+	// for models which do not accept images
+	Projector string `json:"projector,omitempty"`
+	// SourceRepo, SourceRevision and SourceCommit record the Hugging Face repository an
+	// imported asset was downloaded from, the revision asked for and the commit it resolved
+	// to, and SourceSHA256 the checksum of the downloaded file. They are empty for uploads.
+	SourceRepo     string `json:"source_repo,omitempty"`
+	SourceRevision string `json:"source_revision,omitempty"`
+	SourceCommit   string `json:"source_commit,omitempty"`
+	SourceSHA256   string `json:"source_sha256,omitempty"`
+}
+
 func GetExistingAssets(s *InferenceStorage) ([]string, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -27,3 +47,99 @@ func GetExistingAssets(s *InferenceStorage) ([]string, error) {
 
 	return assets, nil
 }
+
+// AddAsset registers an uploaded asset, replacing any previous entry with the same ID
+func AddAsset(s *InferenceStorage, a *Asset) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.Exec(
+		"INSERT OR REPLACE INTO assets (id, name, asset_type, model_tag, runtime, projector, source_repo, source_revision, source_commit, source_sha256) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		a.ID, a.Name, a.Type, a.ModelTag, a.Runtime, a.Projector, a.SourceRepo, a.SourceRevision, a.SourceCommit, a.SourceSHA256,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert asset %s: %v", a.ID, err)
+	}
+	return nil
+}
+
+// GetAsset returns the registered asset, or nil if the asset is unknown
+func GetAsset(s *InferenceStorage, assetID string) (*Asset, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var a Asset
+	err := s.db.QueryRow("SELECT id, name, asset_type, model_tag, runtime, projector, source_repo, source_revision, source_commit, source_sha256 FROM assets WHERE id = ?", assetID).
+		Scan(&a.ID, &a.Name, &a.Type, &a.ModelTag, &a.Runtime, &a.Projector, &a.SourceRepo, &a.SourceRevision, &a.SourceCommit, &a.SourceSHA256)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch asset %s: %v", assetID, err)
+	}
+	return &a, nil
+}
+
+// AssetFile is a file of an asset, listed in the manifest minted for assets made of
+// several files
+type AssetFile struct {
+	// Path is relative to the upload directory of the asset, with slash separators
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// SetAssetFiles stores the files of an asset, replacing those stored before
+func SetAssetFiles(s *InferenceStorage, assetID string, files []AssetFile) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM asset_files WHERE asset_id = ?", assetID); err != nil {
+		return fmt.Errorf("failed to delete files of asset %s: %v", assetID, err)
+	}
+	for _, file := range files {
+		if _, err := tx.Exec(
+			"INSERT INTO asset_files (asset_id, path, size, sha256) VALUES (?, ?, ?, ?)",
+			assetID, file.Path, file.Size, file.SHA256,
+		); err != nil {
+			return fmt.Errorf("failed to insert file %s of asset %s: %v", file.Path, assetID, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return nil
+}
+
+// GetAssetFiles returns the files of an asset ordered by path. Assets registered before
+// files were tracked have none.
+func GetAssetFiles(s *InferenceStorage, assetID string) ([]AssetFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rows, err := s.db.Query("SELECT path, size, sha256 FROM asset_files WHERE asset_id = ? ORDER BY path", assetID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch files of asset %s: %v", assetID, err)
+	}
+	defer rows.Close()
+
+	files := []AssetFile{}
+	for rows.Next() {
+		var file AssetFile
+		if err := rows.Scan(&file.Path, &file.Size, &file.SHA256); err != nil {
+			return nil, fmt.Errorf("failed to scan asset file: %v", err)
+		}
+		files = append(files, file)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to fetch files of asset %s: %v", assetID, err)
+	}
+	return files, nil
+}
@@ -0,0 +1,318 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"depin-server/constants"
+)
+
+// BatchJob is a set of inference requests against one asset, signed once by the DID
+// and processed in the background. The signature is never sent to clients.
+type BatchJob struct {
+	ID         string `json:"id"`
+	Did        string `json:"did"`
+	AssetID    string `json:"asset_id"`
+	AssetValue string `json:"asset_value"`
+	Timestamp  string `json:"timestamp"`
+	Signature  string `json:"-"`
+	Status     string `json:"status"`
+	Total      int    `json:"total"`
+	Succeeded  int    `json:"succeeded"`
+	Failed     int    `json:"failed"`
+	Cancelled  int    `json:"cancelled"`
+	CreatedAt  int64  `json:"created_at"`
+	UpdatedAt  int64  `json:"updated_at"`
+}
+
+// BatchItem is a single request of a batch job and, once processed, its outcome
+type BatchItem struct {
+	BatchID  string `json:"batch_id"`
+	Index    int    `json:"index"`
+	CustomID string `json:"custom_id"`
+	// Input is the JSON encoded inference input
+	Input    string `json:"input"`
+	Query    string `json:"query"`
+	Status   string `json:"status"`
+	Response string `json:"response"`
+	Error    string `json:"error"`
+	RecordID string `json:"record_id"`
+}
+
+// CreateBatchJob stores a queued batch job with its pending items
+func CreateBatchJob(s *InferenceStorage, job *BatchJob, items []*BatchItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		"INSERT INTO batch_jobs (id, did, asset_id, asset_value, timestamp, signature, status, total, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		job.ID, job.Did, job.AssetID, job.AssetValue, job.Timestamp, job.Signature, job.Status, job.Total, job.CreatedAt, job.UpdatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert batch job %s: %v", job.ID, err)
+	}
+
+	stmt, err := tx.Prepare("INSERT INTO batch_items (batch_id, item_index, custom_id, input, query, status) VALUES (?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return fmt.Errorf("failed to prepare batch item insert: %v", err)
+	}
+	defer stmt.Close()
+
+	for _, item := range items {
+		if _, err := stmt.Exec(job.ID, item.Index, item.CustomID, item.Input, item.Query, item.Status); err != nil {
+			return fmt.Errorf("failed to insert item %d of batch job %s: %v", item.Index, job.ID, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return nil
+}
+
+// GetBatchJob returns a batch job, or nil if it is unknown
+func GetBatchJob(s *InferenceStorage, batchID string) (*BatchJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return getBatchJob(s.db, batchID)
+}
+
+// CancelBatchJob cancels the pending items of a queued or running batch job. Items
+// already running complete normally. It returns nil if the job is unknown.
+func CancelBatchJob(s *InferenceStorage, batchID string) (*BatchJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	job, err := getBatchJob(tx, batchID)
+	if err != nil || job == nil {
+		return nil, err
+	}
+	if job.Status != constants.BATCH_STATUS_QUEUED && job.Status != constants.BATCH_STATUS_RUNNING {
+		return job, nil
+	}
+
+	result, err := tx.Exec(
+		"UPDATE batch_items SET status = ? WHERE batch_id = ? AND status = ?",
+		constants.BATCH_ITEM_STATUS_CANCELLED, batchID, constants.BATCH_ITEM_STATUS_PENDING,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to cancel items of batch job %s: %v", batchID, err)
+	}
+	cancelled, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("failed to cancel items of batch job %s: %v", batchID, err)
+	}
+
+	_, err = tx.Exec(
+		"UPDATE batch_jobs SET status = ?, cancelled = cancelled + ?, updated_at = ? WHERE id = ?",
+		constants.BATCH_STATUS_CANCELLED, cancelled, time.Now().Unix(), batchID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to cancel batch job %s: %v", batchID, err)
+	}
+
+	job, err = getBatchJob(tx, batchID)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return job, nil
+}
+
+// ClaimBatchItem marks the next pending item of the oldest active batch job as running
+// and returns it with its job. It returns nil if no item is pending.
+func ClaimBatchItem(s *InferenceStorage) (*BatchJob, *BatchItem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var item BatchItem
+	err = tx.QueryRow(`
+		SELECT i.batch_id, i.item_index, i.custom_id, i.input, i.query
+		FROM batch_items i JOIN batch_jobs j ON j.id = i.batch_id
+		WHERE i.status = ? AND j.status IN (?, ?)
+		ORDER BY j.created_at, i.batch_id, i.item_index
+		LIMIT 1`,
+		constants.BATCH_ITEM_STATUS_PENDING, constants.BATCH_STATUS_QUEUED, constants.BATCH_STATUS_RUNNING,
+	).Scan(&item.BatchID, &item.Index, &item.CustomID, &item.Input, &item.Query)
+	if err == sql.ErrNoRows {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch pending batch item: %v", err)
+	}
+	item.Status = constants.BATCH_ITEM_STATUS_RUNNING
+
+	if _, err := tx.Exec(
+		"UPDATE batch_items SET status = ? WHERE batch_id = ? AND item_index = ?",
+		item.Status, item.BatchID, item.Index,
+	); err != nil {
+		return nil, nil, fmt.Errorf("failed to claim item %d of batch job %s: %v", item.Index, item.BatchID, err)
+	}
+	if _, err := tx.Exec(
+		"UPDATE batch_jobs SET status = ?, updated_at = ? WHERE id = ? AND status = ?",
+		constants.BATCH_STATUS_RUNNING, time.Now().Unix(), item.BatchID, constants.BATCH_STATUS_QUEUED,
+	); err != nil {
+		return nil, nil, fmt.Errorf("failed to start batch job %s: %v", item.BatchID, err)
+	}
+
+	job, err := getBatchJob(tx, item.BatchID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, nil, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return job, &item, nil
+}
+
+// ReleaseBatchItem returns a claimed item to the pending items, to be retried later
+func ReleaseBatchItem(s *InferenceStorage, item *BatchItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.Exec(
+		"UPDATE batch_items SET status = ? WHERE batch_id = ? AND item_index = ? AND status = ?",
+		constants.BATCH_ITEM_STATUS_PENDING, item.BatchID, item.Index, constants.BATCH_ITEM_STATUS_RUNNING,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to release item %d of batch job %s: %v", item.Index, item.BatchID, err)
+	}
+	return nil
+}
+
+// FinishBatchItem stores the outcome of a processed item and updates the progress of its
+// job, which is completed once every item has been processed or cancelled. It reports
+// whether this item completed the job.
+func FinishBatchItem(s *InferenceStorage, item *BatchItem) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		"UPDATE batch_items SET status = ?, response = ?, error = ?, record_id = ? WHERE batch_id = ? AND item_index = ?",
+		item.Status, item.Response, item.Error, item.RecordID, item.BatchID, item.Index,
+	); err != nil {
+		return false, fmt.Errorf("failed to update item %d of batch job %s: %v", item.Index, item.BatchID, err)
+	}
+
+	counter := "failed"
+	if item.Status == constants.INFERENCE_STATUS_SUCCESS {
+		counter = "succeeded"
+	}
+	if _, err := tx.Exec(
+		fmt.Sprintf("UPDATE batch_jobs SET %s = %s + 1, updated_at = ? WHERE id = ?", counter, counter),
+		time.Now().Unix(), item.BatchID,
+	); err != nil {
+		return false, fmt.Errorf("failed to update progress of batch job %s: %v", item.BatchID, err)
+	}
+
+	result, err := tx.Exec(
+		"UPDATE batch_jobs SET status = ? WHERE id = ? AND status = ? AND succeeded + failed + cancelled >= total",
+		constants.BATCH_STATUS_COMPLETED, item.BatchID, constants.BATCH_STATUS_RUNNING,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to complete batch job %s: %v", item.BatchID, err)
+	}
+	completed, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to complete batch job %s: %v", item.BatchID, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return completed > 0, nil
+}
+
+// ResetRunningBatchItems returns items left running by a previous server process to the
+// pending items
+func ResetRunningBatchItems(s *InferenceStorage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.Exec(
+		"UPDATE batch_items SET status = ? WHERE status = ?",
+		constants.BATCH_ITEM_STATUS_PENDING, constants.BATCH_ITEM_STATUS_RUNNING,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to reset running batch items: %v", err)
+	}
+	return nil
+}
+
+// GetBatchItems returns up to limit items of a batch job, starting after the item at
+// afterIndex (-1 for the first page)
+func GetBatchItems(s *InferenceStorage, batchID string, afterIndex int, limit int) ([]*BatchItem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rows, err := s.db.Query(
+		"SELECT batch_id, item_index, custom_id, query, status, response, error, record_id FROM batch_items WHERE batch_id = ? AND item_index > ? ORDER BY item_index LIMIT ?",
+		batchID, afterIndex, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch items of batch job %s: %v", batchID, err)
+	}
+	defer rows.Close()
+
+	var items []*BatchItem
+	for rows.Next() {
+		var item BatchItem
+		if err := rows.Scan(&item.BatchID, &item.Index, &item.CustomID, &item.Query, &item.Status, &item.Response, &item.Error, &item.RecordID); err != nil {
+			return nil, fmt.Errorf("failed to scan batch item: %v", err)
+		}
+		items = append(items, &item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to fetch items of batch job %s: %v", batchID, err)
+	}
+	return items, nil
+}
+
+// queryRower is implemented by both *sql.DB and *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func getBatchJob(q queryRower, batchID string) (*BatchJob, error) {
+	var job BatchJob
+	err := q.QueryRow(
+		"SELECT id, did, asset_id, asset_value, timestamp, signature, status, total, succeeded, failed, cancelled, created_at, updated_at FROM batch_jobs WHERE id = ?",
+		batchID,
+	).Scan(&job.ID, &job.Did, &job.AssetID, &job.AssetValue, &job.Timestamp, &job.Signature, &job.Status,
+		&job.Total, &job.Succeeded, &job.Failed, &job.Cancelled, &job.CreatedAt, &job.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch batch job %s: %v", batchID, err)
+	}
+	return &job, nil
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"log"
 	"strings"
+
+	"depin-server/constants"
 )
 
 func AddInferenceRecord(s *InferenceStorage, r *InferenceRecord, rubixNodeAddress string) error {
@@ -16,17 +18,33 @@ func AddInferenceRecord(s *InferenceStorage, r *InferenceRecord, rubixNodeAddres
 	}
 
 	_, err = tx.Exec(
-		"INSERT INTO inference_record_queue (id, did, timestamp, signature, asset_id, asset_value) VALUES (?, ?, ?, ?, ?)",
-		r.ID, r.Did, r.Timestamp, r.Signature, r.AssetID, r.AssetValue,
+		"INSERT INTO inference_record_queue (id, did, timestamp, signature, asset_id, asset_value, status, query, prompt_eval_count, eval_count, total_duration, eval_duration, image_count, tool_call_count, cached, download) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		r.ID, r.Did, r.Timestamp, r.Signature, r.AssetID, r.AssetValue, r.Status, r.Query, r.PromptEvalCount, r.EvalCount, r.TotalDuration, r.EvalDuration, r.ImageCount, r.ToolCallCount, r.Cached, r.Download,
 	)
 	if err != nil {
 		tx.Rollback()
 		return fmt.Errorf("failed to insert record: %v", err)
 	}
 
-	// Check record count
+	// Failed inferences are kept for auditing only, they are neither counted nor billed
+	if r.Status != constants.INFERENCE_STATUS_SUCCESS {
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit transaction: %v", err)
+		}
+		return nil
+	}
+
+	// Cached responses and downloads did not run the model, so they do not add to its usage
+	if !r.Cached && !r.Download {
+		if err := addAssetUsage(tx, r); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	// Check record count, only completed inferences are billed
 	var count int
-	err = tx.QueryRow("SELECT COUNT(*) FROM inference_record_queue WHERE asset_id = ?", r.AssetID).Scan(&count)
+	err = tx.QueryRow("SELECT COUNT(*) FROM inference_record_queue WHERE asset_id = ? AND status = ?", r.AssetID, constants.INFERENCE_STATUS_SUCCESS).Scan(&count)
 	if err != nil {
 		tx.Rollback()
 		return fmt.Errorf("failed to count records: %v", err)
@@ -47,7 +65,7 @@ func ProcessBatchInferenceRecords(s *InferenceStorage, assetID string, rubixNode
 	defer s.mu.Unlock()
 
 	// Fetch records ordered by timestamp (oldest first)
-	rows, err := s.db.Query("SELECT id, did, timestamp, signature, asset_id FROM inference_record_queue WHERE asset_id = ? ORDER BY timestamp ASC LIMIT ?", assetID, s.threshold)
+	rows, err := s.db.Query("SELECT id, did, timestamp, signature, asset_id, asset_value, status, query, prompt_eval_count, eval_count, total_duration, eval_duration, image_count, tool_call_count, cached, download FROM inference_record_queue WHERE asset_id = ? AND status = ? ORDER BY timestamp ASC LIMIT ?", assetID, constants.INFERENCE_STATUS_SUCCESS, s.threshold)
 	if err != nil {
 		log.Printf("Error querying records: %v", err)
 		return
@@ -58,7 +76,7 @@ func ProcessBatchInferenceRecords(s *InferenceStorage, assetID string, rubixNode
 	var ids []string
 	for rows.Next() {
 		var r InferenceRecord
-		if err := rows.Scan(&r.ID, &r.Did, &r.Timestamp, &r.Signature, &r.AssetID, &r.AssetValue); err != nil {
+		if err := rows.Scan(&r.ID, &r.Did, &r.Timestamp, &r.Signature, &r.AssetID, &r.AssetValue, &r.Status, &r.Query, &r.PromptEvalCount, &r.EvalCount, &r.TotalDuration, &r.EvalDuration, &r.ImageCount, &r.ToolCallCount, &r.Cached, &r.Download); err != nil {
 			log.Printf("Error scanning record: %v", err)
 			return
 		}
@@ -76,9 +94,11 @@ func ProcessBatchInferenceRecords(s *InferenceStorage, assetID string, rubixNode
 		log.Printf("Error starting delete transaction: %v", err)
 		return
 	}
+	defer tx.Rollback()
 
 	if err := ExecuteSmartContract(records, rubixNodeAddress); err != nil {
 		log.Printf("Error executing smart contract: %v", err)
+		s.notifySettlement(assetID, records, err)
 		return
 	}
 
@@ -91,12 +111,13 @@ func ProcessBatchInferenceRecords(s *InferenceStorage, assetID string, rubixNode
 
 	_, err = tx.Exec(recordsDeleteQuery, args...)
 	if err != nil {
-		tx.Rollback()
 		log.Printf("Error deleting records: %v", err)
 		return
 	}
 
 	if err := tx.Commit(); err != nil {
 		log.Printf("Error committing delete transaction: %v", err)
+		return
 	}
+	s.notifySettlement(assetID, records, nil)
 }
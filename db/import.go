@@ -0,0 +1,210 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"depin-server/constants"
+)
+
+// importJobColumns are the columns of import_jobs in the order getImportJob scans them
+const importJobColumns = "id, asset_name, asset_type, runtime, model_tag, price, pricing_unit, url, include, exclude, filename, projector, files, checksum, status, bytes_done, bytes_total, error, asset_id, created_at, updated_at"
+
+// ImportJob registers an asset in the background, downloading it first when it is
+// imported by URL. BytesDone and BytesTotal track the progress of the download.
+type ImportJob struct {
+	ID          string `json:"id"`
+	AssetName   string `json:"assetName"`
+	AssetType   string `json:"assetType"`
+	Runtime     string `json:"runtime"`
+	ModelTag    string `json:"modelTag"`
+	Price       string `json:"price"`
+	PricingUnit string `json:"pricingUnit"`
+	// URL is the Hugging Face file to import, empty for files uploaded with the request
+	URL string `json:"url"`
+	// Include and Exclude are the glob patterns selecting the files of a whole repository import
+	Include []string `json:"include"`
+	Exclude []string `json:"exclude"`
+	// Filename is the main asset file in the upload directory of the asset, known once downloaded
+	Filename  string `json:"filename"`
+	Projector string `json:"projector"`
+	// Files are all the files of an asset made of several files, relative to its upload directory
+	Files []string `json:"files"`
+	// Checksum is the SHA-256 of the main file already verified when it was uploaded, so
+	// that it is not hashed again
+	Checksum  string `json:"checksum,omitempty"`
+	Status    string `json:"status"`
+	BytesDone int64  `json:"bytesDone"`
+	// BytesTotal is the size of the file to download, 0 until it is known
+	BytesTotal int64 `json:"bytesTotal"`
+	// Percent is the share of BytesTotal downloaded, derived when the job is read
+	Percent   float64 `json:"percent"`
+	Error     string  `json:"error"`
+	AssetID   string  `json:"assetId"`
+	CreatedAt int64   `json:"createdAt"`
+	UpdatedAt int64   `json:"updatedAt"`
+}
+
+// CreateImportJob stores a queued import job
+func CreateImportJob(s *InferenceStorage, job *ImportJob) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.Exec(
+		"INSERT INTO import_jobs ("+importJobColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		job.ID, job.AssetName, job.AssetType, job.Runtime, job.ModelTag, job.Price, job.PricingUnit, job.URL,
+		encodeList(job.Include), encodeList(job.Exclude), job.Filename, job.Projector, encodeList(job.Files), job.Checksum, job.Status, job.BytesDone, job.BytesTotal, job.Error, job.AssetID, job.CreatedAt, job.UpdatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert import job %s: %v", job.ID, err)
+	}
+	return nil
+}
+
+// GetImportJob returns an import job, or nil if it is unknown
+func GetImportJob(s *InferenceStorage, jobID string) (*ImportJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return getImportJob(s.db, jobID)
+}
+
+// ClaimImportJob starts the oldest queued import job, in the downloading stage for
+// imports by URL and the hashing stage for uploaded files. It returns nil if no job is queued.
+func ClaimImportJob(s *InferenceStorage) (*ImportJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var jobID string
+	err = tx.QueryRow("SELECT id FROM import_jobs WHERE status = ? ORDER BY created_at, id LIMIT 1", constants.IMPORT_STATUS_QUEUED).Scan(&jobID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch queued import job: %v", err)
+	}
+
+	if _, err := tx.Exec(
+		"UPDATE import_jobs SET status = CASE WHEN url = '' THEN ? ELSE ? END, updated_at = ? WHERE id = ?",
+		constants.IMPORT_STATUS_HASHING, constants.IMPORT_STATUS_DOWNLOADING, time.Now().Unix(), jobID,
+	); err != nil {
+		return nil, fmt.Errorf("failed to claim import job %s: %v", jobID, err)
+	}
+
+	job, err := getImportJob(tx, jobID)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return job, nil
+}
+
+// UpdateImportJob stores the stage, files, progress and outcome of an import job. It reports
+// false, leaving the job unchanged, if the job was cancelled meanwhile.
+func UpdateImportJob(s *InferenceStorage, job *ImportJob) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job.UpdatedAt = time.Now().Unix()
+	result, err := s.db.Exec(
+		"UPDATE import_jobs SET status = ?, filename = ?, projector = ?, files = ?, bytes_done = ?, bytes_total = ?, error = ?, asset_id = ?, updated_at = ? WHERE id = ? AND status != ?",
+		job.Status, job.Filename, job.Projector, encodeList(job.Files), job.BytesDone, job.BytesTotal, job.Error, job.AssetID, job.UpdatedAt, job.ID, constants.IMPORT_STATUS_CANCELLED,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to update import job %s: %v", job.ID, err)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to update import job %s: %v", job.ID, err)
+	}
+	return updated > 0, nil
+}
+
+// CancelImportJob cancels an import job which is queued, downloading or hashing. Jobs
+// which started minting run to completion. It returns nil if the job is unknown.
+func CancelImportJob(s *InferenceStorage, jobID string) (*ImportJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.Exec(
+		"UPDATE import_jobs SET status = ?, updated_at = ? WHERE id = ? AND status IN (?, ?, ?)",
+		constants.IMPORT_STATUS_CANCELLED, time.Now().Unix(), jobID,
+		constants.IMPORT_STATUS_QUEUED, constants.IMPORT_STATUS_DOWNLOADING, constants.IMPORT_STATUS_HASHING,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to cancel import job %s: %v", jobID, err)
+	}
+	return getImportJob(s.db, jobID)
+}
+
+// ResetInterruptedImportJobs requeues the downloads left running by a previous server
+// process, which resume from the partial file. Jobs interrupted while minting or launching
+// may have been partly registered, so they fail instead.
+func ResetInterruptedImportJobs(s *InferenceStorage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().Unix()
+	_, err := s.db.Exec(
+		"UPDATE import_jobs SET status = ?, updated_at = ? WHERE status IN (?, ?)",
+		constants.IMPORT_STATUS_QUEUED, now, constants.IMPORT_STATUS_DOWNLOADING, constants.IMPORT_STATUS_HASHING,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to requeue interrupted import jobs: %v", err)
+	}
+
+	_, err = s.db.Exec(
+		"UPDATE import_jobs SET status = ?, error = ?, updated_at = ? WHERE status IN (?, ?)",
+		constants.IMPORT_STATUS_FAILED, "interrupted by a server restart", now, constants.IMPORT_STATUS_MINTING, constants.IMPORT_STATUS_LAUNCHING,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to fail interrupted import jobs: %v", err)
+	}
+	return nil
+}
+
+func getImportJob(q queryRower, jobID string) (*ImportJob, error) {
+	var job ImportJob
+	var include, exclude, files string
+	err := q.QueryRow("SELECT "+importJobColumns+" FROM import_jobs WHERE id = ?", jobID).
+		Scan(&job.ID, &job.AssetName, &job.AssetType, &job.Runtime, &job.ModelTag, &job.Price, &job.PricingUnit, &job.URL, &include, &exclude,
+			&job.Filename, &job.Projector, &files, &job.Checksum, &job.Status, &job.BytesDone, &job.BytesTotal, &job.Error, &job.AssetID, &job.CreatedAt, &job.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch import job %s: %v", jobID, err)
+	}
+	job.Include, job.Exclude, job.Files = decodeList(include), decodeList(exclude), decodeList(files)
+	if job.BytesTotal > 0 {
+		job.Percent = float64(job.BytesDone*1000/job.BytesTotal) / 10
+	}
+	return &job, nil
+}
+
+// encodeList stores a list of strings in a TEXT column as a JSON array, or empty if it is empty
+func encodeList(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	encoded, _ := json.Marshal(values)
+	return string(encoded)
+}
+
+func decodeList(encoded string) []string {
+	values := []string{}
+	if encoded != "" {
+		json.Unmarshal([]byte(encoded), &values)
+	}
+	return values
+}
@@ -0,0 +1,56 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// AssetLimits bounds the inference options clients may request for an asset and the
+// inferences it runs at once. Zero values leave the corresponding option unbounded.
+type AssetLimits struct {
+	AssetID string `json:"asset_id"`
+	// MaxNumCtx is the largest context window (num_ctx) a request may ask for
+	MaxNumCtx int `json:"max_num_ctx"`
+	// MaxNumPredict caps the tokens generated per request (num_predict), and is
+	// applied to requests which do not set it
+	MaxNumPredict int `json:"max_num_predict"`
+	// MaxKeepAlive is the longest time in seconds a request may keep the model loaded
+	MaxKeepAlive int `json:"max_keep_alive"`
+	// MaxGenerationTime is the longest time in seconds an inference may run before it is aborted
+	MaxGenerationTime int `json:"max_generation_time"`
+	// MaxConcurrency is the number of inferences the asset runs at once, the server-wide
+	// INFERENCE_MAX_CONCURRENCY when zero
+	MaxConcurrency int `json:"max_concurrency"`
+	// MaxQueueDepth is the number of requests waiting for the asset before new ones are
+	// rejected, the server-wide INFERENCE_MAX_QUEUE when zero
+	MaxQueueDepth int `json:"max_queue_depth"`
+}
+
+// SetAssetLimits sets the option limits of an asset, replacing any previous limits
+func SetAssetLimits(s *InferenceStorage, l *AssetLimits) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.Exec(
+		"INSERT OR REPLACE INTO asset_limits (asset_id, max_num_ctx, max_num_predict, max_keep_alive, max_generation_time, max_concurrency, max_queue_depth) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		l.AssetID, l.MaxNumCtx, l.MaxNumPredict, l.MaxKeepAlive, l.MaxGenerationTime, l.MaxConcurrency, l.MaxQueueDepth,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to set limits of asset %s: %v", l.AssetID, err)
+	}
+	return nil
+}
+
+// GetAssetLimits returns the option limits of an asset, unbounded limits if none are set
+func GetAssetLimits(s *InferenceStorage, assetID string) (*AssetLimits, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l := AssetLimits{AssetID: assetID}
+	err := s.db.QueryRow("SELECT max_num_ctx, max_num_predict, max_keep_alive, max_generation_time, max_concurrency, max_queue_depth FROM asset_limits WHERE asset_id = ?", assetID).
+		Scan(&l.MaxNumCtx, &l.MaxNumPredict, &l.MaxKeepAlive, &l.MaxGenerationTime, &l.MaxConcurrency, &l.MaxQueueDepth)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to fetch limits of asset %s: %v", assetID, err)
+	}
+	return &l, nil
+}
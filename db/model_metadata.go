@@ -0,0 +1,72 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// ModelMetadata describes a model asset as read from the header of its GGUF file
+type ModelMetadata struct {
+	AssetID      string `json:"asset_id"`
+	Architecture string `json:"architecture"`
+	Name         string `json:"name"`
+	// ParameterCount is the number of weights over all the shards of the model
+	ParameterCount int64 `json:"parameter_count"`
+	// Quantization is the GGUF file type of the model, such as Q4_K_M or F16
+	Quantization  string `json:"quantization"`
+	ContextLength int64  `json:"context_length"`
+	ChatTemplate  string `json:"chat_template,omitempty"`
+	// TokenizerModel is the kind of tokenizer, such as llama or gpt2
+	TokenizerModel string `json:"tokenizer_model"`
+	VocabSize      int64  `json:"vocab_size"`
+	BOSTokenID     *int64 `json:"bos_token_id,omitempty"`
+	EOSTokenID     *int64 `json:"eos_token_id,omitempty"`
+}
+
+// SetModelMetadata stores the metadata of a model, replacing any previous metadata
+func SetModelMetadata(s *InferenceStorage, m *ModelMetadata) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.Exec(
+		"INSERT OR REPLACE INTO model_metadata (asset_id, architecture, name, parameter_count, quantization, context_length, chat_template, tokenizer_model, vocab_size, bos_token_id, eos_token_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		m.AssetID, m.Architecture, m.Name, m.ParameterCount, m.Quantization, m.ContextLength, m.ChatTemplate, m.TokenizerModel, m.VocabSize, m.BOSTokenID, m.EOSTokenID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to set metadata of model %s: %v", m.AssetID, err)
+	}
+	return nil
+}
+
+// GetModelMetadatas returns the metadata of all models keyed by asset ID
+func GetModelMetadatas(s *InferenceStorage) (map[string]*ModelMetadata, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rows, err := s.db.Query("SELECT asset_id, architecture, name, parameter_count, quantization, context_length, chat_template, tokenizer_model, vocab_size, bos_token_id, eos_token_id FROM model_metadata")
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch model metadata: %v", err)
+	}
+	defer rows.Close()
+
+	metadatas := make(map[string]*ModelMetadata)
+	for rows.Next() {
+		var m ModelMetadata
+		var bos, eos sql.NullInt64
+		if err := rows.Scan(&m.AssetID, &m.Architecture, &m.Name, &m.ParameterCount, &m.Quantization, &m.ContextLength,
+			&m.ChatTemplate, &m.TokenizerModel, &m.VocabSize, &bos, &eos); err != nil {
+			return nil, fmt.Errorf("failed to scan model metadata: %v", err)
+		}
+		if bos.Valid {
+			m.BOSTokenID = &bos.Int64
+		}
+		if eos.Valid {
+			m.EOSTokenID = &eos.Int64
+		}
+		metadatas[m.AssetID] = &m
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to fetch model metadata: %v", err)
+	}
+	return metadatas, nil
+}
@@ -0,0 +1,52 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrReplayedSignature is returned when a signed request has already been accepted
+var ErrReplayedSignature = errors.New("request signature has already been used")
+
+// ConsumeSignature records the hash of an accepted request signature until expiresAt.
+// It returns ErrReplayedSignature if the same hash is still recorded, and prunes
+// entries whose acceptance window has passed.
+func ConsumeSignature(s *InferenceStorage, signatureHash string, did string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+
+	if _, err := tx.Exec("DELETE FROM used_signatures WHERE expires_at < ?", time.Now().Unix()); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to prune used signatures: %v", err)
+	}
+
+	result, err := tx.Exec(
+		"INSERT OR IGNORE INTO used_signatures (hash, did, expires_at) VALUES (?, ?, ?)",
+		signatureHash, did, expiresAt.Unix(),
+	)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to record signature: %v", err)
+	}
+
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to record signature: %v", err)
+	}
+	if inserted == 0 {
+		tx.Rollback()
+		return ErrReplayedSignature
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return nil
+}
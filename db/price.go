@@ -0,0 +1,71 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// AssetPrice is the server-defined price of an asset. Amount is charged once per
+// Unit, which is one of the constants.PRICING_UNIT_* values.
+type AssetPrice struct {
+	AssetID string  `json:"asset_id"`
+	Unit    string  `json:"unit"`
+	Amount  float64 `json:"amount"`
+}
+
+// SetAssetPrice sets the price of an asset, replacing any previous price
+func SetAssetPrice(s *InferenceStorage, p *AssetPrice) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.Exec(
+		"INSERT OR REPLACE INTO asset_prices (asset_id, unit, amount) VALUES (?, ?, ?)",
+		p.AssetID, p.Unit, p.Amount,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to set price of asset %s: %v", p.AssetID, err)
+	}
+	return nil
+}
+
+// GetAssetPrice returns the price of an asset, or nil if no price is set
+func GetAssetPrice(s *InferenceStorage, assetID string) (*AssetPrice, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var p AssetPrice
+	err := s.db.QueryRow("SELECT asset_id, unit, amount FROM asset_prices WHERE asset_id = ?", assetID).
+		Scan(&p.AssetID, &p.Unit, &p.Amount)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch price of asset %s: %v", assetID, err)
+	}
+	return &p, nil
+}
+
+// GetAssetPrices returns the prices of all priced assets keyed by asset ID
+func GetAssetPrices(s *InferenceStorage) (map[string]*AssetPrice, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rows, err := s.db.Query("SELECT asset_id, unit, amount FROM asset_prices")
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch asset prices: %v", err)
+	}
+	defer rows.Close()
+
+	prices := make(map[string]*AssetPrice)
+	for rows.Next() {
+		var p AssetPrice
+		if err := rows.Scan(&p.AssetID, &p.Unit, &p.Amount); err != nil {
+			return nil, fmt.Errorf("failed to scan asset price: %v", err)
+		}
+		prices[p.AssetID] = &p
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to fetch asset prices: %v", err)
+	}
+	return prices, nil
+}
@@ -0,0 +1,226 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"time"
+)
+
+// DefaultTier is the tier of DIDs without an assigned tier, and of clients identified by IP
+const DefaultTier = "default"
+
+// RateLimit configures a token bucket and request quotas. Limits set for an asset
+// are counted per asset, limits set for all assets (empty AssetID) across them.
+// Zero values disable the corresponding limit.
+type RateLimit struct {
+	Tier          string  `json:"tier"`
+	AssetID       string  `json:"asset_id"`
+	RatePerMinute float64 `json:"rate_per_minute"`
+	Burst         int     `json:"burst"`
+	DailyQuota    int     `json:"daily_quota"`
+	MonthlyQuota  int     `json:"monthly_quota"`
+}
+
+// RateLimitResult is the outcome of consuming a request from a rate limit
+type RateLimitResult struct {
+	Allowed bool
+	// Reason is set when the request is not allowed
+	Reason string
+	// Remaining requests in the bucket, and seconds until it is full again
+	Remaining int
+	Reset     int
+	// RetryAfter is the number of seconds after which a rejected request may succeed
+	RetryAfter int
+	// Remaining quotas, -1 if the quota is not limited
+	DailyRemaining   int
+	MonthlyRemaining int
+}
+
+// SetRateLimit configures the limits of a tier, for one asset or for all assets
+func SetRateLimit(s *InferenceStorage, l *RateLimit) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.Exec(
+		"INSERT OR REPLACE INTO rate_limits (tier, asset_id, rate_per_minute, burst, daily_quota, monthly_quota) VALUES (?, ?, ?, ?, ?, ?)",
+		l.Tier, l.AssetID, l.RatePerMinute, l.Burst, l.DailyQuota, l.MonthlyQuota,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to set rate limit of tier %s: %v", l.Tier, err)
+	}
+	return nil
+}
+
+// GetRateLimit returns the limits of a tier for an asset, falling back to the limits
+// of the tier for all assets. It returns nil if neither is configured.
+func GetRateLimit(s *InferenceStorage, tier string, assetID string) (*RateLimit, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var l RateLimit
+	err := s.db.QueryRow(
+		"SELECT tier, asset_id, rate_per_minute, burst, daily_quota, monthly_quota FROM rate_limits WHERE tier = ? AND asset_id IN (?, '') ORDER BY asset_id DESC LIMIT 1",
+		tier, assetID,
+	).Scan(&l.Tier, &l.AssetID, &l.RatePerMinute, &l.Burst, &l.DailyQuota, &l.MonthlyQuota)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch rate limit of tier %s: %v", tier, err)
+	}
+	return &l, nil
+}
+
+// SetDIDTier assigns a DID to a rate limit tier
+func SetDIDTier(s *InferenceStorage, did string, tier string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.db.Exec("INSERT OR REPLACE INTO did_tiers (did, tier) VALUES (?, ?)", did, tier); err != nil {
+		return fmt.Errorf("failed to set tier of DID %s: %v", did, err)
+	}
+	return nil
+}
+
+// GetDIDTier returns the tier of a DID, DefaultTier if none is assigned
+func GetDIDTier(s *InferenceStorage, did string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var tier string
+	err := s.db.QueryRow("SELECT tier FROM did_tiers WHERE did = ?", did).Scan(&tier)
+	if err == sql.ErrNoRows {
+		return DefaultTier, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch tier of DID %s: %v", did, err)
+	}
+	return tier, nil
+}
+
+// ConsumeRateLimit takes one request from the token bucket and quotas of subject under the
+// limit. Nothing is consumed if the request is not allowed. Bucket and quota state is
+// persisted, so limits hold across restarts.
+func ConsumeRateLimit(s *InferenceStorage, subject string, l *RateLimit, now time.Time) (*RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	result := &RateLimitResult{Allowed: true, DailyRemaining: -1, MonthlyRemaining: -1}
+
+	// Refill the bucket for the time elapsed since it was last used, new buckets start full
+	tokens := float64(l.Burst)
+	if l.RatePerMinute > 0 {
+		var storedTokens float64
+		var updatedAt int64
+		err := tx.QueryRow("SELECT tokens, updated_at FROM rate_limit_buckets WHERE subject = ? AND asset_id = ?", subject, l.AssetID).
+			Scan(&storedTokens, &updatedAt)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, fmt.Errorf("failed to fetch rate limit bucket of %s: %v", subject, err)
+		}
+		if err == nil {
+			elapsed := now.Sub(time.UnixMilli(updatedAt)).Minutes()
+			tokens = math.Min(float64(l.Burst), storedTokens+math.Max(elapsed, 0)*l.RatePerMinute)
+		}
+
+		if tokens < 1 {
+			result.Allowed = false
+			result.Reason = "rate limit exceeded"
+			result.RetryAfter = int(math.Ceil((1 - tokens) / l.RatePerMinute * 60))
+		}
+	}
+
+	day := now.UTC().Format("2006-01-02")
+	month := now.UTC().Format("2006-01")
+	quotas := []struct {
+		period    string
+		quota     int
+		remaining *int
+		reset     time.Time
+	}{
+		{"day:" + day, l.DailyQuota, &result.DailyRemaining, time.Date(now.UTC().Year(), now.UTC().Month(), now.UTC().Day()+1, 0, 0, 0, 0, time.UTC)},
+		{"month:" + month, l.MonthlyQuota, &result.MonthlyRemaining, time.Date(now.UTC().Year(), now.UTC().Month()+1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	if _, err := tx.Exec(
+		"DELETE FROM quota_usage WHERE subject = ? AND asset_id = ? AND period NOT IN (?, ?)",
+		subject, l.AssetID, quotas[0].period, quotas[1].period,
+	); err != nil {
+		return nil, fmt.Errorf("failed to prune quota usage of %s: %v", subject, err)
+	}
+
+	for _, q := range quotas {
+		if q.quota <= 0 {
+			continue
+		}
+
+		var used int
+		err := tx.QueryRow("SELECT count FROM quota_usage WHERE subject = ? AND asset_id = ? AND period = ?", subject, l.AssetID, q.period).
+			Scan(&used)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, fmt.Errorf("failed to fetch quota usage of %s: %v", subject, err)
+		}
+
+		*q.remaining = q.quota - used
+		if used < q.quota {
+			continue
+		}
+
+		// An exhausted quota outlasts the token bucket, report the longest wait
+		retryAfter := int(math.Ceil(q.reset.Sub(now).Seconds()))
+		if result.Allowed || retryAfter > result.RetryAfter {
+			result.Allowed = false
+			result.Reason = "quota exceeded"
+			result.RetryAfter = retryAfter
+		}
+	}
+
+	if !result.Allowed {
+		result.Remaining, result.Reset = bucketState(tokens, l)
+		return result, nil
+	}
+
+	if l.RatePerMinute > 0 {
+		tokens--
+		if _, err := tx.Exec(
+			"INSERT OR REPLACE INTO rate_limit_buckets (subject, asset_id, tokens, updated_at) VALUES (?, ?, ?, ?)",
+			subject, l.AssetID, tokens, now.UnixMilli(),
+		); err != nil {
+			return nil, fmt.Errorf("failed to update rate limit bucket of %s: %v", subject, err)
+		}
+	}
+
+	for _, q := range quotas {
+		if q.quota <= 0 {
+			continue
+		}
+		if _, err := tx.Exec(
+			"INSERT INTO quota_usage (subject, asset_id, period, count) VALUES (?, ?, ?, 1) ON CONFLICT (subject, asset_id, period) DO UPDATE SET count = count + 1",
+			subject, l.AssetID, q.period,
+		); err != nil {
+			return nil, fmt.Errorf("failed to update quota usage of %s: %v", subject, err)
+		}
+		*q.remaining--
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	result.Remaining, result.Reset = bucketState(tokens, l)
+	return result, nil
+}
+
+// bucketState returns the whole requests left in a bucket and the seconds until it is full
+func bucketState(tokens float64, l *RateLimit) (int, int) {
+	if l.RatePerMinute <= 0 {
+		return l.Burst, 0
+	}
+	return int(math.Floor(tokens)), int(math.Ceil((float64(l.Burst) - tokens) / l.RatePerMinute * 60))
+}
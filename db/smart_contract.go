@@ -10,6 +10,8 @@ import (
 	"os"
 	"strconv"
 	"time"
+
+	"depin-server/constants"
 )
 
 type BasicResponse struct {
@@ -45,6 +47,20 @@ func prepareSmartContractData(inferenceRecords []InferenceRecord, depinDID strin
 		return "", fmt.Errorf("unexpected error: no inference records found while executing smart contract")
 	}
 
+	// Every record is charged its own value, which depends on its usage for assets
+	// priced per token
+	var assetValue float64
+	for _, record := range inferenceRecords {
+		if record.Status != constants.INFERENCE_STATUS_SUCCESS {
+			return "", fmt.Errorf("inference record %s has status %s and cannot be settled", record.ID, record.Status)
+		}
+		value, err := strconv.ParseFloat(record.AssetValue, 64)
+		if err != nil {
+			return "", fmt.Errorf("inference record %s has invalid asset value %q", record.ID, record.AssetValue)
+		}
+		assetValue += value
+	}
+
 	// 0th index is the asseumption that all records have the same asset_id
 	info := "Inference records for asset ID: " + inferenceRecords[0].AssetID + " at " + currTimestamp
 
@@ -63,7 +79,7 @@ func prepareSmartContractData(inferenceRecords []InferenceRecord, depinDID strin
 		"store_inference": {
 			AssetID:       inferenceRecords[0].AssetID,
 			InferenceInfo: string(inferenceInfoBytes),
-			AssetValue:    inferenceRecords[0].AssetValue,
+			AssetValue:    strconv.FormatFloat(assetValue, 'f', -1, 64),
 			DepinDID:      depinDID,
 		},
 	}
@@ -148,7 +164,7 @@ func signatureResponse(requestId string, nodeAddress string) (*BasicResponse, er
 
 	bodyJSON, err := json.Marshal(data)
 	if err != nil {
-		return nil, fmt.Errorf("Error marshaling JSON:", err)
+		return nil, fmt.Errorf("Error marshaling JSON: %v", err)
 	}
 
 	url, err := url.JoinPath(nodeAddress, "/api/signature-response")
@@ -158,14 +174,14 @@ func signatureResponse(requestId string, nodeAddress string) (*BasicResponse, er
 
 	req, err := http.NewRequest("POST", url, bytes.NewBuffer(bodyJSON))
 	if err != nil {
-		return nil, fmt.Errorf("Error creating HTTP request:", err)
+		return nil, fmt.Errorf("Error creating HTTP request: %v", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("Error sending HTTP request:", err)
+		return nil, fmt.Errorf("Error sending HTTP request: %v", err)
 	}
 	defer resp.Body.Close()
 
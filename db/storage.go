@@ -12,16 +12,37 @@ type InferenceStorage struct {
 	mu        sync.Mutex
 	db        *sql.DB
 	threshold int
+
+	// settlementListener is notified of the outcome of every settlement attempt
+	settlementListener SettlementListener
 }
 
+// SettlementListener receives the inference records settled for an asset through the
+// smart contract, and the error if the settlement failed
+type SettlementListener func(assetID string, records []InferenceRecord, err error)
+
 type InferenceRecord struct {
-	ID        string `json:"id"`
-	Did       string `json:"did"`
-	Timestamp string `json:"timestamp"`
-	Signature string `json:"signature"`
-	Query     string `json:"query"`
-	AssetID   string `json:"asset_id"`
-	AssetValue string `json:"asset_value"`	
+	ID         string `json:"id"`
+	Did        string `json:"did"`
+	Timestamp  string `json:"timestamp"`
+	Signature  string `json:"signature"`
+	Query      string `json:"query"`
+	AssetID    string `json:"asset_id"`
+	AssetValue string `json:"asset_value"`
+	Status     string `json:"status"`
+	// Token counts and durations (in nanoseconds) reported by the inference backend
+	PromptEvalCount int   `json:"prompt_eval_count"`
+	EvalCount       int   `json:"eval_count"`
+	TotalDuration   int64 `json:"total_duration"`
+	EvalDuration    int64 `json:"eval_duration"`
+	// ImageCount is the number of images sent to a multimodal model
+	ImageCount int `json:"image_count"`
+	// ToolCallCount is the number of tool invocations the model requested in its response
+	ToolCallCount int `json:"tool_call_count"`
+	// Cached is set when the response was served from the response cache without inference
+	Cached bool `json:"cached"`
+	// Download is set on records charging the download of an asset priced per download
+	Download bool `json:"download,omitempty"`
 }
 
 func applyDBConfig(db *sql.DB) error {
@@ -32,6 +53,41 @@ func applyDBConfig(db *sql.DB) error {
 	return nil
 }
 
+// addColumnIfMissing adds a column to an existing table so that databases
+// created by older versions of the server pick up new fields on startup.
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("failed to read schema of table %s: %v", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid          int
+			name         string
+			columnType   string
+			notNull      int
+			defaultValue sql.NullString
+			primaryKey   int
+		)
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &primaryKey); err != nil {
+			return fmt.Errorf("failed to scan schema of table %s: %v", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read schema of table %s: %v", table, err)
+	}
+
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("failed to add column %s to table %s: %v", column, table, err)
+	}
+	return nil
+}
+
 func NewStorage(dbPath string, threshold int) (*InferenceStorage, error) {
 	db, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
@@ -50,7 +106,13 @@ func NewStorage(dbPath string, threshold int) (*InferenceStorage, error) {
 			timestamp TEXT NOT NULL,
 			signature TEXT NOT NULL,
 			asset_id TEXT NOT NULL,
-			asset_value TEXT NOT NULL
+			asset_value TEXT NOT NULL,
+			status TEXT NOT NULL DEFAULT 'success',
+			query TEXT NOT NULL DEFAULT '',
+			prompt_eval_count INTEGER NOT NULL DEFAULT 0,
+			eval_count INTEGER NOT NULL DEFAULT 0,
+			total_duration INTEGER NOT NULL DEFAULT 0,
+			eval_duration INTEGER NOT NULL DEFAULT 0
 		)
 	`)
 	if err != nil {
@@ -58,13 +120,338 @@ func NewStorage(dbPath string, threshold int) (*InferenceStorage, error) {
 		return nil, fmt.Errorf("failed to create inference_record_queue table: %v", err)
 	}
 
+	if err := addColumnIfMissing(db, "inference_record_queue", "status", "TEXT NOT NULL DEFAULT 'success'"); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := addColumnIfMissing(db, "inference_record_queue", "query", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	for _, column := range []string{"prompt_eval_count", "eval_count", "total_duration", "eval_duration", "image_count", "tool_call_count", "cached", "download"} {
+		if err := addColumnIfMissing(db, "inference_record_queue", column, "INTEGER NOT NULL DEFAULT 0"); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
 	_, err = db.Exec(`
 		CREATE TABLE IF NOT EXISTS assets (
-			id TEXT PRIMARY KEY
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL DEFAULT '',
+			asset_type TEXT NOT NULL DEFAULT '',
+			model_tag TEXT NOT NULL DEFAULT '',
+			runtime TEXT NOT NULL DEFAULT '',
+			projector TEXT NOT NULL DEFAULT '',
+			source_repo TEXT NOT NULL DEFAULT '',
+			source_revision TEXT NOT NULL DEFAULT '',
+			source_commit TEXT NOT NULL DEFAULT '',
+			source_sha256 TEXT NOT NULL DEFAULT ''
 		)`)
 	if err != nil {
 		db.Close()
-		return nil, fmt.Errorf("failed to create inference_record_queue table: %v", err)
+		return nil, fmt.Errorf("failed to create assets table: %v", err)
+	}
+
+	for _, column := range []string{"name", "asset_type", "model_tag", "runtime", "projector", "source_repo", "source_revision", "source_commit", "source_sha256"} {
+		if err := addColumnIfMissing(db, "assets", column, "TEXT NOT NULL DEFAULT ''"); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS used_signatures (
+			hash TEXT PRIMARY KEY,
+			did TEXT NOT NULL,
+			expires_at INTEGER NOT NULL
+		)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create used_signatures table: %v", err)
+	}
+
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS idx_used_signatures_expires_at ON used_signatures (expires_at)")
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create used_signatures index: %v", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS asset_prices (
+			asset_id TEXT PRIMARY KEY,
+			unit TEXT NOT NULL,
+			amount REAL NOT NULL
+		)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create asset_prices table: %v", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS asset_usage (
+			asset_id TEXT PRIMARY KEY,
+			inferences INTEGER NOT NULL DEFAULT 0,
+			prompt_eval_count INTEGER NOT NULL DEFAULT 0,
+			eval_count INTEGER NOT NULL DEFAULT 0,
+			total_duration INTEGER NOT NULL DEFAULT 0,
+			eval_duration INTEGER NOT NULL DEFAULT 0
+		)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create asset_usage table: %v", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS asset_limits (
+			asset_id TEXT PRIMARY KEY,
+			max_num_ctx INTEGER NOT NULL DEFAULT 0,
+			max_num_predict INTEGER NOT NULL DEFAULT 0,
+			max_keep_alive INTEGER NOT NULL DEFAULT 0,
+			max_generation_time INTEGER NOT NULL DEFAULT 0,
+			max_concurrency INTEGER NOT NULL DEFAULT 0,
+			max_queue_depth INTEGER NOT NULL DEFAULT 0
+		)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create asset_limits table: %v", err)
+	}
+
+	for _, column := range []string{"max_generation_time", "max_concurrency", "max_queue_depth"} {
+		if err := addColumnIfMissing(db, "asset_limits", column, "INTEGER NOT NULL DEFAULT 0"); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS rate_limits (
+			tier TEXT NOT NULL,
+			asset_id TEXT NOT NULL DEFAULT '',
+			rate_per_minute REAL NOT NULL DEFAULT 0,
+			burst INTEGER NOT NULL DEFAULT 0,
+			daily_quota INTEGER NOT NULL DEFAULT 0,
+			monthly_quota INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (tier, asset_id)
+		)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create rate_limits table: %v", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS did_tiers (
+			did TEXT PRIMARY KEY,
+			tier TEXT NOT NULL
+		)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create did_tiers table: %v", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS rate_limit_buckets (
+			subject TEXT NOT NULL,
+			asset_id TEXT NOT NULL DEFAULT '',
+			tokens REAL NOT NULL,
+			updated_at INTEGER NOT NULL,
+			PRIMARY KEY (subject, asset_id)
+		)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create rate_limit_buckets table: %v", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS quota_usage (
+			subject TEXT NOT NULL,
+			asset_id TEXT NOT NULL DEFAULT '',
+			period TEXT NOT NULL,
+			count INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (subject, asset_id, period)
+		)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create quota_usage table: %v", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS batch_jobs (
+			id TEXT PRIMARY KEY,
+			did TEXT NOT NULL,
+			asset_id TEXT NOT NULL,
+			asset_value TEXT NOT NULL,
+			timestamp TEXT NOT NULL,
+			signature TEXT NOT NULL,
+			status TEXT NOT NULL,
+			total INTEGER NOT NULL DEFAULT 0,
+			succeeded INTEGER NOT NULL DEFAULT 0,
+			failed INTEGER NOT NULL DEFAULT 0,
+			cancelled INTEGER NOT NULL DEFAULT 0,
+			created_at INTEGER NOT NULL,
+			updated_at INTEGER NOT NULL
+		)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create batch_jobs table: %v", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS batch_items (
+			batch_id TEXT NOT NULL,
+			item_index INTEGER NOT NULL,
+			custom_id TEXT NOT NULL DEFAULT '',
+			input TEXT NOT NULL,
+			query TEXT NOT NULL DEFAULT '',
+			status TEXT NOT NULL,
+			response TEXT NOT NULL DEFAULT '',
+			error TEXT NOT NULL DEFAULT '',
+			record_id TEXT NOT NULL DEFAULT '',
+			PRIMARY KEY (batch_id, item_index)
+		)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create batch_items table: %v", err)
+	}
+
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS idx_batch_items_status ON batch_items (status)")
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create batch_items index: %v", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS webhooks (
+			id TEXT PRIMARY KEY,
+			did TEXT NOT NULL DEFAULT '',
+			url TEXT NOT NULL,
+			secret TEXT NOT NULL,
+			events TEXT NOT NULL DEFAULT '',
+			created_at INTEGER NOT NULL
+		)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create webhooks table: %v", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS webhook_deliveries (
+			id TEXT PRIMARY KEY,
+			webhook_id TEXT NOT NULL,
+			event_id TEXT NOT NULL,
+			event TEXT NOT NULL,
+			payload TEXT NOT NULL,
+			status TEXT NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			response_code INTEGER NOT NULL DEFAULT 0,
+			last_error TEXT NOT NULL DEFAULT '',
+			next_attempt_at INTEGER NOT NULL,
+			created_at INTEGER NOT NULL,
+			updated_at INTEGER NOT NULL
+		)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create webhook_deliveries table: %v", err)
+	}
+
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries (status, next_attempt_at)")
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create webhook_deliveries index: %v", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS resumable_uploads (
+			id TEXT PRIMARY KEY,
+			asset_name TEXT NOT NULL,
+			asset_type TEXT NOT NULL,
+			runtime TEXT NOT NULL DEFAULT '',
+			model_tag TEXT NOT NULL DEFAULT '',
+			price TEXT NOT NULL DEFAULT '',
+			pricing_unit TEXT NOT NULL DEFAULT '',
+			filename TEXT NOT NULL,
+			length INTEGER NOT NULL,
+			upload_offset INTEGER NOT NULL DEFAULT 0,
+			checksum TEXT NOT NULL DEFAULT '',
+			status TEXT NOT NULL,
+			import_job_id TEXT NOT NULL DEFAULT '',
+			created_at INTEGER NOT NULL,
+			updated_at INTEGER NOT NULL
+		)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create resumable_uploads table: %v", err)
+	}
+
+	if err := addColumnIfMissing(db, "resumable_uploads", "import_job_id", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS import_jobs (
+			id TEXT PRIMARY KEY,
+			asset_name TEXT NOT NULL,
+			asset_type TEXT NOT NULL,
+			runtime TEXT NOT NULL DEFAULT '',
+			model_tag TEXT NOT NULL DEFAULT '',
+			price TEXT NOT NULL DEFAULT '',
+			pricing_unit TEXT NOT NULL DEFAULT '',
+			url TEXT NOT NULL DEFAULT '',
+			filename TEXT NOT NULL DEFAULT '',
+			projector TEXT NOT NULL DEFAULT '',
+			status TEXT NOT NULL,
+			bytes_done INTEGER NOT NULL DEFAULT 0,
+			bytes_total INTEGER NOT NULL DEFAULT 0,
+			error TEXT NOT NULL DEFAULT '',
+			asset_id TEXT NOT NULL DEFAULT '',
+			created_at INTEGER NOT NULL,
+			updated_at INTEGER NOT NULL
+		)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create import_jobs table: %v", err)
+	}
+
+	for _, column := range []string{"include", "exclude", "files", "checksum"} {
+		if err := addColumnIfMissing(db, "import_jobs", column, "TEXT NOT NULL DEFAULT ''"); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS asset_files (
+			asset_id TEXT NOT NULL,
+			path TEXT NOT NULL,
+			size INTEGER NOT NULL,
+			sha256 TEXT NOT NULL,
+			PRIMARY KEY (asset_id, path)
+		)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create asset_files table: %v", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS model_metadata (
+			asset_id TEXT PRIMARY KEY,
+			architecture TEXT NOT NULL DEFAULT '',
+			name TEXT NOT NULL DEFAULT '',
+			parameter_count INTEGER NOT NULL DEFAULT 0,
+			quantization TEXT NOT NULL DEFAULT '',
+			context_length INTEGER NOT NULL DEFAULT 0,
+			chat_template TEXT NOT NULL DEFAULT '',
+			tokenizer_model TEXT NOT NULL DEFAULT '',
+			vocab_size INTEGER NOT NULL DEFAULT 0,
+			bos_token_id INTEGER,
+			eos_token_id INTEGER
+		)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create model_metadata table: %v", err)
 	}
 
 	storage := &InferenceStorage{
@@ -74,3 +461,19 @@ func NewStorage(dbPath string, threshold int) (*InferenceStorage, error) {
 
 	return storage, nil
 }
+
+// SetSettlementListener registers the listener notified of settlement outcomes. It is
+// called in its own goroutine, so it may use the storage.
+func (s *InferenceStorage) SetSettlementListener(listener SettlementListener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.settlementListener = listener
+}
+
+// notifySettlement hands a settlement outcome to the listener, the caller holds s.mu
+func (s *InferenceStorage) notifySettlement(assetID string, records []InferenceRecord, err error) {
+	if s.settlementListener != nil {
+		go s.settlementListener(assetID, records, err)
+	}
+}
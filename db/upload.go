@@ -0,0 +1,126 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"depin-server/constants"
+)
+
+// ResumableUpload is an asset file uploaded in chunks to a staging file. Offset is the
+// number of bytes received so far, the upload is finalized once it reaches Length.
+type ResumableUpload struct {
+	ID          string `json:"id"`
+	AssetName   string `json:"assetName"`
+	AssetType   string `json:"assetType"`
+	Runtime     string `json:"runtime"`
+	ModelTag    string `json:"modelTag"`
+	Price       string `json:"price"`
+	PricingUnit string `json:"pricingUnit"`
+	Filename    string `json:"filename"`
+	Length      int64  `json:"length"`
+	Offset      int64  `json:"offset"`
+	// Checksum is the hex SHA-256 of the whole file, verified when the upload is finalized
+	Checksum string `json:"checksum"`
+	Status   string `json:"status"`
+	// ImportJobID is the job registering the asset once the upload is finalized
+	ImportJobID string `json:"importJobId"`
+	CreatedAt   int64  `json:"createdAt"`
+	UpdatedAt   int64  `json:"updatedAt"`
+}
+
+// CreateResumableUpload stores a new upload
+func CreateResumableUpload(s *InferenceStorage, u *ResumableUpload) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.Exec(
+		"INSERT INTO resumable_uploads (id, asset_name, asset_type, runtime, model_tag, price, pricing_unit, filename, length, upload_offset, checksum, status, import_job_id, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		u.ID, u.AssetName, u.AssetType, u.Runtime, u.ModelTag, u.Price, u.PricingUnit, u.Filename, u.Length, u.Offset, u.Checksum, u.Status, u.ImportJobID, u.CreatedAt, u.UpdatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert upload %s: %v", u.ID, err)
+	}
+	return nil
+}
+
+// GetResumableUpload returns an upload, or nil if it is unknown
+func GetResumableUpload(s *InferenceStorage, uploadID string) (*ResumableUpload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var u ResumableUpload
+	err := s.db.QueryRow(
+		"SELECT id, asset_name, asset_type, runtime, model_tag, price, pricing_unit, filename, length, upload_offset, checksum, status, import_job_id, created_at, updated_at FROM resumable_uploads WHERE id = ?",
+		uploadID,
+	).Scan(&u.ID, &u.AssetName, &u.AssetType, &u.Runtime, &u.ModelTag, &u.Price, &u.PricingUnit, &u.Filename,
+		&u.Length, &u.Offset, &u.Checksum, &u.Status, &u.ImportJobID, &u.CreatedAt, &u.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch upload %s: %v", uploadID, err)
+	}
+	return &u, nil
+}
+
+// UpdateResumableUpload stores the offset, checksum, status and import job of an upload
+func UpdateResumableUpload(s *InferenceStorage, u *ResumableUpload) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u.UpdatedAt = time.Now().Unix()
+	_, err := s.db.Exec(
+		"UPDATE resumable_uploads SET upload_offset = ?, checksum = ?, status = ?, import_job_id = ?, updated_at = ? WHERE id = ?",
+		u.Offset, u.Checksum, u.Status, u.ImportJobID, u.UpdatedAt, u.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update upload %s: %v", u.ID, err)
+	}
+	return nil
+}
+
+// DeleteResumableUpload removes an upload
+func DeleteResumableUpload(s *InferenceStorage, uploadID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.db.Exec("DELETE FROM resumable_uploads WHERE id = ?", uploadID); err != nil {
+		return fmt.Errorf("failed to delete upload %s: %v", uploadID, err)
+	}
+	return nil
+}
+
+// ExpireResumableUploads removes the unfinished uploads not updated since before, and
+// returns their IDs so that their staging files can be deleted
+func ExpireResumableUploads(s *InferenceStorage, before int64) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rows, err := s.db.Query("SELECT id FROM resumable_uploads WHERE status = ? AND updated_at < ?", constants.UPLOAD_STATUS_PENDING, before)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch expired uploads: %v", err)
+	}
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan expired upload: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to fetch expired uploads: %v", err)
+	}
+
+	for _, id := range ids {
+		if _, err := s.db.Exec("DELETE FROM resumable_uploads WHERE id = ?", id); err != nil {
+			return nil, fmt.Errorf("failed to delete upload %s: %v", id, err)
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,61 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// AssetUsage aggregates the work done for all successful inferences of an asset.
+// Durations are in nanoseconds, as reported by the inference backend.
+type AssetUsage struct {
+	AssetID         string  `json:"asset_id"`
+	Inferences      int64   `json:"inferences"`
+	PromptEvalCount int64   `json:"prompt_eval_count"`
+	EvalCount       int64   `json:"eval_count"`
+	TotalDuration   int64   `json:"total_duration"`
+	EvalDuration    int64   `json:"eval_duration"`
+	TokensPerSecond float64 `json:"tokens_per_second"`
+}
+
+// addAssetUsage adds the token counts and durations of a record to the usage of its asset
+func addAssetUsage(tx *sql.Tx, r *InferenceRecord) error {
+	_, err := tx.Exec(`
+		INSERT INTO asset_usage (asset_id, inferences, prompt_eval_count, eval_count, total_duration, eval_duration)
+		VALUES (?, 1, ?, ?, ?, ?)
+		ON CONFLICT (asset_id) DO UPDATE SET
+			inferences = inferences + 1,
+			prompt_eval_count = prompt_eval_count + excluded.prompt_eval_count,
+			eval_count = eval_count + excluded.eval_count,
+			total_duration = total_duration + excluded.total_duration,
+			eval_duration = eval_duration + excluded.eval_duration`,
+		r.AssetID, r.PromptEvalCount, r.EvalCount, r.TotalDuration, r.EvalDuration,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update usage of asset %s: %v", r.AssetID, err)
+	}
+	return nil
+}
+
+// GetAssetUsage returns the aggregate usage of an asset, or nil if it has not served any inference
+func GetAssetUsage(s *InferenceStorage, assetID string) (*AssetUsage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var u AssetUsage
+	err := s.db.QueryRow(
+		"SELECT asset_id, inferences, prompt_eval_count, eval_count, total_duration, eval_duration FROM asset_usage WHERE asset_id = ?",
+		assetID,
+	).Scan(&u.AssetID, &u.Inferences, &u.PromptEvalCount, &u.EvalCount, &u.TotalDuration, &u.EvalDuration)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch usage of asset %s: %v", assetID, err)
+	}
+
+	// Generation throughput, prompt evaluation is excluded
+	if u.EvalDuration > 0 {
+		u.TokensPerSecond = float64(u.EvalCount) / (float64(u.EvalDuration) / 1e9)
+	}
+	return &u, nil
+}
@@ -0,0 +1,274 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"depin-server/constants"
+)
+
+// Webhook is a subscription to server events. Subscriptions of a DID receive the events
+// concerning that DID, global subscriptions (empty DID) receive every event.
+type Webhook struct {
+	ID  string `json:"id"`
+	Did string `json:"did"`
+	URL string `json:"url"`
+	// Secret is the HMAC key deliveries are signed with, it is only returned at creation
+	Secret string `json:"secret,omitempty"`
+	// Events are the constants.WEBHOOK_EVENT_* values subscribed to, all events if empty
+	Events    []string `json:"events"`
+	CreatedAt int64    `json:"created_at"`
+}
+
+// WebhookDelivery is an event queued for a webhook and the outcome of its delivery attempts
+type WebhookDelivery struct {
+	ID        string `json:"id"`
+	WebhookID string `json:"webhook_id"`
+	EventID   string `json:"event_id"`
+	Event     string `json:"event"`
+	// Payload is the JSON body posted to the webhook
+	Payload       string `json:"payload"`
+	Status        string `json:"status"`
+	Attempts      int    `json:"attempts"`
+	ResponseCode  int    `json:"response_code"`
+	LastError     string `json:"last_error"`
+	NextAttemptAt int64  `json:"next_attempt_at"`
+	CreatedAt     int64  `json:"created_at"`
+	UpdatedAt     int64  `json:"updated_at"`
+}
+
+// subscribes reports whether the webhook subscribed to an event
+func (w *Webhook) subscribes(event string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// AddWebhook stores a webhook subscription
+func AddWebhook(s *InferenceStorage, w *Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.Exec(
+		"INSERT INTO webhooks (id, did, url, secret, events, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		w.ID, w.Did, w.URL, w.Secret, strings.Join(w.Events, ","), w.CreatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert webhook %s: %v", w.ID, err)
+	}
+	return nil
+}
+
+// DeleteWebhook removes a webhook subscription with its delivery log. It reports whether
+// the webhook existed.
+func DeleteWebhook(s *InferenceStorage, webhookID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM webhooks WHERE id = ?", webhookID)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete webhook %s: %v", webhookID, err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to delete webhook %s: %v", webhookID, err)
+	}
+
+	if _, err := tx.Exec("DELETE FROM webhook_deliveries WHERE webhook_id = ?", webhookID); err != nil {
+		return false, fmt.Errorf("failed to delete deliveries of webhook %s: %v", webhookID, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return deleted > 0, nil
+}
+
+// GetWebhook returns a webhook subscription without its secret, or nil if it is unknown
+func GetWebhook(s *InferenceStorage, webhookID string) (*Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	webhooks, err := queryWebhooks(s.db, "SELECT id, did, url, '', events, created_at FROM webhooks WHERE id = ?", webhookID)
+	if err != nil || len(webhooks) == 0 {
+		return nil, err
+	}
+	return webhooks[0], nil
+}
+
+// GetWebhooks returns the webhook subscriptions of a DID, or the global subscriptions if
+// did is empty, without their secrets
+func GetWebhooks(s *InferenceStorage, did string) ([]*Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return queryWebhooks(s.db, "SELECT id, did, url, '', events, created_at FROM webhooks WHERE did = ? ORDER BY created_at", did)
+}
+
+// AddWebhookDeliveries queues an event for every webhook subscribed to it, the global
+// webhooks and those of the DID the event concerns. It returns the number of deliveries
+// queued.
+func AddWebhookDeliveries(s *InferenceStorage, eventID string, event string, did string, payload string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	webhooks, err := queryWebhooks(tx, "SELECT id, did, url, '', events, created_at FROM webhooks WHERE did = '' OR did = ?", did)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now().Unix()
+	queued := 0
+	for _, webhook := range webhooks {
+		if !webhook.subscribes(event) {
+			continue
+		}
+		_, err := tx.Exec(
+			"INSERT INTO webhook_deliveries (id, webhook_id, event_id, event, payload, status, next_attempt_at, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			eventID+":"+webhook.ID, webhook.ID, eventID, event, payload, constants.WEBHOOK_DELIVERY_STATUS_PENDING, now, now, now,
+		)
+		if err != nil {
+			return 0, fmt.Errorf("failed to queue %s event for webhook %s: %v", event, webhook.ID, err)
+		}
+		queued++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return queued, nil
+}
+
+// GetDueWebhookDeliveries returns up to limit pending deliveries whose next attempt is due,
+// with the URL and secret of their webhook
+func GetDueWebhookDeliveries(s *InferenceStorage, now int64, limit int) ([]*WebhookDelivery, []*Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rows, err := s.db.Query(`
+		SELECT d.id, d.webhook_id, d.event_id, d.event, d.payload, d.status, d.attempts, d.response_code,
+			d.last_error, d.next_attempt_at, d.created_at, d.updated_at, w.url, w.secret
+		FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id
+		WHERE d.status = ? AND d.next_attempt_at <= ?
+		ORDER BY d.next_attempt_at
+		LIMIT ?`,
+		constants.WEBHOOK_DELIVERY_STATUS_PENDING, now, limit,
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch due webhook deliveries: %v", err)
+	}
+	defer rows.Close()
+
+	var deliveries []*WebhookDelivery
+	var webhooks []*Webhook
+	for rows.Next() {
+		var d WebhookDelivery
+		w := Webhook{}
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.EventID, &d.Event, &d.Payload, &d.Status, &d.Attempts, &d.ResponseCode,
+			&d.LastError, &d.NextAttemptAt, &d.CreatedAt, &d.UpdatedAt, &w.URL, &w.Secret); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan webhook delivery: %v", err)
+		}
+		w.ID = d.WebhookID
+		deliveries = append(deliveries, &d)
+		webhooks = append(webhooks, &w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch due webhook deliveries: %v", err)
+	}
+	return deliveries, webhooks, nil
+}
+
+// UpdateWebhookDelivery stores the outcome of a delivery attempt
+func UpdateWebhookDelivery(s *InferenceStorage, d *WebhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.Exec(
+		"UPDATE webhook_deliveries SET status = ?, attempts = ?, response_code = ?, last_error = ?, next_attempt_at = ?, updated_at = ? WHERE id = ?",
+		d.Status, d.Attempts, d.ResponseCode, d.LastError, d.NextAttemptAt, d.UpdatedAt, d.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update webhook delivery %s: %v", d.ID, err)
+	}
+	return nil
+}
+
+// GetWebhookDeliveries returns the delivery log of a webhook, most recent first
+func GetWebhookDeliveries(s *InferenceStorage, webhookID string, limit int) ([]*WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rows, err := s.db.Query(
+		"SELECT id, webhook_id, event_id, event, payload, status, attempts, response_code, last_error, next_attempt_at, created_at, updated_at FROM webhook_deliveries WHERE webhook_id = ? ORDER BY created_at DESC, id LIMIT ?",
+		webhookID, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch deliveries of webhook %s: %v", webhookID, err)
+	}
+	defer rows.Close()
+
+	var deliveries []*WebhookDelivery
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.EventID, &d.Event, &d.Payload, &d.Status, &d.Attempts, &d.ResponseCode,
+			&d.LastError, &d.NextAttemptAt, &d.CreatedAt, &d.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan webhook delivery: %v", err)
+		}
+		deliveries = append(deliveries, &d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to fetch deliveries of webhook %s: %v", webhookID, err)
+	}
+	return deliveries, nil
+}
+
+// queryer is implemented by both *sql.DB and *sql.Tx
+type queryer interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+func queryWebhooks(q queryer, query string, args ...any) ([]*Webhook, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch webhooks: %v", err)
+	}
+	defer rows.Close()
+
+	var webhooks []*Webhook
+	for rows.Next() {
+		var w Webhook
+		var events string
+		if err := rows.Scan(&w.ID, &w.Did, &w.URL, &w.Secret, &events, &w.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan webhook: %v", err)
+		}
+		w.Events = []string{}
+		if events != "" {
+			w.Events = strings.Split(events, ",")
+		}
+		webhooks = append(webhooks, &w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to fetch webhooks: %v", err)
+	}
+	return webhooks, nil
+}
@@ -0,0 +1,51 @@
+package rubix
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// GetDIDPublicKey fetches the public key of a DID from the Rubix node. The key
+// is returned as sent by the node, either PEM encoded or as hex encoded DER.
+func GetDIDPublicKey(rubixNodeAddress string, did string) (string, error) {
+	pubKeyAPIPath := os.Getenv("RUBIX_DID_PUBKEY_API")
+	if pubKeyAPIPath == "" {
+		pubKeyAPIPath = "/api/get-pub-key"
+	}
+
+	pubKeyURL, err := url.JoinPath(rubixNodeAddress, pubKeyAPIPath)
+	if err != nil {
+		return "", fmt.Errorf("error joining URL path: %v", err)
+	}
+	pubKeyURL += "?did=" + url.QueryEscape(did)
+
+	resp, err := http.Get(pubKeyURL)
+	if err != nil {
+		return "", fmt.Errorf("error fetching public key from Rubix node: %v", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading response body: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected response from Rubix node: %s", respBody)
+	}
+
+	var basicResponse *BasicResponse
+	if err := json.Unmarshal(respBody, &basicResponse); err != nil {
+		return "", fmt.Errorf("failed to parse response JSON: %v", err)
+	}
+
+	if !basicResponse.Status || basicResponse.Result == "" {
+		return "", fmt.Errorf("unable to fetch public key for DID %s: %s", did, basicResponse.Message)
+	}
+
+	return basicResponse.Result, nil
+}
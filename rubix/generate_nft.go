@@ -2,7 +2,6 @@ package rubix
 
 import (
 	"bytes"
-	"depin-server/constants"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -10,7 +9,6 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
 )
 
 type BasicResponse struct {
@@ -19,9 +17,11 @@ type BasicResponse struct {
 	Status  bool   `json:"status"`
 }
 
-// GenerateAssetHash calls the /api/create-nft endpoint of 
-// Rubix node to generate a hash for the given asset.
-func GenerateAssetHash(assetName string, assetType string) (string, error) {
+// GenerateAssetHash calls the /api/create-nft endpoint of
+// Rubix node to mint the artifact file of an asset and generate its hash.
+// The artifact is the asset file itself, or the manifest of an asset made
+// of several files.
+func GenerateAssetHash(artifactPath string) (string, error) {
 	var requestBody bytes.Buffer
 
 	writer := multipart.NewWriter(&requestBody)
@@ -31,46 +31,16 @@ func GenerateAssetHash(assetName string, assetType string) (string, error) {
 		return "", fmt.Errorf("DEPIN_DID environment variable is not set")
 	}
 
-	uploadRoot := os.Getenv("UPLOAD_DIR")
-	if uploadRoot == "" {
-		uploadRoot = "uploads"
-	}
-
 	// Add form fields (simple text fields)
 	writer.WriteField("did", depinDid)
 
 	// Add the NFTFile to the form
-	var artifactPath string
-	switch assetType {
-		case constants.ASSET_TYPE_MODEL:
-			artifactPath = filepath.Join(uploadRoot, constants.ASSET_TYPE_MODEL+"s", assetName)
-		case constants.ASSET_TYPE_DATASET:
-			artifactPath = filepath.Join(uploadRoot, constants.ASSET_TYPE_DATASET+"s", assetName)
-		default:
-			return "", fmt.Errorf("Invalid asset type: %s. Must be 'model' or 'dataset'", assetType)
-	}
-
-	entries, err := os.ReadDir(artifactPath)
+	nftArtifactFilepath := artifactPath
+	nftArtifact, err := os.Open(nftArtifactFilepath)
 	if err != nil {
-		return "", fmt.Errorf("Error reading directory %s: %v", artifactPath, err)
-	}
-
-	if len(entries) == 0 {
-		return "", fmt.Errorf("No files found in the directory %s", artifactPath)
-	}
-
-	var nftArtifact *os.File
-	var nftArtifactFilepath string = ""
-	for _, entry := range entries {
-		if !entry.IsDir() {
-			nftArtifactFilepath = filepath.Join(artifactPath, entry.Name())
-			nftArtifact, err = os.Open(nftArtifactFilepath)
-			if err != nil {
-				return "", fmt.Errorf("Error opening file %s: %v", nftArtifactFilepath, err)
-			}
-			defer nftArtifact.Close()
-		}
+		return "", fmt.Errorf("Error opening file %s: %v", nftArtifactFilepath, err)
 	}
+	defer nftArtifact.Close()
 
 	nftArtifactFile, err := writer.CreateFormFile("artifact", nftArtifactFilepath)
 	if err != nil {
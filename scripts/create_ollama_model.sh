@@ -1,13 +1,14 @@
 #!/bin/bash
 
-# Check if both parameters are provided
-if [ $# -ne 2 ]; then
-  echo "Error: Missing arguments. Usage: $0 <model-file-path.gguf> <model-name>"
+# Check if both parameters are provided, the vision projector is optional
+if [ $# -lt 2 ] || [ $# -gt 3 ]; then
+  echo "Error: Missing arguments. Usage: $0 <model-file-path.gguf> <model-name> [projector-file-path.gguf]"
   exit 1
 fi
 
 MODEL_FILE="$1"
 MODEL_NAME="$2"
+PROJECTOR_FILE="$3"
 
 # Check if the file ends with .gguf
 if [[ ! "$MODEL_FILE" =~ \.gguf$ ]]; then
@@ -15,12 +16,30 @@ if [[ ! "$MODEL_FILE" =~ \.gguf$ ]]; then
   exit 1
 fi
 
+# Ollama only imports the file named in the Modelfile, the other shards of a split model would be lost
+if [[ "$MODEL_FILE" =~ -[0-9]{5}-of-[0-9]{5}\.gguf$ ]]; then
+  echo "Error: Sharded GGUF models cannot be created with Ollama, merge the shards with llama-gguf-split --merge first."
+  exit 1
+fi
+
 # Check if the file exists (any path)
 if [ ! -f "$MODEL_FILE" ]; then
   echo "Error: File '$MODEL_FILE' not found."
   exit 1
 fi
 
+# Check the projector file of vision models
+if [ -n "$PROJECTOR_FILE" ]; then
+  if [[ ! "$PROJECTOR_FILE" =~ \.gguf$ ]]; then
+    echo "Error: Projector file name must end with .gguf"
+    exit 1
+  fi
+  if [ ! -f "$PROJECTOR_FILE" ]; then
+    echo "Error: Projector file '$PROJECTOR_FILE' not found."
+    exit 1
+  fi
+fi
+
 # Validate that model name is alphanumeric only
 if [[ ! "$MODEL_NAME" =~ ^[a-zA-Z0-9]+$ ]]; then
   echo "Error: Model name must be alphanumeric only (letters and numbers)."
@@ -42,11 +61,23 @@ if [ $? -ne 0 ]; then
   exit 1
 fi
 
+# Copy the projector next to the model
+if [ -n "$PROJECTOR_FILE" ]; then
+  cp "$PROJECTOR_FILE" "models/$MODEL_NAME/mmproj.gguf"
+  if [ $? -ne 0 ]; then
+    echo "Error: Failed to copy the projector file."
+    exit 1
+  fi
+fi
+
 # Move into model directory
 cd "models/$MODEL_NAME" || exit 1
 
 # Create Modelfile
 echo "FROM ./$MODEL_NAME.gguf" > Modelfile
+if [ -n "$PROJECTOR_FILE" ]; then
+  echo "FROM ./mmproj.gguf" >> Modelfile
+fi
 
 echo "Created model directory and prepared files successfully."
 
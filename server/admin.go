@@ -0,0 +1,98 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+
+	"depin-server/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// adminTokenFromEnv reads ADMIN_TOKEN, the bearer token of the routes configuring the
+// node, such as asset prices and rate limits. Those routes reject every request when it is not set.
+func adminTokenFromEnv() string {
+	token := os.Getenv("ADMIN_TOKEN")
+	if token == "" {
+		utils.LogInfo("ADMIN_TOKEN is not set, admin routes are disabled")
+	}
+	return token
+}
+
+// requireAdmin only lets requests through which carry the admin token in an
+// "Authorization: Bearer" header
+func (s *DepinServer) requireAdmin(c *gin.Context) {
+	if err := s.authorizeAdmin(c); err != nil {
+		utils.LogInfo("Rejecting admin request from %s: %v", c.ClientIP(), err)
+		utils.RespondError(c, http.StatusUnauthorized, "Admin authorization required", err)
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// authorizeAdmin returns an error unless the request carries the admin token
+func (s *DepinServer) authorizeAdmin(c *gin.Context) error {
+	if s.AdminToken == "" {
+		return errors.New("admin routes are disabled, set ADMIN_TOKEN to enable them")
+	}
+
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.AdminToken)) != 1 {
+		return errors.New("missing or invalid admin token")
+	}
+	return nil
+}
+
+// errNotOwner is returned for requests acting on a resource of another DID
+var errNotOwner = errors.New("the resource belongs to another DID")
+
+// authorizeOwner checks that a request acting on a resource of the owner DID was sent by
+// the DID, which signs the payload
+//
+//	action \n resource_id \n timestamp
+//
+// sent in the X-Depin-Did, X-Depin-Timestamp and X-Depin-Signature headers. The admin may
+// act on any resource, and is the only one allowed to act on resources without DID. It
+// returns errNotOwner if the request is sent on behalf of another DID.
+func (s *DepinServer) authorizeOwner(c *gin.Context, owner string, action string, resourceID string) error {
+	if s.authorizeAdmin(c) == nil {
+		return nil
+	}
+	if owner == "" {
+		return errors.New("resources without DID are restricted to the admin")
+	}
+	if c.GetHeader(headerDepinDid) != owner {
+		return errNotOwner
+	}
+
+	timestamp := c.GetHeader(headerDepinTimestamp)
+	payload := []byte(action + "\n" + resourceID + "\n" + timestamp)
+	return s.verifySignedRequest(owner, payload, timestamp, c.GetHeader(headerDepinSignature))
+}
+
+// verifySignedRequest checks the signature of a DID over payload and consumes it, so that
+// the request cannot be replayed. Requests of a DID are restricted to the admin while
+// signature verification is disabled.
+func (s *DepinServer) verifySignedRequest(did string, payload []byte, timestamp string, signature string) error {
+	if s.Verifier == nil {
+		return errors.New("signature verification is disabled, requests of a DID are restricted to the admin")
+	}
+	if signature == "" || timestamp == "" {
+		return errors.New("timestamp and signature are required")
+	}
+
+	requestTime, err := checkTimestampWindow(timestamp, s.TimestampWindow)
+	if err != nil {
+		return err
+	}
+
+	if err := s.Verifier.VerifyPayload(did, payload, signature); err != nil {
+		return err
+	}
+
+	return s.consumeSignature(did, payload, requestTime)
+}
@@ -0,0 +1,294 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+
+	"depin-server/db"
+	"depin-server/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultMaxConcurrency = 1
+	defaultMaxQueueDepth  = 8
+	// admissionRetryAfter is the number of seconds a rejected client is asked to wait
+	admissionRetryAfter = 5
+)
+
+// errQueueFull is returned when an asset is already running and queueing the maximum
+var errQueueFull = errors.New("too many inference requests queued for this asset")
+
+// errInvalidQueueTicket is returned for queue tickets clients cannot poll with
+var errInvalidQueueTicket = errors.New("queue ticket must be 1 to 64 letters, digits, dashes or underscores")
+
+// AdmissionController bounds the number of concurrent inferences per asset. Requests
+// beyond the limit wait in a FIFO queue of bounded depth, and are rejected once it is full.
+// MaxConcurrency and MaxQueueDepth apply to assets without limits of their own.
+type AdmissionController struct {
+	MaxConcurrency int
+	MaxQueueDepth  int
+
+	mu     sync.Mutex
+	assets map[string]*assetQueue
+}
+
+type assetQueue struct {
+	running int
+	waiting []*queuedRequest
+	// maxConcurrency is the concurrency limit of the asset as of its last request
+	maxConcurrency int
+}
+
+// queuedRequest is a request waiting for a slot, ready is closed once it may run
+type queuedRequest struct {
+	ready  chan struct{}
+	ticket string
+}
+
+// AdmissionStatus is a snapshot of the inferences running and queued for an asset
+type AdmissionStatus struct {
+	AssetID        string `json:"asset_id"`
+	Running        int    `json:"running"`
+	Queued         int    `json:"queued"`
+	MaxConcurrency int    `json:"max_concurrency"`
+	MaxQueueDepth  int    `json:"max_queue_depth"`
+}
+
+// QueuePosition is the position of a queued request, polled with the ticket the client
+// sent along with the request
+type QueuePosition struct {
+	AssetID  string `json:"asset_id"`
+	Ticket   string `json:"ticket"`
+	Position int    `json:"position"`
+}
+
+func NewAdmissionController(maxConcurrency int, maxQueueDepth int) *AdmissionController {
+	return &AdmissionController{
+		MaxConcurrency: maxConcurrency,
+		MaxQueueDepth:  maxQueueDepth,
+		assets:         make(map[string]*assetQueue),
+	}
+}
+
+// limitsFor returns the concurrency and queue depth of an asset, the defaults of the
+// controller where limits sets none
+func (a *AdmissionController) limitsFor(limits *db.AssetLimits) (int, int) {
+	maxConcurrency, maxQueueDepth := a.MaxConcurrency, a.MaxQueueDepth
+	if limits != nil {
+		if limits.MaxConcurrency > 0 {
+			maxConcurrency = limits.MaxConcurrency
+		}
+		if limits.MaxQueueDepth > 0 {
+			maxQueueDepth = limits.MaxQueueDepth
+		}
+	}
+	return maxConcurrency, maxQueueDepth
+}
+
+// Admit waits until the request may run an inference on the asset, within the limits of
+// the asset, and returns the function releasing its slot. A waiting request can be found
+// with Position by its ticket, if not empty, and onQueued is called with its 1-based
+// queue position. A request whose context ends while queued leaves the queue.
+func (a *AdmissionController) Admit(ctx context.Context, assetID string, limits *db.AssetLimits, ticket string, onQueued func(position int)) (func(), error) {
+	maxConcurrency, maxQueueDepth := a.limitsFor(limits)
+
+	a.mu.Lock()
+	queue, ok := a.assets[assetID]
+	if !ok {
+		queue = &assetQueue{}
+		a.assets[assetID] = queue
+	}
+	// A raised limit lets queued requests run right away
+	queue.maxConcurrency = maxConcurrency
+	queue.dispatch()
+
+	if queue.running < maxConcurrency && len(queue.waiting) == 0 {
+		queue.running++
+		a.mu.Unlock()
+		return a.releaseFunc(assetID, queue), nil
+	}
+
+	if len(queue.waiting) >= maxQueueDepth {
+		a.mu.Unlock()
+		return nil, errQueueFull
+	}
+
+	waiter := &queuedRequest{ready: make(chan struct{}), ticket: ticket}
+	queue.waiting = append(queue.waiting, waiter)
+	position := len(queue.waiting)
+	a.mu.Unlock()
+
+	if onQueued != nil {
+		onQueued(position)
+	}
+
+	select {
+	case <-waiter.ready:
+		return a.releaseFunc(assetID, queue), nil
+	case <-ctx.Done():
+		a.mu.Lock()
+		for i, queued := range queue.waiting {
+			if queued == waiter {
+				queue.waiting = append(queue.waiting[:i], queue.waiting[i+1:]...)
+				a.mu.Unlock()
+				return nil, ctx.Err()
+			}
+		}
+		a.mu.Unlock()
+
+		// The slot was handed over while the request was cancelled, pass it on
+		a.releaseFunc(assetID, queue)()
+		return nil, ctx.Err()
+	}
+}
+
+// dispatch hands free slots to the first queued requests, it is called with the mutex held
+func (q *assetQueue) dispatch() {
+	for q.running < q.maxConcurrency && len(q.waiting) > 0 {
+		close(q.waiting[0].ready)
+		q.waiting = q.waiting[1:]
+		q.running++
+	}
+}
+
+// Status returns the running and queued inferences of an asset, with its limits
+func (a *AdmissionController) Status(assetID string, limits *db.AssetLimits) *AdmissionStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	status := &AdmissionStatus{AssetID: assetID}
+	status.MaxConcurrency, status.MaxQueueDepth = a.limitsFor(limits)
+	if queue, ok := a.assets[assetID]; ok {
+		status.Running = queue.running
+		status.Queued = len(queue.waiting)
+	}
+	return status
+}
+
+// Position returns the 1-based position of the queued request with the ticket, or 0 if no
+// such request is waiting for the asset
+func (a *AdmissionController) Position(assetID string, ticket string) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if queue, ok := a.assets[assetID]; ok {
+		for i, queued := range queue.waiting {
+			if queued.ticket == ticket {
+				return i + 1
+			}
+		}
+	}
+	return 0
+}
+
+// releaseFunc frees the slot of a request, handing it to the first queued request if any
+func (a *AdmissionController) releaseFunc(assetID string, queue *assetQueue) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+
+			queue.running--
+			queue.dispatch()
+			if queue.running == 0 && len(queue.waiting) == 0 {
+				delete(a.assets, assetID)
+			}
+		})
+	}
+}
+
+// admissionControllerFromEnv reads INFERENCE_MAX_CONCURRENCY and INFERENCE_MAX_QUEUE,
+// which apply to every asset
+func admissionControllerFromEnv() *AdmissionController {
+	return NewAdmissionController(
+		intFromEnv("INFERENCE_MAX_CONCURRENCY", defaultMaxConcurrency, 1),
+		intFromEnv("INFERENCE_MAX_QUEUE", defaultMaxQueueDepth, 0),
+	)
+}
+
+// intFromEnv reads an integer setting, falling back to defaultValue if it is below minValue
+func intFromEnv(key string, defaultValue int, minValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < minValue {
+		utils.LogInfo("Invalid %s %q, using default of %d", key, value, defaultValue)
+		return defaultValue
+	}
+	return parsed
+}
+
+// admitInference admits an inference request on the asset. Clients follow the position
+// of a queued request by sending an X-Queue-Ticket header of their choosing and polling it
+// with HandleGetQueuePosition. When the queue is full the Retry-After header is set.
+func (s *DepinServer) admitInference(c *gin.Context, assetID string, limits *db.AssetLimits) (func(), error) {
+	ticket := c.GetHeader("X-Queue-Ticket")
+	if ticket != "" && !validQueueTicket(ticket) {
+		return nil, errInvalidQueueTicket
+	}
+
+	release, err := s.Admission.Admit(c.Request.Context(), assetID, limits, ticket, func(position int) {
+		utils.LogInfo("Inference request for asset %s queued at position %d", assetID, position)
+	})
+	if errors.Is(err, errQueueFull) {
+		c.Header("Retry-After", strconv.Itoa(admissionRetryAfter))
+	}
+	return release, err
+}
+
+func validQueueTicket(ticket string) bool {
+	if len(ticket) > 64 {
+		return false
+	}
+	for _, r := range ticket {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// HandleGetAssetQueue returns the inferences running and queued for an asset
+func (s *DepinServer) HandleGetAssetQueue(c *gin.Context) {
+	assetID := c.Param("assetId")
+	if assetID == "" {
+		utils.RespondError(c, http.StatusBadRequest, "Asset ID is required", nil)
+		return
+	}
+
+	limits, err := db.GetAssetLimits(s.Storage, assetID)
+	if err != nil {
+		utils.LogInfo("Error fetching limits of asset %s: %v", assetID, err)
+		utils.RespondError(c, http.StatusInternalServerError, "Failed to fetch asset limits", err)
+		return
+	}
+
+	utils.RespondSuccess(c, "Asset queue fetched successfully", s.Admission.Status(assetID, limits))
+}
+
+// HandleGetQueuePosition returns the position of a request waiting for an asset, by the
+// X-Queue-Ticket it was sent with. Requests which are running or done are not found.
+func (s *DepinServer) HandleGetQueuePosition(c *gin.Context) {
+	assetID, ticket := c.Param("assetId"), c.Param("ticket")
+	if assetID == "" || !validQueueTicket(ticket) {
+		utils.RespondError(c, http.StatusBadRequest, "Asset ID and a valid ticket are required", nil)
+		return
+	}
+
+	position := s.Admission.Position(assetID, ticket)
+	if position == 0 {
+		utils.RespondError(c, http.StatusNotFound, "No queued request with this ticket", nil)
+		return
+	}
+	utils.RespondSuccess(c, "Queue position fetched successfully", &QueuePosition{AssetID: assetID, Ticket: ticket, Position: position})
+}
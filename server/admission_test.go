@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"depin-server/db"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAdmissionAssetLimits(t *testing.T) {
+	admission := NewAdmissionController(1, 1)
+	limits := &db.AssetLimits{AssetID: "asset-1", MaxConcurrency: 2, MaxQueueDepth: 2}
+
+	var releases []func()
+	for i := 0; i < 2; i++ {
+		release, err := admission.Admit(context.Background(), "asset-1", limits, "", nil)
+		if err != nil {
+			t.Fatalf("Admit() %d within the asset concurrency error = %v", i, err)
+		}
+		releases = append(releases, release)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	queued := make(chan error, 2)
+	for _, ticket := range []string{"first", "second"} {
+		go func(ticket string) {
+			release, err := admission.Admit(ctx, "asset-1", limits, ticket, nil)
+			if err == nil {
+				defer release()
+			}
+			queued <- err
+		}(ticket)
+		waitForQueued(t, admission, "asset-1", ticket)
+	}
+	if _, err := admission.Admit(context.Background(), "asset-1", limits, "", nil); !errors.Is(err, errQueueFull) {
+		t.Errorf("Admit() beyond the asset queue depth error = %v, want %v", err, errQueueFull)
+	}
+
+	status := admission.Status("asset-1", limits)
+	if status.Running != 2 || status.Queued != 2 || status.MaxConcurrency != 2 || status.MaxQueueDepth != 2 {
+		t.Errorf("Status() = %+v", status)
+	}
+	if position := admission.Position("asset-1", "second"); position != 2 {
+		t.Errorf("Position() = %d, want 2", position)
+	}
+
+	// Assets without limits of their own use the defaults of the controller
+	if status := admission.Status("asset-2", nil); status.MaxConcurrency != 1 || status.MaxQueueDepth != 1 {
+		t.Errorf("Status() without asset limits = %+v", status)
+	}
+
+	// Raising the limit of the asset lets both queued requests run
+	limits.MaxConcurrency = 4
+	release, err := admission.Admit(context.Background(), "asset-1", limits, "", nil)
+	if err != nil {
+		t.Fatalf("Admit() after raising the limit error = %v", err)
+	}
+	releases = append(releases, release)
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-queued:
+			if err != nil {
+				t.Errorf("queued request error = %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("queued requests did not run after the limit was raised")
+		}
+	}
+
+	for _, release := range releases {
+		release()
+	}
+	if status := admission.Status("asset-1", limits); status.Running != 0 || status.Queued != 0 {
+		t.Errorf("Status() after releasing every slot = %+v", status)
+	}
+}
+
+func TestQueuePositionPolling(t *testing.T) {
+	s, _ := newTestServer(t)
+	router := gin.New()
+	router.GET("/assets/:assetId/queue/:ticket", s.HandleGetQueuePosition)
+	poll := func(ticket string) (int, int) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/assets/asset-1/queue/"+ticket, nil))
+		var body struct {
+			Data QueuePosition `json:"data"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Code, body.Data.Position
+	}
+
+	release, err := s.Admission.Admit(context.Background(), "asset-1", nil, "", nil)
+	if err != nil {
+		t.Fatalf("Admit() error = %v", err)
+	}
+
+	admitted := make(chan struct{})
+	go func() {
+		if release, err := s.Admission.Admit(context.Background(), "asset-1", nil, "ticket-1", nil); err == nil {
+			release()
+		}
+		close(admitted)
+	}()
+	waitForQueued(t, s.Admission, "asset-1", "ticket-1")
+
+	if code, position := poll("ticket-1"); code != http.StatusOK || position != 1 {
+		t.Errorf("polling a queued request = %d, position %d", code, position)
+	}
+
+	release()
+	<-admitted
+	if code, _ := poll("ticket-1"); code != http.StatusNotFound {
+		t.Errorf("polling a request which left the queue = %d, want %d", code, http.StatusNotFound)
+	}
+	if code, _ := poll("not*valid"); code != http.StatusBadRequest {
+		t.Errorf("polling an invalid ticket = %d, want %d", code, http.StatusBadRequest)
+	}
+}
+
+// waitForQueued waits until the request with the ticket is queued for the asset
+func waitForQueued(t *testing.T, admission *AdmissionController, assetID string, ticket string) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for admission.Position(assetID, ticket) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("request %s was not queued", ticket)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -4,14 +4,18 @@ import (
 	"encoding/json"
 	"os"
 
+	"depin-server/db"
 	"depin-server/utils"
 
 	"github.com/gin-gonic/gin"
 )
 
 type AssetEntry struct {
-	Name    string `json:"name"`
-	AssetID string `json:"assetId"`
+	Name    string         `json:"name"`
+	AssetID string         `json:"assetId"`
+	Price   *db.AssetPrice `json:"price,omitempty"`
+	// Metadata describes a model, as read from its GGUF file
+	Metadata *db.ModelMetadata `json:"metadata,omitempty"`
 }
 
 type AssetMetadata struct {
@@ -41,6 +45,28 @@ func (s *DepinServer) HandleGetAssets(c *gin.Context) {
 		return
 	}
 
+	prices, err := db.GetAssetPrices(s.Storage)
+	if err != nil {
+		utils.LogInfo("Error fetching asset prices: %v", err)
+		utils.RespondError(c, 500, "Failed to fetch asset prices", err)
+		return
+	}
+	for _, entries := range [][]AssetEntry{metadata.Models, metadata.Datasets} {
+		for i := range entries {
+			entries[i].Price = prices[entries[i].AssetID]
+		}
+	}
+
+	models, err := db.GetModelMetadatas(s.Storage)
+	if err != nil {
+		utils.LogInfo("Error fetching model metadata: %v", err)
+		utils.RespondError(c, 500, "Failed to fetch model metadata", err)
+		return
+	}
+	for i := range metadata.Models {
+		metadata.Models[i].Metadata = models[metadata.Models[i].AssetID]
+	}
+
 	utils.RespondSuccess(c, "Assets fetched successfully", metadata)
 }
 
@@ -51,6 +77,31 @@ func (s *DepinServer) HandleDownloadAsset(c *gin.Context) {
 		return
 	}
 
+	// The NFT of an asset made of several files only holds its manifest, the files are
+	// served together as an archive
+	files, err := db.GetAssetFiles(s.Storage, assetID)
+	if err != nil {
+		utils.LogInfo("Error fetching asset files: %v", err)
+		utils.RespondError(c, 500, "Failed to fetch asset files", err)
+		return
+	}
+	if len(files) > 1 {
+		asset, err := db.GetAsset(s.Storage, assetID)
+		if err != nil || asset == nil {
+			utils.LogInfo("Error fetching asset %s: %v", assetID, err)
+			utils.RespondError(c, 500, "Failed to fetch asset", err)
+			return
+		}
+		download, ok := s.authorizeDownload(c, assetID)
+		if !ok {
+			return
+		}
+		if s.streamAssetArchive(c, asset, files) {
+			s.recordDownload(download)
+		}
+		return
+	}
+
 	assetPath := getAssetLocation(assetID)
 	if _, err := os.Stat(assetPath); os.IsNotExist(err) {
 		utils.LogInfo("Asset not found: %s", assetPath)
@@ -58,6 +109,35 @@ func (s *DepinServer) HandleDownloadAsset(c *gin.Context) {
 		return
 	}
 
+	download, ok := s.authorizeDownload(c, assetID)
+	if !ok {
+		return
+	}
+
 	c.File(assetPath)
 	utils.LogInfo("Serving asset: %s", assetPath)
+	if c.Writer.Status() == 200 {
+		s.recordDownload(download)
+	}
+}
+
+// HandleGetAssetUsage returns the tokens served and the generation throughput of an asset
+func (s *DepinServer) HandleGetAssetUsage(c *gin.Context) {
+	assetID := c.Param("assetId")
+	if assetID == "" {
+		utils.RespondError(c, 400, "Asset ID is required", nil)
+		return
+	}
+
+	usage, err := db.GetAssetUsage(s.Storage, assetID)
+	if err != nil {
+		utils.LogInfo("Error fetching usage of asset %s: %v", assetID, err)
+		utils.RespondError(c, 500, "Failed to fetch asset usage", err)
+		return
+	}
+	if usage == nil {
+		usage = &db.AssetUsage{AssetID: assetID}
+	}
+
+	utils.RespondSuccess(c, "Asset usage fetched successfully", usage)
 }
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"depin-server/constants"
+	"depin-server/utils"
+)
+
+// InferenceBackend is a model runtime serving inference for assets. Implementations
+// translate their native API to the Ollama response format, so that handlers relay
+// and bill every runtime the same way.
+type InferenceBackend interface {
+	// Chat runs a chat completion. A successful response body holds NDJSON
+	// ChatResponse chunks when streaming, or a single ChatResponse otherwise.
+	// Cancelling ctx aborts the generation, including a streamed response body.
+	Chat(ctx context.Context, input *InferenceInput) (*BackendResponse, error)
+	// Generate runs a raw prompt completion, responding like the Ollama /api/generate endpoint
+	Generate(ctx context.Context, req *GenerateRequest) (*BackendResponse, error)
+	// Embed computes one embedding per input
+	Embed(ctx context.Context, req *EmbedRequest) (*EmbedResponse, error)
+	// ListModels returns the models the runtime can serve
+	ListModels() ([]string, error)
+	// Health returns an error if the runtime cannot serve requests
+	Health() error
+}
+
+// BackendResponse is the response of a backend call. When StatusCode is not 200
+// the body holds the error returned by the runtime.
+type BackendResponse struct {
+	StatusCode  int
+	ContentType string
+	Body        io.ReadCloser
+}
+
+type GenerateRequest struct {
+	Model  string `json:"model"`
+	Prompt string `json:"prompt"`
+	System string `json:"system,omitempty"`
+	Stream bool   `json:"stream"`
+}
+
+// GenerateResponse is a response (or a single stream chunk) in the Ollama /api/generate format
+type GenerateResponse struct {
+	Model      string `json:"model"`
+	CreatedAt  string `json:"created_at"`
+	Response   string `json:"response"`
+	Done       bool   `json:"done"`
+	DoneReason string `json:"done_reason,omitempty"`
+	InferenceUsage
+}
+
+type EmbedRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+type EmbedResponse struct {
+	Model      string      `json:"model"`
+	Embeddings [][]float64 `json:"embeddings"`
+}
+
+// backendsFromEnv configures a backend for every runtime whose API address is set:
+// OLLAMA_API, LLAMACPP_API and OPENAI_COMPAT_API (with an optional OPENAI_COMPAT_API_KEY).
+// An address may list several comma separated instances, which are load balanced.
+func backendsFromEnv() map[string]InferenceBackend {
+	backends := make(map[string]InferenceBackend)
+	healthInterval := healthIntervalFromEnv()
+
+	runtimes := []struct {
+		runtime    string
+		env        string
+		newBackend func(baseURL string) InferenceBackend
+	}{
+		{constants.RUNTIME_OLLAMA, "OLLAMA_API", func(baseURL string) InferenceBackend {
+			return NewOllamaBackend(baseURL)
+		}},
+		{constants.RUNTIME_LLAMACPP, "LLAMACPP_API", func(baseURL string) InferenceBackend {
+			return NewLlamaCppBackend(baseURL)
+		}},
+		{constants.RUNTIME_OPENAI, "OPENAI_COMPAT_API", func(baseURL string) InferenceBackend {
+			return NewOpenAICompatBackend(baseURL, os.Getenv("OPENAI_COMPAT_API_KEY"))
+		}},
+	}
+
+	for _, r := range runtimes {
+		urls := splitBackendURLs(os.Getenv(r.env))
+		switch len(urls) {
+		case 0:
+		case 1:
+			backends[r.runtime] = r.newBackend(urls[0])
+		default:
+			instances := make(map[string]InferenceBackend, len(urls))
+			for _, url := range urls {
+				instances[url] = r.newBackend(url)
+			}
+			backends[r.runtime] = NewBackendPool(instances, healthInterval)
+			utils.LogInfo("Balancing %s inference over %d instances", r.runtime, len(urls))
+		}
+	}
+
+	if len(backends) == 0 {
+		utils.LogInfo("No inference backend is configured, set OLLAMA_API, LLAMACPP_API or OPENAI_COMPAT_API")
+	}
+	return backends
+}
+
+// backendFor returns the backend serving assets of the given runtime
+func (s *DepinServer) backendFor(runtime string) (InferenceBackend, error) {
+	if runtime == "" {
+		runtime = constants.RUNTIME_OLLAMA
+	}
+
+	backend, ok := s.Backends[runtime]
+	if !ok {
+		return nil, fmt.Errorf("no inference backend is configured for runtime %s", runtime)
+	}
+	return backend, nil
+}
+
+// backendError returns an error describing a failed backend call, consuming its body
+func backendError(resp *http.Response) error {
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return fmt.Errorf("backend returned %d: %s", resp.StatusCode, body)
+}
+
+func rawBackendResponse(resp *http.Response) *BackendResponse {
+	return &BackendResponse{
+		StatusCode:  resp.StatusCode,
+		ContentType: resp.Header.Get("Content-Type"),
+		Body:        resp.Body,
+	}
+}
+
+func jsonBackendResponse(v any) (*BackendResponse, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal response: %v", err)
+	}
+
+	return &BackendResponse{
+		StatusCode:  http.StatusOK,
+		ContentType: "application/json; charset=utf-8",
+		Body:        io.NopCloser(bytes.NewReader(body)),
+	}, nil
+}
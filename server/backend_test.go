@@ -0,0 +1,413 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"depin-server/constants"
+)
+
+func newTestInput(stream bool) *InferenceInput {
+	return &InferenceInput{
+		Model:    "m:latest",
+		Messages: []*Message{{Role: constants.MESSAGE_ROLE_USER, Content: "hello"}},
+		Stream:   stream,
+		Options:  map[string]any{"temperature": 0.5, "num_predict": float64(16)},
+	}
+}
+
+// readChatChunks decodes the NDJSON ChatResponse chunks of a backend response
+func readChatChunks(t *testing.T, resp *BackendResponse) []*ChatResponse {
+	t.Helper()
+	defer resp.Body.Close()
+
+	var chunks []*ChatResponse
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var chunk ChatResponse
+		err := dec.Decode(&chunk)
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatalf("failed to decode chunk: %v", err)
+		}
+		chunks = append(chunks, &chunk)
+	}
+}
+
+func TestOllamaBackendChat(t *testing.T) {
+	var received InferenceInput
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/chat" {
+			http.NotFound(w, r)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Errorf("failed to decode request: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"model":"m:latest","message":{"role":"assistant","content":"hi"},"done":true,"prompt_eval_count":3,"eval_count":1}`)
+	}))
+	defer server.Close()
+
+	resp, err := NewOllamaBackend(server.URL).Chat(context.Background(), newTestInput(false))
+	if err != nil {
+		t.Fatalf("Chat() error = %v", err)
+	}
+
+	if received.Model != "m:latest" || len(received.Messages) != 1 || received.Options["temperature"] != 0.5 {
+		t.Errorf("request was not forwarded unchanged: %+v", received)
+	}
+	chunks := readChatChunks(t, resp)
+	if len(chunks) != 1 || chunks[0].Message.Content != "hi" || chunks[0].PromptEvalCount != 3 || chunks[0].EvalCount != 1 {
+		t.Errorf("unexpected response: %+v", chunks)
+	}
+}
+
+func TestOllamaBackendModels(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/tags":
+			io.WriteString(w, `{"models":[{"name":"m:latest","digest":"abc"},{"name":"other:7b","digest":"def"}]}`)
+		case "/api/ps":
+			io.WriteString(w, `{"models":[{"name":"m:latest","digest":"abc"}]}`)
+		case "/api/version":
+			io.WriteString(w, `{"version":"0.5.0"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	backend := NewOllamaBackend(server.URL)
+
+	models, err := backend.ListModels()
+	if err != nil || strings.Join(models, ",") != "m:latest,other:7b" {
+		t.Errorf("ListModels() = %v, %v", models, err)
+	}
+	if loaded, err := backend.LoadedModels(); err != nil || strings.Join(loaded, ",") != "m:latest" {
+		t.Errorf("LoadedModels() = %v, %v", loaded, err)
+	}
+	if digest, err := backend.ModelDigest("m"); err != nil || digest != "abc" {
+		t.Errorf("ModelDigest() = %q, %v", digest, err)
+	}
+	if err := backend.Health(); err != nil {
+		t.Errorf("Health() error = %v", err)
+	}
+}
+
+func TestOllamaBackendGenerateAndEmbed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/generate":
+			var req GenerateRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Prompt != "hello" {
+				t.Errorf("unexpected generate request: %+v, %v", req, err)
+			}
+			io.WriteString(w, `{"model":"m:latest","response":"hi","done":true,"eval_count":1}`)
+		case "/api/embed":
+			io.WriteString(w, `{"model":"m:latest","embeddings":[[0.1,0.2],[0.3,0.4]]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	backend := NewOllamaBackend(server.URL)
+
+	resp, err := backend.Generate(context.Background(), &GenerateRequest{Model: "m:latest", Prompt: "hello"})
+	if err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+	defer resp.Body.Close()
+	var generateResp GenerateResponse
+	if err := json.NewDecoder(resp.Body).Decode(&generateResp); err != nil || generateResp.Response != "hi" || generateResp.EvalCount != 1 {
+		t.Errorf("unexpected generate response: %+v, %v", generateResp, err)
+	}
+
+	embedResp, err := backend.Embed(context.Background(), &EmbedRequest{Model: "m:latest", Input: []string{"a", "b"}})
+	if err != nil || len(embedResp.Embeddings) != 2 || embedResp.Embeddings[1][0] != 0.3 {
+		t.Errorf("Embed() = %+v, %v", embedResp, err)
+	}
+}
+
+// newOpenAICompatServer serves the OpenAI endpoint at path with respond, checking the API key
+func newOpenAICompatServer(t *testing.T, path string, respond func(w http.ResponseWriter, chatReq map[string]any)) *httptest.Server {
+	t.Helper()
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, `{"error":{"message":"invalid api key"}}`)
+			return
+		}
+		var chatReq map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&chatReq); err != nil {
+			t.Errorf("failed to decode request: %v", err)
+		}
+		respond(w, chatReq)
+	}))
+}
+
+func TestOpenAICompatBackendChat(t *testing.T) {
+	server := newOpenAICompatServer(t, "/v1/chat/completions", func(w http.ResponseWriter, chatReq map[string]any) {
+		if chatReq["max_tokens"] != float64(16) || chatReq["temperature"] != 0.5 || chatReq["stream"] != false {
+			t.Errorf("options were not translated: %v", chatReq)
+		}
+		io.WriteString(w, `{"model":"m","created":1700000000,"choices":[{"index":0,"message":{"role":"assistant","content":"hi"},"finish_reason":"length"}],"usage":{"prompt_tokens":3,"completion_tokens":1,"total_tokens":4}}`)
+	})
+	defer server.Close()
+
+	resp, err := NewOpenAICompatBackend(server.URL, "key").Chat(context.Background(), newTestInput(false))
+	if err != nil {
+		t.Fatalf("Chat() error = %v", err)
+	}
+
+	chunks := readChatChunks(t, resp)
+	if len(chunks) != 1 {
+		t.Fatalf("got %d chunks, want 1", len(chunks))
+	}
+	chatResp := chunks[0]
+	if !chatResp.Done || chatResp.Message.Content != "hi" || chatResp.Message.Role != constants.MESSAGE_ROLE_ASSISTANT || chatResp.DoneReason != "length" {
+		t.Errorf("unexpected response: %+v", chatResp)
+	}
+	if chatResp.PromptEvalCount != 3 || chatResp.EvalCount != 1 {
+		t.Errorf("usage = %+v, want 3 prompt and 1 completion tokens", chatResp.InferenceUsage)
+	}
+}
+
+func TestOpenAICompatBackendChatStream(t *testing.T) {
+	server := newOpenAICompatServer(t, "/v1/chat/completions", func(w http.ResponseWriter, chatReq map[string]any) {
+		if options, _ := chatReq["stream_options"].(map[string]any); options["include_usage"] != true {
+			t.Errorf("streamed usage was not requested: %v", chatReq)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, event := range []string{
+			`{"model":"m","choices":[{"index":0,"delta":{"role":"assistant","content":"hel"}}]}`,
+			`{"model":"m","choices":[{"index":0,"delta":{"content":"lo"},"finish_reason":"stop"}]}`,
+			`{"model":"m","choices":[],"usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}}`,
+			`[DONE]`,
+		} {
+			io.WriteString(w, "data: "+event+"\n\n")
+		}
+	})
+	defer server.Close()
+
+	resp, err := NewOpenAICompatBackend(server.URL, "key").Chat(context.Background(), newTestInput(true))
+	if err != nil {
+		t.Fatalf("Chat() error = %v", err)
+	}
+
+	chunks := readChatChunks(t, resp)
+	var content strings.Builder
+	for _, chunk := range chunks[:len(chunks)-1] {
+		if chunk.Done {
+			t.Errorf("chunk before the last one is done: %+v", chunk)
+		}
+		content.WriteString(chunk.Message.Content)
+	}
+	if content.String() != "hello" {
+		t.Errorf("content = %q, want %q", content.String(), "hello")
+	}
+
+	final := chunks[len(chunks)-1]
+	if !final.Done || final.DoneReason != "stop" || final.PromptEvalCount != 3 || final.EvalCount != 2 {
+		t.Errorf("unexpected final chunk: %+v", final)
+	}
+}
+
+func TestOpenAICompatBackendGenerate(t *testing.T) {
+	server := newOpenAICompatServer(t, "/v1/completions", func(w http.ResponseWriter, completionReq map[string]any) {
+		if completionReq["prompt"] != "be brief\n\nhello" {
+			t.Errorf("system prompt was not prepended: %v", completionReq)
+		}
+		if completionReq["stream"] == true {
+			w.Header().Set("Content-Type", "text/event-stream")
+			for _, event := range []string{
+				`{"model":"m","choices":[{"text":"hel"}]}`,
+				`{"model":"m","choices":[{"text":"lo","finish_reason":"stop"}]}`,
+				`{"model":"m","choices":[],"usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}}`,
+				`[DONE]`,
+			} {
+				io.WriteString(w, "data: "+event+"\n\n")
+			}
+			return
+		}
+		io.WriteString(w, `{"model":"m","choices":[{"text":"hi","finish_reason":"length"}],"usage":{"prompt_tokens":3,"completion_tokens":1,"total_tokens":4}}`)
+	})
+	defer server.Close()
+	backend := NewOpenAICompatBackend(server.URL, "key")
+
+	for _, stream := range []bool{false, true} {
+		resp, err := backend.Generate(context.Background(), &GenerateRequest{Model: "m", Prompt: "hello", System: "be brief", Stream: stream})
+		if err != nil {
+			t.Fatalf("Generate(stream %v) error = %v", stream, err)
+		}
+
+		var chunks []*GenerateResponse
+		dec := json.NewDecoder(resp.Body)
+		for {
+			var chunk GenerateResponse
+			if err := dec.Decode(&chunk); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("failed to decode chunk: %v", err)
+			}
+			chunks = append(chunks, &chunk)
+		}
+		resp.Body.Close()
+
+		var content strings.Builder
+		for _, chunk := range chunks {
+			content.WriteString(chunk.Response)
+		}
+		final := chunks[len(chunks)-1]
+		if !stream && (content.String() != "hi" || final.DoneReason != "length" || final.EvalCount != 1) {
+			t.Errorf("unexpected response: %+v", final)
+		}
+		if stream && (content.String() != "hello" || !final.Done || final.DoneReason != "stop" || final.EvalCount != 2) {
+			t.Errorf("unexpected streamed response %q: %+v", content.String(), final)
+		}
+	}
+}
+
+func TestOpenAICompatBackendEmbed(t *testing.T) {
+	server := newOpenAICompatServer(t, "/v1/embeddings", func(w http.ResponseWriter, embedReq map[string]any) {
+		// Embeddings may come back in any order, their index places them
+		io.WriteString(w, `{"model":"m","data":[{"index":1,"embedding":[0.3]},{"index":0,"embedding":[0.1]}]}`)
+	})
+	defer server.Close()
+
+	embedResp, err := NewOpenAICompatBackend(server.URL, "key").Embed(context.Background(), &EmbedRequest{Model: "m", Input: []string{"a", "b"}})
+	if err != nil || len(embedResp.Embeddings) != 2 || embedResp.Embeddings[0][0] != 0.1 || embedResp.Embeddings[1][0] != 0.3 {
+		t.Errorf("Embed() = %+v, %v", embedResp, err)
+	}
+}
+
+func TestOpenAICompatBackendTruncatedStream(t *testing.T) {
+	server := newOpenAICompatServer(t, "/v1/chat/completions", func(w http.ResponseWriter, chatReq map[string]any) {
+		io.WriteString(w, `data: {"model":"m","choices":[{"index":0,"delta":{"content":"hel"}}]}`+"\n\n")
+	})
+	defer server.Close()
+
+	resp, err := NewOpenAICompatBackend(server.URL, "key").Chat(context.Background(), newTestInput(true))
+	if err != nil {
+		t.Fatalf("Chat() error = %v", err)
+	}
+	defer resp.Body.Close()
+
+	if _, err := io.ReadAll(resp.Body); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("reading a stream without [DONE] error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestOpenAICompatBackendError(t *testing.T) {
+	server := newOpenAICompatServer(t, "/v1/chat/completions", nil)
+	defer server.Close()
+
+	resp, err := NewOpenAICompatBackend(server.URL, "wrong").Chat(context.Background(), newTestInput(false))
+	if err != nil {
+		t.Fatalf("Chat() error = %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusUnauthorized || !strings.Contains(string(body), "invalid api key") {
+		t.Errorf("runtime error was not passed on: %d %s", resp.StatusCode, body)
+	}
+}
+
+func TestLlamaCppBackend(t *testing.T) {
+	var loading atomic.Bool
+	loading.Store(true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health":
+			if loading.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				io.WriteString(w, `{"error":{"message":"Loading model"}}`)
+				return
+			}
+			io.WriteString(w, `{"status":"ok"}`)
+		case "/v1/chat/completions":
+			io.WriteString(w, `{"model":"m","choices":[{"index":0,"message":{"role":"assistant","content":"hi"},"finish_reason":"stop"}],"usage":{"prompt_tokens":3,"completion_tokens":1,"total_tokens":4}}`)
+		case "/v1/completions":
+			io.WriteString(w, `{"model":"m","choices":[{"text":"hi","finish_reason":"stop"}],"usage":{"prompt_tokens":3,"completion_tokens":1,"total_tokens":4}}`)
+		case "/v1/embeddings":
+			io.WriteString(w, `{"model":"m","data":[{"index":0,"embedding":[0.1,0.2]}]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	backend := NewLlamaCppBackend(server.URL)
+
+	if err := backend.Health(); err == nil {
+		t.Error("Health() reported a loading llama-server as healthy")
+	}
+	loading.Store(false)
+	if err := backend.Health(); err != nil {
+		t.Errorf("Health() error = %v", err)
+	}
+
+	resp, err := backend.Chat(context.Background(), newTestInput(false))
+	if err != nil {
+		t.Fatalf("Chat() error = %v", err)
+	}
+	if chunks := readChatChunks(t, resp); len(chunks) != 1 || chunks[0].Message.Content != "hi" || chunks[0].EvalCount != 1 {
+		t.Errorf("unexpected response: %+v", chunks)
+	}
+
+	resp, err = backend.Generate(context.Background(), &GenerateRequest{Model: "m", Prompt: "hello"})
+	if err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+	defer resp.Body.Close()
+	var generateResp GenerateResponse
+	if err := json.NewDecoder(resp.Body).Decode(&generateResp); err != nil || generateResp.Response != "hi" {
+		t.Errorf("unexpected generate response: %+v, %v", generateResp, err)
+	}
+
+	if embedResp, err := backend.Embed(context.Background(), &EmbedRequest{Model: "m", Input: []string{"a"}}); err != nil || len(embedResp.Embeddings) != 1 {
+		t.Errorf("Embed() = %+v, %v", embedResp, err)
+	}
+}
+
+func TestBackendPoolGenerateAndEmbed(t *testing.T) {
+	pool, member := newTestPool(NewFakeBackend("m:latest"))
+
+	resp, err := pool.Generate(context.Background(), &GenerateRequest{Model: "m:latest", Prompt: "hello there", Stream: true})
+	if err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+	if member.outstanding != 1 {
+		t.Errorf("outstanding = %d while the response is read, want 1", member.outstanding)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `"response":"hello"`) || !strings.Contains(string(body), `"done":true`) {
+		t.Errorf("unexpected generate stream: %s", body)
+	}
+
+	embedResp, err := pool.Embed(context.Background(), &EmbedRequest{Model: "m:latest", Input: []string{"a", "abc"}})
+	if err != nil || len(embedResp.Embeddings) != 2 || embedResp.Embeddings[1][0] != 3 {
+		t.Errorf("Embed() = %+v, %v", embedResp, err)
+	}
+	if member.outstanding != 0 {
+		t.Errorf("outstanding = %d after the requests completed", member.outstanding)
+	}
+
+	if _, err := pool.Embed(context.Background(), &EmbedRequest{Model: "other:latest", Input: []string{"a"}}); err == nil {
+		t.Error("Embed() of a model no instance serves succeeded")
+	}
+}
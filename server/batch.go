@@ -0,0 +1,560 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"depin-server/constants"
+	"depin-server/db"
+	"depin-server/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultBatchConcurrency = 2
+	defaultBatchMaxItems    = 10000
+	// batchPollInterval is how often idle workers look for pending items
+	batchPollInterval = 5 * time.Second
+	// batchRetryDelay is how long a worker backs off when the asset queue is full
+	batchRetryDelay = 5 * time.Second
+	// batchResultsPageSize is the number of items read at a time when writing results
+	batchResultsPageSize = 500
+)
+
+// BatchRequestItem is a line of the JSONL file of a batch job
+type BatchRequestItem struct {
+	CustomID             string          `json:"custom_id"`
+	OllamaInferenceInput *InferenceInput `json:"ollama_inference_input"`
+}
+
+// BatchResultItem is a line of the JSONL results of a batch job
+type BatchResultItem struct {
+	CustomID string          `json:"custom_id"`
+	Index    int             `json:"index"`
+	Status   string          `json:"status"`
+	Response json.RawMessage `json:"response,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	RecordID string          `json:"record_id,omitempty"`
+}
+
+// BatchRunner processes the items of batch jobs in the background with bounded concurrency
+type BatchRunner struct {
+	Concurrency int
+	MaxItems    int
+
+	wake chan struct{}
+}
+
+func NewBatchRunner(concurrency int, maxItems int) *BatchRunner {
+	return &BatchRunner{
+		Concurrency: concurrency,
+		MaxItems:    maxItems,
+		wake:        make(chan struct{}, concurrency),
+	}
+}
+
+// notify wakes idle workers after a job was queued
+func (r *BatchRunner) notify() {
+	for i := 0; i < r.Concurrency; i++ {
+		select {
+		case r.wake <- struct{}{}:
+		default:
+			return
+		}
+	}
+}
+
+// batchRunnerFromEnv reads BATCH_CONCURRENCY, the number of batch items processed at
+// once, and BATCH_MAX_ITEMS, the largest number of requests accepted in a batch job
+func batchRunnerFromEnv() *BatchRunner {
+	return NewBatchRunner(
+		intFromEnv("BATCH_CONCURRENCY", defaultBatchConcurrency, 1),
+		intFromEnv("BATCH_MAX_ITEMS", defaultBatchMaxItems, 1),
+	)
+}
+
+// startBatchWorkers resumes the items left running by a previous process and starts the workers
+func (s *DepinServer) startBatchWorkers() {
+	if err := db.ResetRunningBatchItems(s.Storage); err != nil {
+		utils.LogInfo("Error resetting running batch items: %v", err)
+	}
+	for i := 0; i < s.Batches.Concurrency; i++ {
+		go s.batchWorker()
+	}
+}
+
+func (s *DepinServer) batchWorker() {
+	for {
+		job, item, err := db.ClaimBatchItem(s.Storage)
+		if err != nil {
+			utils.LogInfo("Error claiming batch item: %v", err)
+		}
+		if item == nil {
+			select {
+			case <-s.Batches.wake:
+			case <-time.After(batchPollInterval):
+			}
+			continue
+		}
+
+		s.processBatchItem(job, item)
+	}
+}
+
+// processBatchItem runs the inference of a batch item and records it like an interactive
+// inference, so that every item is billed on its own
+func (s *DepinServer) processBatchItem(job *db.BatchJob, item *db.BatchItem) {
+	var input InferenceInput
+	if err := json.Unmarshal([]byte(item.Input), &input); err != nil {
+		s.finishBatchItem(item, constants.INFERENCE_STATUS_BACKEND_ERROR, nil, fmt.Errorf("invalid stored input: %v", err))
+		return
+	}
+
+	inferenceReq := &HandleInferenceReq{
+		OllamaInferenceInput: &input,
+		Did:                  job.Did,
+		Timestamp:            job.Timestamp,
+		Signature:            job.Signature,
+		AssetID:              job.AssetID,
+		AssetValue:           job.AssetValue,
+	}
+
+	asset, err := s.resolveAssetModel(inferenceReq)
+	if err != nil {
+		s.finishBatchItem(item, constants.INFERENCE_STATUS_BACKEND_ERROR, nil, err)
+		return
+	}
+	backend, err := s.backendFor(asset.Runtime)
+	if err != nil {
+		s.finishBatchItem(item, constants.INFERENCE_STATUS_BACKEND_ERROR, nil, err)
+		return
+	}
+	limits, err := s.assetLimits(asset.ID)
+	if err != nil {
+		s.finishBatchItem(item, constants.INFERENCE_STATUS_BACKEND_ERROR, nil, err)
+		return
+	}
+	// The price may have changed since the job was queued, items are only charged
+	// at the value the DID signed
+	price, err := s.resolveAssetValue(inferenceReq)
+	if err != nil {
+		s.finishBatchItem(item, constants.INFERENCE_STATUS_BACKEND_ERROR, nil, err)
+		return
+	}
+
+	// Batch items share the per-asset concurrency with interactive requests
+	release, err := s.Admission.Admit(context.Background(), asset.ID, limits, "", nil)
+	if err != nil {
+		if err := db.ReleaseBatchItem(s.Storage, item); err != nil {
+			utils.LogInfo("Error releasing batch item: %v", err)
+		}
+		time.Sleep(batchRetryDelay)
+		return
+	}
+	defer release()
+
+	record := newInferenceRecord(inferenceReq, item.Query)
+
+	ctx, cancel := generationContext(context.Background(), limits)
+	defer cancel()
+
+	resp, err := backend.Chat(ctx, &input)
+	if err != nil {
+		record.Status = inferenceFailureStatus(ctx, err)
+		s.recordInference(record, price)
+		s.finishBatchItem(item, record.Status, record, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		record.Status = inferenceFailureStatus(ctx, err)
+		s.recordInference(record, price)
+		s.finishBatchItem(item, record.Status, record, err)
+		return
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		record.Status = constants.INFERENCE_STATUS_BACKEND_ERROR
+		s.recordInference(record, price)
+		s.finishBatchItem(item, record.Status, record, fmt.Errorf("inference backend returned %d: %s", resp.StatusCode, respBody))
+		return
+	}
+
+	var chatResp ChatResponse
+	if err := json.Unmarshal(respBody, &chatResp); err != nil {
+		utils.LogInfo("Error parsing usage from inference backend response: %v", err)
+	}
+	chatResp.InferenceUsage.applyTo(record)
+	record.ToolCallCount = countToolCalls(chatResp.Message)
+	record.Status = constants.INFERENCE_STATUS_SUCCESS
+	s.recordInference(record, price)
+
+	item.Response = string(respBody)
+	s.finishBatchItem(item, record.Status, record, nil)
+}
+
+func (s *DepinServer) finishBatchItem(item *db.BatchItem, status string, record *db.InferenceRecord, err error) {
+	item.Status = status
+	if record != nil {
+		item.RecordID = record.ID
+	}
+	if err != nil {
+		utils.LogInfo("Batch item %d of job %s failed: %v", item.Index, item.BatchID, err)
+		item.Error = err.Error()
+	}
+
+	completed, err := db.FinishBatchItem(s.Storage, item)
+	if err != nil {
+		utils.LogInfo("Error storing outcome of batch item: %v", err)
+		return
+	}
+	if completed {
+		s.emitBatchEvent(constants.WEBHOOK_EVENT_BATCH_COMPLETED, item.BatchID)
+	}
+}
+
+// emitBatchEvent notifies webhooks of a batch job which reached a final status
+func (s *DepinServer) emitBatchEvent(event string, batchID string) {
+	job, err := db.GetBatchJob(s.Storage, batchID)
+	if err != nil || job == nil {
+		utils.LogInfo("Error fetching batch job %s for %s event: %v", batchID, event, err)
+		return
+	}
+	s.emitEvent(event, job.Did, job)
+}
+
+// HandleCreateBatch queues a batch job from a JSONL file of requests against one asset.
+// The file is signed once by the DID, over the payload
+//
+//	"batch" \n sha256_hex(file) \n asset_id \n asset_value \n timestamp
+//
+// and every request is charged the asset value.
+func (s *DepinServer) HandleCreateBatch(c *gin.Context) {
+	batchReq := &HandleInferenceReq{
+		Did:        c.PostForm("did"),
+		Timestamp:  c.PostForm("timestamp"),
+		Signature:  c.PostForm("signature"),
+		AssetID:    c.PostForm("asset_id"),
+		AssetValue: c.PostForm("asset_value"),
+	}
+
+	file, _, err := c.Request.FormFile("file")
+	if err != nil {
+		utils.LogInfo("Error reading batch file: %v", err)
+		utils.RespondError(c, http.StatusBadRequest, "File read error or missing file field", err)
+		return
+	}
+	defer file.Close()
+
+	fileBytes, err := io.ReadAll(file)
+	if err != nil {
+		utils.LogInfo("Error reading batch file: %v", err)
+		utils.RespondError(c, http.StatusBadRequest, "File read error", err)
+		return
+	}
+
+	asset, items, err := s.parseBatchItems(batchReq, fileBytes)
+	if err != nil {
+		utils.LogInfo("Invalid batch file: %v", err)
+		utils.RespondError(c, http.StatusBadRequest, "Invalid batch file", err)
+		return
+	}
+
+	price, err := s.resolveAssetValue(batchReq)
+	if err != nil {
+		utils.LogInfo("Error resolving value of asset %s: %v", batchReq.AssetID, err)
+		utils.RespondError(c, http.StatusPaymentRequired, "Asset value does not match asset price", err)
+		return
+	}
+
+	if err := s.authenticateBatch(batchReq, fileBytes); err != nil {
+		utils.LogInfo("Authentication failed for DID %s: %v", batchReq.Did, err)
+		utils.RespondError(c, http.StatusUnauthorized, "Invalid or replayed signature", err)
+		return
+	}
+
+	if _, err := s.backendFor(asset.Runtime); err != nil {
+		utils.LogInfo("Error selecting backend for asset %s: %v", asset.ID, err)
+		utils.RespondError(c, http.StatusServiceUnavailable, "Inference backend unavailable", err)
+		return
+	}
+
+	err = s.rateLimitInference(c, batchReq)
+	if errors.Is(err, errRateLimited) {
+		utils.RespondError(c, http.StatusTooManyRequests, "Too many requests, retry later", err)
+		return
+	}
+	if err != nil {
+		utils.LogInfo("Error checking rate limit: %v", err)
+		utils.RespondError(c, http.StatusInternalServerError, "Failed to check rate limit", err)
+		return
+	}
+
+	if err := s.consumeBatchSignature(batchReq, fileBytes); err != nil {
+		utils.LogInfo("Replay check failed for DID %s: %v", batchReq.Did, err)
+		utils.RespondError(c, http.StatusUnauthorized, "Invalid or replayed signature", err)
+		return
+	}
+
+	now := time.Now().Unix()
+	job := &db.BatchJob{
+		ID:         uuid.New().String(),
+		Did:        batchReq.Did,
+		AssetID:    asset.ID,
+		AssetValue: formatAssetValue(price.Amount),
+		Timestamp:  batchReq.Timestamp,
+		Signature:  batchReq.Signature,
+		Status:     constants.BATCH_STATUS_QUEUED,
+		Total:      len(items),
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	if err := db.CreateBatchJob(s.Storage, job, items); err != nil {
+		utils.LogInfo("Error creating batch job: %v", err)
+		utils.RespondError(c, http.StatusInternalServerError, "Failed to create batch job", err)
+		return
+	}
+	s.Batches.notify()
+
+	utils.LogInfo("Batch job %s queued with %d requests for asset %s", job.ID, job.Total, job.AssetID)
+	utils.RespondSuccess(c, "Batch job queued successfully", job)
+}
+
+// parseBatchItems validates every request of a batch file like an interactive request,
+// and returns the asset they run on with the items to queue
+func (s *DepinServer) parseBatchItems(batchReq *HandleInferenceReq, fileBytes []byte) (*db.Asset, []*db.BatchItem, error) {
+	var asset *db.Asset
+	var limits *db.AssetLimits
+	var items []*db.BatchItem
+
+	scanner := bufio.NewScanner(bytes.NewReader(fileBytes))
+	scanner.Buffer(make([]byte, 0, 64*1024), maxStreamChunkSize)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		if len(items) >= s.Batches.MaxItems {
+			return nil, nil, fmt.Errorf("a batch may hold at most %d requests", s.Batches.MaxItems)
+		}
+
+		var requestItem BatchRequestItem
+		if err := json.Unmarshal(scanner.Bytes(), &requestItem); err != nil {
+			return nil, nil, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		query, err := getUserInferenceInput(requestItem.OllamaInferenceInput, s.QueryPolicy)
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		itemReq := *batchReq
+		itemReq.OllamaInferenceInput = requestItem.OllamaInferenceInput
+		itemAsset, err := s.resolveAssetModel(&itemReq)
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if asset == nil {
+			asset = itemAsset
+			if limits, err = s.assetLimits(asset.ID); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		input := requestItem.OllamaInferenceInput
+		if err := validateInferenceOptions(input, limits); err != nil {
+			return nil, nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if err := s.validateImages(input, asset); err != nil {
+			return nil, nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		input.Model = asset.ModelTag
+		input.Stream = false
+
+		inputBytes, err := json.Marshal(input)
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		items = append(items, &db.BatchItem{
+			Index:    len(items),
+			CustomID: requestItem.CustomID,
+			Input:    string(inputBytes),
+			Query:    query,
+			Status:   constants.BATCH_ITEM_STATUS_PENDING,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(items) == 0 {
+		return nil, nil, errors.New("the batch holds no requests")
+	}
+	return asset, items, nil
+}
+
+// authenticateBatch checks the signature of a batch file like authenticateInference does
+// for a single request. It is a no-op when signature verification is disabled.
+func (s *DepinServer) authenticateBatch(batchReq *HandleInferenceReq, fileBytes []byte) error {
+	if s.Verifier == nil {
+		return nil
+	}
+	if batchReq.Did == "" || batchReq.Signature == "" || batchReq.Timestamp == "" {
+		return errors.New("did, timestamp and signature are required")
+	}
+
+	if _, err := checkTimestampWindow(batchReq.Timestamp, s.TimestampWindow); err != nil {
+		return err
+	}
+
+	return s.Verifier.VerifyPayload(batchReq.Did, batchSignedPayload(batchReq, fileBytes), batchReq.Signature)
+}
+
+// consumeBatchSignature rejects an authenticated batch which replays an accepted one. It
+// is a no-op when signature verification is disabled.
+func (s *DepinServer) consumeBatchSignature(batchReq *HandleInferenceReq, fileBytes []byte) error {
+	if s.Verifier == nil {
+		return nil
+	}
+
+	requestTime, err := parseRequestTimestamp(batchReq.Timestamp)
+	if err != nil {
+		return err
+	}
+	return s.consumeSignature(batchReq.Did, batchSignedPayload(batchReq, fileBytes), requestTime)
+}
+
+func batchSignedPayload(batchReq *HandleInferenceReq, fileBytes []byte) []byte {
+	sum := sha256.Sum256(fileBytes)
+	payload := strings.Join([]string{
+		"batch",
+		hex.EncodeToString(sum[:]),
+		batchReq.AssetID,
+		batchReq.AssetValue,
+		batchReq.Timestamp,
+	}, "\n")
+	return []byte(payload)
+}
+
+// HandleGetBatch returns the status and progress of a batch job. Like the other batch
+// routes, it is restricted to the DID of the job, which signs the payload
+//
+//	"batch-get" \n batch_id \n timestamp
+//
+// sent in the X-Depin-Did, X-Depin-Timestamp and X-Depin-Signature headers, and to the admin.
+func (s *DepinServer) HandleGetBatch(c *gin.Context) {
+	job, ok := s.batchJobParam(c, "batch-get")
+	if !ok {
+		return
+	}
+	utils.RespondSuccess(c, "Batch job fetched successfully", job)
+}
+
+// HandleCancelBatch cancels the requests of a batch job which have not started yet, the
+// DID of the job signs the "batch-cancel" payload
+func (s *DepinServer) HandleCancelBatch(c *gin.Context) {
+	if _, ok := s.batchJobParam(c, "batch-cancel"); !ok {
+		return
+	}
+
+	job, err := db.CancelBatchJob(s.Storage, c.Param("batchId"))
+	if err != nil {
+		utils.LogInfo("Error cancelling batch job: %v", err)
+		utils.RespondError(c, http.StatusInternalServerError, "Failed to cancel batch job", err)
+		return
+	}
+	if job == nil {
+		utils.RespondError(c, http.StatusNotFound, "Batch job not found", nil)
+		return
+	}
+
+	if job.Status == constants.BATCH_STATUS_CANCELLED {
+		utils.LogInfo("Batch job %s cancelled", job.ID)
+		s.emitEvent(constants.WEBHOOK_EVENT_BATCH_CANCELLED, job.Did, job)
+	}
+	utils.RespondSuccess(c, "Batch job cancelled successfully", job)
+}
+
+// HandleGetBatchResults returns the outcome of every request of a batch job as JSONL,
+// in the order of the submitted file. Requests not processed yet have a pending status.
+// The DID of the job signs the "batch-results" payload.
+func (s *DepinServer) HandleGetBatchResults(c *gin.Context) {
+	job, ok := s.batchJobParam(c, "batch-results")
+	if !ok {
+		return
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(http.StatusOK)
+
+	enc := json.NewEncoder(c.Writer)
+	for afterIndex := -1; ; {
+		items, err := db.GetBatchItems(s.Storage, job.ID, afterIndex, batchResultsPageSize)
+		if err != nil {
+			// The status is already sent, the truncated body signals the failure
+			utils.LogInfo("Error fetching results of batch job %s: %v", job.ID, err)
+			return
+		}
+
+		for _, item := range items {
+			result := &BatchResultItem{
+				CustomID: item.CustomID,
+				Index:    item.Index,
+				Status:   item.Status,
+				Error:    item.Error,
+				RecordID: item.RecordID,
+			}
+			if item.Response != "" {
+				result.Response = json.RawMessage(item.Response)
+			}
+			if err := enc.Encode(result); err != nil {
+				utils.LogInfo("Error writing results of batch job %s: %v", job.ID, err)
+				return
+			}
+			afterIndex = item.Index
+		}
+		if len(items) < batchResultsPageSize {
+			return
+		}
+	}
+}
+
+// batchJobParam returns the batch job of the request once authorized for action by the
+// DID of the job, or responds with an error
+func (s *DepinServer) batchJobParam(c *gin.Context, action string) (*db.BatchJob, bool) {
+	job, err := db.GetBatchJob(s.Storage, c.Param("batchId"))
+	if err != nil {
+		utils.LogInfo("Error fetching batch job: %v", err)
+		utils.RespondError(c, http.StatusInternalServerError, "Failed to fetch batch job", err)
+		return nil, false
+	}
+	if job == nil {
+		utils.RespondError(c, http.StatusNotFound, "Batch job not found", nil)
+		return nil, false
+	}
+
+	err = s.authorizeOwner(c, job.Did, action, job.ID)
+	if errors.Is(err, errNotOwner) {
+		utils.RespondError(c, http.StatusForbidden, "Batch job belongs to another DID", nil)
+		return nil, false
+	}
+	if err != nil {
+		utils.LogInfo("Authorization failed for batch job %s: %v", job.ID, err)
+		utils.RespondError(c, http.StatusUnauthorized, "Batch job authorization failed", err)
+		return nil, false
+	}
+	return job, true
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"crypto"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"depin-server/constants"
+	"depin-server/db"
+
+	"github.com/gin-gonic/gin"
+)
+
+const testAdminToken = "admin-token"
+
+// newOwnerTestServer is newTestServer verifying the signatures of testDid with key, and
+// accepting testAdminToken as admin token
+func newOwnerTestServer(t *testing.T, key crypto.Signer) (*DepinServer, *gin.Engine) {
+	t.Helper()
+
+	s, _ := newTestServer(t)
+	s.Verifier = NewDIDSignatureVerifier(StaticKeyRegistry{testDid: key.Public()})
+	s.AdminToken = testAdminToken
+	return s, gin.New()
+}
+
+// ownerRequest builds a request on behalf of did, signed by key over the payload of action
+// on the resource
+func ownerRequest(t *testing.T, key crypto.Signer, method string, path string, did string, action string, resourceID string) *http.Request {
+	t.Helper()
+
+	timestamp := time.Now().UTC().Format(time.RFC3339Nano)
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set(headerDepinDid, did)
+	req.Header.Set(headerDepinTimestamp, timestamp)
+	req.Header.Set(headerDepinSignature, signPayload(t, key, []byte(action+"\n"+resourceID+"\n"+timestamp)))
+	return req
+}
+
+func adminRequest(method string, path string) *http.Request {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	return req
+}
+
+func TestBatchOwnerAuthorization(t *testing.T) {
+	key := newTestECDSAKey(t)
+	s, router := newOwnerTestServer(t, key)
+	router.GET("/batches/:batchId", s.HandleGetBatch)
+	router.POST("/batches/:batchId/cancel", s.HandleCancelBatch)
+	router.GET("/batches/:batchId/results", s.HandleGetBatchResults)
+
+	now := time.Now().Unix()
+	job := &db.BatchJob{ID: "batch-1", Did: testDid, AssetID: "asset-1", AssetValue: "1", Signature: "batch-signature", Status: constants.BATCH_STATUS_QUEUED, Total: 1, CreatedAt: now, UpdatedAt: now}
+	items := []*db.BatchItem{{Index: 0, CustomID: "first", Input: `{}`, Query: "secret prompt", Status: constants.BATCH_ITEM_STATUS_PENDING}}
+	if err := db.CreateBatchJob(s.Storage, job, items); err != nil {
+		t.Fatalf("failed to create batch job: %v", err)
+	}
+
+	replayed := ownerRequest(t, key, http.MethodGet, "/batches/batch-1", testDid, "batch-get", "batch-1")
+	tests := []struct {
+		name     string
+		req      *http.Request
+		wantCode int
+	}{
+		{"unsigned", httptest.NewRequest(http.MethodGet, "/batches/batch-1", nil), http.StatusForbidden},
+		{"other DID", ownerRequest(t, key, http.MethodGet, "/batches/batch-1", "bafyother", "batch-get", "batch-1"), http.StatusForbidden},
+		{"signed for another action", ownerRequest(t, key, http.MethodGet, "/batches/batch-1/results", testDid, "batch-get", "batch-1"), http.StatusUnauthorized},
+		{"owner", replayed, http.StatusOK},
+		{"replayed", replayed.Clone(replayed.Context()), http.StatusUnauthorized},
+		{"owner results", ownerRequest(t, key, http.MethodGet, "/batches/batch-1/results", testDid, "batch-results", "batch-1"), http.StatusOK},
+		{"admin", adminRequest(http.MethodGet, "/batches/batch-1/results"), http.StatusOK},
+		{"cancel by another DID", ownerRequest(t, key, http.MethodPost, "/batches/batch-1/cancel", "bafyother", "batch-cancel", "batch-1"), http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, tt.req)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			if strings.Contains(w.Body.String(), "batch-signature") {
+				t.Errorf("response leaks the signature of the batch: %s", w.Body.String())
+			}
+		})
+	}
+
+	if batch, _ := db.GetBatchJob(s.Storage, "batch-1"); batch.Status != constants.BATCH_STATUS_QUEUED {
+		t.Fatalf("batch job was cancelled by another DID")
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, ownerRequest(t, key, http.MethodPost, "/batches/batch-1/cancel", testDid, "batch-cancel", "batch-1"))
+	if batch, _ := db.GetBatchJob(s.Storage, "batch-1"); w.Code != http.StatusOK || batch.Status != constants.BATCH_STATUS_CANCELLED {
+		t.Errorf("cancel by the owner = %d %s", w.Code, w.Body.String())
+	}
+}
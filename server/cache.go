@@ -0,0 +1,317 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"depin-server/constants"
+	"depin-server/db"
+	"depin-server/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultResponseCacheMaxMB = 256
+	defaultResponseCacheTTL   = 24 * time.Hour
+)
+
+// headerDepinCache opts a request into the response cache, and reports hits and misses
+const headerDepinCache = "X-Depin-Cache"
+
+// ResponseCache stores final chat responses on disk, keyed by model and request, so that
+// repeated deterministic prompts are served without running the model again. Entries
+// expire after TTL, and the oldest entries are evicted once MaxBytes is exceeded.
+type ResponseCache struct {
+	Dir      string
+	MaxBytes int64
+	TTL      time.Duration
+
+	mu sync.Mutex
+}
+
+func NewResponseCache(dir string, maxBytes int64, ttl time.Duration) (*ResponseCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create response cache directory: %v", err)
+	}
+	return &ResponseCache{Dir: dir, MaxBytes: maxBytes, TTL: ttl}, nil
+}
+
+// Get returns the cached response for key, or nil if there is none or it has expired
+func (rc *ResponseCache) Get(key string) *ChatResponse {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	path := rc.path(key)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+	if time.Since(info.ModTime()) > rc.TTL {
+		os.Remove(path)
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	var chatResp ChatResponse
+	if err := json.Unmarshal(data, &chatResp); err != nil {
+		utils.LogInfo("Removing corrupted response cache entry %s: %v", key, err)
+		os.Remove(path)
+		return nil
+	}
+	return &chatResp
+}
+
+// Put stores the response for key and evicts the oldest entries beyond the size bound
+func (rc *ResponseCache) Put(key string, chatResp *ChatResponse) error {
+	data, err := json.Marshal(chatResp)
+	if err != nil {
+		return fmt.Errorf("failed to marshal cached response: %v", err)
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	// Write to a temporary file first so that readers never see a partial entry
+	tmpPath := rc.path(key) + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write cached response: %v", err)
+	}
+	if err := os.Rename(tmpPath, rc.path(key)); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to store cached response: %v", err)
+	}
+
+	return rc.evict()
+}
+
+func (rc *ResponseCache) path(key string) string {
+	return filepath.Join(rc.Dir, key+".json")
+}
+
+// evict removes expired entries, then the oldest entries until the cache fits in MaxBytes
+func (rc *ResponseCache) evict() error {
+	entries, err := os.ReadDir(rc.Dir)
+	if err != nil {
+		return fmt.Errorf("failed to read response cache directory: %v", err)
+	}
+
+	var files []os.FileInfo
+	var total int64
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if time.Since(info.ModTime()) > rc.TTL {
+			os.Remove(filepath.Join(rc.Dir, info.Name()))
+			continue
+		}
+		files = append(files, info)
+		total += info.Size()
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, info := range files {
+		if total <= rc.MaxBytes {
+			break
+		}
+		if err := os.Remove(filepath.Join(rc.Dir, info.Name())); err == nil {
+			total -= info.Size()
+		}
+	}
+	return nil
+}
+
+// modelDigester is implemented by backends which can report the digest of a model, so
+// that cached responses are invalidated when the model behind a tag changes
+type modelDigester interface {
+	ModelDigest(model string) (string, error)
+}
+
+// responseCacheKey returns the cache key of a request, or an empty string if the request
+// is not cacheable. Requests opt in to caching, and the key covers the model digest,
+// the normalized messages and every other field of the inference input except streaming.
+func (s *DepinServer) responseCacheKey(inferenceReq *HandleInferenceReq, asset *db.Asset, backend InferenceBackend) string {
+	if s.Cache == nil || !inferenceReq.Cache {
+		return ""
+	}
+
+	// Asset IDs are derived from the model artifact, the digest also tracks the runtime's copy
+	digest := asset.ID
+	if digester, ok := backend.(modelDigester); ok {
+		modelDigest, err := digester.ModelDigest(inferenceReq.OllamaInferenceInput.Model)
+		if err != nil {
+			utils.LogInfo("Skipping response cache, unable to fetch digest of model %s: %v", inferenceReq.OllamaInferenceInput.Model, err)
+			return ""
+		}
+		digest += ":" + modelDigest
+	}
+
+	input := *inferenceReq.OllamaInferenceInput
+	input.Stream = false
+	input.Messages = make([]*Message, len(inferenceReq.OllamaInferenceInput.Messages))
+	for i, message := range inferenceReq.OllamaInferenceInput.Messages {
+		normalized := *message
+		normalized.Role = strings.ToLower(strings.TrimSpace(message.Role))
+		normalized.Content = strings.TrimSpace(message.Content)
+		input.Messages[i] = &normalized
+	}
+
+	inputBytes, err := json.Marshal(&input)
+	if err != nil {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(digest + "\n" + string(inputBytes)))
+	return hex.EncodeToString(sum[:])
+}
+
+// cachedResponse returns the cached response for key in the form the backend would have
+// sent it, or nil on a miss. Streaming clients receive the whole response as a single chunk.
+func (s *DepinServer) cachedResponse(c *gin.Context, key string, stream bool) *BackendResponse {
+	if key == "" {
+		return nil
+	}
+
+	chatResp := s.Cache.Get(key)
+	if chatResp == nil {
+		c.Header(headerDepinCache, "miss")
+		return nil
+	}
+	c.Header(headerDepinCache, "hit")
+
+	body, err := json.Marshal(chatResp)
+	if err != nil {
+		return nil
+	}
+
+	contentType := "application/json; charset=utf-8"
+	if stream {
+		contentType = "application/x-ndjson"
+		body = append(body, '\n')
+	}
+	return &BackendResponse{
+		StatusCode:  http.StatusOK,
+		ContentType: contentType,
+		Body:        io.NopCloser(bytes.NewReader(body)),
+	}
+}
+
+// captureForCache copies the response body into the returned buffer as it is read, so that
+// it can be cached once the inference has succeeded. It returns nil when key is empty.
+func captureForCache(key string, resp *BackendResponse) *bytes.Buffer {
+	if key == "" || resp.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	captured := &bytes.Buffer{}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(resp.Body, captured), resp.Body}
+	return captured
+}
+
+// storeInCache caches the captured response of a successful inference
+func (s *DepinServer) storeInCache(key string, captured *bytes.Buffer, record *db.InferenceRecord) {
+	if captured == nil || record.Status != constants.INFERENCE_STATUS_SUCCESS {
+		return
+	}
+
+	chatResp, err := aggregateChatResponse(captured.Bytes())
+	if err != nil {
+		utils.LogInfo("Unable to cache response of inference %s: %v", record.ID, err)
+		return
+	}
+	if err := s.Cache.Put(key, chatResp); err != nil {
+		utils.LogInfo("Unable to cache response of inference %s: %v", record.ID, err)
+	}
+}
+
+// aggregateChatResponse folds a single response or a stream of chunks into one final
+// response carrying the full message and all tool calls
+func aggregateChatResponse(body []byte) (*ChatResponse, error) {
+	var content strings.Builder
+	var toolCalls []*ToolCall
+	var final *ChatResponse
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	for dec.More() {
+		var chunk ChatResponse
+		if err := dec.Decode(&chunk); err != nil {
+			return nil, err
+		}
+		if chunk.Message != nil {
+			content.WriteString(chunk.Message.Content)
+			toolCalls = append(toolCalls, chunk.Message.ToolCalls...)
+		}
+		final = &chunk
+	}
+
+	if final == nil || !final.Done {
+		return nil, errors.New("response is incomplete")
+	}
+	final.Message = &Message{Role: constants.MESSAGE_ROLE_ASSISTANT, Content: content.String(), ToolCalls: toolCalls}
+	return final, nil
+}
+
+// responseCacheFromEnv enables the response cache when RESPONSE_CACHE_DIR is set, bounded by
+// RESPONSE_CACHE_MAX_MB and RESPONSE_CACHE_TTL (a Go duration such as "24h")
+func responseCacheFromEnv() *ResponseCache {
+	dir := os.Getenv("RESPONSE_CACHE_DIR")
+	if dir == "" {
+		return nil
+	}
+
+	maxMB := intFromEnv("RESPONSE_CACHE_MAX_MB", defaultResponseCacheMaxMB, 1)
+
+	ttl := defaultResponseCacheTTL
+	if value := os.Getenv("RESPONSE_CACHE_TTL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			utils.LogInfo("Invalid RESPONSE_CACHE_TTL %q, using default of %v", value, defaultResponseCacheTTL)
+		} else {
+			ttl = parsed
+		}
+	}
+
+	cache, err := NewResponseCache(dir, int64(maxMB)<<20, ttl)
+	if err != nil {
+		utils.LogInfo("Response cache is disabled: %v", err)
+		return nil
+	}
+	utils.LogInfo("Response cache enabled in %s (max %d MB, TTL %v)", dir, maxMB, ttl)
+	return cache
+}
+
+// wantsCache reports whether an OpenAI-compatible request opted in to the response cache
+func wantsCache(c *gin.Context, billing *DepinBilling) bool {
+	if billing != nil && billing.Cache {
+		return true
+	}
+	cache, _ := strconv.ParseBool(c.GetHeader(headerDepinCache))
+	return cache
+}
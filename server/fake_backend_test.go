@@ -0,0 +1,163 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"depin-server/constants"
+)
+
+// FakeBackend is an in-process backend for testing handlers without a model
+// runtime. It echoes the prompt back and counts whitespace separated words as tokens.
+type FakeBackend struct {
+	Models []string
+	// Loaded are the models reported as held in memory, like the running models of Ollama
+	Loaded []string
+	// Reply computes the response to a prompt, the prompt is echoed back when nil
+	Reply func(prompt string) string
+	// Err is returned by every call when set, to simulate an unavailable runtime
+	Err error
+}
+
+func NewFakeBackend(models ...string) *FakeBackend {
+	return &FakeBackend{Models: models}
+}
+
+func (b *FakeBackend) Chat(ctx context.Context, input *InferenceInput) (*BackendResponse, error) {
+	if err := b.fail(ctx); err != nil {
+		return nil, err
+	}
+
+	var prompt string
+	for _, message := range input.Messages {
+		if message != nil {
+			prompt = message.Content
+		}
+	}
+
+	words, usage := b.respond(prompt)
+	chunk := func(content string, done bool) any {
+		chatResp := &ChatResponse{
+			Model:     input.Model,
+			CreatedAt: time.Now().UTC().Format(time.RFC3339Nano),
+			Message:   &Message{Role: constants.MESSAGE_ROLE_ASSISTANT, Content: content},
+			Done:      done,
+		}
+		if done {
+			chatResp.DoneReason = "stop"
+			chatResp.InferenceUsage = usage
+		}
+		return chatResp
+	}
+
+	if !input.Stream {
+		return jsonBackendResponse(chunk(strings.Join(words, " "), true))
+	}
+	return fakeStream(words, chunk)
+}
+
+func (b *FakeBackend) Generate(ctx context.Context, req *GenerateRequest) (*BackendResponse, error) {
+	if err := b.fail(ctx); err != nil {
+		return nil, err
+	}
+
+	words, usage := b.respond(req.Prompt)
+	chunk := func(content string, done bool) any {
+		generateResp := &GenerateResponse{
+			Model:     req.Model,
+			CreatedAt: time.Now().UTC().Format(time.RFC3339Nano),
+			Response:  content,
+			Done:      done,
+		}
+		if done {
+			generateResp.DoneReason = "stop"
+			generateResp.InferenceUsage = usage
+		}
+		return generateResp
+	}
+
+	if !req.Stream {
+		return jsonBackendResponse(chunk(strings.Join(words, " "), true))
+	}
+	return fakeStream(words, chunk)
+}
+
+// Embed returns the length of each input as its single embedding dimension
+func (b *FakeBackend) Embed(ctx context.Context, req *EmbedRequest) (*EmbedResponse, error) {
+	if err := b.fail(ctx); err != nil {
+		return nil, err
+	}
+
+	embedResp := &EmbedResponse{Model: req.Model}
+	for _, input := range req.Input {
+		embedResp.Embeddings = append(embedResp.Embeddings, []float64{float64(len(input))})
+	}
+	return embedResp, nil
+}
+
+func (b *FakeBackend) ListModels() ([]string, error) {
+	if b.Err != nil {
+		return nil, b.Err
+	}
+	return b.Models, nil
+}
+
+func (b *FakeBackend) LoadedModels() ([]string, error) {
+	if b.Err != nil {
+		return nil, b.Err
+	}
+	return b.Loaded, nil
+}
+
+func (b *FakeBackend) Health() error {
+	return b.Err
+}
+
+// fail returns the simulated error, or the error of ctx once it is done
+func (b *FakeBackend) fail(ctx context.Context) error {
+	if b.Err != nil {
+		return b.Err
+	}
+	return ctx.Err()
+}
+
+func (b *FakeBackend) respond(prompt string) ([]string, InferenceUsage) {
+	reply := prompt
+	if b.Reply != nil {
+		reply = b.Reply(prompt)
+	}
+
+	words := strings.Fields(reply)
+	return words, InferenceUsage{
+		PromptEvalCount: len(strings.Fields(prompt)),
+		EvalCount:       len(words),
+	}
+}
+
+// fakeStream emits one NDJSON chunk per word followed by the final "done" chunk
+func fakeStream(words []string, chunk func(content string, done bool) any) (*BackendResponse, error) {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for i, word := range words {
+		if i > 0 {
+			word = " " + word
+		}
+		if err := enc.Encode(chunk(word, false)); err != nil {
+			return nil, err
+		}
+	}
+	if err := enc.Encode(chunk("", true)); err != nil {
+		return nil, err
+	}
+
+	return &BackendResponse{
+		StatusCode:  http.StatusOK,
+		ContentType: "application/x-ndjson",
+		Body:        io.NopCloser(&body),
+	}, nil
+}
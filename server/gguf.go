@@ -0,0 +1,482 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"depin-server/db"
+)
+
+// Limits guarding the GGUF reader against corrupt headers claiming huge sizes
+const (
+	ggufMagic          = "GGUF"
+	ggufMaxStringLen   = 1 << 24
+	ggufMaxArrayLen    = 1 << 26
+	ggufMaxKVCount     = 1 << 16
+	ggufMaxTensorCount = 1 << 24
+	ggufMaxDims        = 8
+	// ggufDefaultAlignment is the alignment of the tensor data unless general.alignment is set
+	ggufDefaultAlignment = 32
+)
+
+// Types of GGUF metadata values
+const (
+	ggufTypeUint8 uint32 = iota
+	ggufTypeInt8
+	ggufTypeUint16
+	ggufTypeInt16
+	ggufTypeUint32
+	ggufTypeInt32
+	ggufTypeFloat32
+	ggufTypeBool
+	ggufTypeString
+	ggufTypeArray
+	ggufTypeUint64
+	ggufTypeInt64
+	ggufTypeFloat64
+)
+
+var errNotGGUF = errors.New("not a GGUF file")
+
+// ggufFileTypes names the general.file_type values, the quantization of most tensors
+var ggufFileTypes = map[int64]string{
+	0: "F32", 1: "F16", 2: "Q4_0", 3: "Q4_1", 7: "Q8_0", 8: "Q5_0", 9: "Q5_1",
+	10: "Q2_K", 11: "Q3_K_S", 12: "Q3_K_M", 13: "Q3_K_L", 14: "Q4_K_S", 15: "Q4_K_M",
+	16: "Q5_K_S", 17: "Q5_K_M", 18: "Q6_K", 19: "IQ2_XXS", 20: "IQ2_XS", 21: "Q2_K_S",
+	22: "IQ3_XS", 23: "IQ3_XXS", 24: "IQ1_S", 25: "IQ4_NL", 26: "IQ3_S", 27: "IQ3_M",
+	28: "IQ2_S", 29: "IQ2_M", 30: "IQ4_XS", 31: "IQ1_M", 32: "BF16", 36: "TQ1_0", 37: "TQ2_0",
+}
+
+// ggmlTypes names the tensor types, used when the file type is not set
+var ggmlTypes = map[uint32]string{
+	0: "F32", 1: "F16", 2: "Q4_0", 3: "Q4_1", 6: "Q5_0", 7: "Q5_1", 8: "Q8_0", 9: "Q8_1",
+	10: "Q2_K", 11: "Q3_K", 12: "Q4_K", 13: "Q5_K", 14: "Q6_K", 15: "Q8_K", 16: "IQ2_XXS",
+	17: "IQ2_XS", 18: "IQ3_XXS", 19: "IQ1_S", 20: "IQ4_NL", 21: "IQ3_S", 22: "IQ2_S",
+	23: "IQ4_XS", 24: "I8", 25: "I16", 26: "I32", 27: "I64", 28: "F64", 29: "IQ1_M", 30: "BF16",
+}
+
+// ggmlBlockSizes gives for each tensor type the number of weights stored in a block and
+// the size of a block in bytes, from which the size of the tensor data is computed
+var ggmlBlockSizes = map[uint32]struct{ weights, bytes uint64 }{
+	0: {1, 4}, 1: {1, 2}, 2: {32, 18}, 3: {32, 20}, 6: {32, 22}, 7: {32, 24}, 8: {32, 34},
+	9: {32, 36}, 10: {256, 84}, 11: {256, 110}, 12: {256, 144}, 13: {256, 176}, 14: {256, 210},
+	15: {256, 292}, 16: {256, 66}, 17: {256, 74}, 18: {256, 98}, 19: {256, 50}, 20: {32, 18},
+	21: {256, 110}, 22: {256, 82}, 23: {256, 136}, 24: {1, 1}, 25: {1, 2}, 26: {1, 4},
+	27: {1, 8}, 28: {1, 8}, 29: {256, 56}, 30: {1, 2}, 34: {256, 54}, 35: {256, 66},
+}
+
+// ggufArray stands for an array value of the metadata, of which only the length is kept
+type ggufArray struct {
+	Type uint32
+	Len  uint64
+}
+
+// ggufHeader is the header of a GGUF file: its metadata, with scalar values as int64,
+// uint64, float64, bool or string and arrays as ggufArray, and a summary of its tensors
+type ggufHeader struct {
+	Version  uint32
+	Metadata map[string]any
+	// ParameterCount is the number of weights of all the tensors in the file
+	ParameterCount int64
+	// TensorTypes counts the tensors of each ggml type
+	TensorTypes map[uint32]int
+}
+
+// ggufReader decodes the values of a GGUF header, counting the bytes read
+type ggufReader struct {
+	r     *bufio.Reader
+	order binary.ByteOrder
+	// wide is set from version 2, where lengths and counts are 64 bits wide
+	wide bool
+	read int64
+}
+
+// readGGUFHeader reads and checks the header of a GGUF file. It fails for files which are
+// not GGUF files and for corrupt headers, including tensors lying beyond the end of the file.
+func readGGUFHeader(path string) (*ggufHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	gr := &ggufReader{r: bufio.NewReaderSize(f, 1<<20), order: binary.LittleEndian}
+	header, err := gr.readHeader(info.Size())
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, fmt.Errorf("truncated GGUF header after %d bytes", gr.read)
+	}
+	return header, err
+}
+
+func (gr *ggufReader) readHeader(fileSize int64) (*ggufHeader, error) {
+	magic := make([]byte, len(ggufMagic))
+	if err := gr.bytes(magic); err != nil || string(magic) != ggufMagic {
+		return nil, errNotGGUF
+	}
+
+	version, err := gr.uint32()
+	if err != nil {
+		return nil, err
+	}
+	// Big endian files have the version bytes swapped, which shows as a huge version
+	if version&0xFFFF == 0 {
+		gr.order = binary.BigEndian
+		version = binary.BigEndian.Uint32(binary.LittleEndian.AppendUint32(nil, version))
+	}
+	if version < 1 || version > 3 {
+		return nil, fmt.Errorf("unsupported GGUF version %d", version)
+	}
+	gr.wide = version >= 2
+
+	tensorCount, err := gr.count()
+	if err != nil {
+		return nil, err
+	}
+	kvCount, err := gr.count()
+	if err != nil {
+		return nil, err
+	}
+	if tensorCount > ggufMaxTensorCount || kvCount > ggufMaxKVCount {
+		return nil, fmt.Errorf("implausible GGUF header with %d tensors and %d metadata keys", tensorCount, kvCount)
+	}
+
+	header := &ggufHeader{
+		Version:     version,
+		Metadata:    make(map[string]any, kvCount),
+		TensorTypes: make(map[uint32]int),
+	}
+	for i := uint64(0); i < kvCount; i++ {
+		key, err := gr.string()
+		if err != nil {
+			return nil, err
+		}
+		valueType, err := gr.uint32()
+		if err != nil {
+			return nil, err
+		}
+		value, err := gr.value(valueType, 0)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of GGUF key %q: %w", key, err)
+		}
+		header.Metadata[key] = value
+	}
+
+	// dataSize is the end of the tensor lying furthest in the data section
+	var dataSize uint64
+	for i := uint64(0); i < tensorCount; i++ {
+		name, err := gr.string()
+		if err != nil {
+			return nil, err
+		}
+		dimCount, err := gr.uint32()
+		if err != nil {
+			return nil, err
+		}
+		if dimCount == 0 || dimCount > ggufMaxDims {
+			return nil, fmt.Errorf("tensor %q has %d dimensions", name, dimCount)
+		}
+		elements := int64(1)
+		var rowLen uint64
+		for d := uint32(0); d < dimCount; d++ {
+			dim, err := gr.count()
+			if err != nil {
+				return nil, err
+			}
+			if dim == 0 || dim > math.MaxInt64/uint64(elements) {
+				return nil, fmt.Errorf("tensor %q has an invalid shape", name)
+			}
+			if d == 0 {
+				rowLen = dim
+			}
+			elements *= int64(dim)
+		}
+		tensorType, err := gr.uint32()
+		if err != nil {
+			return nil, err
+		}
+		offset, err := gr.uint64()
+		if err != nil {
+			return nil, err
+		}
+
+		// Rows are stored in whole blocks of the tensor type
+		block, ok := ggmlBlockSizes[tensorType]
+		if !ok {
+			return nil, fmt.Errorf("tensor %q has unknown ggml type %d", name, tensorType)
+		}
+		if rowLen%block.weights != 0 {
+			return nil, fmt.Errorf("tensor %q has rows of %d weights, not a multiple of the block size %d", name, rowLen, block.weights)
+		}
+		blocks := uint64(elements) / block.weights
+		if blocks > math.MaxInt64/block.bytes || offset > math.MaxInt64-blocks*block.bytes {
+			return nil, fmt.Errorf("tensor %q has an invalid size or offset", name)
+		}
+		if end := offset + blocks*block.bytes; end > dataSize {
+			dataSize = end
+		}
+
+		header.ParameterCount += elements
+		header.TensorTypes[tensorType]++
+	}
+
+	// The tensor data starts at the next alignment boundary after the header
+	alignment := int64(ggufDefaultAlignment)
+	if value, ok := header.Metadata["general.alignment"]; ok {
+		if a, ok := ggufInt(value); ok && a > 0 {
+			alignment = a
+		}
+	}
+	dataStart := (gr.read + alignment - 1) / alignment * alignment
+	if tensorCount > 0 && (dataStart > fileSize || dataSize > uint64(fileSize-dataStart)) {
+		return nil, fmt.Errorf("GGUF tensor data lies beyond the end of the file")
+	}
+	return header, nil
+}
+
+func (gr *ggufReader) value(valueType uint32, depth int) (any, error) {
+	switch valueType {
+	case ggufTypeUint8, ggufTypeInt8, ggufTypeBool:
+		var b [1]byte
+		if err := gr.bytes(b[:]); err != nil {
+			return nil, err
+		}
+		switch valueType {
+		case ggufTypeInt8:
+			return int64(int8(b[0])), nil
+		case ggufTypeBool:
+			return b[0] != 0, nil
+		}
+		return int64(b[0]), nil
+	case ggufTypeUint16, ggufTypeInt16:
+		var b [2]byte
+		if err := gr.bytes(b[:]); err != nil {
+			return nil, err
+		}
+		v := gr.order.Uint16(b[:])
+		if valueType == ggufTypeInt16 {
+			return int64(int16(v)), nil
+		}
+		return int64(v), nil
+	case ggufTypeUint32, ggufTypeInt32, ggufTypeFloat32:
+		v, err := gr.uint32()
+		if err != nil {
+			return nil, err
+		}
+		switch valueType {
+		case ggufTypeInt32:
+			return int64(int32(v)), nil
+		case ggufTypeFloat32:
+			return float64(math.Float32frombits(v)), nil
+		}
+		return int64(v), nil
+	case ggufTypeUint64, ggufTypeInt64, ggufTypeFloat64:
+		v, err := gr.uint64()
+		if err != nil {
+			return nil, err
+		}
+		switch valueType {
+		case ggufTypeInt64:
+			return int64(v), nil
+		case ggufTypeFloat64:
+			return math.Float64frombits(v), nil
+		}
+		return v, nil
+	case ggufTypeString:
+		return gr.string()
+	case ggufTypeArray:
+		if depth > 0 {
+			return nil, fmt.Errorf("nested GGUF arrays are not supported")
+		}
+		elemType, err := gr.uint32()
+		if err != nil {
+			return nil, err
+		}
+		length, err := gr.count()
+		if err != nil {
+			return nil, err
+		}
+		if length > ggufMaxArrayLen {
+			return nil, fmt.Errorf("implausible GGUF array of %d values", length)
+		}
+		for i := uint64(0); i < length; i++ {
+			if _, err := gr.value(elemType, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return ggufArray{Type: elemType, Len: length}, nil
+	}
+	return nil, fmt.Errorf("unknown GGUF value type %d", valueType)
+}
+
+func (gr *ggufReader) bytes(b []byte) error {
+	n, err := io.ReadFull(gr.r, b)
+	gr.read += int64(n)
+	return err
+}
+
+func (gr *ggufReader) uint32() (uint32, error) {
+	var b [4]byte
+	if err := gr.bytes(b[:]); err != nil {
+		return 0, err
+	}
+	return gr.order.Uint32(b[:]), nil
+}
+
+func (gr *ggufReader) uint64() (uint64, error) {
+	var b [8]byte
+	if err := gr.bytes(b[:]); err != nil {
+		return 0, err
+	}
+	return gr.order.Uint64(b[:]), nil
+}
+
+// count reads a length or count, 32 bits wide in version 1 files
+func (gr *ggufReader) count() (uint64, error) {
+	if !gr.wide {
+		v, err := gr.uint32()
+		return uint64(v), err
+	}
+	return gr.uint64()
+}
+
+func (gr *ggufReader) string() (string, error) {
+	length, err := gr.count()
+	if err != nil {
+		return "", err
+	}
+	if length > ggufMaxStringLen {
+		return "", fmt.Errorf("implausible GGUF string of %d bytes", length)
+	}
+	b := make([]byte, length)
+	if err := gr.bytes(b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// ggufInt converts an integer metadata value to int64
+func ggufInt(value any) (int64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return v, true
+	case uint64:
+		if v <= math.MaxInt64 {
+			return int64(v), true
+		}
+	}
+	return 0, false
+}
+
+// modelMetadata extracts the description of a model from the header of its main GGUF file
+func (h *ggufHeader) modelMetadata() *db.ModelMetadata {
+	str := func(key string) string {
+		s, _ := h.Metadata[key].(string)
+		return s
+	}
+	integer := func(key string) *int64 {
+		if v, ok := ggufInt(h.Metadata[key]); ok {
+			return &v
+		}
+		return nil
+	}
+
+	metadata := &db.ModelMetadata{
+		Architecture:   str("general.architecture"),
+		Name:           str("general.name"),
+		ParameterCount: h.ParameterCount,
+		ChatTemplate:   str("tokenizer.chat_template"),
+		TokenizerModel: str("tokenizer.ggml.model"),
+		BOSTokenID:     integer("tokenizer.ggml.bos_token_id"),
+		EOSTokenID:     integer("tokenizer.ggml.eos_token_id"),
+	}
+	if contextLength := integer(metadata.Architecture + ".context_length"); contextLength != nil {
+		metadata.ContextLength = *contextLength
+	}
+	if tokens, ok := h.Metadata["tokenizer.ggml.tokens"].(ggufArray); ok {
+		metadata.VocabSize = int64(tokens.Len)
+	}
+
+	if fileType := integer("general.file_type"); fileType != nil {
+		metadata.Quantization = ggufFileTypes[*fileType]
+	}
+	if metadata.Quantization == "" {
+		// Without a known file type, the most common tensor type stands for the quantization
+		types := make([]uint32, 0, len(h.TensorTypes))
+		for t := range h.TensorTypes {
+			types = append(types, t)
+		}
+		sort.Slice(types, func(i, j int) bool {
+			if h.TensorTypes[types[i]] != h.TensorTypes[types[j]] {
+				return h.TensorTypes[types[i]] > h.TensorTypes[types[j]]
+			}
+			return types[i] < types[j]
+		})
+		if len(types) > 0 {
+			metadata.Quantization = ggmlTypes[types[0]]
+		}
+	}
+	return metadata
+}
+
+// inspectGGUFFiles checks the headers of the GGUF files among the files of an asset,
+// relative to uploadDir, and returns the metadata of the model read from its main file,
+// or nil if the main file is not a GGUF file. The parameters of all the shards are
+// counted, those of the vision projector are not.
+func inspectGGUFFiles(uploadDir string, files []string, mainFile string, projector string) (*db.ModelMetadata, error) {
+	var metadata *db.ModelMetadata
+	var parameterCount int64
+	for _, file := range files {
+		if strings.ToLower(path.Ext(file)) != ".gguf" {
+			continue
+		}
+		header, err := readGGUFHeader(filepath.Join(uploadDir, filepath.FromSlash(file)))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		if file == projector {
+			continue
+		}
+		parameterCount += header.ParameterCount
+		if file == mainFile {
+			metadata = header.modelMetadata()
+		}
+	}
+
+	if metadata != nil {
+		metadata.ParameterCount = parameterCount
+	}
+	return metadata, nil
+}
+
+// errShardedOllamaModel is returned for models split across several GGUF files, which
+// `ollama create` cannot import since it only copies the file named in the Modelfile
+var errShardedOllamaModel = errors.New("sharded GGUF models cannot be launched with Ollama, merge the shards with llama-gguf-split --merge or serve the model with another runtime")
+
+// checkOllamaShards fails with errShardedOllamaModel if more than one of the files of an
+// asset, other than its vision projector, is a GGUF file
+func checkOllamaShards(files []string, projector string) error {
+	shards := 0
+	for _, file := range files {
+		if file != projector && strings.ToLower(path.Ext(file)) == ".gguf" {
+			shards++
+		}
+	}
+	if shards > 1 {
+		return errShardedOllamaModel
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testGGUFWriter crafts GGUF headers, encoding counts as the given version does
+type testGGUFWriter struct {
+	buf   bytes.Buffer
+	order binary.ByteOrder
+	wide  bool
+}
+
+func newTestGGUFWriter(version uint32, order binary.ByteOrder) *testGGUFWriter {
+	w := &testGGUFWriter{order: order, wide: version >= 2}
+	w.buf.WriteString(ggufMagic)
+	w.uint32(version)
+	return w
+}
+
+func (w *testGGUFWriter) uint32(v uint32) {
+	b := make([]byte, 4)
+	w.order.PutUint32(b, v)
+	w.buf.Write(b)
+}
+
+func (w *testGGUFWriter) uint64(v uint64) {
+	b := make([]byte, 8)
+	w.order.PutUint64(b, v)
+	w.buf.Write(b)
+}
+
+func (w *testGGUFWriter) count(v uint64) {
+	if w.wide {
+		w.uint64(v)
+	} else {
+		w.uint32(uint32(v))
+	}
+}
+
+func (w *testGGUFWriter) string(s string) {
+	w.count(uint64(len(s)))
+	w.buf.WriteString(s)
+}
+
+func (w *testGGUFWriter) tensor(name string, dims []uint64, tensorType uint32, offset uint64) {
+	w.string(name)
+	w.uint32(uint32(len(dims)))
+	for _, dim := range dims {
+		w.count(dim)
+	}
+	w.uint32(tensorType)
+	w.uint64(offset)
+}
+
+// data pads the header to the default alignment and appends size bytes of tensor data
+func (w *testGGUFWriter) data(size int) []byte {
+	for w.buf.Len()%ggufDefaultAlignment != 0 {
+		w.buf.WriteByte(0)
+	}
+	w.buf.Write(make([]byte, size))
+	return w.buf.Bytes()
+}
+
+// testGGUFModel crafts a small model: an F32 tensor of 32 bytes followed by a Q4_K tensor
+// of two blocks of 144 bytes, with dataSize bytes of tensor data
+func testGGUFModel(version uint32, order binary.ByteOrder, dataSize int) []byte {
+	w := newTestGGUFWriter(version, order)
+	w.count(2)
+	w.count(4)
+	w.string("general.architecture")
+	w.uint32(ggufTypeString)
+	w.string("llama")
+	w.string("llama.context_length")
+	w.uint32(ggufTypeUint32)
+	w.uint32(4096)
+	w.string("general.file_type")
+	w.uint32(ggufTypeUint32)
+	w.uint32(15)
+	w.string("tokenizer.ggml.tokens")
+	w.uint32(ggufTypeArray)
+	w.uint32(ggufTypeString)
+	w.count(3)
+	for _, token := range []string{"<s>", "</s>", "hello"} {
+		w.string(token)
+	}
+	w.tensor("token_embd.weight", []uint64{4, 2}, 0, 0)
+	w.tensor("blk.0.attn_q.weight", []uint64{256, 2}, 12, 32)
+	return w.data(dataSize)
+}
+
+func writeTestGGUF(t *testing.T, content []byte) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "model.gguf")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatalf("failed to write GGUF file: %v", err)
+	}
+	return path
+}
+
+func TestReadGGUFHeader(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		version uint32
+		order   binary.ByteOrder
+	}{
+		{"v3", 3, binary.LittleEndian},
+		{"v1 with 32-bit counts", 1, binary.LittleEndian},
+		{"big endian", 3, binary.BigEndian},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			header, err := readGGUFHeader(writeTestGGUF(t, testGGUFModel(tt.version, tt.order, 32+2*144)))
+			if err != nil {
+				t.Fatalf("readGGUFHeader() error = %v", err)
+			}
+			if header.Version != tt.version {
+				t.Errorf("Version = %d, want %d", header.Version, tt.version)
+			}
+
+			metadata := header.modelMetadata()
+			if metadata.Architecture != "llama" || metadata.ContextLength != 4096 || metadata.VocabSize != 3 || metadata.Quantization != "Q4_K_M" {
+				t.Errorf("modelMetadata() = %+v", metadata)
+			}
+			if metadata.ParameterCount != 8+512 {
+				t.Errorf("ParameterCount = %d, want %d", metadata.ParameterCount, 8+512)
+			}
+		})
+	}
+}
+
+func TestReadGGUFHeaderCorrupt(t *testing.T) {
+	valid := testGGUFModel(3, binary.LittleEndian, 32+2*144)
+
+	oversizedString := newTestGGUFWriter(3, binary.LittleEndian)
+	oversizedString.count(0)
+	oversizedString.count(1)
+	oversizedString.count(1 << 40)
+
+	oversizedArray := newTestGGUFWriter(3, binary.LittleEndian)
+	oversizedArray.count(0)
+	oversizedArray.count(1)
+	oversizedArray.string("tokenizer.ggml.tokens")
+	oversizedArray.uint32(ggufTypeArray)
+	oversizedArray.uint32(ggufTypeString)
+	oversizedArray.count(1 << 40)
+
+	oversizedTensors := newTestGGUFWriter(3, binary.LittleEndian)
+	oversizedTensors.count(1 << 40)
+	oversizedTensors.count(0)
+
+	unknownType := newTestGGUFWriter(3, binary.LittleEndian)
+	unknownType.count(1)
+	unknownType.count(0)
+	unknownType.tensor("weight", []uint64{32}, 1000, 0)
+
+	partialBlock := newTestGGUFWriter(3, binary.LittleEndian)
+	partialBlock.count(1)
+	partialBlock.count(0)
+	partialBlock.tensor("weight", []uint64{100}, 12, 0)
+
+	hugeTensor := newTestGGUFWriter(3, binary.LittleEndian)
+	hugeTensor.count(1)
+	hugeTensor.count(0)
+	hugeTensor.tensor("weight", []uint64{1 << 31, 1 << 31}, 0, 0)
+
+	tests := []struct {
+		name    string
+		content []byte
+		wantErr string
+	}{
+		{"wrong magic", append([]byte("GGML"), valid[4:]...), errNotGGUF.Error()},
+		{"unsupported version", append(append([]byte(ggufMagic), 4, 0, 0, 0), valid[8:]...), "unsupported GGUF version"},
+		{"truncated header", valid[:40], "truncated GGUF header"},
+		{"oversized string", oversizedString.data(0), "implausible GGUF string"},
+		{"oversized array", oversizedArray.data(0), "implausible GGUF array"},
+		{"oversized tensor count", oversizedTensors.data(0), "implausible GGUF header"},
+		{"unknown tensor type", unknownType.data(4 * 32), "unknown ggml type"},
+		{"partial block", partialBlock.data(144), "not a multiple of the block size"},
+		{"tensor size overflow", hugeTensor.data(0), "invalid size or offset"},
+		{"tensor data past EOF", testGGUFModel(3, binary.LittleEndian, 32), "beyond the end of the file"},
+		{"file truncated in the last tensor", valid[:len(valid)-1], "beyond the end of the file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readGGUFHeader(writeTestGGUF(t, tt.content))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("readGGUFHeader() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := readGGUFHeader(writeTestGGUF(t, []byte("GGML"))); !errors.Is(err, errNotGGUF) {
+		t.Errorf("readGGUFHeader() of another format error = %v, want %v", err, errNotGGUF)
+	}
+}
@@ -0,0 +1,504 @@
+package server
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"depin-server/constants"
+	"depin-server/utils"
+)
+
+// defaultHuggingFaceEndpoint is the Hugging Face Hub that URL imports are downloaded from
+const defaultHuggingFaceEndpoint = "https://huggingface.co"
+
+// huggingFaceProgressInterval is how often the progress of a download is logged
+const huggingFaceProgressInterval = 10 * time.Second
+
+var (
+	errHuggingFaceAccess   = errors.New("access denied, the repository may be gated or private and require HF_TOKEN")
+	errHuggingFaceNotFound = errors.New("repository, revision or file not found")
+)
+
+// HuggingFaceImporter downloads asset files from the Hugging Face Hub. Files are pinned to
+// the commit their revision resolves to, downloaded with resume support and verified
+// against the checksum the Hub reports for them.
+type HuggingFaceImporter struct {
+	// Endpoint is the base URL of the Hub, import URLs must point to its host
+	Endpoint string
+	// Token is sent as bearer token to access gated and private repositories
+	Token  string
+	Client *http.Client
+}
+
+// huggingFaceFile is a file of a Hugging Face repository. Commit, SHA256 and Size are
+// filled in once the file is resolved.
+type huggingFaceFile struct {
+	// Repo is the repository ID, prefixed with "datasets/" for dataset repositories
+	Repo     string `json:"repo"`
+	Revision string `json:"revision"`
+	Path     string `json:"path"`
+	Commit   string `json:"commit"`
+	SHA256   string `json:"sha256"`
+	Size     int64  `json:"size"`
+	// blobID is the git object ID of files not stored with LFS, which have no SHA-256
+	blobID string
+}
+
+// huggingFaceRepoInfo holds the fields of the Hub API description of a repository revision
+type huggingFaceRepoInfo struct {
+	SHA      string `json:"sha"`
+	Siblings []struct {
+		RFilename string `json:"rfilename"`
+		Size      int64  `json:"size"`
+		BlobID    string `json:"blobId"`
+		LFS       *struct {
+			SHA256 string `json:"sha256"`
+			Size   int64  `json:"size"`
+		} `json:"lfs"`
+	} `json:"siblings"`
+}
+
+func NewHuggingFaceImporter(endpoint string, token string) *HuggingFaceImporter {
+	return &HuggingFaceImporter{
+		Endpoint: strings.TrimSuffix(endpoint, "/"),
+		Token:    token,
+		// Model files take long to download, the request context bounds the download instead
+		Client: &http.Client{},
+	}
+}
+
+// huggingFaceImporterFromEnv reads HF_ENDPOINT, the Hub to import from, and HF_TOKEN, the
+// access token for gated and private repositories
+func huggingFaceImporterFromEnv() *HuggingFaceImporter {
+	endpoint := os.Getenv("HF_ENDPOINT")
+	if endpoint == "" {
+		endpoint = defaultHuggingFaceEndpoint
+	}
+	return NewHuggingFaceImporter(endpoint, os.Getenv("HF_TOKEN"))
+}
+
+// Parse parses the URL of a file on the Hub, such as
+// https://huggingface.co/<owner>/<name>/blob/<revision>/<path> or its /resolve/ form, and
+// /datasets/<owner>/<name>/... for datasets. The URL of a whole repository, as in
+// /<owner>/<name> or /<owner>/<name>/tree/<revision>, gives a file with an empty Path.
+// Revisions containing slashes must be escaped.
+func (h *HuggingFaceImporter) Parse(rawURL string) (*huggingFaceFile, error) {
+	endpoint, err := url.Parse(h.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Hugging Face endpoint %q: %v", h.Endpoint, err)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL: %v", err)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, fmt.Errorf("URL must be an http or https URL")
+	}
+	if !strings.EqualFold(u.Host, endpoint.Host) && !strings.EqualFold(u.Host, "www."+endpoint.Host) {
+		return nil, fmt.Errorf("URL must be from %s", endpoint.Host)
+	}
+
+	var segments []string
+	for _, segment := range strings.Split(strings.Trim(u.EscapedPath(), "/"), "/") {
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			return nil, fmt.Errorf("invalid URL path: %v", err)
+		}
+		segments = append(segments, unescaped)
+	}
+
+	repoPrefix := ""
+	if len(segments) > 0 && segments[0] == "datasets" {
+		repoPrefix = "datasets/"
+		segments = segments[1:]
+	}
+	if len(segments) < 2 || segments[0] == "" || segments[1] == "" {
+		return nil, fmt.Errorf("URL must point to a repository, as in /<owner>/<name>")
+	}
+	file := &huggingFaceFile{
+		Repo:     repoPrefix + segments[0] + "/" + segments[1],
+		Revision: "main",
+	}
+
+	switch {
+	case len(segments) == 2:
+		return file, nil
+	case len(segments) == 4 && segments[2] == "tree":
+		file.Revision = segments[3]
+		return file, nil
+	case len(segments) >= 5 && (segments[2] == "blob" || segments[2] == "resolve"):
+	default:
+		return nil, fmt.Errorf("URL must point to a repository or a file, as in /<owner>/<name>/blob/<revision>/<path>")
+	}
+	for _, segment := range segments[4:] {
+		if segment == "" || segment == "." || segment == ".." {
+			return nil, fmt.Errorf("invalid file path in URL")
+		}
+	}
+
+	file.Revision = segments[3]
+	file.Path = strings.Join(segments[4:], "/")
+	return file, nil
+}
+
+// Resolve pins the file to the commit its revision currently points to, and looks up the
+// size and checksum of the file at that commit
+func (h *HuggingFaceImporter) Resolve(ctx context.Context, file *huggingFaceFile) error {
+	files, err := h.resolveRevision(ctx, file, func(filePath string) bool {
+		return filePath == file.Path
+	})
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("%s not found in %s at revision %s: %w", file.Path, file.Repo, file.Revision, errHuggingFaceNotFound)
+	}
+
+	*file = *files[0]
+	return nil
+}
+
+// ResolveRepository pins a repository to the commit its revision currently points to, and
+// returns the files of the repository at that commit matching one of the include globs,
+// or any file if there are none, and none of the exclude globs. Globs are matched against
+// both the path and the name of a file.
+func (h *HuggingFaceImporter) ResolveRepository(ctx context.Context, repo *huggingFaceFile, include []string, exclude []string) ([]*huggingFaceFile, error) {
+	files, err := h.resolveRevision(ctx, repo, func(filePath string) bool {
+		return (len(include) == 0 || matchesGlob(filePath, include)) && !matchesGlob(filePath, exclude)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no file of %s at revision %s matches the include and exclude patterns: %w", repo.Repo, repo.Revision, errHuggingFaceNotFound)
+	}
+	return files, nil
+}
+
+// resolveRevision looks up the commit the revision of repo points to, setting repo.Commit,
+// and returns the files at that commit selected by match, ordered by path
+func (h *HuggingFaceImporter) resolveRevision(ctx context.Context, repo *huggingFaceFile, match func(filePath string) bool) ([]*huggingFaceFile, error) {
+	apiURL := fmt.Sprintf("%s/api/%s/revision/%s?blobs=true", h.Endpoint, huggingFaceAPIRepoPath(repo.Repo), url.PathEscape(repo.Revision))
+
+	req, err := h.newRequest(ctx, apiURL)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s at revision %s: %v", repo.Repo, repo.Revision, err)
+	}
+	defer resp.Body.Close()
+
+	if err := huggingFaceStatusError(resp); err != nil {
+		return nil, fmt.Errorf("failed to fetch %s at revision %s: %w", repo.Repo, repo.Revision, err)
+	}
+
+	var info huggingFaceRepoInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("failed to decode %s at revision %s: %v", repo.Repo, repo.Revision, err)
+	}
+	if !isHexDigest(info.SHA, sha1.Size) {
+		return nil, fmt.Errorf("revision %s of %s did not resolve to a commit", repo.Revision, repo.Repo)
+	}
+	repo.Commit = info.SHA
+
+	var files []*huggingFaceFile
+	for _, sibling := range info.Siblings {
+		// Files are downloaded to their path in the repository, which must not escape it
+		if err := validateHuggingFacePath(sibling.RFilename); err != nil {
+			return nil, fmt.Errorf("%s at revision %s lists file %q: %v", repo.Repo, repo.Revision, sibling.RFilename, err)
+		}
+		if !match(sibling.RFilename) {
+			continue
+		}
+		file := &huggingFaceFile{
+			Repo:     repo.Repo,
+			Revision: repo.Revision,
+			Path:     sibling.RFilename,
+			Commit:   info.SHA,
+			Size:     sibling.Size,
+			blobID:   sibling.BlobID,
+		}
+		if sibling.LFS != nil {
+			file.SHA256 = strings.ToLower(sibling.LFS.SHA256)
+			file.Size = sibling.LFS.Size
+		}
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+	return files, nil
+}
+
+// Download downloads a resolved file to dst. The bytes received are kept in dst.partial
+// so that an interrupted download resumes where it stopped. The file is verified against
+// its LFS SHA-256, or its git object ID for files not stored with LFS, before being moved
+// to dst, and file.SHA256 is set to the checksum of the downloaded file. progress, if
+// set, is called with the bytes received while downloading and once hashing starts.
+func (h *HuggingFaceImporter) Download(ctx context.Context, file *huggingFaceFile, dst string, progress func(status string, received int64)) error {
+	if file.Commit == "" {
+		return fmt.Errorf("%s of %s must be resolved before it is downloaded", file.Path, file.Repo)
+	}
+	partialPath := dst + ".partial"
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create directory of %s: %v", dst, err)
+	}
+
+	partial, err := os.OpenFile(partialPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", partialPath, err)
+	}
+	defer partial.Close()
+
+	info, err := partial.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %v", partialPath, err)
+	}
+	offset := info.Size()
+	if file.Size > 0 && offset > file.Size {
+		offset = 0
+	}
+
+	if file.Size <= 0 || offset < file.Size {
+		if err := h.fetch(ctx, file, partial, offset, progress); err != nil {
+			return err
+		}
+	}
+
+	if progress != nil {
+		progress(constants.IMPORT_STATUS_HASHING, file.Size)
+	}
+
+	if err := verifyHuggingFaceFile(partial, file); err != nil {
+		partial.Close()
+		os.Remove(partialPath)
+		return err
+	}
+	if err := partial.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %v", partialPath, err)
+	}
+	if err := os.Rename(partialPath, dst); err != nil {
+		return fmt.Errorf("failed to move %s to %s: %v", partialPath, dst, err)
+	}
+	return nil
+}
+
+// fetch downloads the file into partial from offset, or from the start if the Hub does not
+// honour the range request
+func (h *HuggingFaceImporter) fetch(ctx context.Context, file *huggingFaceFile, partial *os.File, offset int64, report func(status string, received int64)) error {
+	downloadURL := fmt.Sprintf("%s/%s/resolve/%s/%s", h.Endpoint, file.Repo, file.Commit, escapeHuggingFacePath(file.Path))
+
+	req, err := h.newRequest(ctx, downloadURL)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %v", file.Path, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)):
+		utils.LogInfo("Resuming download of %s from %s at byte %d", file.Path, file.Repo, offset)
+	case resp.StatusCode == http.StatusOK:
+		offset = 0
+	default:
+		if err := huggingFaceStatusError(resp); err != nil {
+			return fmt.Errorf("failed to download %s: %w", file.Path, err)
+		}
+		return fmt.Errorf("failed to download %s: unexpected response %s", file.Path, resp.Status)
+	}
+
+	if err := partial.Truncate(offset); err != nil {
+		return fmt.Errorf("failed to truncate %s: %v", partial.Name(), err)
+	}
+	if _, err := partial.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek %s: %v", partial.Name(), err)
+	}
+
+	utils.LogInfo("Downloading %s from %s at commit %s", file.Path, file.Repo, file.Commit)
+	progress := &downloadProgress{file: file, received: offset, report: report, logAt: time.Now().Add(huggingFaceProgressInterval)}
+	_, err = io.Copy(io.MultiWriter(partial, progress), resp.Body)
+	// Keep what was received for the next attempt even if the download was interrupted
+	if syncErr := partial.Sync(); err == nil && syncErr != nil {
+		err = syncErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to download %s after %d bytes: %v", file.Path, progress.received, err)
+	}
+	utils.LogInfo("Downloaded %s from %s (%d bytes)", file.Path, file.Repo, progress.received)
+	return nil
+}
+
+func (h *HuggingFaceImporter) newRequest(ctx context.Context, rawURL string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	if h.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.Token)
+	}
+	return req, nil
+}
+
+// apiRepoPath returns the path of a repository in the Hub API, under /api/models or /api/datasets
+func huggingFaceAPIRepoPath(repo string) string {
+	if strings.HasPrefix(repo, "datasets/") {
+		return repo
+	}
+	return "models/" + repo
+}
+
+// downloadProgress counts the bytes of a download, reports them and logs them periodically
+type downloadProgress struct {
+	file     *huggingFaceFile
+	received int64
+	report   func(status string, received int64)
+	logAt    time.Time
+}
+
+func (p *downloadProgress) Write(b []byte) (int, error) {
+	p.received += int64(len(b))
+	if p.report != nil {
+		p.report(constants.IMPORT_STATUS_DOWNLOADING, p.received)
+	}
+	if now := time.Now(); now.After(p.logAt) {
+		p.logAt = now.Add(huggingFaceProgressInterval)
+		if p.file.Size > 0 {
+			utils.LogInfo("Downloading %s: %d of %d bytes (%d%%)", p.file.Path, p.received, p.file.Size, p.received*100/p.file.Size)
+		} else {
+			utils.LogInfo("Downloading %s: %d bytes", p.file.Path, p.received)
+		}
+	}
+	return len(b), nil
+}
+
+// verifyHuggingFaceFile checks the size and checksum of a downloaded file against those
+// reported by the Hub, and sets file.SHA256 for files not stored with LFS
+func verifyHuggingFaceFile(f *os.File, file *huggingFaceFile) error {
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %v", f.Name(), err)
+	}
+	if file.Size > 0 && info.Size() != file.Size {
+		return fmt.Errorf("downloaded %s has %d bytes, expected %d", file.Path, info.Size(), file.Size)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek %s: %v", f.Name(), err)
+	}
+
+	// Git object IDs hash the file prefixed with a "blob <size>\x00" header
+	blobHash := sha1.New()
+	fmt.Fprintf(blobHash, "blob %d\x00", info.Size())
+	contentHash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(contentHash, blobHash), f); err != nil {
+		return fmt.Errorf("failed to read %s: %v", f.Name(), err)
+	}
+	checksum := hex.EncodeToString(contentHash.Sum(nil))
+
+	switch {
+	case file.SHA256 != "":
+		if checksum != file.SHA256 {
+			return fmt.Errorf("checksum of downloaded %s is %s, expected %s", file.Path, checksum, file.SHA256)
+		}
+	case file.blobID != "":
+		if blobID := hex.EncodeToString(blobHash.Sum(nil)); blobID != file.blobID {
+			return fmt.Errorf("git object ID of downloaded %s is %s, expected %s", file.Path, blobID, file.blobID)
+		}
+		file.SHA256 = checksum
+	default:
+		return fmt.Errorf("the Hub reported no checksum for %s", file.Path)
+	}
+	return nil
+}
+
+// huggingFaceStatusError converts an unsuccessful Hub response to an error, wrapping
+// errHuggingFaceAccess or errHuggingFaceNotFound where they apply
+func huggingFaceStatusError(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	// The Hub explains refusals such as gated repositories in the X-Error-Message header
+	message := resp.Header.Get("X-Error-Message")
+	if message == "" {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		message = strings.TrimSpace(string(body))
+	}
+
+	switch resp.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fmt.Errorf("%w (%s: %s)", errHuggingFaceAccess, resp.Status, message)
+	case http.StatusNotFound:
+		return fmt.Errorf("%w (%s: %s)", errHuggingFaceNotFound, resp.Status, message)
+	}
+	return fmt.Errorf("unexpected response %s: %s", resp.Status, message)
+}
+
+// matchesGlob reports whether a file path or its name matches one of the glob patterns
+func matchesGlob(filePath string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, filePath); matched {
+			return true
+		}
+		if matched, _ := path.Match(pattern, path.Base(filePath)); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// validateHuggingFacePath rejects file paths which are not relative paths within the
+// repository, such as absolute paths or paths with ".." segments
+func validateHuggingFacePath(filePath string) error {
+	if filePath == "" || strings.ContainsRune(filePath, '\\') {
+		return errors.New("invalid file path")
+	}
+	for _, segment := range strings.Split(filePath, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return errors.New("file path must be relative and must not contain empty, . or .. segments")
+		}
+	}
+	if !filepath.IsLocal(filepath.FromSlash(filePath)) {
+		return errors.New("file path must be local to the repository")
+	}
+	return nil
+}
+
+// escapeHuggingFacePath escapes each segment of a file path in a repository
+func escapeHuggingFacePath(filePath string) string {
+	segments := strings.Split(filePath, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// isHexDigest reports whether s is the hex encoding of a digest of size bytes
+func isHexDigest(s string, size int) bool {
+	if len(s) != hex.EncodedLen(size) {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
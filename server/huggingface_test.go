@@ -0,0 +1,265 @@
+package server
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testHubCommit = "0123456789abcdef0123456789abcdef01234567"
+
+// testHub is a fake Hugging Face Hub serving the files of the owner/repo repository
+type testHub struct {
+	// files are served as LFS files when their name ends in .gguf, and as git blobs otherwise
+	files map[string][]byte
+	// served replaces the content downloaded for a file, leaving its listed checksum as is
+	served map[string][]byte
+	// extra lists additional file names without serving them
+	extra []string
+	// token is required as bearer token when set
+	token string
+}
+
+func (h *testHub) serve(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.token != "" && r.Header.Get("Authorization") != "Bearer "+h.token {
+			w.Header().Set("X-Error-Message", "Access to model owner/repo is restricted.")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch {
+		case r.URL.Path == "/api/models/owner/repo/revision/main":
+			json.NewEncoder(w).Encode(h.repoInfo())
+		case strings.HasPrefix(r.URL.Path, "/owner/repo/resolve/"+testHubCommit+"/"):
+			filePath := strings.TrimPrefix(r.URL.Path, "/owner/repo/resolve/"+testHubCommit+"/")
+			content, ok := h.served[filePath]
+			if !ok {
+				content, ok = h.files[filePath]
+			}
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			http.ServeContent(w, r, filePath, time.Time{}, strings.NewReader(string(content)))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (h *testHub) repoInfo() map[string]any {
+	var siblings []map[string]any
+	for name, content := range h.files {
+		sibling := map[string]any{"rfilename": name, "size": len(content)}
+		if strings.HasSuffix(name, ".gguf") {
+			sum := sha256.Sum256(content)
+			sibling["lfs"] = map[string]any{"sha256": hex.EncodeToString(sum[:]), "size": len(content)}
+		} else {
+			blob := sha1.New()
+			fmt.Fprintf(blob, "blob %d\x00%s", len(content), content)
+			sibling["blobId"] = hex.EncodeToString(blob.Sum(nil))
+		}
+		siblings = append(siblings, sibling)
+	}
+	for _, name := range h.extra {
+		siblings = append(siblings, map[string]any{"rfilename": name, "size": 1, "blobId": testHubCommit})
+	}
+	return map[string]any{"sha": testHubCommit, "siblings": siblings}
+}
+
+func newTestHub() *testHub {
+	return &testHub{files: map[string][]byte{
+		"model-00001-of-00002.gguf": []byte("first shard"),
+		"model-00002-of-00002.gguf": []byte("second shard"),
+		"README.md":                 []byte("# Model\n"),
+	}}
+}
+
+func TestHuggingFaceResolveRepository(t *testing.T) {
+	server := newTestHub().serve(t)
+	importer := NewHuggingFaceImporter(server.URL, "")
+
+	repo, err := importer.Parse(server.URL + "/owner/repo")
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	files, err := importer.ResolveRepository(context.Background(), repo, nil, nil)
+	if err != nil {
+		t.Fatalf("ResolveRepository() error = %v", err)
+	}
+	var paths []string
+	for _, file := range files {
+		paths = append(paths, file.Path)
+		if file.Commit != testHubCommit {
+			t.Errorf("%s commit = %q, want %q", file.Path, file.Commit, testHubCommit)
+		}
+	}
+	if got := strings.Join(paths, ","); got != "README.md,model-00001-of-00002.gguf,model-00002-of-00002.gguf" {
+		t.Errorf("files = %s", got)
+	}
+
+	files, err = importer.ResolveRepository(context.Background(), repo, []string{"*.gguf"}, []string{"model-00002-*"})
+	if err != nil {
+		t.Fatalf("ResolveRepository() error = %v", err)
+	}
+	if len(files) != 1 || files[0].Path != "model-00001-of-00002.gguf" || files[0].SHA256 == "" || files[0].Size != int64(len("first shard")) {
+		t.Errorf("unexpected files matching the patterns: %+v", files)
+	}
+
+	if _, err := importer.ResolveRepository(context.Background(), repo, []string{"*.safetensors"}, nil); !errors.Is(err, errHuggingFaceNotFound) {
+		t.Errorf("ResolveRepository() without matching files error = %v, want %v", err, errHuggingFaceNotFound)
+	}
+}
+
+func TestHuggingFaceDownload(t *testing.T) {
+	hub := newTestHub()
+	server := hub.serve(t)
+	importer := NewHuggingFaceImporter(server.URL, "")
+	dir := t.TempDir()
+
+	for _, filePath := range []string{"model-00001-of-00002.gguf", "README.md"} {
+		t.Run(filePath, func(t *testing.T) {
+			file, err := importer.Parse(server.URL + "/owner/repo/blob/main/" + filePath)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if err := importer.Resolve(context.Background(), file); err != nil {
+				t.Fatalf("Resolve() error = %v", err)
+			}
+
+			dst := filepath.Join(dir, filePath)
+			// A previous attempt left the first bytes, which are resumed from
+			if err := os.WriteFile(dst+".partial", hub.files[filePath][:4], 0644); err != nil {
+				t.Fatalf("failed to write partial file: %v", err)
+			}
+			if err := importer.Download(context.Background(), file, dst, nil); err != nil {
+				t.Fatalf("Download() error = %v", err)
+			}
+
+			content, err := os.ReadFile(dst)
+			if err != nil || string(content) != string(hub.files[filePath]) {
+				t.Errorf("downloaded %q, %v, want %q", content, err, hub.files[filePath])
+			}
+			sum := sha256.Sum256(hub.files[filePath])
+			if file.SHA256 != hex.EncodeToString(sum[:]) {
+				t.Errorf("SHA256 = %s, want the checksum of the file", file.SHA256)
+			}
+			if _, err := os.Stat(dst + ".partial"); !os.IsNotExist(err) {
+				t.Errorf("partial file was left behind: %v", err)
+			}
+		})
+	}
+}
+
+func TestHuggingFaceChecksumMismatch(t *testing.T) {
+	for _, filePath := range []string{"model-00001-of-00002.gguf", "README.md"} {
+		t.Run(filePath, func(t *testing.T) {
+			hub := newTestHub()
+			hub.served = map[string][]byte{filePath: []byte("tampered!!!")}
+			server := hub.serve(t)
+			importer := NewHuggingFaceImporter(server.URL, "")
+
+			file, err := importer.Parse(server.URL + "/owner/repo/blob/main/" + filePath)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if err := importer.Resolve(context.Background(), file); err != nil {
+				t.Fatalf("Resolve() error = %v", err)
+			}
+
+			dst := filepath.Join(t.TempDir(), filePath)
+			if err := importer.Download(context.Background(), file, dst, nil); err == nil {
+				t.Fatal("Download() accepted a file not matching its checksum")
+			}
+			for _, leftover := range []string{dst, dst + ".partial"} {
+				if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+					t.Errorf("%s exists after a checksum mismatch: %v", filepath.Base(leftover), err)
+				}
+			}
+		})
+	}
+}
+
+func TestHuggingFaceAuthErrors(t *testing.T) {
+	hub := newTestHub()
+	hub.token = "secret"
+	server := hub.serve(t)
+
+	repo, err := NewHuggingFaceImporter(server.URL, "").Parse(server.URL + "/owner/repo")
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	for _, token := range []string{"", "wrong"} {
+		_, err := NewHuggingFaceImporter(server.URL, token).ResolveRepository(context.Background(), repo, nil, nil)
+		if !errors.Is(err, errHuggingFaceAccess) || !strings.Contains(err.Error(), "restricted") {
+			t.Errorf("ResolveRepository() with token %q error = %v, want %v", token, err, errHuggingFaceAccess)
+		}
+	}
+
+	importer := NewHuggingFaceImporter(server.URL, "secret")
+	files, err := importer.ResolveRepository(context.Background(), repo, []string{"README.md"}, nil)
+	if err != nil {
+		t.Fatalf("ResolveRepository() with token error = %v", err)
+	}
+	if err := importer.Download(context.Background(), files[0], filepath.Join(t.TempDir(), "README.md"), nil); err != nil {
+		t.Errorf("Download() with token error = %v", err)
+	}
+
+	missing, err := importer.Parse(server.URL + "/owner/other")
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if _, err := importer.ResolveRepository(context.Background(), missing, nil, nil); !errors.Is(err, errHuggingFaceNotFound) {
+		t.Errorf("ResolveRepository() of a missing repository error = %v, want %v", err, errHuggingFaceNotFound)
+	}
+}
+
+func TestHuggingFaceUnsafeFilenames(t *testing.T) {
+	for _, name := range []string{"../escape.gguf", "/etc/passwd", "weights/../../escape.gguf", "weights//model.gguf", `weights\..\escape.gguf`, "./model.gguf"} {
+		t.Run(name, func(t *testing.T) {
+			hub := newTestHub()
+			hub.extra = []string{name}
+			server := hub.serve(t)
+			importer := NewHuggingFaceImporter(server.URL, "")
+
+			repo, err := importer.Parse(server.URL + "/owner/repo")
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if _, err := importer.ResolveRepository(context.Background(), repo, nil, nil); err == nil {
+				t.Errorf("ResolveRepository() accepted file %q", name)
+			}
+		})
+	}
+}
+
+func TestImportFilePath(t *testing.T) {
+	uploadDir := filepath.Join(t.TempDir(), "uploads")
+
+	if dst, err := importFilePath(uploadDir, "weights/model.gguf"); err != nil || dst != filepath.Join(uploadDir, "weights", "model.gguf") {
+		t.Errorf("importFilePath() = %q, %v", dst, err)
+	}
+	for _, filePath := range []string{"../escape.gguf", "weights/../../escape.gguf", ".."} {
+		if dst, err := importFilePath(uploadDir, filePath); err == nil {
+			t.Errorf("importFilePath(%q) = %q, want an error", filePath, dst)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"depin-server/constants"
+	"depin-server/db"
+)
+
+const (
+	defaultMaxImages      = 4
+	defaultMaxImageMB     = 10
+	dataURLBase64Marker   = ";base64,"
+	openAIContentText     = "text"
+	openAIContentImageURL = "image_url"
+)
+
+// openAIContentPart is an element of an OpenAI multimodal message content array
+type openAIContentPart struct {
+	Type     string          `json:"type"`
+	Text     string          `json:"text,omitempty"`
+	ImageURL *openAIImageURL `json:"image_url,omitempty"`
+}
+
+type openAIImageURL struct {
+	URL string `json:"url"`
+}
+
+// UnmarshalJSON accepts the content of a message either as a string, as in the Ollama
+// API, or as an OpenAI array of text and image parts. Images must be inline data URLs,
+// which are moved to Images as base64.
+func (m *Message) UnmarshalJSON(data []byte) error {
+	type plainMessage Message
+	var raw struct {
+		plainMessage
+		Content json.RawMessage `json:"content"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*m = Message(raw.plainMessage)
+
+	if len(raw.Content) == 0 || string(raw.Content) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(raw.Content, &m.Content); err == nil {
+		return nil
+	}
+
+	var parts []*openAIContentPart
+	if err := json.Unmarshal(raw.Content, &parts); err != nil {
+		return errors.New("message content must be a string or a list of content parts")
+	}
+
+	var texts []string
+	for _, part := range parts {
+		switch part.Type {
+		case openAIContentText:
+			texts = append(texts, part.Text)
+		case openAIContentImageURL:
+			if part.ImageURL == nil {
+				return errors.New("image_url content part has no url")
+			}
+			_, image, ok := strings.Cut(part.ImageURL.URL, dataURLBase64Marker)
+			if !strings.HasPrefix(part.ImageURL.URL, "data:") || !ok {
+				return errors.New("images must be base64 data URLs")
+			}
+			m.Images = append(m.Images, image)
+		default:
+			return fmt.Errorf("content part type %q is not supported", part.Type)
+		}
+	}
+	m.Content = strings.Join(texts, "\n")
+	return nil
+}
+
+// validateImages enforces the image count and size limits, and rejects images sent to
+// Ollama models uploaded without a vision projector
+func (s *DepinServer) validateImages(input *InferenceInput, asset *db.Asset) error {
+	imageCount := countImages(input.Messages)
+	if imageCount == 0 {
+		return nil
+	}
+
+	if asset.Runtime == constants.RUNTIME_OLLAMA && asset.Projector == "" {
+		return fmt.Errorf("model asset %s does not accept images", asset.ID)
+	}
+	if imageCount > s.MaxImages {
+		return fmt.Errorf("at most %d images are accepted per request", s.MaxImages)
+	}
+
+	for _, message := range input.Messages {
+		for i, image := range message.Images {
+			if int64(base64.StdEncoding.DecodedLen(len(image))) > s.MaxImageBytes {
+				return fmt.Errorf("image %d exceeds the maximum size of %d bytes", i, s.MaxImageBytes)
+			}
+			if _, err := base64.StdEncoding.DecodeString(image); err != nil {
+				return fmt.Errorf("image %d is not valid base64: %v", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// countImages returns the number of images across all messages
+func countImages(messages []*Message) int {
+	count := 0
+	for _, message := range messages {
+		if message != nil {
+			count += len(message.Images)
+		}
+	}
+	return count
+}
+
+// imageMediaType sniffs the media type of a base64 encoded image
+func imageMediaType(image string) string {
+	// Content sniffing looks at no more than 512 bytes, the first 684 base64 characters
+	prefix := image
+	if len(prefix) > 684 {
+		prefix = prefix[:684]
+	}
+	decoded, _ := base64.StdEncoding.DecodeString(prefix)
+	return http.DetectContentType(decoded)
+}
+
+// imageLimitsFromEnv reads INFERENCE_MAX_IMAGES, the images accepted per request, and
+// INFERENCE_MAX_IMAGE_MB, the decoded size limit of each image
+func imageLimitsFromEnv() (int, int64) {
+	maxImages := intFromEnv("INFERENCE_MAX_IMAGES", defaultMaxImages, 0)
+	maxImageMB := intFromEnv("INFERENCE_MAX_IMAGE_MB", defaultMaxImageMB, 1)
+	return maxImages, int64(maxImageMB) << 20
+}
@@ -0,0 +1,386 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"depin-server/constants"
+	"depin-server/db"
+	"depin-server/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errImportCancelled = errors.New("import job was cancelled")
+
+const (
+	defaultImportConcurrency = 1
+	// importPollInterval is how often idle workers look for queued import jobs
+	importPollInterval = 5 * time.Second
+	// importProgressInterval is how often the progress of a download is stored
+	importProgressInterval = time.Second
+)
+
+// ImportRunner registers uploaded and imported assets in the background with bounded
+// concurrency, and cancels the downloads of running jobs on request
+type ImportRunner struct {
+	Concurrency int
+
+	wake    chan struct{}
+	mu      sync.Mutex
+	cancels map[string]context.CancelFunc
+}
+
+func NewImportRunner(concurrency int) *ImportRunner {
+	return &ImportRunner{
+		Concurrency: concurrency,
+		wake:        make(chan struct{}, concurrency),
+		cancels:     make(map[string]context.CancelFunc),
+	}
+}
+
+// notify wakes idle workers after a job was queued
+func (r *ImportRunner) notify() {
+	for i := 0; i < r.Concurrency; i++ {
+		select {
+		case r.wake <- struct{}{}:
+		default:
+			return
+		}
+	}
+}
+
+// track returns the context a job runs with until the returned func is called
+func (r *ImportRunner) track(jobID string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cancels[jobID] = cancel
+
+	return ctx, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.cancels, jobID)
+		cancel()
+	}
+}
+
+// cancel stops a running job and reports whether the job was running
+func (r *ImportRunner) cancel(jobID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cancel, ok := r.cancels[jobID]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// importRunnerFromEnv reads IMPORT_CONCURRENCY, the number of assets registered at once
+func importRunnerFromEnv() *ImportRunner {
+	return NewImportRunner(intFromEnv("IMPORT_CONCURRENCY", defaultImportConcurrency, 1))
+}
+
+// startImportWorkers resumes the downloads left running by a previous process and starts the workers
+func (s *DepinServer) startImportWorkers() {
+	if err := db.ResetInterruptedImportJobs(s.Storage); err != nil {
+		utils.LogInfo("Error resetting interrupted import jobs: %v", err)
+	}
+	for i := 0; i < s.Imports.Concurrency; i++ {
+		go s.importWorker()
+	}
+}
+
+func (s *DepinServer) importWorker() {
+	for {
+		job, err := db.ClaimImportJob(s.Storage)
+		if err != nil {
+			utils.LogInfo("Error claiming import job: %v", err)
+		}
+		if job == nil {
+			select {
+			case <-s.Imports.wake:
+			case <-time.After(importPollInterval):
+			}
+			continue
+		}
+
+		s.processImportJob(job)
+	}
+}
+
+// processImportJob downloads the files of an import by URL, then mints and launches the
+// asset like a synchronous upload, storing each stage on the job. The files of a job
+// cancelled while it runs are deleted here, once nothing writes them anymore.
+func (s *DepinServer) processImportJob(job *db.ImportJob) {
+	ctx, done := s.Imports.track(job.ID)
+	defer done()
+
+	uploadDir := assetUploadDir(job.AssetType, job.AssetName)
+	upload := &assetUpload{
+		AssetName: job.AssetName,
+		AssetType: job.AssetType,
+		Runtime:   job.Runtime,
+		ModelTag:  job.ModelTag,
+		Filename:  job.Filename,
+		Files:     job.Files,
+	}
+	if job.Projector != "" {
+		upload.ProjectorName = job.Projector
+		upload.ProjectorPath = filepath.Join(uploadDir, job.Projector)
+	}
+	if job.Price != "" {
+		price, err := parseAssetPrice("", job.PricingUnit, job.Price)
+		if err != nil {
+			s.failImportJob(job, fmt.Errorf("invalid asset price: %v", err))
+			return
+		}
+		upload.Price = price
+	}
+	if job.Checksum != "" {
+		upload.Checksums = map[string]string{job.Filename: job.Checksum}
+	}
+
+	if job.URL != "" {
+		source, checksums, err := s.downloadImport(ctx, job, uploadDir)
+		if ctx.Err() != nil || errors.Is(err, context.Canceled) {
+			utils.LogInfo("Import job %s cancelled", job.ID)
+			removeImportFiles(job)
+			return
+		}
+		if err != nil {
+			s.failImportJob(job, err)
+			return
+		}
+		upload.Filename = job.Filename
+		upload.Files = job.Files
+		upload.Checksums = checksums
+		upload.Source = source
+		if job.Projector != "" {
+			upload.ProjectorName = job.Projector
+			upload.ProjectorPath = filepath.Join(uploadDir, filepath.FromSlash(job.Projector))
+		}
+	}
+
+	assetID, _, err := s.registerAsset(upload, func(status string) bool {
+		job.Status = status
+		return s.updateImportJob(job)
+	})
+	if errors.Is(err, errImportCancelled) {
+		utils.LogInfo("Import job %s cancelled", job.ID)
+		removeImportFiles(job)
+		return
+	}
+	if err != nil {
+		s.failImportJob(job, err)
+		return
+	}
+
+	job.Status = constants.IMPORT_STATUS_DONE
+	job.AssetID = assetID
+	s.updateImportJob(job)
+	utils.LogInfo("Import job %s done, asset %s registered", job.ID, assetID)
+}
+
+// downloadImport resolves and downloads the Hugging Face file of a job, or the selected
+// files of a whole repository, into uploadDir, storing the progress of the download on
+// the job. It returns the source of the asset and the verified checksums of its files.
+func (s *DepinServer) downloadImport(ctx context.Context, job *db.ImportJob, uploadDir string) (*huggingFaceFile, map[string]string, error) {
+	source, err := s.HuggingFace.Parse(job.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var files []*huggingFaceFile
+	if source.Path == "" {
+		files, err = s.HuggingFace.ResolveRepository(ctx, source, job.Include, job.Exclude)
+	} else {
+		err = s.HuggingFace.Resolve(ctx, source)
+		files = []*huggingFaceFile{source}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	job.Files = nil
+	job.BytesTotal = 0
+	for _, file := range files {
+		job.Files = append(job.Files, file.Path)
+		job.BytesTotal += file.Size
+	}
+	job.Filename, job.Projector = mainImportFiles(job.AssetType, job.Files)
+	// Sharded models which cannot be launched are rejected before downloading them
+	if job.AssetType == constants.ASSET_TYPE_MODEL && job.Runtime == constants.RUNTIME_OLLAMA {
+		if err := checkOllamaShards(job.Files, job.Projector); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(job.Files) == 1 {
+		job.Files = nil
+	}
+	if !s.updateImportJob(job) {
+		return nil, nil, context.Canceled
+	}
+
+	// Files are downloaded one after the other, the progress of the job adds up their bytes
+	var downloaded int64
+	var storedAt time.Time
+	progress := func(status string, received int64) {
+		if status == job.Status && time.Since(storedAt) < importProgressInterval {
+			return
+		}
+		storedAt = time.Now()
+		job.Status = status
+		job.BytesDone = downloaded + received
+		s.updateImportJob(job)
+	}
+
+	checksums := make(map[string]string, len(files))
+	for _, file := range files {
+		job.Status = constants.IMPORT_STATUS_DOWNLOADING
+		dst, err := importFilePath(uploadDir, file.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := s.HuggingFace.Download(ctx, file, dst, progress); err != nil {
+			return nil, nil, err
+		}
+		checksums[file.Path] = file.SHA256
+		downloaded += file.Size
+	}
+
+	job.BytesDone = job.BytesTotal
+	return source, checksums, nil
+}
+
+// importFilePath returns where a file of an imported repository is stored in uploadDir,
+// rejecting paths which resolve outside of it
+func importFilePath(uploadDir string, filePath string) (string, error) {
+	dst := filepath.Join(uploadDir, filepath.FromSlash(filePath))
+	rel, err := filepath.Rel(uploadDir, dst)
+	if err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("file %q resolves outside of the asset directory", filePath)
+	}
+	return dst, nil
+}
+
+// mainImportFiles picks the main file of an imported asset among its files ordered by
+// path, and the vision projector of a model. For models the main file is the first GGUF
+// file which is not a projector, the first shard of a sharded model.
+func mainImportFiles(assetType string, files []string) (string, string) {
+	if assetType != constants.ASSET_TYPE_MODEL || len(files) == 1 {
+		return files[0], ""
+	}
+
+	var mainFile, projector string
+	for _, file := range files {
+		if strings.ToLower(path.Ext(file)) != ".gguf" {
+			continue
+		}
+		if strings.Contains(strings.ToLower(path.Base(file)), "mmproj") {
+			if projector == "" {
+				projector = file
+			}
+		} else if mainFile == "" {
+			mainFile = file
+		}
+	}
+	if mainFile == "" {
+		return files[0], ""
+	}
+	return mainFile, projector
+}
+
+// updateImportJob stores the stage and progress of a job, it reports false if the job
+// was cancelled meanwhile
+func (s *DepinServer) updateImportJob(job *db.ImportJob) bool {
+	updated, err := db.UpdateImportJob(s.Storage, job)
+	if err != nil {
+		utils.LogInfo("Error updating import job %s: %v", job.ID, err)
+		return true
+	}
+	return updated
+}
+
+func (s *DepinServer) failImportJob(job *db.ImportJob, err error) {
+	utils.LogInfo("Import job %s failed while %s: %v", job.ID, job.Status, err)
+	job.Status = constants.IMPORT_STATUS_FAILED
+	job.Error = err.Error()
+	s.updateImportJob(job)
+}
+
+// HandleGetImport returns the stage and download progress of an import job
+func (s *DepinServer) HandleGetImport(c *gin.Context) {
+	job, err := db.GetImportJob(s.Storage, c.Param("jobId"))
+	if err != nil {
+		utils.LogInfo("Error fetching import job: %v", err)
+		utils.RespondError(c, http.StatusInternalServerError, "Failed to fetch import job", err)
+		return
+	}
+	if job == nil {
+		utils.RespondError(c, http.StatusNotFound, "Import job not found", nil)
+		return
+	}
+	utils.RespondSuccess(c, "Import job fetched successfully", job)
+}
+
+// HandleCancelImport cancels an import job which has not started minting the asset, and
+// deletes the files it received. The files of a running job are deleted by its worker once
+// the download stops, so that they are not removed while being written.
+func (s *DepinServer) HandleCancelImport(c *gin.Context) {
+	job, err := db.CancelImportJob(s.Storage, c.Param("jobId"))
+	if err != nil {
+		utils.LogInfo("Error cancelling import job: %v", err)
+		utils.RespondError(c, http.StatusInternalServerError, "Failed to cancel import job", err)
+		return
+	}
+	if job == nil {
+		utils.RespondError(c, http.StatusNotFound, "Import job not found", nil)
+		return
+	}
+	if job.Status != constants.IMPORT_STATUS_CANCELLED {
+		utils.RespondError(c, http.StatusConflict, "Import job can no longer be cancelled", fmt.Errorf("job is %s", job.Status))
+		return
+	}
+
+	if !s.Imports.cancel(job.ID) {
+		removeImportFiles(job)
+	}
+
+	utils.LogInfo("Import job %s cancelled", job.ID)
+	utils.RespondSuccess(c, "Import job cancelled successfully", job)
+}
+
+// removeImportFiles deletes the asset files of a cancelled job, including partial downloads
+func removeImportFiles(job *db.ImportJob) {
+	uploadDir := assetUploadDir(job.AssetType, job.AssetName)
+	files := append([]string{}, job.Files...)
+	if len(files) == 0 {
+		for _, file := range []string{job.Filename, job.Projector} {
+			if file != "" {
+				files = append(files, file)
+			}
+		}
+	}
+	if job.URL != "" {
+		for _, file := range files {
+			files = append(files, file+".partial")
+		}
+	}
+
+	for _, file := range files {
+		if err := os.Remove(filepath.Join(uploadDir, filepath.FromSlash(file))); err != nil && !os.IsNotExist(err) {
+			utils.LogInfo("Error deleting %s of import job %s: %v", file, job.ID, err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"depin-server/constants"
+	"depin-server/db"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCancelImport(t *testing.T) {
+	t.Setenv("UPLOAD_DIR", t.TempDir())
+	s, _ := newTestServer(t)
+	s.Imports = NewImportRunner(1)
+	router := gin.New()
+	router.DELETE("/imports/:jobId", s.HandleCancelImport)
+
+	for _, running := range []bool{false, true} {
+		now := time.Now().Unix()
+		job := &db.ImportJob{
+			ID:        "job-running",
+			AssetName: "model",
+			AssetType: constants.ASSET_TYPE_MODEL,
+			Runtime:   constants.RUNTIME_OLLAMA,
+			URL:       "https://huggingface.co/owner/repo/blob/main/model.gguf",
+			Filename:  "model.gguf",
+			Status:    constants.IMPORT_STATUS_DOWNLOADING,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		if !running {
+			job.ID = "job-queued"
+			job.Status = constants.IMPORT_STATUS_QUEUED
+		}
+		if err := db.CreateImportJob(s.Storage, job); err != nil {
+			t.Fatalf("failed to create import job: %v", err)
+		}
+		partial := filepath.Join(assetUploadDir(job.AssetType, job.AssetName), job.Filename+".partial")
+		if err := os.MkdirAll(filepath.Dir(partial), 0755); err != nil {
+			t.Fatalf("failed to create upload directory: %v", err)
+		}
+		if err := os.WriteFile(partial, []byte("first bytes"), 0644); err != nil {
+			t.Fatalf("failed to write partial file: %v", err)
+		}
+
+		ctx, done := s.Imports.track(job.ID)
+		if !running {
+			done()
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/imports/"+job.ID, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("cancel %s = %d %s", job.ID, w.Code, w.Body.String())
+		}
+
+		// The worker of a running job deletes its files once the download stopped
+		_, err := os.Stat(partial)
+		if running && (ctx.Err() == nil || err != nil) {
+			t.Errorf("cancelling a running job: context error = %v, partial file error = %v", ctx.Err(), err)
+		}
+		if !running && !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("partial file of a queued job was not deleted: %v", err)
+		}
+		if running {
+			done()
+			os.Remove(partial)
+		}
+	}
+}
+
+func TestCheckOllamaShards(t *testing.T) {
+	tests := []struct {
+		files     []string
+		projector string
+		wantErr   bool
+	}{
+		{[]string{"model.gguf"}, "", false},
+		{[]string{"model.gguf", "mmproj.gguf"}, "mmproj.gguf", false},
+		{[]string{"model.gguf", "README.md"}, "", false},
+		{[]string{"model-00001-of-00002.gguf", "model-00002-of-00002.gguf"}, "", true},
+	}
+
+	for _, tt := range tests {
+		err := checkOllamaShards(tt.files, tt.projector)
+		if tt.wantErr != errors.Is(err, errShardedOllamaModel) {
+			t.Errorf("checkOllamaShards(%v) error = %v, want error %v", tt.files, err, tt.wantErr)
+		}
+	}
+}
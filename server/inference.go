@@ -2,13 +2,19 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
+	"strings"
 
+	"depin-server/constants"
 	"depin-server/db"
 	"depin-server/utils"
 
@@ -41,11 +47,67 @@ type InferenceInput struct {
 	Model    string     `json:"model"`
 	Messages []*Message `json:"messages"`
 	Stream   bool       `json:"stream"`
+	// Options are Ollama model parameters such as temperature, num_ctx and seed
+	Options map[string]any `json:"options,omitempty"`
+	// Format requests structured output, either "json" or a JSON schema
+	Format json.RawMessage `json:"format,omitempty"`
+	Tools  []*Tool         `json:"tools,omitempty"`
+	// KeepAlive is how long the model stays loaded after the request, a duration
+	// string such as "5m" or a number of seconds
+	KeepAlive json.RawMessage `json:"keep_alive,omitempty"`
 }
 
 type Message struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
+	// Images are base64 encoded images for multimodal models
+	Images []string `json:"images,omitempty"`
+	// ToolCalls are the tool invocations requested by the model in an assistant message
+	ToolCalls []*ToolCall `json:"tool_calls,omitempty"`
+	// ToolName and ToolCallID identify the call a tool message holds the result of, by
+	// function name in the Ollama API and by call ID in the OpenAI API
+	ToolName   string `json:"tool_name,omitempty"`
+	ToolCallID string `json:"tool_call_id,omitempty"`
+}
+
+// Tool is a function the model may call, described by a JSON schema of its parameters
+type Tool struct {
+	Type     string        `json:"type"`
+	Function *ToolFunction `json:"function"`
+}
+
+type ToolFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+// ChatResponse is a response (or a single stream chunk) from the Ollama /api/chat endpoint
+type ChatResponse struct {
+	Model        string   `json:"model"`
+	CreatedAt    string   `json:"created_at"`
+	Message      *Message `json:"message,omitempty"`
+	Done         bool     `json:"done"`
+	DoneReason   string   `json:"done_reason,omitempty"`
+	LoadDuration int64    `json:"load_duration,omitempty"`
+	InferenceUsage
+}
+
+// InferenceUsage holds the token counts and durations (in nanoseconds) Ollama reports
+// in the final response of an inference
+type InferenceUsage struct {
+	TotalDuration   int64 `json:"total_duration,omitempty"`
+	PromptEvalCount int   `json:"prompt_eval_count,omitempty"`
+	EvalCount       int   `json:"eval_count,omitempty"`
+	EvalDuration    int64 `json:"eval_duration,omitempty"`
+}
+
+// applyTo copies the usage onto the inference record billed for it
+func (u *InferenceUsage) applyTo(record *db.InferenceRecord) {
+	record.PromptEvalCount = u.PromptEvalCount
+	record.EvalCount = u.EvalCount
+	record.TotalDuration = u.TotalDuration
+	record.EvalDuration = u.EvalDuration
 }
 
 type HandleInferenceReq struct {
@@ -55,18 +117,14 @@ type HandleInferenceReq struct {
 	Signature            string          `json:"signature"`
 	AssetID              string          `json:"asset_id"`
 	AssetValue           string          `json:"asset_value"`
+	// Cache opts in to serving the response from, and storing it in, the response cache
+	Cache bool `json:"cache,omitempty"`
+	// SignedMessages is the messages array exactly as sent by the client, which the
+	// signature covers
+	SignedMessages json.RawMessage `json:"-"`
 }
 
 func (s *DepinServer) HandleInference(c *gin.Context) {
-	ollamaAPI := os.Getenv("OLLAMA_API")
-	if ollamaAPI == "" {
-		utils.LogInfo("OLLAMA_API environment variable is not set")
-		utils.RespondError(c, http.StatusInternalServerError, "OLLAMA_API is not configured", nil)
-		return
-	}
-
-	ollamaServer := ollamaAPI + "/api/chat"
-
 	// Read the incoming request body
 	inputReqBytes, err := io.ReadAll(c.Request.Body)
 	if err != nil {
@@ -76,79 +134,443 @@ func (s *DepinServer) HandleInference(c *gin.Context) {
 	}
 
 	// Unmarshal the request body into our custom struct
-	var inferenceReq HandleInferenceReq
-	err = json.Unmarshal(inputReqBytes, &inferenceReq)
+	inferenceReq, err := parseInferenceReq(inputReqBytes)
 	if err != nil {
 		utils.LogInfo("Error unmarshalling request body: %v", err)
 		utils.RespondError(c, http.StatusBadRequest, "Invalid request format", err)
 		return
 	}
 
-	ollamaInferenceInputBytes, err := json.Marshal(inferenceReq.OllamaInferenceInput)
+	s.serveInference(c, inferenceReq, ollamaResponder{})
+}
+
+// parseInferenceReq decodes a native inference request body, keeping the messages as
+// sent by the client for signature verification
+func parseInferenceReq(body []byte) (*HandleInferenceReq, error) {
+	var inferenceReq HandleInferenceReq
+	if err := json.Unmarshal(body, &inferenceReq); err != nil {
+		return nil, err
+	}
+
+	var signed struct {
+		OllamaInferenceInput *signedMessages `json:"ollama_inference_input"`
+	}
+	if err := json.Unmarshal(body, &signed); err != nil {
+		return nil, err
+	}
+	if signed.OllamaInferenceInput != nil {
+		inferenceReq.SignedMessages = signed.OllamaInferenceInput.Messages
+	}
+	return &inferenceReq, nil
+}
+
+// inferenceResponder writes the outcome of an inference in the wire format of an endpoint
+type inferenceResponder interface {
+	// Error responds with a failure of the request, errType classifies the failure
+	// for formats which report it
+	Error(c *gin.Context, code int, message string, errType string, err error)
+	// BackendError relays an error response of the inference backend
+	BackendError(c *gin.Context, resp *BackendResponse, body []byte)
+	// Stream relays a successful streamed response and returns the outcome of the stream
+	Stream(ctx context.Context, c *gin.Context, resp *BackendResponse, record *db.InferenceRecord) string
+	// Complete writes a successful non-streamed response
+	Complete(c *gin.Context, resp *BackendResponse, body []byte, chatResp *ChatResponse, record *db.InferenceRecord)
+}
+
+// ollamaResponder passes backend responses through in the Ollama format
+type ollamaResponder struct{}
+
+func (ollamaResponder) Error(c *gin.Context, code int, message string, errType string, err error) {
+	utils.RespondError(c, code, message, err)
+}
+
+func (ollamaResponder) BackendError(c *gin.Context, resp *BackendResponse, body []byte) {
+	c.Data(resp.StatusCode, resp.ContentType, body)
+}
+
+func (ollamaResponder) Stream(ctx context.Context, c *gin.Context, resp *BackendResponse, record *db.InferenceRecord) string {
+	return relayInferenceStream(ctx, c, resp, record)
+}
+
+func (ollamaResponder) Complete(c *gin.Context, resp *BackendResponse, body []byte, chatResp *ChatResponse, record *db.InferenceRecord) {
+	// Set the same content-type as received
+	c.Data(resp.StatusCode, resp.ContentType, body)
+}
+
+// serveInference runs an inference request through the steps shared by the inference
+// endpoints: validation against the asset, pricing, authentication, rate limiting, the
+// response cache, admission, the backend call and the inference record. respond writes
+// the outcome in the wire format of the endpoint.
+func (s *DepinServer) serveInference(c *gin.Context, inferenceReq *HandleInferenceReq, respond inferenceResponder) {
+	userInferenceInput, err := getUserInferenceInput(inferenceReq.OllamaInferenceInput, s.QueryPolicy)
+	if err != nil {
+		utils.LogInfo("Error getting user inference input: %v", err)
+		respond.Error(c, http.StatusBadRequest, "Invalid inference input", errTypeInvalidRequest, err)
+		return
+	}
+
+	asset, err := s.resolveAssetModel(inferenceReq)
+	if errors.Is(err, errAssetNotFound) {
+		utils.LogInfo("Rejecting inference request for unknown asset %s", inferenceReq.AssetID)
+		respond.Error(c, http.StatusNotFound, "Asset not found", errTypeInvalidRequest, err)
+		return
+	}
 	if err != nil {
-		utils.LogInfo("Error marshalling ollama_inference_input: %v", err)
-		utils.RespondError(c, http.StatusBadRequest, "Invalid ollama_inference_input format", err)
+		utils.LogInfo("Error resolving model for asset %s: %v", inferenceReq.AssetID, err)
+		respond.Error(c, http.StatusBadRequest, "Model does not match asset", errTypeInvalidRequest, err)
 		return
 	}
 
-	// Forward the request to the target API
-	resp, err := http.Post(ollamaServer, "application/json", bytes.NewBuffer(ollamaInferenceInputBytes))
+	limits, err := s.assetLimits(asset.ID)
 	if err != nil {
-		utils.LogInfo("Error forwarding request to OLLAMA_API: %v", err)
-		utils.RespondError(c, http.StatusBadGateway, "Error contacting inference backend", err)
+		utils.LogInfo("Error fetching limits of asset %s: %v", asset.ID, err)
+		respond.Error(c, http.StatusInternalServerError, "Failed to fetch asset limits", errTypeServer, err)
+		return
+	}
+	if err := validateInferenceOptions(inferenceReq.OllamaInferenceInput, limits); err != nil {
+		utils.LogInfo("Invalid inference options for asset %s: %v", asset.ID, err)
+		respond.Error(c, http.StatusBadRequest, "Invalid inference options", errTypeInvalidRequest, err)
+		return
+	}
+	if err := s.validateImages(inferenceReq.OllamaInferenceInput, asset); err != nil {
+		utils.LogInfo("Invalid images for asset %s: %v", asset.ID, err)
+		respond.Error(c, http.StatusBadRequest, "Invalid images", errTypeInvalidRequest, err)
 		return
 	}
-	defer resp.Body.Close()
 
-	// Read the response from the target API
-	respBody, err := io.ReadAll(resp.Body)
+	price, err := s.resolveAssetValue(inferenceReq)
+	if err != nil {
+		utils.LogInfo("Error resolving value of asset %s: %v", inferenceReq.AssetID, err)
+		respond.Error(c, http.StatusPaymentRequired, "Asset value does not match asset price", errTypeInvalidRequest, err)
+		return
+	}
+
+	if err := s.authenticateInference(inferenceReq); err != nil {
+		utils.LogInfo("Authentication failed for DID %s: %v", inferenceReq.Did, err)
+		respond.Error(c, http.StatusUnauthorized, "Invalid or replayed signature", errTypeAuthentication, err)
+		return
+	}
+	inferenceReq.OllamaInferenceInput.Model = asset.ModelTag
+
+	backend, err := s.backendFor(asset.Runtime)
 	if err != nil {
-		utils.LogInfo("Error reading response from OLLAMA_API: %v", err)
-		utils.RespondError(c, http.StatusBadGateway, "Error reading inference response", err)
+		utils.LogInfo("Error selecting backend for asset %s: %v", asset.ID, err)
+		respond.Error(c, http.StatusServiceUnavailable, "Inference backend unavailable", errTypeBackend, err)
 		return
 	}
 
-	userInferenceInput, err := getUserInferenceInput(inferenceReq.OllamaInferenceInput)
+	err = s.rateLimitInference(c, inferenceReq)
+	if errors.Is(err, errRateLimited) {
+		respond.Error(c, http.StatusTooManyRequests, "Too many requests, retry later", errTypeRateLimit, err)
+		return
+	}
 	if err != nil {
-		utils.LogInfo("Error getting user inference input: %v", err)
-		utils.RespondError(c, http.StatusBadRequest, "Invalid inference input", err)
+		utils.LogInfo("Error checking rate limit: %v", err)
+		respond.Error(c, http.StatusInternalServerError, "Failed to check rate limit", errTypeServer, err)
 		return
 	}
 
-	// Add inference record to DB
-	userInferenceRecord := &db.InferenceRecord{
-		ID:        uuid.New().String(),
-		Did:       inferenceReq.Did,
-		Timestamp: inferenceReq.Timestamp,
-		Signature: inferenceReq.Signature,
-		AssetID:   inferenceReq.AssetID,
-		AssetValue: inferenceReq.AssetValue,
-		Query:     userInferenceInput,
+	userInferenceRecord := newInferenceRecord(inferenceReq, userInferenceInput)
+	stream := inferenceReq.OllamaInferenceInput.Stream
+
+	// Cache hits are served without running the model, so they skip the admission queue
+	cacheKey := s.responseCacheKey(inferenceReq, asset, backend)
+	resp := s.cachedResponse(c, cacheKey, stream)
+	if resp == nil {
+		release, err := s.admitInference(c, asset.ID, limits)
+		if errors.Is(err, errQueueFull) {
+			utils.LogInfo("Rejecting inference request for asset %s: %v", asset.ID, err)
+			respond.Error(c, http.StatusTooManyRequests, "Too many inference requests, retry later", errTypeRateLimit, err)
+			return
+		}
+		if errors.Is(err, errInvalidQueueTicket) {
+			respond.Error(c, http.StatusBadRequest, "Invalid X-Queue-Ticket header", errTypeInvalidRequest, err)
+			return
+		}
+		if err != nil {
+			utils.LogInfo("Client left the queue of asset %s: %v", asset.ID, err)
+			return
+		}
+		defer release()
 	}
 
-	if err := db.AddInferenceRecord(s.Storage, userInferenceRecord, s.RubixNodeAddress); err != nil {
-		utils.LogInfo("Error adding inference record to DB: %v", err)
-		utils.RespondError(c, http.StatusInternalServerError, "Failed to record inference", err)
+	// The signature is only consumed once the request is served, so that a request turned
+	// away by the rate limit or a full queue can be retried as is
+	if err := s.consumeInferenceSignature(inferenceReq); err != nil {
+		utils.LogInfo("Replay check failed for DID %s: %v", inferenceReq.Did, err)
+		respond.Error(c, http.StatusUnauthorized, "Invalid or replayed signature", errTypeAuthentication, err)
 		return
 	}
 
-	// Set the same content-type as received
-	c.Data(resp.StatusCode, resp.Header.Get("Content-Type"), respBody)
+	var captured *bytes.Buffer
+	ctx := c.Request.Context()
+	if resp != nil {
+		userInferenceRecord.Cached = true
+	} else {
+		// The generation time limit starts once the request leaves the queue
+		var cancel context.CancelFunc
+		ctx, cancel = generationContext(ctx, limits)
+		defer cancel()
+
+		resp, err = backend.Chat(ctx, inferenceReq.OllamaInferenceInput)
+		if err != nil {
+			utils.LogInfo("Error forwarding request to inference backend: %v", err)
+			userInferenceRecord.Status = inferenceFailureStatus(ctx, err)
+			s.recordInference(userInferenceRecord, price)
+			respond.Error(c, failureHTTPStatus(userInferenceRecord.Status), "Error contacting inference backend", errTypeBackend, err)
+			return
+		}
+		captured = captureForCache(cacheKey, resp)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		utils.LogInfo("Inference backend returned %d: %s", resp.StatusCode, respBody)
+		userInferenceRecord.Status = constants.INFERENCE_STATUS_BACKEND_ERROR
+		s.recordInference(userInferenceRecord, price)
+		respond.BackendError(c, resp, respBody)
+		return
+	}
+
+	if stream {
+		userInferenceRecord.Status = respond.Stream(ctx, c, resp, userInferenceRecord)
+		s.recordInference(userInferenceRecord, price)
+		s.storeInCache(cacheKey, captured, userInferenceRecord)
+		return
+	}
+
+	// Non-streamed responses are a single JSON object carrying the usage
+	respBody, err := io.ReadAll(resp.Body)
+	var chatResp ChatResponse
+	if err == nil {
+		err = json.Unmarshal(respBody, &chatResp)
+	}
+	if err != nil {
+		utils.LogInfo("Error reading response from inference backend: %v", err)
+		userInferenceRecord.Status = inferenceFailureStatus(ctx, err)
+		s.recordInference(userInferenceRecord, price)
+		respond.Error(c, failureHTTPStatus(userInferenceRecord.Status), "Error reading inference response", errTypeBackend, err)
+		return
+	}
+
+	chatResp.InferenceUsage.applyTo(userInferenceRecord)
+	userInferenceRecord.ToolCallCount = countToolCalls(chatResp.Message)
+	userInferenceRecord.Status = constants.INFERENCE_STATUS_SUCCESS
+	s.recordInference(userInferenceRecord, price)
+	s.storeInCache(cacheKey, captured, userInferenceRecord)
+
+	respond.Complete(c, resp, respBody, &chatResp, userInferenceRecord)
+}
+
+// recordInference stores the record of an inference attempt with its outcome, charged
+// at the asset price for the usage of the record. The inference has already run at
+// this point, so a failure to store the record is logged rather than withholding the
+// response from the client.
+func (s *DepinServer) recordInference(record *db.InferenceRecord, price *db.AssetPrice) {
+	record.AssetValue = inferenceValue(price, record)
+	if err := db.AddInferenceRecord(s.Storage, record, s.RubixNodeAddress); err != nil {
+		utils.LogInfo("Error adding inference record %s (%s) to DB: %v", record.ID, record.Status, err)
+	}
+	s.emitEvent(constants.WEBHOOK_EVENT_INFERENCE_COMPLETED, record.Did, record)
+}
+
+// inferenceFailureStatus classifies an error talking to the inference backend during an
+// inference bounded by ctx
+func inferenceFailureStatus(ctx context.Context, err error) string {
+	if status := contextFailureStatus(ctx); status != "" {
+		return status
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return constants.INFERENCE_STATUS_TIMEOUT
+	}
+	return constants.INFERENCE_STATUS_BACKEND_ERROR
+}
+
+// failureHTTPStatus is the HTTP status reported for a failed inference
+func failureHTTPStatus(status string) int {
+	if status == constants.INFERENCE_STATUS_TIMEOUT {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// contextFailureStatus returns the outcome of an inference whose context is done: timeout
+// once its generation time limit passed, client_abort if the client went away. It is empty
+// while the context is live.
+func contextFailureStatus(ctx context.Context) string {
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return constants.INFERENCE_STATUS_TIMEOUT
+	case ctx.Err() != nil:
+		return constants.INFERENCE_STATUS_CLIENT_ABORT
+	}
+	return ""
+}
+
+// errAssetNotFound is returned for requests against an asset which is not registered
+var errAssetNotFound = errors.New("asset not found")
+
+// resolveAssetModel returns the model asset a request pays for. A model given by the
+// client must match the asset's model tag, an omitted model is filled in from the asset.
+func (s *DepinServer) resolveAssetModel(inferenceReq *HandleInferenceReq) (*db.Asset, error) {
+	if inferenceReq.AssetID == "" {
+		return nil, errors.New("asset_id is required")
+	}
+
+	asset, err := db.GetAsset(s.Storage, inferenceReq.AssetID)
+	if err != nil {
+		return nil, err
+	}
+	if asset == nil {
+		// Only registered assets are served, so that every model is priced before it can be used
+		return nil, fmt.Errorf("%w: %s", errAssetNotFound, inferenceReq.AssetID)
+	}
+	if asset.Type != constants.ASSET_TYPE_MODEL {
+		return nil, fmt.Errorf("asset %s is not a model", inferenceReq.AssetID)
+	}
+	if asset.ModelTag == "" {
+		return nil, fmt.Errorf("asset %s has no model runtime", inferenceReq.AssetID)
+	}
+
+	requestedModel := inferenceReq.OllamaInferenceInput.Model
+	if requestedModel != "" && normalizeModelTag(requestedModel) != normalizeModelTag(asset.ModelTag) {
+		return nil, fmt.Errorf("model %s does not match asset %s", requestedModel, inferenceReq.AssetID)
+	}
+
+	return asset, nil
+}
+
+// normalizeModelTag adds the implicit ":latest" tag Ollama assumes for untagged models
+func normalizeModelTag(model string) string {
+	if !strings.Contains(model, ":") {
+		return model + ":latest"
+	}
+	return model
+}
+
+// authenticateInference rejects requests that were not signed by their DID or whose
+// timestamp is outside the acceptance window. The signature is consumed separately, once
+// the request is admitted. It is a no-op when signature verification is disabled.
+func (s *DepinServer) authenticateInference(inferenceReq *HandleInferenceReq) error {
+	if s.Verifier == nil {
+		return nil
+	}
+
+	if _, err := checkTimestampWindow(inferenceReq.Timestamp, s.TimestampWindow); err != nil {
+		return err
+	}
+
+	return s.Verifier.Verify(inferenceReq)
+}
+
+// consumeInferenceSignature rejects an authenticated request which replays the signed
+// payload of an accepted one. It is a no-op when signature verification is disabled.
+func (s *DepinServer) consumeInferenceSignature(inferenceReq *HandleInferenceReq) error {
+	if s.Verifier == nil {
+		return nil
+	}
+
+	requestTime, err := parseRequestTimestamp(inferenceReq.Timestamp)
+	if err != nil {
+		return err
+	}
+	payload, err := canonicalSignedPayload(inferenceReq)
+	if err != nil {
+		return err
+	}
+
+	return s.consumeSignature(inferenceReq.Did, payload, requestTime)
 }
 
-func getUserInferenceInput(inferenceInput *InferenceInput) (string, error) {
+// newInferenceRecord builds the inference record for a request. The status and asset
+// value are set by the caller once the outcome of the inference is known.
+func newInferenceRecord(inferenceReq *HandleInferenceReq, userInferenceInput string) *db.InferenceRecord {
+	return &db.InferenceRecord{
+		ID:         uuid.New().String(),
+		Did:        inferenceReq.Did,
+		Timestamp:  inferenceReq.Timestamp,
+		Signature:  inferenceReq.Signature,
+		AssetID:    inferenceReq.AssetID,
+		Query:      userInferenceInput,
+		ImageCount: countImages(inferenceReq.OllamaInferenceInput.Messages),
+	}
+}
+
+// getUserInferenceInput validates the conversation and extracts the query recorded for
+// billing according to the extraction policy:
+//
+//	last_user:       content of the last message from the user
+//	all_user:        contents of all user messages, newline separated
+//	transcript_hash: "sha256:" followed by the hash of the full conversation
+func getUserInferenceInput(inferenceInput *InferenceInput, policy string) (string, error) {
 	if inferenceInput == nil {
 		return "", errors.New("inferenceInput is required")
 	}
 
-	// TODO: need to expected only 1 message with role "user"?
-	if len(inferenceInput.Messages) != 3 {
-		return "", fmt.Errorf("exactly three messages are expected, got %d", len(inferenceInput.Messages))
+	if len(inferenceInput.Messages) == 0 {
+		return "", errors.New("at least one message is expected")
 	}
 
-	if inferenceInput.Messages[2].Role != "user" {
-		return "", fmt.Errorf("the third message must be from the user, got %s", inferenceInput.Messages[2].Role)
+	var userMessages []string
+	for i, message := range inferenceInput.Messages {
+		if message == nil {
+			return "", fmt.Errorf("message %d is empty", i)
+		}
+
+		switch message.Role {
+		case constants.MESSAGE_ROLE_USER:
+			userMessages = append(userMessages, message.Content)
+		case constants.MESSAGE_ROLE_SYSTEM, constants.MESSAGE_ROLE_ASSISTANT, constants.MESSAGE_ROLE_TOOL:
+		default:
+			return "", fmt.Errorf("message %d has unsupported role %q", i, message.Role)
+		}
 	}
 
-	return inferenceInput.Messages[2].Content, nil
+	switch policy {
+	case constants.QUERY_POLICY_TRANSCRIPT_HASH:
+		transcriptHash, err := hashMessages(inferenceInput.Messages)
+		if err != nil {
+			return "", err
+		}
+		return "sha256:" + transcriptHash, nil
+	case constants.QUERY_POLICY_ALL_USER:
+		if len(userMessages) == 0 {
+			return "", errors.New("at least one message from the user is expected")
+		}
+		return strings.Join(userMessages, "\n"), nil
+	default:
+		if len(userMessages) == 0 {
+			return "", errors.New("at least one message from the user is expected")
+		}
+		return userMessages[len(userMessages)-1], nil
+	}
+}
+
+func hashMessages(messages []*Message) (string, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(messages); err != nil {
+		return "", fmt.Errorf("failed to encode messages: %v", err)
+	}
+
+	sum := sha256.Sum256(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// queryPolicyFromEnv reads INFERENCE_QUERY_POLICY, defaulting to the last user message
+func queryPolicyFromEnv() string {
+	policy := os.Getenv("INFERENCE_QUERY_POLICY")
+	switch policy {
+	case constants.QUERY_POLICY_LAST_USER, constants.QUERY_POLICY_ALL_USER, constants.QUERY_POLICY_TRANSCRIPT_HASH:
+		return policy
+	case "":
+		return constants.QUERY_POLICY_LAST_USER
+	default:
+		utils.LogInfo("Invalid INFERENCE_QUERY_POLICY %q, using %s", policy, constants.QUERY_POLICY_LAST_USER)
+		return constants.QUERY_POLICY_LAST_USER
+	}
 }
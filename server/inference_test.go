@@ -0,0 +1,122 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"depin-server/constants"
+	"depin-server/db"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newTestServer serves asset "asset-1", priced 1 per call, with a FakeBackend
+func newTestServer(t *testing.T) (*DepinServer, *gin.Engine) {
+	t.Helper()
+
+	storage, err := db.NewStorage(filepath.Join(t.TempDir(), "inference.db"), 100)
+	if err != nil {
+		t.Fatalf("failed to create storage: %v", err)
+	}
+	if err := db.AddAsset(storage, &db.Asset{ID: "asset-1", Type: constants.ASSET_TYPE_MODEL, ModelTag: "m:latest", Runtime: constants.RUNTIME_OLLAMA}); err != nil {
+		t.Fatalf("failed to add asset: %v", err)
+	}
+	if err := db.SetAssetPrice(storage, &db.AssetPrice{AssetID: "asset-1", Unit: constants.PRICING_UNIT_PER_CALL, Amount: 1}); err != nil {
+		t.Fatalf("failed to set price: %v", err)
+	}
+
+	s := &DepinServer{
+		Storage:          storage,
+		Backends:         map[string]InferenceBackend{constants.RUNTIME_OLLAMA: NewFakeBackend("m:latest")},
+		Admission:        NewAdmissionController(1, 1),
+		DefaultRateLimit: defaultRateLimitFromEnv(),
+		Webhooks:         NewWebhookDispatcher(time.Second, 1),
+		TimestampWindow:  time.Minute,
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/inference", s.HandleInference)
+	router.POST("/v1/chat/completions", s.HandleChatCompletions)
+	return s, router
+}
+
+func serveTestRequest(router *gin.Engine, path string, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+	return w
+}
+
+func TestInferenceEndpoints(t *testing.T) {
+	_, router := newTestServer(t)
+
+	w := serveTestRequest(router, "/inference", `{"asset_id":"asset-1","asset_value":"1","ollama_inference_input":{"messages":[{"role":"user","content":"hello there"}]}}`)
+	var chatResp ChatResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &chatResp); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("native inference = %d %s", w.Code, w.Body.String())
+	}
+	if chatResp.Message.Content != "hello there" || chatResp.EvalCount != 2 {
+		t.Errorf("unexpected native response: %+v", chatResp)
+	}
+
+	w = serveTestRequest(router, "/v1/chat/completions", `{"model":"m","depin":{"asset_id":"asset-1","asset_value":"1"},"messages":[{"role":"user","content":"hello there"}]}`)
+	var completion OpenAIChatCompletion
+	if err := json.Unmarshal(w.Body.Bytes(), &completion); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("chat completion = %d %s", w.Code, w.Body.String())
+	}
+	if len(completion.Choices) != 1 || completion.Choices[0].Message.Content != "hello there" || completion.Usage.TotalTokens != 4 {
+		t.Errorf("unexpected chat completion: %+v", completion)
+	}
+}
+
+func TestInferenceStream(t *testing.T) {
+	_, router := newTestServer(t)
+
+	w := serveTestRequest(router, "/v1/chat/completions", `{"model":"m","stream":true,"depin":{"asset_id":"asset-1","asset_value":"1"},"messages":[{"role":"user","content":"hello there"}]}`)
+	if w.Code != http.StatusOK || !strings.HasSuffix(w.Body.String(), "data: [DONE]\n\n") {
+		t.Fatalf("streamed chat completion = %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestInferenceErrors(t *testing.T) {
+	_, router := newTestServer(t)
+
+	tests := []struct {
+		name     string
+		path     string
+		body     string
+		wantCode int
+	}{
+		{
+			name:     "unknown asset",
+			path:     "/inference",
+			body:     `{"asset_id":"asset-2","asset_value":"1","ollama_inference_input":{"messages":[{"role":"user","content":"hello"}]}}`,
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "unknown asset openai",
+			path:     "/v1/chat/completions",
+			body:     `{"model":"other","messages":[{"role":"user","content":"hello"}]}`,
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "wrong asset value",
+			path:     "/inference",
+			body:     `{"asset_id":"asset-1","asset_value":"0.5","ollama_inference_input":{"messages":[{"role":"user","content":"hello"}]}}`,
+			wantCode: http.StatusPaymentRequired,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := serveTestRequest(router, tt.path, tt.body); w.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+		})
+	}
+}
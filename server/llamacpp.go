@@ -0,0 +1,35 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// LlamaCppBackend serves inference from llama.cpp's llama-server, which exposes
+// the OpenAI API alongside its own health endpoint
+type LlamaCppBackend struct {
+	*OpenAICompatBackend
+}
+
+func NewLlamaCppBackend(baseURL string) *LlamaCppBackend {
+	return &LlamaCppBackend{OpenAICompatBackend: NewOpenAICompatBackend(baseURL, "")}
+}
+
+// Health reports llama-server as unhealthy while its model is still loading
+func (b *LlamaCppBackend) Health() error {
+	healthURL, err := url.JoinPath(b.BaseURL, "/health")
+	if err != nil {
+		return fmt.Errorf("error joining URL path: %v", err)
+	}
+
+	resp, err := http.Get(healthURL)
+	if err != nil {
+		return fmt.Errorf("llama-server is unreachable: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return backendError(resp)
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"depin-server/db"
+	"depin-server/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// assetManifestFile is the manifest written to the upload directory of an asset made of
+// several files, and minted as the NFT of the asset
+const assetManifestFile = ".manifest.json"
+
+// assetManifest lists the files of an asset with their size and checksum, so that the NFT
+// minted from it pins the content of every file
+type assetManifest struct {
+	AssetName string         `json:"assetName"`
+	AssetType string         `json:"assetType"`
+	Files     []db.AssetFile `json:"files"`
+}
+
+// hashAssetFiles returns the size and SHA-256 of the files of an asset, given by their
+// path relative to uploadDir. Checksums already known, such as those verified while
+// downloading, are taken from checksums instead of hashing the file again.
+func hashAssetFiles(uploadDir string, paths []string, checksums map[string]string) ([]db.AssetFile, error) {
+	files := make([]db.AssetFile, 0, len(paths))
+	for _, filePath := range paths {
+		fullPath := filepath.Join(uploadDir, filepath.FromSlash(filePath))
+		info, err := os.Stat(fullPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat %s: %v", fullPath, err)
+		}
+
+		checksum := checksums[filePath]
+		if checksum == "" {
+			if checksum, err = fileChecksum(fullPath); err != nil {
+				return nil, fmt.Errorf("failed to hash %s: %v", fullPath, err)
+			}
+		}
+		files = append(files, db.AssetFile{Path: filePath, Size: info.Size(), SHA256: checksum})
+	}
+	return files, nil
+}
+
+// writeAssetManifest writes the manifest of an asset to its upload directory and returns
+// its path
+func writeAssetManifest(uploadDir string, manifest *assetManifest) (string, error) {
+	data, err := json.MarshalIndent(manifest, "", "    ")
+	if err != nil {
+		return "", fmt.Errorf("failed to encode manifest: %v", err)
+	}
+	manifestPath := filepath.Join(uploadDir, assetManifestFile)
+	if err := os.WriteFile(manifestPath, data, 0644); err != nil {
+		return "", fmt.Errorf("failed to write %s: %v", manifestPath, err)
+	}
+	return manifestPath, nil
+}
+
+// HandleGetAssetFiles returns the manifest of an asset, listing its files
+func (s *DepinServer) HandleGetAssetFiles(c *gin.Context) {
+	asset, files, ok := s.assetFilesParam(c)
+	if !ok {
+		return
+	}
+	utils.RespondSuccess(c, "Asset files fetched successfully", &assetManifest{
+		AssetName: asset.Name,
+		AssetType: asset.Type,
+		Files:     files,
+	})
+}
+
+// HandleDownloadAssetFile serves a single file of an asset
+func (s *DepinServer) HandleDownloadAssetFile(c *gin.Context) {
+	asset, files, ok := s.assetFilesParam(c)
+	if !ok {
+		return
+	}
+
+	filePath := strings.TrimPrefix(c.Param("path"), "/")
+	var file *db.AssetFile
+	for i := range files {
+		if files[i].Path == filePath {
+			file = &files[i]
+			break
+		}
+	}
+	if file == nil {
+		utils.RespondError(c, http.StatusNotFound, "Asset file not found", nil)
+		return
+	}
+
+	fullPath := filepath.Join(assetUploadDir(asset.Type, asset.Name), filepath.FromSlash(file.Path))
+	if _, err := os.Stat(fullPath); err != nil {
+		utils.LogInfo("File %s of asset %s is missing: %v", file.Path, asset.ID, err)
+		utils.RespondError(c, http.StatusNotFound, "Asset file not found", nil)
+		return
+	}
+
+	download, ok := s.authorizeDownload(c, asset.ID)
+	if !ok {
+		return
+	}
+
+	c.Header("X-Checksum-SHA256", file.SHA256)
+	c.FileAttachment(fullPath, path.Base(file.Path))
+	utils.LogInfo("Serving file %s of asset %s", file.Path, asset.ID)
+	if c.Writer.Status() == http.StatusOK {
+		s.recordDownload(download)
+	}
+}
+
+// HandleDownloadAssetArchive streams all the files of an asset as a tar archive
+func (s *DepinServer) HandleDownloadAssetArchive(c *gin.Context) {
+	asset, files, ok := s.assetFilesParam(c)
+	if !ok {
+		return
+	}
+	download, ok := s.authorizeDownload(c, asset.ID)
+	if !ok {
+		return
+	}
+	if s.streamAssetArchive(c, asset, files) {
+		s.recordDownload(download)
+	}
+}
+
+// streamAssetArchive writes the files of an asset, and its manifest, as a tar archive, and
+// reports whether the whole archive was written
+func (s *DepinServer) streamAssetArchive(c *gin.Context, asset *db.Asset, files []db.AssetFile) bool {
+	uploadDir := assetUploadDir(asset.Type, asset.Name)
+	for _, file := range files {
+		if _, err := os.Stat(filepath.Join(uploadDir, filepath.FromSlash(file.Path))); err != nil {
+			utils.LogInfo("File %s of asset %s is missing: %v", file.Path, asset.ID, err)
+			utils.RespondError(c, http.StatusNotFound, "Asset file not found", fmt.Errorf("%s is missing", file.Path))
+			return false
+		}
+	}
+	manifest, err := json.MarshalIndent(&assetManifest{AssetName: asset.Name, AssetType: asset.Type, Files: files}, "", "    ")
+	if err != nil {
+		utils.RespondError(c, http.StatusInternalServerError, "Failed to encode manifest", err)
+		return false
+	}
+
+	c.Header("Content-Type", "application/x-tar")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", asset.Name+".tar"))
+	c.Status(http.StatusOK)
+
+	// The status is sent once the archive starts, a truncated archive signals a failure
+	archive := tar.NewWriter(c.Writer)
+	if err := archive.WriteHeader(&tar.Header{Name: assetManifestFile, Mode: 0644, Size: int64(len(manifest))}); err != nil {
+		utils.LogInfo("Error writing archive of asset %s: %v", asset.ID, err)
+		return false
+	}
+	if _, err := archive.Write(manifest); err != nil {
+		utils.LogInfo("Error writing archive of asset %s: %v", asset.ID, err)
+		return false
+	}
+	for _, file := range files {
+		if err := writeArchiveFile(archive, filepath.Join(uploadDir, filepath.FromSlash(file.Path)), file); err != nil {
+			utils.LogInfo("Error writing %s to archive of asset %s: %v", file.Path, asset.ID, err)
+			return false
+		}
+	}
+	if err := archive.Close(); err != nil {
+		utils.LogInfo("Error writing archive of asset %s: %v", asset.ID, err)
+		return false
+	}
+	utils.LogInfo("Served archive of asset %s (%d files)", asset.ID, len(files))
+	return true
+}
+
+func writeArchiveFile(archive *tar.Writer, fullPath string, file db.AssetFile) error {
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	header := &tar.Header{
+		Name:    file.Path,
+		Mode:    0644,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(archive, f)
+	return err
+}
+
+// assetFilesParam fetches the asset of the request and its files. Assets registered before
+// files were tracked are reported as not found.
+func (s *DepinServer) assetFilesParam(c *gin.Context) (*db.Asset, []db.AssetFile, bool) {
+	assetID := c.Param("assetId")
+	asset, err := db.GetAsset(s.Storage, assetID)
+	if err != nil {
+		utils.LogInfo("Error fetching asset: %v", err)
+		utils.RespondError(c, http.StatusInternalServerError, "Failed to fetch asset", err)
+		return nil, nil, false
+	}
+	if asset == nil {
+		utils.RespondError(c, http.StatusNotFound, "Asset not found", nil)
+		return nil, nil, false
+	}
+
+	files, err := db.GetAssetFiles(s.Storage, assetID)
+	if err != nil {
+		utils.LogInfo("Error fetching asset files: %v", err)
+		utils.RespondError(c, http.StatusInternalServerError, "Failed to fetch asset files", err)
+		return nil, nil, false
+	}
+	if len(files) == 0 {
+		utils.RespondError(c, http.StatusNotFound, "Asset has no tracked files", nil)
+		return nil, nil, false
+	}
+	return asset, files, true
+}
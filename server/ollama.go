@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// OllamaBackend serves inference from an Ollama server. Its responses are
+// already in the Ollama format and are passed through unchanged.
+type OllamaBackend struct {
+	BaseURL string
+}
+
+func NewOllamaBackend(baseURL string) *OllamaBackend {
+	return &OllamaBackend{BaseURL: baseURL}
+}
+
+func (b *OllamaBackend) Chat(ctx context.Context, input *InferenceInput) (*BackendResponse, error) {
+	return b.post(ctx, "/api/chat", input)
+}
+
+func (b *OllamaBackend) Generate(ctx context.Context, req *GenerateRequest) (*BackendResponse, error) {
+	return b.post(ctx, "/api/generate", req)
+}
+
+func (b *OllamaBackend) Embed(ctx context.Context, req *EmbedRequest) (*EmbedResponse, error) {
+	resp, err := b.post(ctx, "/api/embed", req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("embedding failed with status %d", resp.StatusCode)
+	}
+
+	var embedResp EmbedResponse
+	if err := json.NewDecoder(resp.Body).Decode(&embedResp); err != nil {
+		return nil, fmt.Errorf("failed to decode embed response: %v", err)
+	}
+	return &embedResp, nil
+}
+
+func (b *OllamaBackend) ListModels() ([]string, error) {
+	tags, err := b.tags()
+	if err != nil {
+		return nil, err
+	}
+
+	models := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		models = append(models, tag.Name)
+	}
+	return models, nil
+}
+
+// ModelDigest returns the digest of a local model, which changes whenever the
+// model behind the tag is replaced
+func (b *OllamaBackend) ModelDigest(model string) (string, error) {
+	tags, err := b.tags()
+	if err != nil {
+		return "", err
+	}
+
+	for _, tag := range tags {
+		if tag.Name == normalizeModelTag(model) {
+			return tag.Digest, nil
+		}
+	}
+	return "", fmt.Errorf("model %s not found", model)
+}
+
+type ollamaTag struct {
+	Name   string `json:"name"`
+	Digest string `json:"digest"`
+}
+
+func (b *OllamaBackend) tags() ([]ollamaTag, error) {
+	var tags struct {
+		Models []ollamaTag `json:"models"`
+	}
+	if err := b.getJSON("/api/tags", &tags); err != nil {
+		return nil, fmt.Errorf("error listing Ollama models: %v", err)
+	}
+	return tags.Models, nil
+}
+
+// LoadedModels returns the models Ollama holds in memory, which answer without being
+// read from disk first. ListModels returns all the installed models.
+func (b *OllamaBackend) LoadedModels() ([]string, error) {
+	var running struct {
+		Models []ollamaTag `json:"models"`
+	}
+	if err := b.getJSON("/api/ps", &running); err != nil {
+		return nil, fmt.Errorf("error listing loaded Ollama models: %v", err)
+	}
+
+	models := make([]string, 0, len(running.Models))
+	for _, model := range running.Models {
+		models = append(models, model.Name)
+	}
+	return models, nil
+}
+
+func (b *OllamaBackend) getJSON(path string, v any) error {
+	endpoint, err := url.JoinPath(b.BaseURL, path)
+	if err != nil {
+		return fmt.Errorf("error joining URL path: %v", err)
+	}
+
+	resp, err := http.Get(endpoint)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return backendError(resp)
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+	return nil
+}
+
+func (b *OllamaBackend) Health() error {
+	versionURL, err := url.JoinPath(b.BaseURL, "/api/version")
+	if err != nil {
+		return fmt.Errorf("error joining URL path: %v", err)
+	}
+
+	resp, err := http.Get(versionURL)
+	if err != nil {
+		return fmt.Errorf("Ollama is unreachable: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return backendError(resp)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (b *OllamaBackend) post(ctx context.Context, path string, body any) (*BackendResponse, error) {
+	endpoint, err := url.JoinPath(b.BaseURL, path)
+	if err != nil {
+		return nil, fmt.Errorf("error joining URL path: %v", err)
+	}
+
+	bodyBytes, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal Ollama request: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewBuffer(bodyBytes))
+	if err != nil {
+		return nil, fmt.Errorf("error creating HTTP request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return rawBackendResponse(resp), nil
+}
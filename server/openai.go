@@ -0,0 +1,360 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"depin-server/db"
+	"depin-server/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Headers carrying the DePIN billing fields for OpenAI-compatible clients
+// which cannot add custom fields to the request body
+const (
+	headerDepinDid        = "X-Depin-Did"
+	headerDepinTimestamp  = "X-Depin-Timestamp"
+	headerDepinSignature  = "X-Depin-Signature"
+	headerDepinAssetID    = "X-Depin-Asset-Id"
+	headerDepinAssetValue = "X-Depin-Asset-Value"
+)
+
+// DepinBilling is the extension object accepted in OpenAI-compatible request bodies
+type DepinBilling struct {
+	Did        string `json:"did"`
+	Timestamp  string `json:"timestamp"`
+	Signature  string `json:"signature"`
+	AssetID    string `json:"asset_id"`
+	AssetValue string `json:"asset_value"`
+	Cache      bool   `json:"cache,omitempty"`
+}
+
+type OpenAIChatRequest struct {
+	Model            string                `json:"model"`
+	Messages         []*Message            `json:"messages"`
+	Stream           bool                  `json:"stream"`
+	Temperature      *float64              `json:"temperature,omitempty"`
+	TopP             *float64              `json:"top_p,omitempty"`
+	Seed             *int                  `json:"seed,omitempty"`
+	MaxTokens        *int                  `json:"max_tokens,omitempty"`
+	PresencePenalty  *float64              `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64              `json:"frequency_penalty,omitempty"`
+	Stop             stopSequences         `json:"stop,omitempty"`
+	ResponseFormat   *OpenAIResponseFormat `json:"response_format,omitempty"`
+	Tools            []*Tool               `json:"tools,omitempty"`
+	Depin            *DepinBilling         `json:"depin,omitempty"`
+}
+
+// OpenAIResponseFormat selects plain text, JSON or JSON schema constrained output
+type OpenAIResponseFormat struct {
+	Type       string            `json:"type"`
+	JSONSchema *OpenAIJSONSchema `json:"json_schema,omitempty"`
+}
+
+type OpenAIJSONSchema struct {
+	Name   string          `json:"name"`
+	Schema json.RawMessage `json:"schema"`
+}
+
+// stopSequences accepts the OpenAI "stop" field as either a string or a list of strings
+type stopSequences []string
+
+func (s *stopSequences) UnmarshalJSON(data []byte) error {
+	var stop string
+	if err := json.Unmarshal(data, &stop); err == nil {
+		*s = stopSequences{stop}
+		return nil
+	}
+
+	var stops []string
+	if err := json.Unmarshal(data, &stops); err != nil {
+		return errors.New("stop must be a string or a list of strings")
+	}
+	*s = stops
+	return nil
+}
+
+type OpenAIChatCompletion struct {
+	ID      string          `json:"id"`
+	Object  string          `json:"object"`
+	Created int64           `json:"created"`
+	Model   string          `json:"model"`
+	Choices []*OpenAIChoice `json:"choices"`
+	Usage   *OpenAIUsage    `json:"usage,omitempty"`
+}
+
+type OpenAIChoice struct {
+	Index        int            `json:"index"`
+	Message      *OpenAIMessage `json:"message,omitempty"`
+	Delta        *OpenAIMessage `json:"delta,omitempty"`
+	FinishReason *string        `json:"finish_reason"`
+}
+
+type OpenAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type OpenAIError struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+}
+
+// Types of the errors reported in the OpenAI format
+const (
+	errTypeInvalidRequest = "invalid_request_error"
+	errTypeAuthentication = "authentication_error"
+	errTypeRateLimit      = "rate_limit_error"
+	errTypeBackend        = "backend_error"
+	errTypeServer         = "server_error"
+)
+
+// HandleChatCompletions serves the OpenAI chat-completions schema on top of the
+// inference backends, so that existing OpenAI SDKs can target a DePIN node unchanged
+func (s *DepinServer) HandleChatCompletions(c *gin.Context) {
+	inputReqBytes, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		utils.LogInfo("Error reading request body: %v", err)
+		respondOpenAIError(c, http.StatusBadRequest, "Invalid request body", errTypeInvalidRequest)
+		return
+	}
+
+	var chatReq OpenAIChatRequest
+	if err := json.Unmarshal(inputReqBytes, &chatReq); err != nil {
+		utils.LogInfo("Error unmarshalling chat completion request: %v", err)
+		respondOpenAIError(c, http.StatusBadRequest, "Invalid request format: "+err.Error(), errTypeInvalidRequest)
+		return
+	}
+
+	inferenceReq := chatReq.toInferenceReq(c)
+	var signed signedMessages
+	if err := json.Unmarshal(inputReqBytes, &signed); err == nil {
+		inferenceReq.SignedMessages = signed.Messages
+	}
+
+	s.serveInference(c, inferenceReq, openAIResponder{})
+}
+
+// openAIResponder converts backend responses to the OpenAI chat-completions format
+type openAIResponder struct{}
+
+func (openAIResponder) Error(c *gin.Context, code int, message string, errType string, err error) {
+	if err != nil {
+		message += ": " + err.Error()
+	}
+	respondOpenAIError(c, code, message, errType)
+}
+
+func (openAIResponder) BackendError(c *gin.Context, resp *BackendResponse, body []byte) {
+	respondOpenAIError(c, resp.StatusCode, "Inference backend error: "+string(body), errTypeBackend)
+}
+
+func (openAIResponder) Stream(ctx context.Context, c *gin.Context, resp *BackendResponse, record *db.InferenceRecord) string {
+	return relayChatCompletionStream(ctx, c, resp, record, openAICompletionID(record))
+}
+
+func (openAIResponder) Complete(c *gin.Context, resp *BackendResponse, body []byte, chatResp *ChatResponse, record *db.InferenceRecord) {
+	finishReason := openAIFinishReason(chatResp.DoneReason, record.ToolCallCount > 0)
+	c.JSON(http.StatusOK, &OpenAIChatCompletion{
+		ID:      openAICompletionID(record),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   chatResp.Model,
+		Choices: []*OpenAIChoice{
+			{
+				Index:        0,
+				Message:      toOpenAIMessage(chatResp.Message),
+				FinishReason: &finishReason,
+			},
+		},
+		Usage: openAIUsage(chatResp),
+	})
+}
+
+// openAICompletionID derives the completion ID from the inference record
+func openAICompletionID(record *db.InferenceRecord) string {
+	return "chatcmpl-" + record.ID
+}
+
+// relayChatCompletionStream converts the Ollama NDJSON stream into OpenAI
+// chat.completion.chunk SSE events, terminated by "data: [DONE]", and returns the
+// outcome of the stream
+func relayChatCompletionStream(ctx context.Context, c *gin.Context, resp *BackendResponse, record *db.InferenceRecord, completionID string) string {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Status(http.StatusOK)
+
+	created := time.Now().Unix()
+
+	return relayChunks(ctx, c, resp.Body, record, func(line []byte, done bool) error {
+		var chatResp ChatResponse
+		if err := json.Unmarshal(line, &chatResp); err != nil {
+			return err
+		}
+
+		choice := &OpenAIChoice{Index: 0, Delta: toOpenAIMessage(chatResp.Message)}
+
+		chunk := &OpenAIChatCompletion{
+			ID:      completionID,
+			Object:  "chat.completion.chunk",
+			Created: created,
+			Model:   chatResp.Model,
+			Choices: []*OpenAIChoice{choice},
+		}
+		if done {
+			finishReason := openAIFinishReason(chatResp.DoneReason, record.ToolCallCount > 0)
+			choice.FinishReason = &finishReason
+			chunk.Usage = openAIUsage(&chatResp)
+		}
+
+		if err := writeSSEData(c.Writer, chunk); err != nil {
+			return err
+		}
+		if done {
+			_, err := io.WriteString(c.Writer, "data: [DONE]\n\n")
+			return err
+		}
+		return nil
+	})
+}
+
+// toInferenceReq maps an OpenAI chat request onto the native inference request.
+// Billing fields in the "depin" extension object take precedence over headers,
+// and the asset ID defaults to the model name without its ":latest" tag.
+func (r *OpenAIChatRequest) toInferenceReq(c *gin.Context) *HandleInferenceReq {
+	billing := r.Depin
+	if billing == nil {
+		billing = &DepinBilling{}
+	}
+
+	return &HandleInferenceReq{
+		OllamaInferenceInput: &InferenceInput{
+			Model:    r.Model,
+			Messages: r.Messages,
+			Stream:   r.Stream,
+			Options:  r.ollamaOptions(),
+			Format:   r.ollamaFormat(),
+			Tools:    r.Tools,
+		},
+		Did:        firstNonEmpty(billing.Did, c.GetHeader(headerDepinDid)),
+		Timestamp:  firstNonEmpty(billing.Timestamp, c.GetHeader(headerDepinTimestamp)),
+		Signature:  firstNonEmpty(billing.Signature, c.GetHeader(headerDepinSignature)),
+		AssetID:    firstNonEmpty(billing.AssetID, c.GetHeader(headerDepinAssetID), strings.TrimSuffix(r.Model, ":latest")),
+		AssetValue: firstNonEmpty(billing.AssetValue, c.GetHeader(headerDepinAssetValue)),
+		Cache:      wantsCache(c, billing),
+	}
+}
+
+// ollamaOptions maps the OpenAI sampling parameters onto Ollama options
+func (r *OpenAIChatRequest) ollamaOptions() map[string]any {
+	options := make(map[string]any)
+	setOption := func(name string, value *float64) {
+		if value != nil {
+			options[name] = *value
+		}
+	}
+	setOption("temperature", r.Temperature)
+	setOption("top_p", r.TopP)
+	setOption("presence_penalty", r.PresencePenalty)
+	setOption("frequency_penalty", r.FrequencyPenalty)
+	if r.Seed != nil {
+		options["seed"] = float64(*r.Seed)
+	}
+	if r.MaxTokens != nil {
+		options["num_predict"] = float64(*r.MaxTokens)
+	}
+	if len(r.Stop) > 0 {
+		stops := make([]any, len(r.Stop))
+		for i, stop := range r.Stop {
+			stops[i] = stop
+		}
+		options["stop"] = stops
+	}
+
+	if len(options) == 0 {
+		return nil
+	}
+	return options
+}
+
+// ollamaFormat maps the OpenAI response format onto the Ollama format field. Unknown
+// types are passed on by name so that validation rejects them.
+func (r *OpenAIChatRequest) ollamaFormat() json.RawMessage {
+	if r.ResponseFormat == nil {
+		return nil
+	}
+
+	switch r.ResponseFormat.Type {
+	case "", "text":
+		return nil
+	case "json_object":
+		return json.RawMessage(`"json"`)
+	case "json_schema":
+		if r.ResponseFormat.JSONSchema != nil {
+			return r.ResponseFormat.JSONSchema.Schema
+		}
+	}
+	format, _ := json.Marshal(r.ResponseFormat.Type)
+	return format
+}
+
+// openAIFinishReason maps the Ollama done reason, which is "stop" even when the model
+// called tools, onto the OpenAI finish reason
+func openAIFinishReason(doneReason string, toolCalls bool) string {
+	if toolCalls {
+		return "tool_calls"
+	}
+	if doneReason == "" {
+		return "stop"
+	}
+	return doneReason
+}
+
+func openAIUsage(chatResp *ChatResponse) *OpenAIUsage {
+	return &OpenAIUsage{
+		PromptTokens:     chatResp.PromptEvalCount,
+		CompletionTokens: chatResp.EvalCount,
+		TotalTokens:      chatResp.PromptEvalCount + chatResp.EvalCount,
+	}
+}
+
+func writeSSEData(w io.Writer, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, "data: "); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n\n")
+	return err
+}
+
+func respondOpenAIError(c *gin.Context, code int, message string, errType string) {
+	c.JSON(code, gin.H{
+		"error": &OpenAIError{
+			Message: message,
+			Type:    errType,
+		},
+	})
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
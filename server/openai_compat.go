@@ -0,0 +1,477 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"depin-server/constants"
+)
+
+// OpenAICompatBackend serves inference from any server implementing the OpenAI
+// API, such as vLLM or LocalAI. Responses are translated to the Ollama format.
+type OpenAICompatBackend struct {
+	BaseURL string
+	APIKey  string
+}
+
+func NewOpenAICompatBackend(baseURL string, apiKey string) *OpenAICompatBackend {
+	return &OpenAICompatBackend{BaseURL: baseURL, APIKey: apiKey}
+}
+
+type openAIStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type openAICompatChatRequest struct {
+	Model            string                `json:"model"`
+	Messages         []any                 `json:"messages"`
+	Stream           bool                  `json:"stream"`
+	StreamOptions    *openAIStreamOptions  `json:"stream_options,omitempty"`
+	Temperature      any                   `json:"temperature,omitempty"`
+	TopP             any                   `json:"top_p,omitempty"`
+	Seed             any                   `json:"seed,omitempty"`
+	MaxTokens        any                   `json:"max_tokens,omitempty"`
+	PresencePenalty  any                   `json:"presence_penalty,omitempty"`
+	FrequencyPenalty any                   `json:"frequency_penalty,omitempty"`
+	Stop             any                   `json:"stop,omitempty"`
+	ResponseFormat   *OpenAIResponseFormat `json:"response_format,omitempty"`
+	Tools            []*Tool               `json:"tools,omitempty"`
+}
+
+type openAICompatCompletionRequest struct {
+	Model         string               `json:"model"`
+	Prompt        string               `json:"prompt"`
+	Stream        bool                 `json:"stream"`
+	StreamOptions *openAIStreamOptions `json:"stream_options,omitempty"`
+}
+
+type openAICompletion struct {
+	Model   string `json:"model"`
+	Choices []struct {
+		Text         string  `json:"text"`
+		FinishReason *string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *OpenAIUsage `json:"usage,omitempty"`
+}
+
+// openAIStreamEvent is the part of an OpenAI stream event needed to build Ollama chunks
+type openAIStreamEvent struct {
+	Model        string
+	Content      string
+	ToolCalls    []*OpenAIToolCall
+	FinishReason string
+	Usage        *OpenAIUsage
+}
+
+func (b *OpenAICompatBackend) Chat(ctx context.Context, input *InferenceInput) (*BackendResponse, error) {
+	// Options without an OpenAI equivalent, such as num_ctx or keep_alive, are
+	// configured on the runtime itself and are not forwarded
+	chatReq := &openAICompatChatRequest{
+		Model:            input.Model,
+		Messages:         openAIMessages(input.Messages),
+		Stream:           input.Stream,
+		Temperature:      input.Options["temperature"],
+		TopP:             input.Options["top_p"],
+		Seed:             input.Options["seed"],
+		MaxTokens:        input.Options["num_predict"],
+		PresencePenalty:  input.Options["presence_penalty"],
+		FrequencyPenalty: input.Options["frequency_penalty"],
+		Stop:             input.Options["stop"],
+		ResponseFormat:   openAIResponseFormat(input.Format),
+		Tools:            input.Tools,
+	}
+	if numPredict, ok := chatReq.MaxTokens.(float64); ok && numPredict < 0 {
+		// Ollama uses negative values for unlimited generation
+		chatReq.MaxTokens = nil
+	}
+	if input.Stream {
+		chatReq.StreamOptions = &openAIStreamOptions{IncludeUsage: true}
+	}
+
+	start := time.Now()
+	resp, err := b.post(ctx, "/v1/chat/completions", chatReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return rawBackendResponse(resp), nil
+	}
+
+	if input.Stream {
+		return translateOpenAIStream(resp.Body, parseChatStreamEvent, func(event *openAIStreamEvent, done bool, usage InferenceUsage) any {
+			chunk := &ChatResponse{
+				Model:     event.Model,
+				CreatedAt: time.Now().UTC().Format(time.RFC3339Nano),
+				Message:   &Message{Role: constants.MESSAGE_ROLE_ASSISTANT, Content: event.Content},
+				Done:      done,
+			}
+			if done {
+				chunk.Message.ToolCalls = toolCallsFromOpenAI(event.ToolCalls)
+				chunk.DoneReason = event.FinishReason
+				chunk.InferenceUsage = usage
+			}
+			return chunk
+		}, start), nil
+	}
+
+	defer resp.Body.Close()
+	var completion OpenAIChatCompletion
+	if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+		return nil, fmt.Errorf("failed to decode chat completion: %v", err)
+	}
+
+	chatResp := &ChatResponse{
+		Model:     completion.Model,
+		CreatedAt: time.Unix(completion.Created, 0).UTC().Format(time.RFC3339Nano),
+		Message:   &Message{Role: constants.MESSAGE_ROLE_ASSISTANT},
+		Done:      true,
+	}
+	if len(completion.Choices) > 0 {
+		if completion.Choices[0].Message != nil {
+			chatResp.Message = fromOpenAIMessage(completion.Choices[0].Message)
+			chatResp.Message.Role = constants.MESSAGE_ROLE_ASSISTANT
+		}
+		if completion.Choices[0].FinishReason != nil {
+			chatResp.DoneReason = *completion.Choices[0].FinishReason
+		}
+	}
+	chatResp.InferenceUsage = usageFromOpenAI(completion.Usage, time.Since(start))
+
+	return jsonBackendResponse(chatResp)
+}
+
+// openAIMessages converts messages for OpenAI-compatible runtimes, which expect images
+// as data URL content parts rather than a separate list, and tool call arguments as strings
+func openAIMessages(messages []*Message) []any {
+	converted := make([]any, len(messages))
+	for i, message := range messages {
+		if len(message.Images) == 0 && len(message.ToolCalls) == 0 {
+			converted[i] = message
+			continue
+		}
+
+		openAIMessage := map[string]any{
+			"role":    message.Role,
+			"content": message.Content,
+		}
+		if len(message.Images) > 0 {
+			parts := []*openAIContentPart{{Type: openAIContentText, Text: message.Content}}
+			for _, image := range message.Images {
+				parts = append(parts, &openAIContentPart{
+					Type:     openAIContentImageURL,
+					ImageURL: &openAIImageURL{URL: "data:" + imageMediaType(image) + dataURLBase64Marker + image},
+				})
+			}
+			openAIMessage["content"] = parts
+		}
+		if len(message.ToolCalls) > 0 {
+			openAIMessage["tool_calls"] = toOpenAIMessage(message).ToolCalls
+		}
+		converted[i] = openAIMessage
+	}
+	return converted
+}
+
+// openAIResponseFormat maps the Ollama format field onto the OpenAI response format
+func openAIResponseFormat(format json.RawMessage) *OpenAIResponseFormat {
+	if len(format) == 0 {
+		return nil
+	}
+	if string(format) == `"json"` {
+		return &OpenAIResponseFormat{Type: "json_object"}
+	}
+	return &OpenAIResponseFormat{
+		Type:       "json_schema",
+		JSONSchema: &OpenAIJSONSchema{Name: "response", Schema: format},
+	}
+}
+
+func (b *OpenAICompatBackend) Generate(ctx context.Context, req *GenerateRequest) (*BackendResponse, error) {
+	completionReq := &openAICompatCompletionRequest{
+		Model:  req.Model,
+		Prompt: req.Prompt,
+		Stream: req.Stream,
+	}
+	if req.System != "" {
+		completionReq.Prompt = req.System + "\n\n" + req.Prompt
+	}
+	if req.Stream {
+		completionReq.StreamOptions = &openAIStreamOptions{IncludeUsage: true}
+	}
+
+	start := time.Now()
+	resp, err := b.post(ctx, "/v1/completions", completionReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return rawBackendResponse(resp), nil
+	}
+
+	if req.Stream {
+		return translateOpenAIStream(resp.Body, parseCompletionStreamEvent, func(event *openAIStreamEvent, done bool, usage InferenceUsage) any {
+			chunk := &GenerateResponse{
+				Model:     event.Model,
+				CreatedAt: time.Now().UTC().Format(time.RFC3339Nano),
+				Response:  event.Content,
+				Done:      done,
+			}
+			if done {
+				chunk.DoneReason = event.FinishReason
+				chunk.InferenceUsage = usage
+			}
+			return chunk
+		}, start), nil
+	}
+
+	defer resp.Body.Close()
+	var completion openAICompletion
+	if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+		return nil, fmt.Errorf("failed to decode completion: %v", err)
+	}
+
+	generateResp := &GenerateResponse{
+		Model:     completion.Model,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339Nano),
+		Done:      true,
+	}
+	if len(completion.Choices) > 0 {
+		generateResp.Response = completion.Choices[0].Text
+		if completion.Choices[0].FinishReason != nil {
+			generateResp.DoneReason = *completion.Choices[0].FinishReason
+		}
+	}
+	generateResp.InferenceUsage = usageFromOpenAI(completion.Usage, time.Since(start))
+
+	return jsonBackendResponse(generateResp)
+}
+
+func (b *OpenAICompatBackend) Embed(ctx context.Context, req *EmbedRequest) (*EmbedResponse, error) {
+	resp, err := b.post(ctx, "/v1/embeddings", req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, backendError(resp)
+	}
+	defer resp.Body.Close()
+
+	var embeddings struct {
+		Model string `json:"model"`
+		Data  []struct {
+			Index     int       `json:"index"`
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&embeddings); err != nil {
+		return nil, fmt.Errorf("failed to decode embeddings: %v", err)
+	}
+
+	embedResp := &EmbedResponse{
+		Model:      embeddings.Model,
+		Embeddings: make([][]float64, len(embeddings.Data)),
+	}
+	for _, data := range embeddings.Data {
+		if data.Index < 0 || data.Index >= len(embedResp.Embeddings) {
+			return nil, fmt.Errorf("embedding index %d is out of range", data.Index)
+		}
+		embedResp.Embeddings[data.Index] = data.Embedding
+	}
+	return embedResp, nil
+}
+
+func (b *OpenAICompatBackend) ListModels() ([]string, error) {
+	resp, err := b.get("/v1/models")
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, backendError(resp)
+	}
+	defer resp.Body.Close()
+
+	var modelList struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&modelList); err != nil {
+		return nil, fmt.Errorf("failed to decode model list: %v", err)
+	}
+
+	models := make([]string, 0, len(modelList.Data))
+	for _, model := range modelList.Data {
+		models = append(models, model.ID)
+	}
+	return models, nil
+}
+
+// Health probes the model list, which every OpenAI-compatible server implements
+func (b *OpenAICompatBackend) Health() error {
+	_, err := b.ListModels()
+	return err
+}
+
+func (b *OpenAICompatBackend) get(path string) (*http.Response, error) {
+	return b.do(context.Background(), http.MethodGet, path, nil)
+}
+
+func (b *OpenAICompatBackend) post(ctx context.Context, path string, body any) (*http.Response, error) {
+	bodyBytes, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	}
+	return b.do(ctx, http.MethodPost, path, bodyBytes)
+}
+
+func (b *OpenAICompatBackend) do(ctx context.Context, method string, path string, body []byte) (*http.Response, error) {
+	endpoint, err := url.JoinPath(b.BaseURL, path)
+	if err != nil {
+		return nil, fmt.Errorf("error joining URL path: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("error creating HTTP request: %v", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if b.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+b.APIKey)
+	}
+
+	return http.DefaultClient.Do(req)
+}
+
+func parseChatStreamEvent(data []byte) (*openAIStreamEvent, error) {
+	var chunk OpenAIChatCompletion
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return nil, err
+	}
+
+	event := &openAIStreamEvent{Model: chunk.Model, Usage: chunk.Usage}
+	if len(chunk.Choices) > 0 {
+		if chunk.Choices[0].Delta != nil {
+			event.Content = chunk.Choices[0].Delta.Content
+			event.ToolCalls = chunk.Choices[0].Delta.ToolCalls
+		}
+		if chunk.Choices[0].FinishReason != nil {
+			event.FinishReason = *chunk.Choices[0].FinishReason
+		}
+	}
+	return event, nil
+}
+
+func parseCompletionStreamEvent(data []byte) (*openAIStreamEvent, error) {
+	var chunk openAICompletion
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return nil, err
+	}
+
+	event := &openAIStreamEvent{Model: chunk.Model, Usage: chunk.Usage}
+	if len(chunk.Choices) > 0 {
+		event.Content = chunk.Choices[0].Text
+		if chunk.Choices[0].FinishReason != nil {
+			event.FinishReason = *chunk.Choices[0].FinishReason
+		}
+	}
+	return event, nil
+}
+
+// translateOpenAIStream converts an OpenAI SSE stream into Ollama NDJSON chunks built by
+// toChunk. The final "done" chunk is emitted once the stream reports [DONE], carrying the
+// finish reason and usage; a stream ending without it is closed with an error.
+func translateOpenAIStream(
+	body io.ReadCloser,
+	parse func(data []byte) (*openAIStreamEvent, error),
+	toChunk func(event *openAIStreamEvent, done bool, usage InferenceUsage) any,
+	start time.Time,
+) *BackendResponse {
+	pr, pw := io.Pipe()
+
+	go func() {
+		defer body.Close()
+
+		final := &openAIStreamEvent{}
+		var usage *OpenAIUsage
+		enc := json.NewEncoder(pw)
+
+		scanner := bufio.NewScanner(body)
+		scanner.Buffer(make([]byte, 0, 64*1024), maxStreamChunkSize)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(strings.TrimSpace(scanner.Text()), "data:")
+			if !ok {
+				continue
+			}
+			data = strings.TrimSpace(data)
+
+			if data == "[DONE]" {
+				if final.FinishReason == "" {
+					final.FinishReason = "stop"
+				}
+				final.Content = ""
+				pw.CloseWithError(enc.Encode(toChunk(final, true, usageFromOpenAI(usage, time.Since(start)))))
+				return
+			}
+
+			event, err := parse([]byte(data))
+			if err != nil {
+				pw.CloseWithError(fmt.Errorf("failed to parse stream event: %v", err))
+				return
+			}
+			if event.Model != "" {
+				final.Model = event.Model
+			}
+			if event.FinishReason != "" {
+				final.FinishReason = event.FinishReason
+			}
+			if event.Usage != nil {
+				usage = event.Usage
+			}
+			// Tool calls arrive in fragments, they are emitted whole with the final chunk
+			final.ToolCalls = mergeToolCallDeltas(final.ToolCalls, event.ToolCalls)
+			if event.Content == "" {
+				continue
+			}
+			if err := enc.Encode(toChunk(event, false, InferenceUsage{})); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(io.ErrUnexpectedEOF)
+	}()
+
+	return &BackendResponse{
+		StatusCode:  http.StatusOK,
+		ContentType: "application/x-ndjson",
+		Body:        pr,
+	}
+}
+
+// usageFromOpenAI maps OpenAI token counts onto Ollama usage. OpenAI servers do not
+// report timings, so the elapsed wall time stands in for both durations.
+func usageFromOpenAI(usage *OpenAIUsage, elapsed time.Duration) InferenceUsage {
+	inferenceUsage := InferenceUsage{
+		TotalDuration: elapsed.Nanoseconds(),
+		EvalDuration:  elapsed.Nanoseconds(),
+	}
+	if usage != nil {
+		inferenceUsage.PromptEvalCount = usage.PromptTokens
+		inferenceUsage.EvalCount = usage.CompletionTokens
+	}
+	return inferenceUsage
+}
@@ -0,0 +1,282 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"depin-server/db"
+	"depin-server/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultGenerationTimeout bounds inferences of assets without a generation time limit
+const defaultGenerationTimeout = 10 * time.Minute
+
+// optionRange is the valid range of a numeric Ollama option
+type optionRange struct {
+	min, max float64
+	integer  bool
+}
+
+// inferenceOptions are the Ollama model parameters clients may set. Runtime options such
+// as num_gpu, num_thread or use_mmap tune the node's hardware and are left to the operator.
+var inferenceOptions = map[string]optionRange{
+	"num_keep":          {min: -1, max: math.MaxInt32, integer: true},
+	"seed":              {min: math.MinInt32, max: math.MaxInt32, integer: true},
+	"num_predict":       {min: -2, max: math.MaxInt32, integer: true},
+	"num_ctx":           {min: 1, max: math.MaxInt32, integer: true},
+	"top_k":             {min: 0, max: math.MaxInt32, integer: true},
+	"top_p":             {min: 0, max: 1},
+	"min_p":             {min: 0, max: 1},
+	"typical_p":         {min: 0, max: 1},
+	"repeat_last_n":     {min: -1, max: math.MaxInt32, integer: true},
+	"temperature":       {min: 0, max: 2},
+	"repeat_penalty":    {min: 0, max: math.MaxFloat64},
+	"presence_penalty":  {min: -2, max: 2},
+	"frequency_penalty": {min: -2, max: 2},
+	"mirostat":          {min: 0, max: 2, integer: true},
+	"mirostat_tau":      {min: 0, max: math.MaxFloat64},
+	"mirostat_eta":      {min: 0, max: math.MaxFloat64},
+}
+
+// validateInferenceOptions checks the options, format, tools and keep_alive of a request
+// against the limits of its asset. A num_predict cap is applied to requests without one.
+func validateInferenceOptions(input *InferenceInput, limits *db.AssetLimits) error {
+	for name, value := range input.Options {
+		if name == "stop" {
+			if err := validateStopOption(value); err != nil {
+				return err
+			}
+			continue
+		}
+
+		valueRange, ok := inferenceOptions[name]
+		if !ok {
+			return fmt.Errorf("option %q is not supported", name)
+		}
+		number, ok := value.(float64)
+		if !ok {
+			return fmt.Errorf("option %q must be a number", name)
+		}
+		if number < valueRange.min || number > valueRange.max {
+			return fmt.Errorf("option %q is out of range", name)
+		}
+		if valueRange.integer && number != math.Trunc(number) {
+			return fmt.Errorf("option %q must be an integer", name)
+		}
+	}
+
+	if limits.MaxNumCtx > 0 {
+		if numCtx, ok := input.Options["num_ctx"].(float64); ok && numCtx > float64(limits.MaxNumCtx) {
+			return fmt.Errorf("num_ctx exceeds the maximum of %d for this asset", limits.MaxNumCtx)
+		}
+	}
+
+	if limits.MaxNumPredict > 0 {
+		numPredict, ok := input.Options["num_predict"].(float64)
+		if ok && (numPredict < 0 || numPredict > float64(limits.MaxNumPredict)) {
+			return fmt.Errorf("num_predict exceeds the maximum of %d for this asset", limits.MaxNumPredict)
+		}
+		if !ok {
+			if input.Options == nil {
+				input.Options = make(map[string]any)
+			}
+			input.Options["num_predict"] = float64(limits.MaxNumPredict)
+		}
+	}
+
+	if err := validateFormat(input.Format); err != nil {
+		return err
+	}
+
+	for i, tool := range input.Tools {
+		if tool == nil || tool.Type != "function" || tool.Function == nil || tool.Function.Name == "" {
+			return fmt.Errorf("tool %d must be a function with a name", i)
+		}
+	}
+
+	return validateKeepAlive(input.KeepAlive, limits.MaxKeepAlive)
+}
+
+func validateStopOption(value any) error {
+	stops, ok := value.([]any)
+	if !ok {
+		return errors.New(`option "stop" must be a list of strings`)
+	}
+	for _, stop := range stops {
+		if _, ok := stop.(string); !ok {
+			return errors.New(`option "stop" must be a list of strings`)
+		}
+	}
+	return nil
+}
+
+// validateFormat accepts "json" or a JSON schema object
+func validateFormat(format json.RawMessage) error {
+	if len(format) == 0 {
+		return nil
+	}
+
+	var formatName string
+	if err := json.Unmarshal(format, &formatName); err == nil {
+		if formatName != "json" {
+			return fmt.Errorf("format %q is not supported", formatName)
+		}
+		return nil
+	}
+
+	if !bytes.HasPrefix(bytes.TrimSpace(format), []byte("{")) || !json.Valid(format) {
+		return errors.New(`format must be "json" or a JSON schema object`)
+	}
+	return nil
+}
+
+// validateKeepAlive checks that keep_alive is a duration string or a number of seconds,
+// and that it does not exceed maxSeconds. Negative values keep the model loaded forever.
+func validateKeepAlive(keepAlive json.RawMessage, maxSeconds int) error {
+	if len(keepAlive) == 0 {
+		return nil
+	}
+
+	duration, err := parseKeepAlive(keepAlive)
+	if err != nil {
+		return err
+	}
+
+	if maxSeconds > 0 && (duration < 0 || duration > time.Duration(maxSeconds)*time.Second) {
+		return fmt.Errorf("keep_alive exceeds the maximum of %ds for this asset", maxSeconds)
+	}
+	return nil
+}
+
+func parseKeepAlive(keepAlive json.RawMessage) (time.Duration, error) {
+	var seconds float64
+	if err := json.Unmarshal(keepAlive, &seconds); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+
+	var value string
+	if err := json.Unmarshal(keepAlive, &value); err != nil {
+		return 0, errors.New("keep_alive must be a duration or a number of seconds")
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid keep_alive %q", value)
+	}
+	return duration, nil
+}
+
+// assetLimits returns the limits of an asset, with the server-wide generation timeout and
+// output token cap applied where the asset sets none
+func (s *DepinServer) assetLimits(assetID string) (*db.AssetLimits, error) {
+	limits, err := db.GetAssetLimits(s.Storage, assetID)
+	if err != nil {
+		return nil, err
+	}
+
+	if limits.MaxNumPredict == 0 {
+		limits.MaxNumPredict = s.MaxOutputTokens
+	}
+	if limits.MaxGenerationTime == 0 {
+		limits.MaxGenerationTime = int(s.GenerationTimeout / time.Second)
+	}
+	return limits, nil
+}
+
+// generationContext bounds an inference by the generation time limit of its asset. The
+// context is also cancelled with parent, when the client goes away.
+func generationContext(parent context.Context, limits *db.AssetLimits) (context.Context, context.CancelFunc) {
+	if limits.MaxGenerationTime > 0 {
+		return context.WithTimeout(parent, time.Duration(limits.MaxGenerationTime)*time.Second)
+	}
+	return context.WithCancel(parent)
+}
+
+// generationLimitsFromEnv reads INFERENCE_TIMEOUT (a Go duration such as "10m", 0 for no
+// timeout) and INFERENCE_MAX_TOKENS (0 for no cap), the limits of assets without their own
+func generationLimitsFromEnv() (time.Duration, int) {
+	timeout := defaultGenerationTimeout
+	if value := os.Getenv("INFERENCE_TIMEOUT"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			utils.LogInfo("Invalid INFERENCE_TIMEOUT %q, using default of %v", value, defaultGenerationTimeout)
+		} else {
+			timeout = parsed
+		}
+	}
+
+	return timeout, intFromEnv("INFERENCE_MAX_TOKENS", 0, 0)
+}
+
+// HandleSetAssetLimits sets the bounds on the inference options clients may request for an
+// asset, it is restricted to the admin
+func (s *DepinServer) HandleSetAssetLimits(c *gin.Context) {
+	assetID := c.Param("assetId")
+	if assetID == "" {
+		utils.RespondError(c, http.StatusBadRequest, "Asset ID is required", nil)
+		return
+	}
+
+	var limits db.AssetLimits
+	if err := c.ShouldBindJSON(&limits); err != nil {
+		utils.LogInfo("Error unmarshalling asset limits request: %v", err)
+		utils.RespondError(c, http.StatusBadRequest, "Invalid request format", err)
+		return
+	}
+	limits.AssetID = assetID
+
+	if limits.MaxNumCtx < 0 || limits.MaxNumPredict < 0 || limits.MaxKeepAlive < 0 || limits.MaxGenerationTime < 0 ||
+		limits.MaxConcurrency < 0 || limits.MaxQueueDepth < 0 {
+		utils.RespondError(c, http.StatusBadRequest, "Invalid asset limits", errors.New("limits must not be negative"))
+		return
+	}
+
+	asset, err := db.GetAsset(s.Storage, assetID)
+	if err != nil {
+		utils.LogInfo("Error fetching asset %s: %v", assetID, err)
+		utils.RespondError(c, http.StatusInternalServerError, "Failed to fetch asset", err)
+		return
+	}
+	if asset == nil {
+		utils.RespondError(c, http.StatusNotFound, "Asset not found", nil)
+		return
+	}
+
+	if err := db.SetAssetLimits(s.Storage, &limits); err != nil {
+		utils.LogInfo("Error setting limits of asset %s: %v", assetID, err)
+		utils.RespondError(c, http.StatusInternalServerError, "Failed to set asset limits", err)
+		return
+	}
+
+	utils.RespondSuccess(c, "Asset limits set successfully", limits)
+}
+
+// HandleGetAssetLimits returns the bounds on the inference options of an asset
+func (s *DepinServer) HandleGetAssetLimits(c *gin.Context) {
+	assetID := c.Param("assetId")
+	if assetID == "" {
+		utils.RespondError(c, http.StatusBadRequest, "Asset ID is required", nil)
+		return
+	}
+
+	limits, err := db.GetAssetLimits(s.Storage, assetID)
+	if err != nil {
+		utils.LogInfo("Error fetching limits of asset %s: %v", assetID, err)
+		utils.RespondError(c, http.StatusInternalServerError, "Failed to fetch asset limits", err)
+		return
+	}
+
+	utils.RespondSuccess(c, "Asset limits fetched successfully", limits)
+}
@@ -0,0 +1,404 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"depin-server/utils"
+)
+
+// defaultHealthInterval is how often pool members are probed for health and models
+const defaultHealthInterval = 10 * time.Second
+
+// modelMissTTL is how long requests for a model no instance serves fail without probing
+// the instances again
+const modelMissTTL = 5 * time.Second
+
+// BackendPool balances inference over several instances of a runtime. Requests for a
+// model only go to healthy instances which have it installed, preferring those which
+// hold it loaded in memory, then the one with the fewest outstanding requests.
+// Instances are ejected when a probe or request fails and readmitted once a probe
+// succeeds again.
+type BackendPool struct {
+	mu      sync.Mutex
+	members []*poolMember
+	next    int
+	stop    chan struct{}
+	// misses holds when requested models were last found on no instance
+	misses map[string]time.Time
+
+	// refreshMu lets a single request probe the instances for a missing model at a time
+	refreshMu sync.Mutex
+}
+
+// loadedModelLister is implemented by backends which load models on demand and can
+// report the models currently loaded, such as Ollama
+type loadedModelLister interface {
+	LoadedModels() ([]string, error)
+}
+
+type poolMember struct {
+	name    string
+	backend InferenceBackend
+
+	// Guarded by the pool mutex
+	healthy     bool
+	outstanding int
+	models      map[string]bool
+	// loaded are the installed models held in memory, for runtimes reporting them
+	loaded map[string]bool
+}
+
+// NewBackendPool creates a pool over the named backends and starts probing them
+// every interval until Close is called
+func NewBackendPool(backends map[string]InferenceBackend, interval time.Duration) *BackendPool {
+	pool := &BackendPool{stop: make(chan struct{})}
+	for name, backend := range backends {
+		pool.members = append(pool.members, &poolMember{
+			name:    name,
+			backend: backend,
+			healthy: true,
+		})
+	}
+
+	for _, member := range pool.members {
+		go pool.probeLoop(member, interval)
+	}
+	return pool
+}
+
+// Close stops the health probes
+func (p *BackendPool) Close() {
+	close(p.stop)
+}
+
+func (p *BackendPool) Chat(ctx context.Context, input *InferenceInput) (*BackendResponse, error) {
+	member, err := p.acquire(input.Model)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := member.backend.Chat(ctx, input)
+	return p.track(ctx, member, resp, err)
+}
+
+func (p *BackendPool) Generate(ctx context.Context, req *GenerateRequest) (*BackendResponse, error) {
+	member, err := p.acquire(req.Model)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := member.backend.Generate(ctx, req)
+	return p.track(ctx, member, resp, err)
+}
+
+func (p *BackendPool) Embed(ctx context.Context, req *EmbedRequest) (*EmbedResponse, error) {
+	member, err := p.acquire(req.Model)
+	if err != nil {
+		return nil, err
+	}
+	defer p.release(member)
+
+	embedResp, err := member.backend.Embed(ctx, req)
+	if err != nil && ctx.Err() == nil && isTransportError(err) {
+		p.eject(member, err)
+	}
+	return embedResp, err
+}
+
+// ListModels returns the models served by at least one healthy instance
+func (p *BackendPool) ListModels() ([]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	seen := make(map[string]bool)
+	var models []string
+	for _, member := range p.members {
+		if !member.healthy {
+			continue
+		}
+		for model := range member.models {
+			if !seen[model] {
+				seen[model] = true
+				models = append(models, model)
+			}
+		}
+	}
+	return models, nil
+}
+
+// ModelDigest returns the digest of a model from a healthy instance serving it. It is
+// empty for runtimes which do not report digests.
+func (p *BackendPool) ModelDigest(model string) (string, error) {
+	member, err := p.acquire(model)
+	if err != nil {
+		return "", err
+	}
+	defer p.release(member)
+
+	digester, ok := member.backend.(modelDigester)
+	if !ok {
+		return "", nil
+	}
+	return digester.ModelDigest(model)
+}
+
+// Health reports the pool as healthy while at least one instance is
+func (p *BackendPool) Health() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, member := range p.members {
+		if member.healthy {
+			return nil
+		}
+	}
+	return errors.New("no healthy backend instance")
+}
+
+// acquire picks the instance to serve a model and counts the request as outstanding on it.
+// Model lists are refreshed if no instance is known to serve the model, as it may have
+// been created since the last probe. Misses are remembered for modelMissTTL so that
+// requests for unknown models do not probe the instances every time.
+func (p *BackendPool) acquire(model string) (*poolMember, error) {
+	if member := p.pick(model); member != nil {
+		return member, nil
+	}
+	missErr := fmt.Errorf("no healthy backend instance serves model %s", model)
+	if p.recentMiss(model) {
+		return nil, missErr
+	}
+
+	// Requests missing a model while it is being refreshed wait for that refresh
+	p.refreshMu.Lock()
+	defer p.refreshMu.Unlock()
+
+	if member := p.pick(model); member != nil {
+		return member, nil
+	}
+	if p.recentMiss(model) {
+		return nil, missErr
+	}
+	p.refreshModels()
+	if member := p.pick(model); member != nil {
+		return member, nil
+	}
+
+	p.recordMiss(model)
+	return nil, missErr
+}
+
+func (p *BackendPool) recentMiss(model string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	missed, ok := p.misses[normalizeModelTag(model)]
+	return ok && time.Since(missed) < modelMissTTL
+}
+
+func (p *BackendPool) recordMiss(model string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.misses == nil {
+		p.misses = make(map[string]time.Time)
+	}
+	now := time.Now()
+	for missed, at := range p.misses {
+		if now.Sub(at) >= modelMissTTL {
+			delete(p.misses, missed)
+		}
+	}
+	p.misses[normalizeModelTag(model)] = now
+}
+
+func (p *BackendPool) pick(model string) *poolMember {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	tag := normalizeModelTag(model)
+	var picked *poolMember
+	for i := range p.members {
+		// Start from a rotating offset so that ties are spread over the instances
+		member := p.members[(p.next+i)%len(p.members)]
+		if !member.healthy || (model != "" && !member.models[tag]) {
+			continue
+		}
+		if picked == nil {
+			picked = member
+			continue
+		}
+		// Instances holding the model in memory answer without loading it first
+		if loaded, pickedLoaded := member.loaded[tag], picked.loaded[tag]; loaded != pickedLoaded {
+			if loaded {
+				picked = member
+			}
+			continue
+		}
+		if member.outstanding < picked.outstanding {
+			picked = member
+		}
+	}
+	if picked == nil {
+		return nil
+	}
+
+	p.next++
+	picked.outstanding++
+	return picked
+}
+
+func (p *BackendPool) release(member *poolMember) {
+	p.mu.Lock()
+	member.outstanding--
+	p.mu.Unlock()
+}
+
+// track keeps a request outstanding until its response body is closed, and ejects
+// the instance if the request could not be sent or the runtime failed with a 5xx.
+// Requests cancelled or timed out by their caller say nothing about the health of
+// the instance and never eject it.
+func (p *BackendPool) track(ctx context.Context, member *poolMember, resp *BackendResponse, err error) (*BackendResponse, error) {
+	if err != nil {
+		p.release(member)
+		if ctx.Err() == nil && isTransportError(err) {
+			p.eject(member, err)
+		}
+		return nil, err
+	}
+
+	if resp.StatusCode >= http.StatusInternalServerError && ctx.Err() == nil {
+		p.eject(member, fmt.Errorf("backend returned %d", resp.StatusCode))
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: func() { p.release(member) }}
+	return resp, nil
+}
+
+// isTransportError reports whether err comes from reaching the instance, rather than
+// from encoding the request or decoding a response
+func isTransportError(err error) bool {
+	var urlErr *url.Error
+	var netErr net.Error
+	return errors.As(err, &urlErr) || errors.As(err, &netErr)
+}
+
+func (p *BackendPool) eject(member *poolMember, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if member.healthy {
+		utils.LogInfo("Ejecting backend instance %s: %v", member.name, err)
+	}
+	member.healthy = false
+}
+
+func (p *BackendPool) probeLoop(member *poolMember, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		p.probe(member)
+
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe checks the health of an instance and refreshes the models it serves
+func (p *BackendPool) probe(member *poolMember) {
+	err := member.backend.Health()
+
+	var models, loaded []string
+	if err == nil {
+		models, err = member.backend.ListModels()
+	}
+	if err != nil {
+		p.eject(member, err)
+		return
+	}
+	if lister, ok := member.backend.(loadedModelLister); ok {
+		// Without the loaded models, requests are balanced over the instances regardless
+		if loaded, err = lister.LoadedModels(); err != nil {
+			utils.LogInfo("Error listing the loaded models of backend instance %s: %v", member.name, err)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !member.healthy {
+		utils.LogInfo("Readmitting backend instance %s", member.name)
+	}
+	member.healthy = true
+	member.models = make(map[string]bool, len(models))
+	for _, model := range models {
+		member.models[normalizeModelTag(model)] = true
+	}
+	member.loaded = make(map[string]bool, len(loaded))
+	for _, model := range loaded {
+		member.loaded[normalizeModelTag(model)] = true
+	}
+}
+
+func (p *BackendPool) refreshModels() {
+	var wg sync.WaitGroup
+	for _, member := range p.members {
+		wg.Add(1)
+		go func(member *poolMember) {
+			defer wg.Done()
+			p.probe(member)
+		}(member)
+	}
+	wg.Wait()
+}
+
+// releasingBody runs release once when the response body is closed
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// healthIntervalFromEnv reads BACKEND_HEALTH_INTERVAL (a Go duration such as "10s")
+func healthIntervalFromEnv() time.Duration {
+	value := os.Getenv("BACKEND_HEALTH_INTERVAL")
+	if value == "" {
+		return defaultHealthInterval
+	}
+
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval <= 0 {
+		utils.LogInfo("Invalid BACKEND_HEALTH_INTERVAL %q, using default of %v", value, defaultHealthInterval)
+		return defaultHealthInterval
+	}
+	return interval
+}
+
+// splitBackendURLs splits a comma separated list of backend addresses
+func splitBackendURLs(value string) []string {
+	var urls []string
+	for _, url := range strings.Split(value, ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
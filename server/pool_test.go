@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"depin-server/constants"
+	"depin-server/db"
+)
+
+// newTestPool builds a pool over a single healthy instance serving "m:latest", without
+// starting the health probes
+func newTestPool(backend InferenceBackend) (*BackendPool, *poolMember) {
+	member := &poolMember{
+		name:    "instance",
+		backend: backend,
+		healthy: true,
+		models:  map[string]bool{"m:latest": true},
+	}
+	return &BackendPool{members: []*poolMember{member}}, member
+}
+
+func TestBackendPoolEjection(t *testing.T) {
+	statusServer := func(status int) string {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		}))
+		t.Cleanup(server.Close)
+		return server.URL
+	}
+	closedServer := httptest.NewServer(http.NotFoundHandler())
+	closedServer.Close()
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name      string
+		backend   InferenceBackend
+		ctx       context.Context
+		wantEject bool
+	}{
+		{"success", NewOllamaBackend(statusServer(http.StatusOK)), context.Background(), false},
+		{"client error", NewOllamaBackend(statusServer(http.StatusBadRequest)), context.Background(), false},
+		{"server error", NewOllamaBackend(statusServer(http.StatusInternalServerError)), context.Background(), true},
+		{"unreachable", NewOllamaBackend(closedServer.URL), context.Background(), true},
+		{"cancelled", NewOllamaBackend(statusServer(http.StatusOK)), cancelled, false},
+		{"local error", &FakeBackend{Err: errors.New("failed to marshal request")}, context.Background(), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, member := newTestPool(tt.backend)
+
+			resp, _ := pool.Chat(tt.ctx, newTestInput(false))
+			if resp != nil {
+				resp.Body.Close()
+			}
+
+			if member.healthy == tt.wantEject {
+				t.Errorf("healthy = %v, want %v", member.healthy, !tt.wantEject)
+			}
+			if member.outstanding != 0 {
+				t.Errorf("outstanding = %d after the request completed", member.outstanding)
+			}
+		})
+	}
+}
+
+func TestBackendPoolGenerationTimeout(t *testing.T) {
+	unblock := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer server.Close()
+	defer close(unblock)
+	pool, member := newTestPool(NewOllamaBackend(server.URL))
+
+	ctx, cancel := generationContext(context.Background(), &db.AssetLimits{MaxGenerationTime: 1})
+	defer cancel()
+
+	_, err := pool.Chat(ctx, newTestInput(false))
+	if status := inferenceFailureStatus(ctx, err); status != constants.INFERENCE_STATUS_TIMEOUT {
+		t.Fatalf("status = %q, want %q", status, constants.INFERENCE_STATUS_TIMEOUT)
+	}
+	if !member.healthy {
+		t.Error("a generation timeout ejected a healthy instance")
+	}
+}
+
+// countingBackend counts the model listings of the pool probes
+type countingBackend struct {
+	*FakeBackend
+	lists atomic.Int32
+}
+
+func (b *countingBackend) ListModels() ([]string, error) {
+	b.lists.Add(1)
+	return b.FakeBackend.ListModels()
+}
+
+func TestBackendPoolUnknownModel(t *testing.T) {
+	backend := &countingBackend{FakeBackend: NewFakeBackend("m:latest")}
+	pool, _ := newTestPool(backend)
+
+	for i := 0; i < 3; i++ {
+		if _, err := pool.Chat(context.Background(), &InferenceInput{Model: "other"}); err == nil {
+			t.Fatal("Chat() of a model no instance serves succeeded")
+		}
+	}
+	if lists := backend.lists.Load(); lists != 1 {
+		t.Errorf("instances were probed %d times for an unknown model, want once", lists)
+	}
+
+	// A model created since the last probe is found by refreshing the instances
+	backend.Models = append(backend.Models, "new:latest")
+	resp, err := pool.Chat(context.Background(), &InferenceInput{Model: "new"})
+	if err != nil {
+		t.Fatalf("Chat() of a new model error = %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestBackendPoolLoadedAffinity(t *testing.T) {
+	cold := &poolMember{name: "cold", backend: NewFakeBackend("m:latest"), healthy: true}
+	warm := &poolMember{name: "warm", backend: &FakeBackend{Models: []string{"m:latest"}, Loaded: []string{"m:latest"}}, healthy: true}
+	pool := &BackendPool{members: []*poolMember{cold, warm}}
+	pool.refreshModels()
+
+	// The instance holding the model in memory is preferred despite its outstanding requests
+	warm.outstanding = 2
+	for i := 0; i < 2; i++ {
+		member, err := pool.acquire("m")
+		if err != nil || member != warm {
+			t.Fatalf("acquire() = %v, %v, want the instance with the model loaded", member, err)
+		}
+	}
+	if warm.outstanding != 4 || cold.outstanding != 0 {
+		t.Errorf("outstanding = %d warm, %d cold", warm.outstanding, cold.outstanding)
+	}
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"depin-server/constants"
+	"depin-server/db"
+	"depin-server/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type SetAssetPriceReq struct {
+	Unit   string `json:"unit"`
+	Amount string `json:"amount"`
+}
+
+// HandleSetAssetPrice sets the price charged for an asset, it is restricted to the admin
+func (s *DepinServer) HandleSetAssetPrice(c *gin.Context) {
+	assetID := c.Param("assetId")
+	if assetID == "" {
+		utils.RespondError(c, http.StatusBadRequest, "Asset ID is required", nil)
+		return
+	}
+
+	var priceReq SetAssetPriceReq
+	if err := c.ShouldBindJSON(&priceReq); err != nil {
+		utils.LogInfo("Error unmarshalling price request: %v", err)
+		utils.RespondError(c, http.StatusBadRequest, "Invalid request format", err)
+		return
+	}
+
+	price, err := parseAssetPrice(assetID, priceReq.Unit, priceReq.Amount)
+	if err != nil {
+		utils.LogInfo("Invalid price for asset %s: %v", assetID, err)
+		utils.RespondError(c, http.StatusBadRequest, "Invalid asset price", err)
+		return
+	}
+
+	asset, err := db.GetAsset(s.Storage, assetID)
+	if err != nil {
+		utils.LogInfo("Error fetching asset %s: %v", assetID, err)
+		utils.RespondError(c, http.StatusInternalServerError, "Failed to fetch asset", err)
+		return
+	}
+	if asset == nil {
+		utils.RespondError(c, http.StatusNotFound, "Asset not found", nil)
+		return
+	}
+
+	if err := db.SetAssetPrice(s.Storage, price); err != nil {
+		utils.LogInfo("Error setting price of asset %s: %v", assetID, err)
+		utils.RespondError(c, http.StatusInternalServerError, "Failed to set asset price", err)
+		return
+	}
+
+	utils.LogInfo("Price of asset %s set to %s %s", assetID, formatAssetValue(price.Amount), price.Unit)
+	utils.RespondSuccess(c, "Asset price set successfully", price)
+}
+
+// parseAssetPrice validates a pricing unit and a non-negative decimal amount
+func parseAssetPrice(assetID string, unit string, amount string) (*db.AssetPrice, error) {
+	if unit == "" {
+		unit = constants.PRICING_UNIT_PER_CALL
+	}
+
+	switch unit {
+	case constants.PRICING_UNIT_PER_CALL, constants.PRICING_UNIT_PER_1K_TOKENS, constants.PRICING_UNIT_PER_DOWNLOAD:
+	default:
+		return nil, fmt.Errorf("unsupported pricing unit %q", unit)
+	}
+
+	value, err := parseAssetValue(amount)
+	if err != nil {
+		return nil, err
+	}
+
+	return &db.AssetPrice{
+		AssetID: assetID,
+		Unit:    unit,
+		Amount:  value,
+	}, nil
+}
+
+func parseAssetValue(value string) (float64, error) {
+	if value == "" {
+		return 0, errors.New("asset value is required")
+	}
+
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil || parsed < 0 {
+		return 0, fmt.Errorf("asset value must be a non-negative number, got %q", value)
+	}
+	return parsed, nil
+}
+
+func formatAssetValue(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// resolveAssetValue returns the server-defined price of an inference on the requested
+// asset. The asset value signed by the client must match the price amount, so that the
+// client has agreed to what it is charged.
+func (s *DepinServer) resolveAssetValue(inferenceReq *HandleInferenceReq) (*db.AssetPrice, error) {
+	price, err := db.GetAssetPrice(s.Storage, inferenceReq.AssetID)
+	if err != nil {
+		return nil, err
+	}
+	if price == nil {
+		return nil, fmt.Errorf("asset %s has no price set", inferenceReq.AssetID)
+	}
+	if price.Unit == constants.PRICING_UNIT_PER_DOWNLOAD {
+		return nil, fmt.Errorf("asset %s is priced per download and cannot be used for inference", inferenceReq.AssetID)
+	}
+
+	if err := checkAssetValue(price, inferenceReq.AssetValue); err != nil {
+		return nil, err
+	}
+	return price, nil
+}
+
+// checkAssetValue rejects a client asset value which differs from the price amount
+func checkAssetValue(price *db.AssetPrice, assetValue string) error {
+	clientValue, err := parseAssetValue(assetValue)
+	if err != nil {
+		return err
+	}
+	if clientValue != price.Amount {
+		return fmt.Errorf("asset value %s does not match the price of asset %s (%s %s)",
+			assetValue, price.AssetID, formatAssetValue(price.Amount), price.Unit)
+	}
+	return nil
+}
+
+// inferenceValue is the value charged for an inference record: the price amount for
+// assets priced per call, and the amount per thousand prompt and completion tokens for
+// assets priced per token
+func inferenceValue(price *db.AssetPrice, record *db.InferenceRecord) string {
+	if price.Unit == constants.PRICING_UNIT_PER_1K_TOKENS {
+		tokens := record.PromptEvalCount + record.EvalCount
+		return formatAssetValue(price.Amount * float64(tokens) / 1000)
+	}
+	return formatAssetValue(price.Amount)
+}
+
+// authorizeDownload checks the payment for the download of an asset priced per download,
+// and returns the record charging it, or nil for assets which download for free. The DID
+// signs the payload
+//
+//	"download" \n asset_id \n asset_value \n timestamp
+//
+// sent with the asset value in the X-Depin-* headers. It responds with the error and
+// returns false when the download is refused.
+func (s *DepinServer) authorizeDownload(c *gin.Context, assetID string) (*db.InferenceRecord, bool) {
+	price, err := db.GetAssetPrice(s.Storage, assetID)
+	if err != nil {
+		utils.LogInfo("Error fetching price of asset %s: %v", assetID, err)
+		utils.RespondError(c, http.StatusInternalServerError, "Failed to fetch asset price", err)
+		return nil, false
+	}
+	if price == nil || price.Unit != constants.PRICING_UNIT_PER_DOWNLOAD {
+		return nil, true
+	}
+
+	downloadReq := &HandleInferenceReq{
+		Did:        c.GetHeader(headerDepinDid),
+		Timestamp:  c.GetHeader(headerDepinTimestamp),
+		Signature:  c.GetHeader(headerDepinSignature),
+		AssetID:    assetID,
+		AssetValue: c.GetHeader(headerDepinAssetValue),
+	}
+	if err := checkAssetValue(price, downloadReq.AssetValue); err != nil {
+		utils.LogInfo("Error resolving value of asset %s: %v", assetID, err)
+		utils.RespondError(c, http.StatusPaymentRequired, "Asset value does not match asset price", err)
+		return nil, false
+	}
+
+	if err := s.authenticateDownload(downloadReq); err != nil {
+		utils.LogInfo("Authentication failed for DID %s: %v", downloadReq.Did, err)
+		utils.RespondError(c, http.StatusUnauthorized, "Invalid or replayed signature", err)
+		return nil, false
+	}
+
+	return &db.InferenceRecord{
+		ID:         uuid.New().String(),
+		Did:        downloadReq.Did,
+		Timestamp:  downloadReq.Timestamp,
+		Signature:  downloadReq.Signature,
+		AssetID:    assetID,
+		AssetValue: formatAssetValue(price.Amount),
+		Query:      c.Request.URL.Path,
+		Status:     constants.INFERENCE_STATUS_SUCCESS,
+		Download:   true,
+	}, true
+}
+
+// authenticateDownload checks and consumes the signature of a paid download. It is a
+// no-op when signature verification is disabled.
+func (s *DepinServer) authenticateDownload(downloadReq *HandleInferenceReq) error {
+	if s.Verifier == nil {
+		return nil
+	}
+	if downloadReq.Did == "" || downloadReq.Signature == "" || downloadReq.Timestamp == "" {
+		return errors.New("did, timestamp and signature are required")
+	}
+
+	requestTime, err := checkTimestampWindow(downloadReq.Timestamp, s.TimestampWindow)
+	if err != nil {
+		return err
+	}
+
+	payload := []byte(strings.Join([]string{"download", downloadReq.AssetID, downloadReq.AssetValue, downloadReq.Timestamp}, "\n"))
+	if err := s.Verifier.VerifyPayload(downloadReq.Did, payload, downloadReq.Signature); err != nil {
+		return err
+	}
+
+	return s.consumeSignature(downloadReq.Did, payload, requestTime)
+}
+
+// recordDownload stores the record charging a download once the whole asset was served.
+// Nothing is charged for free downloads.
+func (s *DepinServer) recordDownload(record *db.InferenceRecord) {
+	if record == nil {
+		return
+	}
+	if err := db.AddInferenceRecord(s.Storage, record, s.RubixNodeAddress); err != nil {
+		utils.LogInfo("Error adding download record %s to DB: %v", record.ID, err)
+	}
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"depin-server/db"
+	"depin-server/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultRatePerMinute = 60
+	defaultRateBurst     = 10
+)
+
+// errRateLimited is returned when a client has exhausted its rate limit or quota
+var errRateLimited = errors.New("rate limit exceeded")
+
+type SetDIDTierReq struct {
+	Tier string `json:"tier"`
+}
+
+// HandleSetRateLimit configures the rate limit and quotas of a tier, for one asset
+// or for all assets when asset_id is empty, it is restricted to the admin
+func (s *DepinServer) HandleSetRateLimit(c *gin.Context) {
+	var rateLimit db.RateLimit
+	if err := c.ShouldBindJSON(&rateLimit); err != nil {
+		utils.LogInfo("Error unmarshalling rate limit request: %v", err)
+		utils.RespondError(c, http.StatusBadRequest, "Invalid request format", err)
+		return
+	}
+
+	if err := validateRateLimit(&rateLimit); err != nil {
+		utils.RespondError(c, http.StatusBadRequest, "Invalid rate limit", err)
+		return
+	}
+
+	if err := db.SetRateLimit(s.Storage, &rateLimit); err != nil {
+		utils.LogInfo("Error setting rate limit: %v", err)
+		utils.RespondError(c, http.StatusInternalServerError, "Failed to set rate limit", err)
+		return
+	}
+
+	utils.LogInfo("Rate limit of tier %s set for asset %q", rateLimit.Tier, rateLimit.AssetID)
+	utils.RespondSuccess(c, "Rate limit set successfully", rateLimit)
+}
+
+// HandleSetDIDTier assigns a DID to a rate limit tier, it is restricted to the admin
+func (s *DepinServer) HandleSetDIDTier(c *gin.Context) {
+	did := c.Param("did")
+
+	var tierReq SetDIDTierReq
+	if err := c.ShouldBindJSON(&tierReq); err != nil {
+		utils.LogInfo("Error unmarshalling tier request: %v", err)
+		utils.RespondError(c, http.StatusBadRequest, "Invalid request format", err)
+		return
+	}
+	if tierReq.Tier == "" {
+		utils.RespondError(c, http.StatusBadRequest, "Tier is required", nil)
+		return
+	}
+
+	if err := db.SetDIDTier(s.Storage, did, tierReq.Tier); err != nil {
+		utils.LogInfo("Error setting tier of DID %s: %v", did, err)
+		utils.RespondError(c, http.StatusInternalServerError, "Failed to set DID tier", err)
+		return
+	}
+
+	utils.RespondSuccess(c, "DID tier set successfully", gin.H{
+		"did":  did,
+		"tier": tierReq.Tier,
+	})
+}
+
+// rateLimitByIP limits routes which do not carry a DID signature by client IP
+func (s *DepinServer) rateLimitByIP(c *gin.Context) {
+	if err := s.consumeRateLimit(c, "ip:"+c.ClientIP(), db.DefaultTier, ""); err != nil {
+		if errors.Is(err, errRateLimited) {
+			utils.RespondError(c, http.StatusTooManyRequests, "Too many requests, retry later", err)
+		} else {
+			utils.LogInfo("Error checking rate limit: %v", err)
+			utils.RespondError(c, http.StatusInternalServerError, "Failed to check rate limit", err)
+		}
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// rateLimitInference limits an authenticated inference request by its DID and tier.
+// Without signature verification the DID cannot be trusted, so the client IP is used.
+func (s *DepinServer) rateLimitInference(c *gin.Context, inferenceReq *HandleInferenceReq) error {
+	if s.Verifier == nil {
+		return s.consumeRateLimit(c, "ip:"+c.ClientIP(), db.DefaultTier, inferenceReq.AssetID)
+	}
+
+	tier, err := db.GetDIDTier(s.Storage, inferenceReq.Did)
+	if err != nil {
+		return err
+	}
+	return s.consumeRateLimit(c, "did:"+inferenceReq.Did, tier, inferenceReq.AssetID)
+}
+
+// consumeRateLimit takes one request from the limits of subject and reports the remaining
+// allowance in X-RateLimit-* headers. It returns errRateLimited if the request is rejected.
+func (s *DepinServer) consumeRateLimit(c *gin.Context, subject string, tier string, assetID string) error {
+	rateLimit, err := s.rateLimitFor(tier, assetID)
+	if err != nil {
+		return err
+	}
+
+	result, err := db.ConsumeRateLimit(s.Storage, subject, rateLimit, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if rateLimit.RatePerMinute > 0 {
+		c.Header("X-RateLimit-Limit", strconv.Itoa(rateLimit.Burst))
+		c.Header("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		c.Header("X-RateLimit-Reset", strconv.Itoa(result.Reset))
+	}
+	if result.DailyRemaining >= 0 {
+		c.Header("X-RateLimit-Daily-Remaining", strconv.Itoa(result.DailyRemaining))
+	}
+	if result.MonthlyRemaining >= 0 {
+		c.Header("X-RateLimit-Monthly-Remaining", strconv.Itoa(result.MonthlyRemaining))
+	}
+
+	if !result.Allowed {
+		c.Header("Retry-After", strconv.Itoa(result.RetryAfter))
+		utils.LogInfo("Rate limited %s on asset %q: %s", subject, assetID, result.Reason)
+		return fmt.Errorf("%w: %s", errRateLimited, result.Reason)
+	}
+	return nil
+}
+
+// rateLimitFor resolves the limits of a tier for an asset, falling back to the
+// default tier and then to the limits configured in the environment
+func (s *DepinServer) rateLimitFor(tier string, assetID string) (*db.RateLimit, error) {
+	rateLimit, err := db.GetRateLimit(s.Storage, tier, assetID)
+	if err != nil {
+		return nil, err
+	}
+	if rateLimit == nil && tier != db.DefaultTier {
+		rateLimit, err = db.GetRateLimit(s.Storage, db.DefaultTier, assetID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if rateLimit == nil {
+		rateLimit = s.DefaultRateLimit
+	}
+	return rateLimit, nil
+}
+
+func validateRateLimit(rateLimit *db.RateLimit) error {
+	if rateLimit.Tier == "" {
+		return errors.New("tier is required")
+	}
+	if rateLimit.RatePerMinute < 0 || rateLimit.Burst < 0 || rateLimit.DailyQuota < 0 || rateLimit.MonthlyQuota < 0 {
+		return errors.New("limits must not be negative")
+	}
+	if rateLimit.RatePerMinute > 0 && rateLimit.Burst < 1 {
+		return errors.New("burst must be at least 1 when rate_per_minute is set")
+	}
+	return nil
+}
+
+// defaultRateLimitFromEnv reads RATE_LIMIT_PER_MINUTE, RATE_LIMIT_BURST, QUOTA_DAILY and
+// QUOTA_MONTHLY, which apply to tiers and assets without configured limits
+func defaultRateLimitFromEnv() *db.RateLimit {
+	rateLimit := &db.RateLimit{
+		Tier:          db.DefaultTier,
+		RatePerMinute: defaultRatePerMinute,
+		Burst:         intFromEnv("RATE_LIMIT_BURST", defaultRateBurst, 1),
+		DailyQuota:    intFromEnv("QUOTA_DAILY", 0, 0),
+		MonthlyQuota:  intFromEnv("QUOTA_MONTHLY", 0, 0),
+	}
+
+	if value := os.Getenv("RATE_LIMIT_PER_MINUTE"); value != "" {
+		ratePerMinute, err := strconv.ParseFloat(value, 64)
+		if err != nil || ratePerMinute < 0 {
+			utils.LogInfo("Invalid RATE_LIMIT_PER_MINUTE %q, using default of %d", value, defaultRatePerMinute)
+		} else {
+			rateLimit.RatePerMinute = ratePerMinute
+		}
+	}
+	return rateLimit
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"depin-server/db"
+	"depin-server/utils"
+)
+
+// defaultTimestampWindow is how far a signed request timestamp may drift from the server clock
+const defaultTimestampWindow = 5 * time.Minute
+
+// timestampWindowFromEnv reads SIGNATURE_TIMESTAMP_WINDOW (a Go duration such as "5m")
+func timestampWindowFromEnv() time.Duration {
+	value := os.Getenv("SIGNATURE_TIMESTAMP_WINDOW")
+	if value == "" {
+		return defaultTimestampWindow
+	}
+
+	window, err := time.ParseDuration(value)
+	if err != nil || window <= 0 {
+		utils.LogInfo("Invalid SIGNATURE_TIMESTAMP_WINDOW %q, using default of %v", value, defaultTimestampWindow)
+		return defaultTimestampWindow
+	}
+	return window
+}
+
+// parseRequestTimestamp normalizes a request timestamp given either as RFC3339 or unix seconds
+func parseRequestTimestamp(timestamp string) (time.Time, error) {
+	if unixSeconds, err := strconv.ParseInt(timestamp, 10, 64); err == nil {
+		return time.Unix(unixSeconds, 0).UTC(), nil
+	}
+
+	parsed, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("timestamp must be RFC3339 or unix seconds, got %q", timestamp)
+	}
+	return parsed.UTC(), nil
+}
+
+// checkTimestampWindow rejects timestamps further than window away from the current time
+func checkTimestampWindow(timestamp string, window time.Duration) (time.Time, error) {
+	requestTime, err := parseRequestTimestamp(timestamp)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	drift := time.Since(requestTime)
+	if drift < 0 {
+		drift = -drift
+	}
+	if drift > window {
+		return time.Time{}, fmt.Errorf("timestamp %s is outside the accepted window of %v", timestamp, window)
+	}
+	return requestTime, nil
+}
+
+// consumeSignature stores the hash of a signed payload so that the same signed request
+// cannot be accepted again while its timestamp is still within the window. The hash
+// covers the DID and the payload rather than the signature, which has several valid
+// encodings for the same payload.
+func (s *DepinServer) consumeSignature(did string, payload []byte, requestTime time.Time) error {
+	sum := sha256.Sum256([]byte(did + "\n" + string(payload)))
+	payloadHash := hex.EncodeToString(sum[:])
+
+	return db.ConsumeSignature(s.Storage, payloadHash, did, requestTime.Add(s.TimestampWindow))
+}
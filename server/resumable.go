@@ -0,0 +1,521 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"depin-server/constants"
+	"depin-server/db"
+	"depin-server/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// defaultResumableUploadTTL is how long an unfinished upload is kept without receiving data
+const defaultResumableUploadTTL = 24 * time.Hour
+
+// Headers of the resumable upload protocol. Upload-Offset is the number of bytes received,
+// which a chunk must start at, and Upload-Length the size of the whole file.
+const (
+	uploadOffsetHeader = "Upload-Offset"
+	uploadLengthHeader = "Upload-Length"
+	// uploadChunkContentType is the content type of the raw bytes of a chunk
+	uploadChunkContentType = "application/offset+octet-stream"
+)
+
+var errUploadBusy = errors.New("another request is writing to this upload")
+
+// CreateUploadReq starts a resumable upload of an asset file. The asset fields are those
+// of the single request upload, and the file is described by its name, size and SHA-256.
+type CreateUploadReq struct {
+	AssetName   string `json:"assetName"`
+	AssetType   string `json:"assetType"`
+	Runtime     string `json:"runtime"`
+	ModelTag    string `json:"modelTag"`
+	Price       string `json:"price"`
+	PricingUnit string `json:"pricingUnit"`
+	Filename    string `json:"filename"`
+	Length      int64  `json:"length"`
+	// Checksum is the hex SHA-256 of the file, it may instead be given when finalizing
+	Checksum string `json:"checksum"`
+}
+
+type FinalizeUploadReq struct {
+	Checksum string `json:"checksum"`
+}
+
+// UploadStager keeps the staging files of resumable uploads, and ensures that only one
+// request at a time writes to an upload
+type UploadStager struct {
+	Dir string
+	// TTL is how long an unfinished upload is kept after its last chunk
+	TTL time.Duration
+
+	mu   sync.Mutex
+	busy map[string]bool
+}
+
+func NewUploadStager(dir string, ttl time.Duration) *UploadStager {
+	return &UploadStager{
+		Dir:  dir,
+		TTL:  ttl,
+		busy: make(map[string]bool),
+	}
+}
+
+// uploadStagerFromEnv stages uploads in UPLOAD_DIR/.staging, and reads RESUMABLE_UPLOAD_TTL
+// (a Go duration such as "24h")
+func uploadStagerFromEnv() *UploadStager {
+	ttl := defaultResumableUploadTTL
+	if value := os.Getenv("RESUMABLE_UPLOAD_TTL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			utils.LogInfo("Invalid RESUMABLE_UPLOAD_TTL %q, using default of %v", value, defaultResumableUploadTTL)
+		} else {
+			ttl = parsed
+		}
+	}
+	return NewUploadStager(filepath.Join(uploadRoot(), ".staging"), ttl)
+}
+
+// path returns the staging file of an upload
+func (u *UploadStager) path(uploadID string) string {
+	return filepath.Join(u.Dir, uploadID+".part")
+}
+
+// lock reserves an upload for the calling request, the returned func releases it
+func (u *UploadStager) lock(uploadID string) (func(), error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.busy[uploadID] {
+		return nil, errUploadBusy
+	}
+	u.busy[uploadID] = true
+	return func() {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		delete(u.busy, uploadID)
+	}, nil
+}
+
+// HandleCreateUpload starts a resumable upload. The file is then sent in chunks with
+// PATCH requests, and registered as an asset by the finalize request once complete.
+func (s *DepinServer) HandleCreateUpload(c *gin.Context) {
+	var uploadReq CreateUploadReq
+	if err := c.ShouldBindJSON(&uploadReq); err != nil {
+		utils.LogInfo("Error unmarshalling upload request: %v", err)
+		utils.RespondError(c, http.StatusBadRequest, "Invalid request format", err)
+		return
+	}
+
+	if uploadReq.AssetName == "" || uploadReq.AssetType == "" {
+		utils.RespondError(c, http.StatusBadRequest, "Both assetName and assetType fields are required", nil)
+		return
+	}
+	runtime, err := validateAssetKind(uploadReq.AssetType, uploadReq.Runtime, uploadReq.ModelTag)
+	if err != nil {
+		utils.LogInfo("Invalid asset: %v", err)
+		utils.RespondError(c, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	if uploadReq.Price != "" {
+		if _, err := parseAssetPrice("", uploadReq.PricingUnit, uploadReq.Price); err != nil {
+			utils.LogInfo("Invalid asset price: %v", err)
+			utils.RespondError(c, http.StatusBadRequest, "Invalid asset price", err)
+			return
+		}
+	}
+
+	filename := filepath.Base(uploadReq.Filename)
+	if uploadReq.Filename == "" || filename == "." || filename == string(filepath.Separator) {
+		utils.RespondError(c, http.StatusBadRequest, "filename is required", nil)
+		return
+	}
+	if uploadReq.Length <= 0 {
+		utils.RespondError(c, http.StatusBadRequest, "length must be a positive number of bytes", nil)
+		return
+	}
+	checksum, err := normalizeChecksum(uploadReq.Checksum)
+	if err != nil {
+		utils.RespondError(c, http.StatusBadRequest, "Invalid checksum", err)
+		return
+	}
+
+	s.expireUploads()
+
+	if err := os.MkdirAll(s.Uploads.Dir, os.ModePerm); err != nil {
+		utils.LogInfo("Failed to create staging directory: %v", err)
+		utils.RespondError(c, http.StatusInternalServerError, "Upload directory error", err)
+		return
+	}
+
+	now := time.Now().Unix()
+	upload := &db.ResumableUpload{
+		ID:          uuid.New().String(),
+		AssetName:   uploadReq.AssetName,
+		AssetType:   uploadReq.AssetType,
+		Runtime:     runtime,
+		ModelTag:    uploadReq.ModelTag,
+		Price:       uploadReq.Price,
+		PricingUnit: uploadReq.PricingUnit,
+		Filename:    filename,
+		Length:      uploadReq.Length,
+		Checksum:    checksum,
+		Status:      constants.UPLOAD_STATUS_PENDING,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+
+	stagingFile, err := os.Create(s.Uploads.path(upload.ID))
+	if err != nil {
+		utils.LogInfo("Error creating staging file: %v", err)
+		utils.RespondError(c, http.StatusInternalServerError, "File creation error", err)
+		return
+	}
+	stagingFile.Close()
+
+	if err := db.CreateResumableUpload(s.Storage, upload); err != nil {
+		utils.LogInfo("Error creating upload: %v", err)
+		os.Remove(s.Uploads.path(upload.ID))
+		utils.RespondError(c, http.StatusInternalServerError, "Failed to create upload", err)
+		return
+	}
+
+	utils.LogInfo("Resumable upload %s created for %s (%d bytes)", upload.ID, filename, upload.Length)
+	c.Header("Location", strings.TrimSuffix(c.Request.URL.Path, "/")+"/"+upload.ID)
+	setUploadHeaders(c, upload)
+	utils.RespondSuccess(c, "Upload created successfully", upload)
+}
+
+// HandleHeadUpload reports the offset an interrupted upload resumes from
+func (s *DepinServer) HandleHeadUpload(c *gin.Context) {
+	upload, ok := s.uploadParam(c)
+	if !ok {
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	setUploadHeaders(c, upload)
+	c.Status(http.StatusOK)
+}
+
+// HandlePatchUpload appends a chunk to an upload. The chunk must start at the current
+// offset given in the Upload-Offset header. The bytes received are kept even if the
+// request is interrupted, and the new offset is returned.
+func (s *DepinServer) HandlePatchUpload(c *gin.Context) {
+	if contentType := c.ContentType(); contentType != uploadChunkContentType {
+		utils.RespondError(c, http.StatusUnsupportedMediaType, "Chunks must be sent as "+uploadChunkContentType, nil)
+		return
+	}
+	offset, err := strconv.ParseInt(c.GetHeader(uploadOffsetHeader), 10, 64)
+	if err != nil || offset < 0 {
+		utils.RespondError(c, http.StatusBadRequest, "Upload-Offset header must be a non-negative integer", err)
+		return
+	}
+
+	upload, release, ok := s.lockUpload(c)
+	if !ok {
+		return
+	}
+	defer release()
+
+	if offset != upload.Offset {
+		setUploadHeaders(c, upload)
+		utils.RespondError(c, http.StatusConflict, "Upload-Offset does not match the upload offset", fmt.Errorf("expected offset %d, got %d", upload.Offset, offset))
+		return
+	}
+
+	written, writeErr := appendChunk(s.Uploads.path(upload.ID), offset, c.Request.Body, upload.Length-offset)
+	if written > 0 {
+		upload.Offset += written
+		if err := db.UpdateResumableUpload(s.Storage, upload); err != nil {
+			utils.LogInfo("Error storing offset of upload %s: %v", upload.ID, err)
+			utils.RespondError(c, http.StatusInternalServerError, "Failed to store upload offset", err)
+			return
+		}
+	}
+	setUploadHeaders(c, upload)
+
+	if errors.Is(writeErr, errChunkTooLarge) {
+		utils.RespondError(c, http.StatusRequestEntityTooLarge, "Chunk exceeds the upload length", writeErr)
+		return
+	}
+	if writeErr != nil {
+		utils.LogInfo("Error writing chunk of upload %s at offset %d: %v", upload.ID, upload.Offset, writeErr)
+		utils.RespondError(c, http.StatusInternalServerError, "File write error", writeErr)
+		return
+	}
+
+	utils.RespondSuccess(c, "Chunk uploaded successfully", upload)
+}
+
+// HandleFinalizeUpload verifies the checksum of a complete upload, moves the file to the
+// upload directory of the asset and queues the import job registering it, like a single
+// request upload. The job is returned so that clients can follow the registration.
+func (s *DepinServer) HandleFinalizeUpload(c *gin.Context) {
+	var finalizeReq FinalizeUploadReq
+	if c.Request.ContentLength != 0 {
+		if err := json.NewDecoder(c.Request.Body).Decode(&finalizeReq); err != nil && err != io.EOF {
+			utils.LogInfo("Error unmarshalling finalize request: %v", err)
+			utils.RespondError(c, http.StatusBadRequest, "Invalid request format", err)
+			return
+		}
+	}
+	checksum, err := normalizeChecksum(finalizeReq.Checksum)
+	if err != nil {
+		utils.RespondError(c, http.StatusBadRequest, "Invalid checksum", err)
+		return
+	}
+
+	upload, release, ok := s.lockUpload(c)
+	if !ok {
+		return
+	}
+	defer release()
+
+	if upload.Offset != upload.Length {
+		setUploadHeaders(c, upload)
+		utils.RespondError(c, http.StatusConflict, "Upload is incomplete", fmt.Errorf("received %d of %d bytes", upload.Offset, upload.Length))
+		return
+	}
+	if checksum == "" {
+		checksum = upload.Checksum
+	}
+	if checksum == "" {
+		utils.RespondError(c, http.StatusBadRequest, "checksum is required to finalize the upload", nil)
+		return
+	}
+
+	stagingPath := s.Uploads.path(upload.ID)
+	actual, err := fileChecksum(stagingPath)
+	if err != nil {
+		utils.LogInfo("Error hashing upload %s: %v", upload.ID, err)
+		utils.RespondError(c, http.StatusInternalServerError, "File read error", err)
+		return
+	}
+	if actual != checksum {
+		utils.LogInfo("Checksum mismatch for upload %s: expected %s, got %s", upload.ID, checksum, actual)
+		utils.RespondError(c, http.StatusUnprocessableEntity, "Checksum does not match the uploaded file", fmt.Errorf("expected %s, got %s", checksum, actual))
+		return
+	}
+
+	if upload.Price != "" {
+		if _, err := parseAssetPrice("", upload.PricingUnit, upload.Price); err != nil {
+			utils.RespondError(c, http.StatusBadRequest, "Invalid asset price", err)
+			return
+		}
+	}
+
+	uploadDir := assetUploadDir(upload.AssetType, upload.AssetName)
+	if err := os.MkdirAll(uploadDir, os.ModePerm); err != nil {
+		utils.LogInfo("Failed to create directory: %v", err)
+		utils.RespondError(c, http.StatusInternalServerError, "Upload directory error", err)
+		return
+	}
+	assetPath := filepath.Join(uploadDir, upload.Filename)
+	if err := os.Rename(stagingPath, assetPath); err != nil {
+		utils.LogInfo("Error moving upload %s to %s: %v", upload.ID, assetPath, err)
+		utils.RespondError(c, http.StatusInternalServerError, "File write error", err)
+		return
+	}
+	// Keep the file staged so that the client can retry finalizing without uploading again
+	restore := func() {
+		if err := os.Rename(assetPath, stagingPath); err != nil {
+			utils.LogInfo("Error restoring staging file of upload %s: %v", upload.ID, err)
+		}
+	}
+
+	if _, err := inspectGGUFFiles(uploadDir, []string{upload.Filename}, upload.Filename, ""); err != nil {
+		utils.LogInfo("Invalid GGUF file: %v", err)
+		restore()
+		utils.RespondError(c, http.StatusBadRequest, "Invalid GGUF file", err)
+		return
+	}
+
+	// The checksum was verified above, the import job registers the asset without hashing
+	// the file again
+	now := time.Now().Unix()
+	job := &db.ImportJob{
+		ID:          uuid.New().String(),
+		AssetName:   upload.AssetName,
+		AssetType:   upload.AssetType,
+		Runtime:     upload.Runtime,
+		ModelTag:    upload.ModelTag,
+		Price:       upload.Price,
+		PricingUnit: upload.PricingUnit,
+		Filename:    upload.Filename,
+		Checksum:    checksum,
+		Status:      constants.IMPORT_STATUS_QUEUED,
+		BytesDone:   upload.Length,
+		BytesTotal:  upload.Length,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if err := db.CreateImportJob(s.Storage, job); err != nil {
+		utils.LogInfo("Error creating import job: %v", err)
+		restore()
+		utils.RespondError(c, http.StatusInternalServerError, "Failed to queue import job", err)
+		return
+	}
+	s.Imports.notify()
+
+	upload.Checksum = checksum
+	upload.Status = constants.UPLOAD_STATUS_COMPLETED
+	upload.ImportJobID = job.ID
+	if err := db.UpdateResumableUpload(s.Storage, upload); err != nil {
+		utils.LogInfo("Error completing upload %s: %v", upload.ID, err)
+	}
+
+	utils.LogInfo("Import job %s queued for upload %s", job.ID, upload.ID)
+	utils.RespondSuccess(c, "Asset import queued successfully", job)
+}
+
+// HandleDeleteUpload aborts an unfinished upload and deletes its staging file
+func (s *DepinServer) HandleDeleteUpload(c *gin.Context) {
+	upload, release, ok := s.lockUpload(c)
+	if !ok {
+		return
+	}
+	defer release()
+
+	if err := db.DeleteResumableUpload(s.Storage, upload.ID); err != nil {
+		utils.LogInfo("Error deleting upload %s: %v", upload.ID, err)
+		utils.RespondError(c, http.StatusInternalServerError, "Failed to delete upload", err)
+		return
+	}
+	if err := os.Remove(s.Uploads.path(upload.ID)); err != nil && !os.IsNotExist(err) {
+		utils.LogInfo("Error deleting staging file of upload %s: %v", upload.ID, err)
+	}
+
+	utils.LogInfo("Resumable upload %s deleted", upload.ID)
+	utils.RespondSuccess(c, "Upload deleted successfully", gin.H{"id": upload.ID})
+}
+
+func (s *DepinServer) uploadParam(c *gin.Context) (*db.ResumableUpload, bool) {
+	upload, err := db.GetResumableUpload(s.Storage, c.Param("uploadId"))
+	if err != nil {
+		utils.LogInfo("Error fetching upload: %v", err)
+		utils.RespondError(c, http.StatusInternalServerError, "Failed to fetch upload", err)
+		return nil, false
+	}
+	if upload == nil {
+		utils.RespondError(c, http.StatusNotFound, "Upload not found", nil)
+		return nil, false
+	}
+	return upload, true
+}
+
+// lockUpload fetches an unfinished upload and reserves it for the request
+func (s *DepinServer) lockUpload(c *gin.Context) (*db.ResumableUpload, func(), bool) {
+	release, err := s.Uploads.lock(c.Param("uploadId"))
+	if err != nil {
+		utils.RespondError(c, http.StatusConflict, "Upload is busy, retry later", err)
+		return nil, nil, false
+	}
+
+	upload, ok := s.uploadParam(c)
+	if !ok {
+		release()
+		return nil, nil, false
+	}
+	if upload.Status != constants.UPLOAD_STATUS_PENDING {
+		release()
+		utils.RespondError(c, http.StatusConflict, "Upload is already finalized", nil)
+		return nil, nil, false
+	}
+	return upload, release, true
+}
+
+// expireUploads deletes the unfinished uploads which outlived the TTL with their staging files
+func (s *DepinServer) expireUploads() {
+	ids, err := db.ExpireResumableUploads(s.Storage, time.Now().Add(-s.Uploads.TTL).Unix())
+	if err != nil {
+		utils.LogInfo("Error expiring uploads: %v", err)
+		return
+	}
+	for _, id := range ids {
+		if err := os.Remove(s.Uploads.path(id)); err != nil && !os.IsNotExist(err) {
+			utils.LogInfo("Error deleting staging file of upload %s: %v", id, err)
+		}
+		utils.LogInfo("Resumable upload %s expired", id)
+	}
+}
+
+func setUploadHeaders(c *gin.Context, upload *db.ResumableUpload) {
+	c.Header(uploadOffsetHeader, strconv.FormatInt(upload.Offset, 10))
+	c.Header(uploadLengthHeader, strconv.FormatInt(upload.Length, 10))
+}
+
+var errChunkTooLarge = errors.New("chunk exceeds the upload length")
+
+// appendChunk writes body to the staging file at offset, up to remaining bytes, and
+// returns the number of bytes written. Bytes past a previous interrupted write at offset
+// are discarded first. The file is synced before returning, so that the written bytes
+// can be recorded as received.
+func appendChunk(path string, offset int64, body io.Reader, remaining int64) (int64, error) {
+	stagingFile, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer stagingFile.Close()
+
+	if err := stagingFile.Truncate(offset); err != nil {
+		return 0, err
+	}
+	if _, err := stagingFile.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	written, copyErr := io.Copy(stagingFile, io.LimitReader(body, remaining))
+	if err := stagingFile.Sync(); err != nil {
+		return 0, err
+	}
+	if copyErr != nil {
+		return written, copyErr
+	}
+
+	if n, _ := body.Read(make([]byte, 1)); n > 0 {
+		return written, errChunkTooLarge
+	}
+	return written, nil
+}
+
+// normalizeChecksum validates a hex SHA-256 checksum, which may be empty
+func normalizeChecksum(checksum string) (string, error) {
+	checksum = strings.ToLower(strings.TrimPrefix(checksum, "sha256:"))
+	if checksum == "" {
+		return "", nil
+	}
+	if decoded, err := hex.DecodeString(checksum); err != nil || len(decoded) != sha256.Size {
+		return "", fmt.Errorf("checksum must be a hex SHA-256 digest, got %q", checksum)
+	}
+	return checksum, nil
+}
+
+// fileChecksum returns the hex SHA-256 of a file
+func fileChecksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
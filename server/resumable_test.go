@@ -0,0 +1,192 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"depin-server/constants"
+	"depin-server/db"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newUploadTestServer is newTestServer staging resumable uploads in a temporary UPLOAD_DIR
+func newUploadTestServer(t *testing.T) (*DepinServer, *gin.Engine) {
+	t.Helper()
+
+	t.Setenv("UPLOAD_DIR", t.TempDir())
+	s, _ := newTestServer(t)
+	s.Uploads = NewUploadStager(filepath.Join(uploadRoot(), ".staging"), time.Hour)
+	s.Imports = NewImportRunner(1)
+
+	router := gin.New()
+	router.POST("/uploads", s.HandleCreateUpload)
+	router.HEAD("/uploads/:uploadId", s.HandleHeadUpload)
+	router.PATCH("/uploads/:uploadId", s.HandlePatchUpload)
+	router.POST("/uploads/:uploadId/finalize", s.HandleFinalizeUpload)
+	return s, router
+}
+
+// createTestUpload starts the upload of model.gguf of length bytes and returns its ID
+func createTestUpload(t *testing.T, router *gin.Engine, length int, checksum string) string {
+	t.Helper()
+
+	body, _ := json.Marshal(CreateUploadReq{AssetName: "model", AssetType: constants.ASSET_TYPE_MODEL, Filename: "model.gguf", Length: int64(length), Checksum: checksum})
+	w := serveTestRequest(router, "/uploads", string(body))
+	var resp struct {
+		Data db.ResumableUpload `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("create upload = %d %s", w.Code, w.Body.String())
+	}
+	return resp.Data.ID
+}
+
+func patchTestUpload(router *gin.Engine, uploadID string, offset int, body io.Reader) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPatch, "/uploads/"+uploadID, body)
+	req.Header.Set("Content-Type", uploadChunkContentType)
+	req.Header.Set(uploadOffsetHeader, strconv.Itoa(offset))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func finalizeTestUpload(router *gin.Engine, uploadID string, checksum string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(FinalizeUploadReq{Checksum: checksum})
+	return serveTestRequest(router, "/uploads/"+uploadID+"/finalize", string(body))
+}
+
+func testChecksum(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// interruptedReader returns its data, then fails as a connection closed mid-request
+type interruptedReader struct {
+	data []byte
+}
+
+func (r *interruptedReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, errors.New("connection reset by peer")
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestResumableUpload(t *testing.T) {
+	s, router := newUploadTestServer(t)
+	content := testGGUFModel(3, binary.LittleEndian, 32+2*144)
+	checksum := testChecksum(content)
+	uploadID := createTestUpload(t, router, len(content), checksum)
+
+	if w := patchTestUpload(router, uploadID, 0, bytes.NewReader(content[:100])); w.Code != http.StatusOK || w.Header().Get(uploadOffsetHeader) != "100" {
+		t.Fatalf("first chunk = %d, offset %s: %s", w.Code, w.Header().Get(uploadOffsetHeader), w.Body.String())
+	}
+
+	// A chunk sent again at a stale offset is rejected with the offset to resume from
+	w := patchTestUpload(router, uploadID, 0, bytes.NewReader(content[:100]))
+	if w.Code != http.StatusConflict || w.Header().Get(uploadOffsetHeader) != "100" {
+		t.Fatalf("chunk at a stale offset = %d, offset %s", w.Code, w.Header().Get(uploadOffsetHeader))
+	}
+
+	// The bytes received before the connection broke are kept
+	if w := patchTestUpload(router, uploadID, 100, &interruptedReader{data: content[100:200]}); w.Code != http.StatusInternalServerError {
+		t.Fatalf("interrupted chunk = %d %s", w.Code, w.Body.String())
+	}
+	req := httptest.NewRequest(http.MethodHead, "/uploads/"+uploadID, nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Header().Get(uploadOffsetHeader) != "200" || w.Header().Get(uploadLengthHeader) != strconv.Itoa(len(content)) {
+		t.Fatalf("HEAD after an interrupted chunk = %d, offset %s, length %s", w.Code, w.Header().Get(uploadOffsetHeader), w.Header().Get(uploadLengthHeader))
+	}
+	if w := patchTestUpload(router, uploadID, 200, bytes.NewReader(content[200:])); w.Code != http.StatusOK || w.Header().Get(uploadOffsetHeader) != strconv.Itoa(len(content)) {
+		t.Fatalf("resumed chunk = %d %s", w.Code, w.Body.String())
+	}
+
+	// The checksum given when the upload was created is verified and passed to the import job
+	w = finalizeTestUpload(router, uploadID, "")
+	var resp struct {
+		Data db.ImportJob `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("finalize = %d %s", w.Code, w.Body.String())
+	}
+	job, err := db.GetImportJob(s.Storage, resp.Data.ID)
+	if err != nil || job == nil {
+		t.Fatalf("import job %s was not queued: %v", resp.Data.ID, err)
+	}
+	if job.Status != constants.IMPORT_STATUS_QUEUED || job.Checksum != checksum || job.Filename != "model.gguf" {
+		t.Errorf("queued import job = %+v, want checksum %s", job, checksum)
+	}
+	upload, err := db.GetResumableUpload(s.Storage, uploadID)
+	if err != nil || upload.Status != constants.UPLOAD_STATUS_COMPLETED || upload.ImportJobID != job.ID {
+		t.Errorf("finalized upload = %+v, error = %v", upload, err)
+	}
+	stored, err := os.ReadFile(filepath.Join(assetUploadDir(constants.ASSET_TYPE_MODEL, "model"), "model.gguf"))
+	if err != nil || !bytes.Equal(stored, content) {
+		t.Errorf("asset file does not hold the uploaded bytes: %v", err)
+	}
+
+	if w := finalizeTestUpload(router, uploadID, ""); w.Code != http.StatusConflict {
+		t.Errorf("finalizing twice = %d, want %d", w.Code, http.StatusConflict)
+	}
+}
+
+func TestResumableUploadChunkOverrun(t *testing.T) {
+	s, router := newUploadTestServer(t)
+	uploadID := createTestUpload(t, router, 10, "")
+
+	w := patchTestUpload(router, uploadID, 0, strings.NewReader("0123456789abcde"))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("chunk overrunning the upload = %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+	if info, err := os.Stat(s.Uploads.path(uploadID)); err != nil || info.Size() > 10 {
+		t.Errorf("staging file grew beyond the upload length: %v", err)
+	}
+}
+
+func TestResumableUploadChecksumMismatch(t *testing.T) {
+	s, router := newUploadTestServer(t)
+	content := testGGUFModel(3, binary.LittleEndian, 32+2*144)
+	uploadID := createTestUpload(t, router, len(content), "")
+
+	if w := patchTestUpload(router, uploadID, 0, bytes.NewReader(content[:100])); w.Code != http.StatusOK {
+		t.Fatalf("first chunk = %d %s", w.Code, w.Body.String())
+	}
+	if w := finalizeTestUpload(router, uploadID, testChecksum(content)); w.Code != http.StatusConflict {
+		t.Errorf("finalizing an incomplete upload = %d, want %d", w.Code, http.StatusConflict)
+	}
+	if w := patchTestUpload(router, uploadID, 100, bytes.NewReader(content[100:])); w.Code != http.StatusOK {
+		t.Fatalf("last chunk = %d %s", w.Code, w.Body.String())
+	}
+
+	if w := finalizeTestUpload(router, uploadID, ""); w.Code != http.StatusBadRequest {
+		t.Errorf("finalizing without checksum = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := finalizeTestUpload(router, uploadID, testChecksum([]byte("other file"))); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("finalizing with another checksum = %d, want %d", w.Code, http.StatusUnprocessableEntity)
+	}
+	if job, err := db.ClaimImportJob(s.Storage); err != nil || job != nil {
+		t.Errorf("import job queued after a checksum mismatch = %+v, error = %v", job, err)
+	}
+
+	// The file stays staged, finalizing with the right checksum succeeds
+	if w := finalizeTestUpload(router, uploadID, testChecksum(content)); w.Code != http.StatusOK {
+		t.Errorf("finalizing after a checksum mismatch = %d %s", w.Code, w.Body.String())
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"depin-server/db"
 	"depin-server/utils"
 	"os"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -12,6 +13,39 @@ type DepinServer struct {
 	Port             string
 	Storage          *db.InferenceStorage
 	RubixNodeAddress string
+	// Verifier checks DID signatures on inference requests, nil disables verification
+	Verifier SignatureVerifier
+	// TimestampWindow bounds the age of signed request timestamps
+	TimestampWindow time.Duration
+	// QueryPolicy selects what part of the conversation is stored as the inference query
+	QueryPolicy string
+	// Backends serve inference for assets, keyed by model runtime
+	Backends map[string]InferenceBackend
+	// Admission bounds concurrent and queued inferences per asset
+	Admission *AdmissionController
+	// DefaultRateLimit applies to tiers and assets without configured limits
+	DefaultRateLimit *db.RateLimit
+	// Cache serves repeated deterministic requests from disk, nil disables caching
+	Cache *ResponseCache
+	// MaxImages and MaxImageBytes bound the images of multimodal requests
+	MaxImages     int
+	MaxImageBytes int64
+	// GenerationTimeout and MaxOutputTokens apply to assets without their own limits,
+	// zero leaves them unbounded
+	GenerationTimeout time.Duration
+	MaxOutputTokens   int
+	// Batches processes queued batch jobs in the background
+	Batches *BatchRunner
+	// Webhooks delivers server events to subscribed URLs
+	Webhooks *WebhookDispatcher
+	// Uploads stages the chunks of resumable uploads
+	Uploads *UploadStager
+	// HuggingFace downloads the assets imported by URL
+	HuggingFace *HuggingFaceImporter
+	// Imports registers uploaded and imported assets in the background
+	Imports *ImportRunner
+	// AdminToken authorizes the routes configuring the node, empty disables them
+	AdminToken string
 
 	router *gin.Engine
 }
@@ -21,7 +55,31 @@ func NewDepinServer(port string, storage *db.InferenceStorage, rubixNodeAddress
 		Port:             port,
 		Storage:          storage,
 		RubixNodeAddress: rubixNodeAddress,
+		TimestampWindow:  timestampWindowFromEnv(),
+		QueryPolicy:      queryPolicyFromEnv(),
+		Backends:         backendsFromEnv(),
+		Admission:        admissionControllerFromEnv(),
+		DefaultRateLimit: defaultRateLimitFromEnv(),
+		Cache:            responseCacheFromEnv(),
+		Batches:          batchRunnerFromEnv(),
+		Webhooks:         webhookDispatcherFromEnv(),
+		Uploads:          uploadStagerFromEnv(),
+		HuggingFace:      huggingFaceImporterFromEnv(),
+		Imports:          importRunnerFromEnv(),
+		AdminToken:       adminTokenFromEnv(),
 	}
+	depinServer.MaxImages, depinServer.MaxImageBytes = imageLimitsFromEnv()
+	depinServer.GenerationTimeout, depinServer.MaxOutputTokens = generationLimitsFromEnv()
+
+	if os.Getenv("VERIFY_INFERENCE_SIGNATURE") != "false" {
+		depinServer.Verifier = NewDIDSignatureVerifier(NewRubixKeyRegistry(rubixNodeAddress))
+	} else {
+		utils.LogInfo("Signature verification of inference requests is disabled")
+	}
+
+	depinServer.startWebhookDispatcher()
+	depinServer.startBatchWorkers()
+	depinServer.startImportWorkers()
 
 	// Register DePIN server API routes
 	depinServer.router = gin.Default()
@@ -39,10 +97,41 @@ func (s *DepinServer) registerRoutes() {
 	{
 		apiV1.GET("/healthz", s.HandleHealthCheck)
 		if os.Getenv("ENABLE_ASSET_UPLOAD") == "true" {
-			apiV1.POST("/upload", s.HandleFileUpload)
+			apiV1.POST("/upload", s.rateLimitByIP, s.HandleFileUpload)
+			apiV1.GET("/imports/:jobId", s.rateLimitByIP, s.HandleGetImport)
+			apiV1.POST("/imports/:jobId/cancel", s.rateLimitByIP, s.HandleCancelImport)
+			// Resumable uploads of large files, sent in chunks and finalized once complete
+			apiV1.POST("/uploads", s.rateLimitByIP, s.HandleCreateUpload)
+			apiV1.HEAD("/uploads/:uploadId", s.rateLimitByIP, s.HandleHeadUpload)
+			apiV1.PATCH("/uploads/:uploadId", s.rateLimitByIP, s.HandlePatchUpload)
+			apiV1.POST("/uploads/:uploadId/finalize", s.rateLimitByIP, s.HandleFinalizeUpload)
+			apiV1.DELETE("/uploads/:uploadId", s.rateLimitByIP, s.HandleDeleteUpload)
+			// Inference requests are rate limited by their DID once authenticated
 			apiV1.POST("/inference", s.HandleInference)
-			apiV1.GET("/assets", s.HandleGetAssets)
-			apiV1.GET("/assets/download/:assetId", s.HandleDownloadAsset)
+			// OpenAI-compatible, SDKs can use /depin-server/v1 as their base URL
+			apiV1.POST("/chat/completions", s.HandleChatCompletions)
+			// Batch jobs are rate limited by their DID once authenticated
+			apiV1.POST("/batches", s.HandleCreateBatch)
+			apiV1.GET("/batches/:batchId", s.rateLimitByIP, s.HandleGetBatch)
+			apiV1.POST("/batches/:batchId/cancel", s.rateLimitByIP, s.HandleCancelBatch)
+			apiV1.GET("/batches/:batchId/results", s.rateLimitByIP, s.HandleGetBatchResults)
+			apiV1.POST("/webhooks", s.rateLimitByIP, s.HandleCreateWebhook)
+			apiV1.GET("/webhooks", s.rateLimitByIP, s.HandleGetWebhooks)
+			apiV1.DELETE("/webhooks/:webhookId", s.rateLimitByIP, s.HandleDeleteWebhook)
+			apiV1.GET("/webhooks/:webhookId/deliveries", s.rateLimitByIP, s.HandleGetWebhookDeliveries)
+			apiV1.GET("/assets", s.rateLimitByIP, s.HandleGetAssets)
+			apiV1.GET("/assets/download/:assetId", s.rateLimitByIP, s.HandleDownloadAsset)
+			apiV1.GET("/assets/:assetId/files", s.rateLimitByIP, s.HandleGetAssetFiles)
+			apiV1.GET("/assets/:assetId/files/*path", s.rateLimitByIP, s.HandleDownloadAssetFile)
+			apiV1.GET("/assets/:assetId/archive", s.rateLimitByIP, s.HandleDownloadAssetArchive)
+			apiV1.PUT("/assets/:assetId/price", s.rateLimitByIP, s.requireAdmin, s.HandleSetAssetPrice)
+			apiV1.GET("/assets/:assetId/limits", s.rateLimitByIP, s.HandleGetAssetLimits)
+			apiV1.PUT("/assets/:assetId/limits", s.rateLimitByIP, s.requireAdmin, s.HandleSetAssetLimits)
+			apiV1.GET("/assets/:assetId/usage", s.rateLimitByIP, s.HandleGetAssetUsage)
+			apiV1.GET("/assets/:assetId/queue", s.rateLimitByIP, s.HandleGetAssetQueue)
+			apiV1.GET("/assets/:assetId/queue/:ticket", s.rateLimitByIP, s.HandleGetQueuePosition)
+			apiV1.PUT("/rate-limits", s.rateLimitByIP, s.requireAdmin, s.HandleSetRateLimit)
+			apiV1.PUT("/dids/:did/tier", s.rateLimitByIP, s.requireAdmin, s.HandleSetDIDTier)
 		} else {
 			utils.LogInfo("Depin Server is not accepting new assets, set ENABLE_ASSET_UPLOAD to true to allow uploads")
 		}
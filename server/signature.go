@@ -0,0 +1,212 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+
+	"depin-server/rubix"
+)
+
+var errInvalidSignature = errors.New("signature does not match the DID public key")
+
+// KeyRegistry resolves the public key of a DID
+type KeyRegistry interface {
+	PublicKey(did string) (crypto.PublicKey, error)
+}
+
+// SignatureVerifier checks that an inference request, or any other payload, was signed by its DID
+type SignatureVerifier interface {
+	Verify(inferenceReq *HandleInferenceReq) error
+	VerifyPayload(did string, payload []byte, signature string) error
+}
+
+// DIDSignatureVerifier verifies inference request signatures against the
+// public keys provided by a KeyRegistry
+type DIDSignatureVerifier struct {
+	Keys KeyRegistry
+}
+
+func NewDIDSignatureVerifier(keys KeyRegistry) *DIDSignatureVerifier {
+	return &DIDSignatureVerifier{Keys: keys}
+}
+
+func (v *DIDSignatureVerifier) Verify(inferenceReq *HandleInferenceReq) error {
+	if inferenceReq.Did == "" || inferenceReq.Signature == "" || inferenceReq.Timestamp == "" {
+		return errors.New("did, timestamp and signature are required")
+	}
+
+	payload, err := canonicalSignedPayload(inferenceReq)
+	if err != nil {
+		return err
+	}
+
+	return v.VerifyPayload(inferenceReq.Did, payload, inferenceReq.Signature)
+}
+
+// VerifyPayload checks a hex or base64 encoded signature of payload against the DID public key
+func (v *DIDSignatureVerifier) VerifyPayload(did string, payload []byte, signature string) error {
+	decoded, err := decodeSignature(signature)
+	if err != nil {
+		return err
+	}
+
+	publicKey, err := v.Keys.PublicKey(did)
+	if err != nil {
+		return fmt.Errorf("unable to resolve public key for DID %s: %v", did, err)
+	}
+
+	return verifySignature(publicKey, payload, decoded)
+}
+
+// canonicalSignedPayload reconstructs the payload a client signs for an inference request:
+//
+//	model \n sha256_hex(messages) \n asset_id \n asset_value \n timestamp
+//
+// where messages is the messages array exactly as sent in the request body, so that the
+// signature covers the bytes the client produced rather than the server's decoding of them.
+func canonicalSignedPayload(inferenceReq *HandleInferenceReq) ([]byte, error) {
+	if inferenceReq.OllamaInferenceInput == nil {
+		return nil, errors.New("inferenceInput is required")
+	}
+	if len(inferenceReq.SignedMessages) == 0 {
+		return nil, errors.New("messages are required")
+	}
+
+	sum := sha256.Sum256(inferenceReq.SignedMessages)
+	payload := strings.Join([]string{
+		inferenceReq.OllamaInferenceInput.Model,
+		hex.EncodeToString(sum[:]),
+		inferenceReq.AssetID,
+		inferenceReq.AssetValue,
+		inferenceReq.Timestamp,
+	}, "\n")
+
+	return []byte(payload), nil
+}
+
+// signedMessages holds the messages array of a request body as sent by the client
+type signedMessages struct {
+	Messages json.RawMessage `json:"messages"`
+}
+
+// decodeSignature accepts hex or base64 encoded signatures
+func decodeSignature(signature string) ([]byte, error) {
+	if decoded, err := hex.DecodeString(signature); err == nil {
+		return decoded, nil
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(signature); err == nil {
+		return decoded, nil
+	}
+	return nil, errors.New("signature must be hex or base64 encoded")
+}
+
+// verifySignature checks an ECDSA (ASN.1 or raw r||s over SHA-256) or Ed25519 signature
+func verifySignature(publicKey crypto.PublicKey, payload []byte, signature []byte) error {
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(payload)
+		if ecdsa.VerifyASN1(key, digest[:], signature) {
+			return nil
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) == 2*size {
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if ecdsa.Verify(key, digest[:], r, s) {
+				return nil
+			}
+		}
+		return errInvalidSignature
+	case ed25519.PublicKey:
+		if ed25519.Verify(key, payload, signature) {
+			return nil
+		}
+		return errInvalidSignature
+	default:
+		return fmt.Errorf("unsupported public key type %T", publicKey)
+	}
+}
+
+// ParsePublicKey parses a PEM encoded or hex encoded DER (PKIX) public key
+func ParsePublicKey(encoded string) (crypto.PublicKey, error) {
+	var der []byte
+	if block, _ := pem.Decode([]byte(encoded)); block != nil {
+		der = block.Bytes
+	} else {
+		decoded, err := hex.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, errors.New("public key must be PEM or hex encoded")
+		}
+		der = decoded
+	}
+
+	publicKey, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %v", err)
+	}
+	return publicKey, nil
+}
+
+// RubixKeyRegistry fetches DID public keys from the Rubix node and caches them
+type RubixKeyRegistry struct {
+	NodeAddress string
+
+	mu   sync.RWMutex
+	keys map[string]crypto.PublicKey
+}
+
+func NewRubixKeyRegistry(nodeAddress string) *RubixKeyRegistry {
+	return &RubixKeyRegistry{
+		NodeAddress: nodeAddress,
+		keys:        make(map[string]crypto.PublicKey),
+	}
+}
+
+func (r *RubixKeyRegistry) PublicKey(did string) (crypto.PublicKey, error) {
+	r.mu.RLock()
+	publicKey, ok := r.keys[did]
+	r.mu.RUnlock()
+	if ok {
+		return publicKey, nil
+	}
+
+	encoded, err := rubix.GetDIDPublicKey(r.NodeAddress, did)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, err = ParsePublicKey(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	r.keys[did] = publicKey
+	r.mu.Unlock()
+
+	return publicKey, nil
+}
+
+// StaticKeyRegistry serves public keys from a fixed in-memory map, for local
+// setups and tests that run without a Rubix node
+type StaticKeyRegistry map[string]crypto.PublicKey
+
+func (r StaticKeyRegistry) PublicKey(did string) (crypto.PublicKey, error) {
+	publicKey, ok := r[did]
+	if !ok {
+		return nil, fmt.Errorf("no public key registered for DID %s", did)
+	}
+	return publicKey, nil
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"depin-server/db"
+)
+
+const testDid = "bafybmitestdid"
+
+// signedRequestBody builds a native inference request body with the given messages
+// array, signed by key over the canonical payload
+func signedRequestBody(t *testing.T, key crypto.Signer, messages string, assetValue string, timestamp string) []byte {
+	t.Helper()
+
+	sum := sha256.Sum256([]byte(messages))
+	payload := "m:latest\n" + hex.EncodeToString(sum[:]) + "\nasset-1\n" + assetValue + "\n" + timestamp
+	body := fmt.Sprintf(`{"did":%q,"timestamp":%q,"signature":%q,"asset_id":"asset-1","asset_value":%q,"ollama_inference_input":{"model":"m:latest","messages":%s}}`,
+		testDid, timestamp, signPayload(t, key, []byte(payload)), assetValue, messages)
+	return []byte(body)
+}
+
+func signPayload(t *testing.T, key crypto.Signer, payload []byte) string {
+	t.Helper()
+
+	if edKey, ok := key.(ed25519.PrivateKey); ok {
+		return base64.StdEncoding.EncodeToString(ed25519.Sign(edKey, payload))
+	}
+	digest := sha256.Sum256(payload)
+	signature, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatalf("failed to sign payload: %v", err)
+	}
+	return hex.EncodeToString(signature)
+}
+
+func newTestECDSAKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	return key
+}
+
+func parseTestRequest(t *testing.T, body []byte) *HandleInferenceReq {
+	t.Helper()
+
+	inferenceReq, err := parseInferenceReq(body)
+	if err != nil {
+		t.Fatalf("failed to parse request: %v", err)
+	}
+	return inferenceReq
+}
+
+func TestVerifyInferenceSignature(t *testing.T) {
+	ecdsaKey := newTestECDSAKey(t)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	otherKey := newTestECDSAKey(t)
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	messages := `[{"role":"user","content":"hello"}]`
+
+	tests := []struct {
+		name    string
+		key     crypto.PublicKey
+		body    []byte
+		wantErr error
+	}{
+		{
+			name: "ecdsa",
+			key:  &ecdsaKey.PublicKey,
+			body: signedRequestBody(t, ecdsaKey, messages, "1", timestamp),
+		},
+		{
+			name: "ed25519",
+			key:  edKey.Public(),
+			body: signedRequestBody(t, edKey, messages, "1", timestamp),
+		},
+		{
+			// Fields the server does not decode, key order and spacing are covered
+			// by the signature as the client sent them
+			name: "raw messages",
+			key:  &ecdsaKey.PublicKey,
+			body: signedRequestBody(t, ecdsaKey, `[ {"content":"hello", "role":"user", "name":"alice"} ]`, "1", timestamp),
+		},
+		{
+			name:    "wrong key",
+			key:     &otherKey.PublicKey,
+			body:    signedRequestBody(t, ecdsaKey, messages, "1", timestamp),
+			wantErr: errInvalidSignature,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifier := NewDIDSignatureVerifier(StaticKeyRegistry{testDid: tt.key})
+
+			err := verifier.Verify(parseTestRequest(t, tt.body))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyTamperedInferenceRequest(t *testing.T) {
+	key := newTestECDSAKey(t)
+	verifier := NewDIDSignatureVerifier(StaticKeyRegistry{testDid: &key.PublicKey})
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	tamper := map[string]func(inferenceReq *HandleInferenceReq){
+		"asset value": func(inferenceReq *HandleInferenceReq) { inferenceReq.AssetValue = "0" },
+		"asset id":    func(inferenceReq *HandleInferenceReq) { inferenceReq.AssetID = "asset-2" },
+		"model":       func(inferenceReq *HandleInferenceReq) { inferenceReq.OllamaInferenceInput.Model = "other:latest" },
+		"timestamp":   func(inferenceReq *HandleInferenceReq) { inferenceReq.Timestamp += "0" },
+		"messages": func(inferenceReq *HandleInferenceReq) {
+			inferenceReq.SignedMessages = []byte(`[{"role":"user","content":"hello!"}]`)
+		},
+	}
+
+	for name, tamperWith := range tamper {
+		t.Run(name, func(t *testing.T) {
+			inferenceReq := parseTestRequest(t, signedRequestBody(t, key, `[{"role":"user","content":"hello"}]`, "1", timestamp))
+			tamperWith(inferenceReq)
+
+			if err := verifier.Verify(inferenceReq); !errors.Is(err, errInvalidSignature) {
+				t.Fatalf("Verify() error = %v, want %v", err, errInvalidSignature)
+			}
+		})
+	}
+}
+
+func TestVerifyUnknownDID(t *testing.T) {
+	key := newTestECDSAKey(t)
+	verifier := NewDIDSignatureVerifier(StaticKeyRegistry{})
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	inferenceReq := parseTestRequest(t, signedRequestBody(t, key, `[{"role":"user","content":"hello"}]`, "1", timestamp))
+	if err := verifier.Verify(inferenceReq); err == nil {
+		t.Fatal("Verify() accepted a DID without a registered key")
+	}
+}
+
+func TestReplayedInferenceSignature(t *testing.T) {
+	key := newTestECDSAKey(t)
+	storage, err := db.NewStorage(filepath.Join(t.TempDir(), "inference.db"), 100)
+	if err != nil {
+		t.Fatalf("failed to create storage: %v", err)
+	}
+
+	s := &DepinServer{
+		Storage:         storage,
+		Verifier:        NewDIDSignatureVerifier(StaticKeyRegistry{testDid: &key.PublicKey}),
+		TimestampWindow: time.Minute,
+	}
+	body := signedRequestBody(t, key, `[{"role":"user","content":"hello"}]`, "1", strconv.FormatInt(time.Now().Unix(), 10))
+
+	accept := func(inferenceReq *HandleInferenceReq) error {
+		if err := s.authenticateInference(inferenceReq); err != nil {
+			return err
+		}
+		return s.consumeInferenceSignature(inferenceReq)
+	}
+
+	if err := accept(parseTestRequest(t, body)); err != nil {
+		t.Fatalf("first request rejected: %v", err)
+	}
+	if err := accept(parseTestRequest(t, body)); !errors.Is(err, db.ErrReplayedSignature) {
+		t.Fatalf("replayed request error = %v, want %v", err, db.ErrReplayedSignature)
+	}
+
+	// Encoding the same signature differently does not make it a new request
+	reencoded := parseTestRequest(t, body)
+	decoded, err := hex.DecodeString(reencoded.Signature)
+	if err != nil {
+		t.Fatalf("failed to decode signature: %v", err)
+	}
+	reencoded.Signature = base64.StdEncoding.EncodeToString(decoded)
+	if err := accept(reencoded); !errors.Is(err, db.ErrReplayedSignature) {
+		t.Fatalf("re-encoded request error = %v, want %v", err, db.ErrReplayedSignature)
+	}
+}
+
+func TestStaleInferenceSignature(t *testing.T) {
+	key := newTestECDSAKey(t)
+	s := &DepinServer{
+		Verifier:        NewDIDSignatureVerifier(StaticKeyRegistry{testDid: &key.PublicKey}),
+		TimestampWindow: time.Minute,
+	}
+	stale := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+
+	body := signedRequestBody(t, key, `[{"role":"user","content":"hello"}]`, "1", stale)
+	if err := s.authenticateInference(parseTestRequest(t, body)); err == nil {
+		t.Fatal("authenticateInference() accepted a stale timestamp")
+	}
+}
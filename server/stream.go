@@ -0,0 +1,124 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"depin-server/constants"
+	"depin-server/db"
+	"depin-server/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxStreamChunkSize is the largest single NDJSON line accepted from the inference backend
+const maxStreamChunkSize = 1 << 20
+
+// streamChunk holds the fields of an Ollama stream chunk needed to track progress,
+// the usage is only set on the final chunk
+type streamChunk struct {
+	Done    bool `json:"done"`
+	Message *struct {
+		ToolCalls []json.RawMessage `json:"tool_calls"`
+	} `json:"message"`
+	InferenceUsage
+}
+
+// wantsSSE reports whether the client asked for Server-Sent Events instead of NDJSON
+func wantsSSE(c *gin.Context) bool {
+	return strings.Contains(c.GetHeader("Accept"), "text/event-stream") || c.Query("sse") == "true"
+}
+
+// relayInferenceStream forwards the Ollama NDJSON stream to the client chunk by chunk,
+// either as-is or wrapped in SSE events, and returns the outcome of the stream.
+func relayInferenceStream(ctx context.Context, c *gin.Context, resp *BackendResponse, record *db.InferenceRecord) string {
+	sse := wantsSSE(c)
+	if sse {
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+	} else {
+		c.Header("Content-Type", "application/x-ndjson")
+	}
+	c.Status(http.StatusOK)
+
+	return relayChunks(ctx, c, resp.Body, record, func(line []byte, done bool) error {
+		if sse {
+			if _, err := io.WriteString(c.Writer, "data: "); err != nil {
+				return err
+			}
+			if _, err := c.Writer.Write(line); err != nil {
+				return err
+			}
+			_, err := io.WriteString(c.Writer, "\n\n")
+			return err
+		}
+
+		if _, err := c.Writer.Write(line); err != nil {
+			return err
+		}
+		_, err := io.WriteString(c.Writer, "\n")
+		return err
+	})
+}
+
+// relayChunks reads newline-delimited JSON chunks from body and hands each one to emit,
+// flushing the client connection after every chunk. The usage of the final chunk and the
+// tool calls of all chunks are copied onto record. It returns the outcome of the stream:
+// success once the final "done" chunk was delivered, client_abort if the client went away,
+// timeout if ctx hit the generation time limit, and partial if the backend stream ended early.
+func relayChunks(ctx context.Context, c *gin.Context, body io.Reader, record *db.InferenceRecord, emit func(line []byte, done bool) error) string {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxStreamChunkSize)
+
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		if status := contextFailureStatus(ctx); status != "" {
+			utils.LogInfo("Inference stream ended early: %v", ctx.Err())
+			return status
+		}
+
+		var chunk streamChunk
+		if err := json.Unmarshal(line, &chunk); err != nil {
+			utils.LogInfo("Error parsing inference stream chunk: %v", err)
+			return constants.INFERENCE_STATUS_PARTIAL
+		}
+
+		if chunk.Done {
+			chunk.InferenceUsage.applyTo(record)
+		}
+		if chunk.Message != nil {
+			record.ToolCallCount += len(chunk.Message.ToolCalls)
+		}
+
+		if err := emit(line, chunk.Done); err != nil {
+			utils.LogInfo("Error writing inference stream chunk to client: %v", err)
+			return constants.INFERENCE_STATUS_CLIENT_ABORT
+		}
+		c.Writer.Flush()
+
+		if chunk.Done {
+			return constants.INFERENCE_STATUS_SUCCESS
+		}
+	}
+
+	if status := contextFailureStatus(ctx); status != "" {
+		return status
+	}
+	if err := scanner.Err(); err != nil {
+		utils.LogInfo("Error reading inference stream from backend: %v", err)
+		if status := inferenceFailureStatus(ctx, err); status == constants.INFERENCE_STATUS_TIMEOUT {
+			return status
+		}
+	}
+	return constants.INFERENCE_STATUS_PARTIAL
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+// ToolCall is a tool invocation requested by the model, in the Ollama format
+type ToolCall struct {
+	ID       string            `json:"id,omitempty"`
+	Function *ToolCallFunction `json:"function"`
+}
+
+type ToolCallFunction struct {
+	Name string `json:"name"`
+	// Arguments is a JSON object of the arguments to call the function with
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// UnmarshalJSON accepts the arguments either as a JSON object, as in the Ollama API, or
+// as a string holding the JSON object, as in the OpenAI API
+func (f *ToolCallFunction) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	f.Name = raw.Name
+	f.Arguments = raw.Arguments
+
+	var encoded string
+	if err := json.Unmarshal(raw.Arguments, &encoded); err == nil {
+		f.Arguments = toolArgumentsFromOpenAI(encoded)
+	}
+	if len(f.Arguments) > 0 && !bytes.HasPrefix(bytes.TrimSpace(f.Arguments), []byte("{")) {
+		return errors.New("tool call arguments must be a JSON object")
+	}
+	return nil
+}
+
+// OpenAIMessage is a message in the OpenAI format, whose tool calls carry their
+// arguments as a string
+type OpenAIMessage struct {
+	Role       string            `json:"role,omitempty"`
+	Content    string            `json:"content"`
+	ToolCalls  []*OpenAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string            `json:"tool_call_id,omitempty"`
+}
+
+type OpenAIToolCall struct {
+	// Index identifies the tool call a stream delta belongs to
+	Index    *int                    `json:"index,omitempty"`
+	ID       string                  `json:"id,omitempty"`
+	Type     string                  `json:"type,omitempty"`
+	Function *OpenAIToolCallFunction `json:"function,omitempty"`
+}
+
+type OpenAIToolCallFunction struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
+}
+
+// toOpenAIMessage converts a message to the OpenAI format, assigning IDs to tool calls
+// from runtimes which do not identify them
+func toOpenAIMessage(message *Message) *OpenAIMessage {
+	if message == nil {
+		return &OpenAIMessage{}
+	}
+
+	openAIMessage := &OpenAIMessage{
+		Role:       message.Role,
+		Content:    message.Content,
+		ToolCallID: message.ToolCallID,
+	}
+	for i, toolCall := range message.ToolCalls {
+		if toolCall == nil || toolCall.Function == nil {
+			continue
+		}
+		index := i
+		id := toolCall.ID
+		if id == "" {
+			id = "call_" + uuid.New().String()
+		}
+		arguments := string(toolCall.Function.Arguments)
+		if arguments == "" {
+			arguments = "{}"
+		}
+		openAIMessage.ToolCalls = append(openAIMessage.ToolCalls, &OpenAIToolCall{
+			Index:    &index,
+			ID:       id,
+			Type:     "function",
+			Function: &OpenAIToolCallFunction{Name: toolCall.Function.Name, Arguments: arguments},
+		})
+	}
+	return openAIMessage
+}
+
+// fromOpenAIMessage converts a message received from an OpenAI-compatible runtime
+func fromOpenAIMessage(openAIMessage *OpenAIMessage) *Message {
+	message := &Message{
+		Role:       openAIMessage.Role,
+		Content:    openAIMessage.Content,
+		ToolCallID: openAIMessage.ToolCallID,
+	}
+	message.ToolCalls = toolCallsFromOpenAI(openAIMessage.ToolCalls)
+	return message
+}
+
+func toolCallsFromOpenAI(openAIToolCalls []*OpenAIToolCall) []*ToolCall {
+	var toolCalls []*ToolCall
+	for _, toolCall := range openAIToolCalls {
+		if toolCall == nil || toolCall.Function == nil {
+			continue
+		}
+		toolCalls = append(toolCalls, &ToolCall{
+			ID: toolCall.ID,
+			Function: &ToolCallFunction{
+				Name:      toolCall.Function.Name,
+				Arguments: toolArgumentsFromOpenAI(toolCall.Function.Arguments),
+			},
+		})
+	}
+	return toolCalls
+}
+
+// toolArgumentsFromOpenAI decodes the string encoded arguments of an OpenAI tool call,
+// which models may leave empty or truncate
+func toolArgumentsFromOpenAI(arguments string) json.RawMessage {
+	if !json.Valid([]byte(arguments)) {
+		return json.RawMessage("{}")
+	}
+	return json.RawMessage(arguments)
+}
+
+// mergeToolCallDeltas folds the tool call deltas of an OpenAI stream event into the calls
+// accumulated so far. Deltas of the same call share its index, and append to its arguments.
+func mergeToolCallDeltas(toolCalls []*OpenAIToolCall, deltas []*OpenAIToolCall) []*OpenAIToolCall {
+	for _, delta := range deltas {
+		index := len(toolCalls)
+		if delta.Index != nil {
+			index = *delta.Index
+		}
+		for len(toolCalls) <= index {
+			toolCalls = append(toolCalls, &OpenAIToolCall{Type: "function", Function: &OpenAIToolCallFunction{}})
+		}
+
+		toolCall := toolCalls[index]
+		if delta.ID != "" {
+			toolCall.ID = delta.ID
+		}
+		if delta.Function != nil {
+			if delta.Function.Name != "" {
+				toolCall.Function.Name = delta.Function.Name
+			}
+			toolCall.Function.Arguments += delta.Function.Arguments
+		}
+	}
+	return toolCalls
+}
+
+// countToolCalls returns the number of tool invocations in a response message
+func countToolCalls(message *Message) int {
+	if message == nil {
+		return 0
+	}
+	return len(message.ToolCalls)
+}
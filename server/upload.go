@@ -1,27 +1,61 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"depin-server/constants"
+	"depin-server/db"
 	"depin-server/rubix"
 	"depin-server/utils"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 )
 
-func (s *DepinServer) HandleFileUpload(c *gin.Context) {
-	uploadRoot := os.Getenv("UPLOAD_DIR")
-	if uploadRoot == "" {
-		uploadRoot = "uploads"
+// assetUpload describes an asset file received by one of the upload APIs, to be minted
+// as an NFT and, for models, launched with its runtime
+type assetUpload struct {
+	AssetName string
+	AssetType string
+	Runtime   string
+	ModelTag  string
+	// Filename is the asset file, stored in the upload directory of the asset. For assets
+	// made of several files it is the main one, such as the first shard of a model.
+	Filename      string
+	ProjectorName string
+	ProjectorPath string
+	// Files are all the files of the asset relative to its upload directory, by default
+	// the asset file and the projector
+	Files []string
+	// Checksums are the SHA-256 of files already verified, by path
+	Checksums map[string]string
+	Price     *db.AssetPrice
+	// Source is the Hugging Face file or repository an imported asset was downloaded from
+	Source *huggingFaceFile
+}
+
+// files returns the paths of the files of the asset relative to its upload directory
+func (u *assetUpload) files() []string {
+	if len(u.Files) > 0 {
+		return u.Files
 	}
+	files := []string{u.Filename}
+	if u.ProjectorName != "" {
+		files = append(files, u.ProjectorName)
+	}
+	return files
+}
 
+func (s *DepinServer) HandleFileUpload(c *gin.Context) {
 	assetName := c.PostForm("assetName")
 	assetType := c.PostForm("assetType")
 	url := c.PostForm("url")
@@ -62,93 +96,412 @@ func (s *DepinServer) HandleFileUpload(c *gin.Context) {
 		return
 	}
 
-	switch assetType {
-	case constants.ASSET_TYPE_DATASET, constants.ASSET_TYPE_MODEL:
-	default:
-		utils.LogInfo("Invalid assetType: %s", assetType)
-		utils.RespondError(c, http.StatusBadRequest, "Invalid assetType. Must be 'model' or 'dataset'", nil)
+	modelTag := c.PostForm("modelTag")
+	runtime, err := validateAssetKind(assetType, c.PostForm("runtime"), modelTag)
+	if err != nil {
+		utils.LogInfo("Invalid asset: %v", err)
+		utils.RespondError(c, http.StatusBadRequest, err.Error(), nil)
 		return
 	}
 
-	uploadDir := filepath.Join(uploadRoot, assetType+"s", assetName)
-	if err := os.MkdirAll(uploadDir, os.ModePerm); err != nil {
-		utils.LogInfo("Failed to create directory: %v", err)
-		utils.RespondError(c, http.StatusInternalServerError, "Upload directory error", err)
+	// Vision models come with a projector file which is uploaded alongside the model
+	projector, projectorHeader, err := c.Request.FormFile("projector")
+	if err == nil {
+		defer projector.Close()
+		if assetType != constants.ASSET_TYPE_MODEL {
+			utils.RespondError(c, http.StatusBadRequest, "A projector can only be uploaded with a model", nil)
+			return
+		}
+		if strings.ToLower(filepath.Ext(projectorHeader.Filename)) != ".gguf" {
+			utils.RespondError(c, http.StatusBadRequest, "Projector must be a .gguf file", nil)
+			return
+		}
+	} else if err != http.ErrMissingFile && err != http.ErrNotMultipart {
+		utils.LogInfo("Error reading projector file: %v", err)
+		utils.RespondError(c, http.StatusBadRequest, "Projector file read error", err)
 		return
 	}
 
-	var filename string
+	// The price is optional at upload and can be set later, it is applied once the asset is registered
+	if c.PostForm("price") != "" {
+		if _, err := parseAssetPrice("", c.PostForm("pricingUnit"), c.PostForm("price")); err != nil {
+			utils.LogInfo("Invalid asset price: %v", err)
+			utils.RespondError(c, http.StatusBadRequest, "Invalid asset price", err)
+			return
+		}
+	}
 
-	if filePresent {
-		filename = filepath.Base(header.Filename)
-		dstPath := filepath.Join(uploadDir, filename)
+	now := time.Now().Unix()
+	job := &db.ImportJob{
+		ID:          uuid.New().String(),
+		AssetName:   assetName,
+		AssetType:   assetType,
+		Runtime:     runtime,
+		ModelTag:    modelTag,
+		Price:       c.PostForm("price"),
+		PricingUnit: c.PostForm("pricingUnit"),
+		Status:      constants.IMPORT_STATUS_QUEUED,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+
+	if url != "" {
+		// The URL is checked now so that the client learns of a bad URL before the job is queued
+		source, err := s.HuggingFace.Parse(url)
+		if err != nil {
+			utils.LogInfo("Invalid import URL %s: %v", url, err)
+			utils.RespondError(c, http.StatusBadRequest, "Invalid Hugging Face URL", err)
+			return
+		}
+		job.URL = url
 
-		outFile, err := os.Create(dstPath)
+		// A whole repository import takes the files matching the comma separated include
+		// globs, or all files, except those matching the exclude globs
+		job.Include, err = parseGlobs(c.PostForm("include"))
+		if err == nil {
+			job.Exclude, err = parseGlobs(c.PostForm("exclude"))
+		}
 		if err != nil {
-			utils.LogInfo("Error creating destination file: %v", err)
-			utils.RespondError(c, http.StatusInternalServerError, "File creation error", err)
+			utils.RespondError(c, http.StatusBadRequest, "Invalid include or exclude pattern", err)
+			return
+		}
+		if source.Path != "" && (len(job.Include) > 0 || len(job.Exclude) > 0) {
+			utils.RespondError(c, http.StatusBadRequest, "include and exclude only apply to repository URLs", nil)
 			return
 		}
-		defer outFile.Close()
+	}
 
-		if _, err := io.Copy(outFile, file); err != nil {
+	uploadDir := assetUploadDir(assetType, assetName)
+	if err := os.MkdirAll(uploadDir, os.ModePerm); err != nil {
+		utils.LogInfo("Failed to create directory: %v", err)
+		utils.RespondError(c, http.StatusInternalServerError, "Upload directory error", err)
+		return
+	}
+
+	if filePresent {
+		job.Filename = filepath.Base(header.Filename)
+		if err := saveUploadedFile(file, filepath.Join(uploadDir, job.Filename)); err != nil {
 			utils.LogInfo("Error saving file: %v", err)
 			utils.RespondError(c, http.StatusInternalServerError, "File write error", err)
 			return
 		}
-	} else {
-		if !strings.Contains(url, "huggingface.co") {
-			utils.RespondError(c, http.StatusBadRequest, "URL must be from huggingface.co", nil)
+		job.BytesTotal = header.Size
+
+		// Assets made of several files, such as sharded models, are uploaded with a file
+		// field for each file, the first being the main file
+		if headers := c.Request.MultipartForm.File["file"]; len(headers) > 1 {
+			job.Files = []string{job.Filename}
+			for _, extra := range headers[1:] {
+				name := filepath.Base(extra.Filename)
+				for _, existing := range job.Files {
+					if existing == name {
+						utils.RespondError(c, http.StatusBadRequest, "Uploaded files must have distinct names", fmt.Errorf("%s is uploaded twice", name))
+						return
+					}
+				}
+				if err := saveFileHeader(extra, filepath.Join(uploadDir, name)); err != nil {
+					utils.LogInfo("Error saving file: %v", err)
+					utils.RespondError(c, http.StatusInternalServerError, "File write error", err)
+					return
+				}
+				job.Files = append(job.Files, name)
+				job.BytesTotal += extra.Size
+			}
+		}
+		job.BytesDone = job.BytesTotal
+	}
+
+	if projector != nil {
+		job.Projector = filepath.Base(projectorHeader.Filename)
+		if err := saveUploadedFile(projector, filepath.Join(uploadDir, job.Projector)); err != nil {
+			utils.LogInfo("Error saving projector file: %v", err)
+			utils.RespondError(c, http.StatusInternalServerError, "Projector write error", err)
 			return
 		}
-		downloadURL := normalizeHuggingFaceURL(url)
-		parts := strings.Split(downloadURL, "/")
-		filename = strings.Split(parts[len(parts)-1], "?")[0]
-		fullPath := filepath.Join(uploadDir, filename)
+		if len(job.Files) > 0 {
+			job.Files = append(job.Files, job.Projector)
+		}
+	}
 
-		utils.LogInfo("Downloading asset from: %s", downloadURL)
-		stdout, stderr, err := runCommand("wget", "-O", fullPath, downloadURL)
-		if err != nil {
-			utils.LogInfo("wget failed: %v\nstdout: %s\nstderr: %s", err, stdout, stderr)
-			utils.RespondError(c, http.StatusInternalServerError, "Failed to download asset", err)
+	// Uploaded GGUF files are checked now so that corrupt files are rejected with the request
+	if filePresent {
+		files := job.Files
+		if len(files) == 0 {
+			files = []string{job.Filename, job.Projector}
+		}
+		if _, err := inspectGGUFFiles(uploadDir, files, job.Filename, job.Projector); err != nil {
+			utils.LogInfo("Invalid GGUF file: %v", err)
+			removeImportFiles(job)
+			utils.RespondError(c, http.StatusBadRequest, "Invalid GGUF file", err)
 			return
 		}
+		if assetType == constants.ASSET_TYPE_MODEL && runtime == constants.RUNTIME_OLLAMA {
+			if err := checkOllamaShards(files, job.Projector); err != nil {
+				removeImportFiles(job)
+				utils.RespondError(c, http.StatusBadRequest, err.Error(), nil)
+				return
+			}
+		}
+	}
+
+	if err := db.CreateImportJob(s.Storage, job); err != nil {
+		utils.LogInfo("Error creating import job: %v", err)
+		utils.RespondError(c, http.StatusInternalServerError, "Failed to queue import job", err)
+		return
+	}
+	s.Imports.notify()
+
+	// Minting and launching the asset, and downloading it for URL imports, take longer than
+	// clients wait for a response, so they run in the background
+	utils.LogInfo("Import job %s queued for %s (Type: %s)", job.ID, assetName, assetType)
+	utils.RespondSuccess(c, "Asset import queued successfully", job)
+}
+
+// validateAssetKind checks the type of an asset and the runtime serving it, and returns the
+// runtime. Models are launched with Ollama unless they are served by another runtime.
+func validateAssetKind(assetType string, runtime string, modelTag string) (string, error) {
+	switch assetType {
+	case constants.ASSET_TYPE_DATASET, constants.ASSET_TYPE_MODEL:
+	default:
+		return "", errors.New("Invalid assetType. Must be 'model' or 'dataset'")
+	}
+
+	switch runtime {
+	case "":
+		runtime = constants.RUNTIME_OLLAMA
+	case constants.RUNTIME_OLLAMA:
+	case constants.RUNTIME_LLAMACPP, constants.RUNTIME_OPENAI:
+		if assetType == constants.ASSET_TYPE_MODEL && modelTag == "" {
+			return "", errors.New("modelTag is required for models served by runtime " + runtime)
+		}
+	default:
+		return "", errors.New("Invalid runtime. Must be 'ollama', 'llamacpp' or 'openai'")
+	}
+	return runtime, nil
+}
+
+// assetError is a failed step of registering an asset, with the HTTP status and message
+// it is reported with
+type assetError struct {
+	Status  int
+	Message string
+	Err     error
+}
+
+func (e *assetError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Message, e.Err)
+}
+
+func (e *assetError) Unwrap() error {
+	return e.Err
+}
+
+// registerAsset hashes the files of an uploaded asset, mints its NFT, launches models with
+// their runtime and registers the asset. An asset made of a single file is minted from the
+// file, one made of several files from its manifest. stage, if set, is called with the
+// constants.IMPORT_STATUS_* stage before each step, and stops the registration if it
+// returns false. It returns the asset ID and the description of the asset sent to clients
+// and webhooks.
+func (s *DepinServer) registerAsset(upload *assetUpload, stage func(status string) bool) (string, gin.H, error) {
+	assetName, assetType, runtime, filename := upload.AssetName, upload.AssetType, upload.Runtime, upload.Filename
+	price := upload.Price
+	enter := func(status string) error {
+		if stage != nil && !stage(status) {
+			return errImportCancelled
+		}
+		return nil
 	}
 
-	assetID, err := rubix.GenerateAssetHash(assetName, assetType)
+	if err := enter(constants.IMPORT_STATUS_HASHING); err != nil {
+		return "", nil, err
+	}
+	uploadDir := assetUploadDir(assetType, assetName)
+	files, err := hashAssetFiles(uploadDir, upload.files(), upload.Checksums)
+	if err != nil {
+		utils.LogInfo("Error hashing asset files: %v", err)
+		return "", nil, &assetError{http.StatusInternalServerError, "File read error", err}
+	}
+	metadata, err := inspectGGUFFiles(uploadDir, upload.files(), filename, upload.ProjectorName)
+	if err != nil {
+		utils.LogInfo("Invalid GGUF file: %v", err)
+		return "", nil, &assetError{http.StatusBadRequest, "Invalid GGUF file", err}
+	}
+	if assetType == constants.ASSET_TYPE_MODEL && runtime == constants.RUNTIME_OLLAMA {
+		if err := checkOllamaShards(upload.files(), upload.ProjectorName); err != nil {
+			return "", nil, &assetError{http.StatusBadRequest, "Unsupported model for Ollama", err}
+		}
+	}
+
+	artifactPath := filepath.Join(uploadDir, filepath.FromSlash(files[0].Path))
+	if len(files) > 1 {
+		artifactPath, err = writeAssetManifest(uploadDir, &assetManifest{AssetName: assetName, AssetType: assetType, Files: files})
+		if err != nil {
+			utils.LogInfo("Error writing asset manifest: %v", err)
+			return "", nil, &assetError{http.StatusInternalServerError, "Manifest write error", err}
+		}
+	}
+
+	if err := enter(constants.IMPORT_STATUS_MINTING); err != nil {
+		return "", nil, err
+	}
+	assetID, err := rubix.GenerateAssetHash(artifactPath)
 	if err != nil {
 		utils.LogInfo("Error generating asset hash: %v", err)
-		utils.RespondError(c, http.StatusInternalServerError, "Asset ID generation failed", err)
-		return
+		return "", nil, &assetError{http.StatusInternalServerError, "Asset ID generation failed", err}
 	}
 
 	if err := utils.AppendAssetMetadata(assetType, assetName, assetID); err != nil {
 		utils.LogInfo("Error updating metadata: %v", err)
-		utils.RespondError(c, http.StatusInternalServerError, "Metadata write error", err)
-		return
+		return "", nil, &assetError{http.StatusInternalServerError, "Metadata write error", err}
+	}
+
+	asset := &db.Asset{
+		ID:   assetID,
+		Name: assetName,
+		Type: assetType,
+	}
+
+	if upload.Source != nil {
+		asset.SourceRepo = upload.Source.Repo
+		asset.SourceRevision = upload.Source.Revision
+		asset.SourceCommit = upload.Source.Commit
+		asset.SourceSHA256 = upload.Source.SHA256
 	}
 
 	if assetType == constants.ASSET_TYPE_MODEL {
-		modelInfo := &ModelInfo{
-			AssetID:       assetID,
-			AssetName:     assetName,
-			AssetFileName: filename,
+		// Runtimes other than Ollama are managed by the operator and serve the model under the given tag
+		asset.Runtime = runtime
+		asset.ModelTag = upload.ModelTag
+		asset.Projector = upload.ProjectorName
+
+		if runtime == constants.RUNTIME_OLLAMA {
+			modelInfo := &ModelInfo{
+				AssetID:       assetID,
+				AssetName:     assetName,
+				AssetFileName: filename,
+				ProjectorPath: upload.ProjectorPath,
+			}
+			// The NFT of an asset made of several files holds the manifest, the model is
+			// created from its GGUF file in the upload directory
+			if len(files) > 1 {
+				modelInfo.AssetPath = filepath.Join(uploadDir, filepath.FromSlash(filename))
+			}
+
+			if err := enter(constants.IMPORT_STATUS_LAUNCHING); err != nil {
+				return "", nil, err
+			}
+			launchedTag, err := runModel(modelInfo)
+			if err != nil {
+				utils.LogInfo("Failed to start Ollama model: %v", err)
+				s.emitEvent(constants.WEBHOOK_EVENT_MODEL_LAUNCH_FAILED, "", gin.H{
+					"assetId":   assetID,
+					"assetName": assetName,
+					"runtime":   runtime,
+					"error":     err.Error(),
+				})
+				return "", nil, &assetError{http.StatusInternalServerError, "Failed to launch model with Ollama", err}
+			}
+			asset.ModelTag = launchedTag
 		}
+	}
 
-		if err := runModel(modelInfo); err != nil {
-			utils.LogInfo("Failed to start Ollama model: %v", err)
-			utils.RespondError(c, http.StatusInternalServerError, "Failed to launch model with Ollama", err)
-			return
+	if err := db.AddAsset(s.Storage, asset); err != nil {
+		utils.LogInfo("Error registering asset: %v", err)
+		return "", nil, &assetError{http.StatusInternalServerError, "Asset registration error", err}
+	}
+	if err := db.SetAssetFiles(s.Storage, assetID, files); err != nil {
+		utils.LogInfo("Error registering asset files: %v", err)
+		return "", nil, &assetError{http.StatusInternalServerError, "Asset registration error", err}
+	}
+	if assetType == constants.ASSET_TYPE_MODEL && metadata != nil {
+		metadata.AssetID = assetID
+		if err := db.SetModelMetadata(s.Storage, metadata); err != nil {
+			utils.LogInfo("Error storing model metadata: %v", err)
+			return "", nil, &assetError{http.StatusInternalServerError, "Asset registration error", err}
 		}
 	}
 
-	utils.LogInfo("Asset uploaded: %s (Asset: %s, Type: %s)", filename, assetName, assetType)
-	utils.RespondSuccess(c, "Asset uploaded/imported successfully", gin.H{
+	if price != nil {
+		price.AssetID = assetID
+		if err := db.SetAssetPrice(s.Storage, price); err != nil {
+			utils.LogInfo("Error setting asset price: %v", err)
+			return "", nil, &assetError{http.StatusInternalServerError, "Asset price error", err}
+		}
+	}
+
+	uploaded := gin.H{
 		"fileName":  filename,
 		"assetName": assetName,
 		"assetType": assetType,
 		"assetId":   assetID,
-	})
+		"price":     price,
+		"projector": upload.ProjectorName,
+		"files":     files,
+	}
+	if assetType == constants.ASSET_TYPE_MODEL && metadata != nil {
+		uploaded["metadata"] = metadata
+	}
+	if upload.Source != nil {
+		uploaded["source"] = upload.Source
+	}
+	s.emitEvent(constants.WEBHOOK_EVENT_ASSET_UPLOADED, "", uploaded)
+
+	utils.LogInfo("Asset uploaded: %s (Asset: %s, Type: %s)", filename, assetName, assetType)
+	return assetID, uploaded, nil
+}
+
+// saveUploadedFile writes an uploaded file to path
+func saveUploadedFile(file multipart.File, path string) error {
+	outFile, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", path, err)
+	}
+	defer outFile.Close()
+
+	if _, err := io.Copy(outFile, file); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return nil
+}
+
+// saveFileHeader writes a file of a multipart form to path
+func saveFileHeader(header *multipart.FileHeader, path string) error {
+	file, err := header.Open()
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", header.Filename, err)
+	}
+	defer file.Close()
+
+	return saveUploadedFile(file, path)
+}
+
+// parseGlobs parses a comma separated list of glob patterns
+func parseGlobs(value string) ([]string, error) {
+	var globs []string
+	for _, glob := range strings.Split(value, ",") {
+		glob = strings.TrimSpace(glob)
+		if glob == "" {
+			continue
+		}
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", glob, err)
+		}
+		globs = append(globs, glob)
+	}
+	return globs, nil
+}
+
+// uploadRoot returns UPLOAD_DIR, the directory uploaded assets are stored in
+func uploadRoot() string {
+	if root := os.Getenv("UPLOAD_DIR"); root != "" {
+		return root
+	}
+	return "uploads"
+}
+
+// assetUploadDir returns the directory in UPLOAD_DIR holding the files of an asset
+func assetUploadDir(assetType string, assetName string) string {
+	return filepath.Join(uploadRoot(), assetType+"s", assetName)
 }
 
 func deleteFile(filePath string) error {
@@ -188,11 +541,3 @@ func getAssetLocationByFilename(assetID string, filename string) string {
 	// TODO: handle build dir for other OS
 	return filepath.Join(homeDir, "depin", "rubixgoplatform", "linux", "node0", "NFT", assetID, filename)
 }
-
-func normalizeHuggingFaceURL(original string) string {
-	original = strings.Replace(original, "/blob/", "/resolve/", 1)
-	if !strings.Contains(original, "?download=true") {
-		original += "?download=true"
-	}
-	return original
-}
@@ -15,35 +15,57 @@ type ModelInfo struct {
 	AssetID       string `json:"assetID"`
 	AssetName     string `json:"assetName"`
 	AssetFileName string `json:"assetFilename"`
+	// ProjectorPath is the vision projector of a multimodal model, if any
+	ProjectorPath string `json:"projectorPath,omitempty"`
+	// AssetPath is the model file, by default the file in the NFT directory of the asset
+	AssetPath string `json:"assetPath,omitempty"`
 }
 
 // runModel checks file type and launches appropriate runtime if supported.
 // Currently only .gguf files are handled via runModelWithOllama.
-func runModel(modelInfo *ModelInfo) error {
+// It returns the model tag under which the runtime serves the asset, or an
+// empty string if no runtime was launched.
+func runModel(modelInfo *ModelInfo) (string, error) {
 	ext := strings.ToLower(filepath.Ext(modelInfo.AssetFileName))
 
 	if ext == ".gguf" {
 		utils.LogInfo("Launching Ollama runtime for .gguf model: %s", modelInfo.AssetName)
-		return runModelWithOllama(
+		ggufPath := modelInfo.AssetPath
+		if ggufPath == "" {
+			ggufPath = getAssetLocationByFilename(modelInfo.AssetID, modelInfo.AssetFileName)
+		}
+		err := runModelWithOllama(
 			modelInfo.AssetID,
 			modelInfo.AssetName,
-			modelInfo.AssetFileName)
+			ggufPath,
+			modelInfo.ProjectorPath)
+		if err != nil {
+			return "", err
+		}
+		return modelTagForAsset(modelInfo.AssetID), nil
 	}
 
 	utils.LogInfo("No runtime associated with file type: %s (skipping execution)", ext)
-	return nil
+	return "", nil
+}
+
+// modelTagForAsset returns the Ollama model tag that runModelWithOllama creates for an asset
+func modelTagForAsset(assetID string) string {
+	return assetID + ":latest"
 }
 
-func runModelWithOllama(assetID, assetName, filename string) error {
+func runModelWithOllama(assetID, assetName, ggufPath, projectorPath string) error {
 	createScriptPath := os.Getenv("CREATE_OLLAMA_MODEL_SCRIPT")
 	if createScriptPath == "" {
 		return fmt.Errorf("CREATE_OLLAMA_MODEL_SCRIPT is not set")
 	}
 
-	ggufPath := getAssetLocationByFilename(assetID, filename)
-
-	// Step 1: Run create.sh
-	stdout, stderr, err := runCommand(createScriptPath, ggufPath, assetID)
+	// Step 1: Run create.sh, passing the projector of vision models as third argument
+	args := []string{ggufPath, assetID}
+	if projectorPath != "" {
+		args = append(args, projectorPath)
+	}
+	stdout, stderr, err := runCommand(createScriptPath, args...)
 	if err != nil {
 		utils.LogInfo("create.sh failed: %v\nstdout: %s\nstderr: %s", err, stdout, stderr)
 		return fmt.Errorf("create.sh failed: %w", err)
@@ -51,7 +73,7 @@ func runModelWithOllama(assetID, assetName, filename string) error {
 
 	// Step 2: Start tmux session to run Ollama
 	session := "ollama-" + assetID
-	stdout, stderr, err = runCommand("tmux", "new", "-s", session, "-d", "ollama", "run", assetID+":latest")
+	stdout, stderr, err = runCommand("tmux", "new", "-s", session, "-d", "ollama", "run", modelTagForAsset(assetID))
 	if err != nil {
 		utils.LogInfo("tmux run failed: %v\nstdout: %s\nstderr: %s", err, stdout, stderr)
 		return fmt.Errorf("tmux run failed: %w", err)
@@ -0,0 +1,489 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"depin-server/constants"
+	"depin-server/db"
+	"depin-server/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultWebhookTimeout     = 10 * time.Second
+	defaultWebhookMaxAttempts = 8
+	// webhookRetryBase is the delay before the first retry, doubled on every further attempt
+	webhookRetryBase = 10 * time.Second
+	webhookRetryMax  = time.Hour
+	// webhookPollInterval is how often the dispatcher looks for retries which became due
+	webhookPollInterval = 5 * time.Second
+	// webhookBatchSize is the number of deliveries attempted at once
+	webhookBatchSize = 50
+	// defaultWebhookDeliveriesLimit is the number of log entries returned by default
+	defaultWebhookDeliveriesLimit = 100
+)
+
+// Headers of webhook deliveries. The signature is the hex HMAC-SHA256 of
+// timestamp "." body under the secret of the webhook, prefixed with "sha256=".
+const (
+	webhookEventHeader     = "X-Depin-Event"
+	webhookDeliveryHeader  = "X-Depin-Delivery"
+	webhookTimestampHeader = "X-Depin-Timestamp"
+	webhookSignatureHeader = "X-Depin-Signature"
+)
+
+var webhookEvents = []string{
+	constants.WEBHOOK_EVENT_INFERENCE_COMPLETED,
+	constants.WEBHOOK_EVENT_BATCH_COMPLETED,
+	constants.WEBHOOK_EVENT_BATCH_CANCELLED,
+	constants.WEBHOOK_EVENT_ASSET_UPLOADED,
+	constants.WEBHOOK_EVENT_MODEL_LAUNCH_FAILED,
+	constants.WEBHOOK_EVENT_SETTLEMENT_EXECUTED,
+	constants.WEBHOOK_EVENT_SETTLEMENT_FAILED,
+}
+
+// CreateWebhookReq subscribes a URL to server events. Subscriptions of a DID must be
+// signed by the DID over the payload
+//
+//	"webhook" \n url \n timestamp
+//
+// while global subscriptions, without DID, receive the events of every DID and are
+// restricted to the admin.
+type CreateWebhookReq struct {
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`
+	Did       string   `json:"did"`
+	Timestamp string   `json:"timestamp"`
+	Signature string   `json:"signature"`
+}
+
+// WebhookEvent is the JSON body posted to webhooks
+type WebhookEvent struct {
+	ID        string `json:"id"`
+	Event     string `json:"event"`
+	Did       string `json:"did,omitempty"`
+	CreatedAt int64  `json:"created_at"`
+	Data      any    `json:"data"`
+}
+
+// SettlementEventData is the data of settlement events
+type SettlementEventData struct {
+	AssetID   string   `json:"asset_id"`
+	RecordIDs []string `json:"record_ids"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// WebhookDispatcher delivers queued events to webhooks, retrying failed deliveries with
+// exponential backoff until MaxAttempts is reached
+type WebhookDispatcher struct {
+	Client      *http.Client
+	MaxAttempts int
+
+	wake chan struct{}
+}
+
+func NewWebhookDispatcher(timeout time.Duration, maxAttempts int) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		Client:      &http.Client{Timeout: timeout},
+		MaxAttempts: maxAttempts,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// notify wakes the dispatcher after events were queued
+func (d *WebhookDispatcher) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// webhookDispatcherFromEnv reads WEBHOOK_TIMEOUT (a Go duration such as "10s") and
+// WEBHOOK_MAX_ATTEMPTS, the delivery attempts made before an event is dropped
+func webhookDispatcherFromEnv() *WebhookDispatcher {
+	timeout := defaultWebhookTimeout
+	if value := os.Getenv("WEBHOOK_TIMEOUT"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			utils.LogInfo("Invalid WEBHOOK_TIMEOUT %q, using default of %v", value, defaultWebhookTimeout)
+		} else {
+			timeout = parsed
+		}
+	}
+
+	return NewWebhookDispatcher(timeout, intFromEnv("WEBHOOK_MAX_ATTEMPTS", defaultWebhookMaxAttempts, 1))
+}
+
+// HandleCreateWebhook subscribes a URL to server events. The secret deliveries are signed
+// with is generated here and only returned in this response.
+func (s *DepinServer) HandleCreateWebhook(c *gin.Context) {
+	var webhookReq CreateWebhookReq
+	if err := c.ShouldBindJSON(&webhookReq); err != nil {
+		utils.LogInfo("Error unmarshalling webhook request: %v", err)
+		utils.RespondError(c, http.StatusBadRequest, "Invalid request format", err)
+		return
+	}
+
+	if err := validateWebhook(&webhookReq); err != nil {
+		utils.RespondError(c, http.StatusBadRequest, "Invalid webhook", err)
+		return
+	}
+
+	payload := []byte("webhook\n" + webhookReq.URL + "\n" + webhookReq.Timestamp)
+	if err := s.authorizeWebhook(c, webhookReq.Did, payload, webhookReq.Timestamp, webhookReq.Signature); err != nil {
+		utils.LogInfo("Authorization failed for webhook of DID %q: %v", webhookReq.Did, err)
+		utils.RespondError(c, http.StatusUnauthorized, "Webhook authorization failed", err)
+		return
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		utils.LogInfo("Error generating webhook secret: %v", err)
+		utils.RespondError(c, http.StatusInternalServerError, "Failed to generate webhook secret", err)
+		return
+	}
+
+	webhook := &db.Webhook{
+		ID:        uuid.New().String(),
+		Did:       webhookReq.Did,
+		URL:       webhookReq.URL,
+		Secret:    hex.EncodeToString(secret),
+		Events:    webhookReq.Events,
+		CreatedAt: time.Now().Unix(),
+	}
+	if webhook.Events == nil {
+		webhook.Events = []string{}
+	}
+	if err := db.AddWebhook(s.Storage, webhook); err != nil {
+		utils.LogInfo("Error adding webhook: %v", err)
+		utils.RespondError(c, http.StatusInternalServerError, "Failed to add webhook", err)
+		return
+	}
+
+	utils.LogInfo("Webhook %s added for DID %q", webhook.ID, webhook.Did)
+	utils.RespondSuccess(c, "Webhook added successfully", webhook)
+}
+
+// HandleGetWebhooks lists the webhooks of the DID given as query parameter, which signs
+// the payload
+//
+//	"webhook-list" \n did \n timestamp
+//
+// sent in the X-Depin-Did, X-Depin-Timestamp and X-Depin-Signature headers. Global
+// webhooks, listed without DID, are restricted to the admin.
+func (s *DepinServer) HandleGetWebhooks(c *gin.Context) {
+	did := c.Query("did")
+	if !s.authorizeWebhookOwner(c, did, "webhook-list", did) {
+		return
+	}
+
+	webhooks, err := db.GetWebhooks(s.Storage, did)
+	if err != nil {
+		utils.LogInfo("Error fetching webhooks: %v", err)
+		utils.RespondError(c, http.StatusInternalServerError, "Failed to fetch webhooks", err)
+		return
+	}
+	if webhooks == nil {
+		webhooks = []*db.Webhook{}
+	}
+	utils.RespondSuccess(c, "Webhooks fetched successfully", webhooks)
+}
+
+// HandleDeleteWebhook removes a webhook with its delivery log. The webhook of a DID can
+// only be removed by the DID, which signs the payload
+//
+//	"webhook-delete" \n webhook_id \n timestamp
+//
+// sent in the X-Depin-Did, X-Depin-Timestamp and X-Depin-Signature headers.
+func (s *DepinServer) HandleDeleteWebhook(c *gin.Context) {
+	webhookID := c.Param("webhookId")
+
+	webhook, err := db.GetWebhook(s.Storage, webhookID)
+	if err != nil {
+		utils.LogInfo("Error fetching webhook %s: %v", webhookID, err)
+		utils.RespondError(c, http.StatusInternalServerError, "Failed to fetch webhook", err)
+		return
+	}
+	if webhook == nil {
+		utils.RespondError(c, http.StatusNotFound, "Webhook not found", nil)
+		return
+	}
+
+	if !s.authorizeWebhookOwner(c, webhook.Did, "webhook-delete", webhookID) {
+		return
+	}
+
+	deleted, err := db.DeleteWebhook(s.Storage, webhookID)
+	if err != nil {
+		utils.LogInfo("Error deleting webhook %s: %v", webhookID, err)
+		utils.RespondError(c, http.StatusInternalServerError, "Failed to delete webhook", err)
+		return
+	}
+	if !deleted {
+		utils.RespondError(c, http.StatusNotFound, "Webhook not found", nil)
+		return
+	}
+
+	utils.LogInfo("Webhook %s deleted", webhookID)
+	utils.RespondSuccess(c, "Webhook deleted successfully", gin.H{"id": webhookID})
+}
+
+// HandleGetWebhookDeliveries returns the delivery log of a webhook, most recent first. The
+// events it holds are only shown to the DID of the webhook, which signs the
+// "webhook-deliveries" payload like for HandleDeleteWebhook, and to the admin.
+func (s *DepinServer) HandleGetWebhookDeliveries(c *gin.Context) {
+	webhookID := c.Param("webhookId")
+
+	limit := defaultWebhookDeliveriesLimit
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			utils.RespondError(c, http.StatusBadRequest, "limit must be a positive integer", err)
+			return
+		}
+		limit = parsed
+	}
+
+	webhook, err := db.GetWebhook(s.Storage, webhookID)
+	if err != nil {
+		utils.LogInfo("Error fetching webhook %s: %v", webhookID, err)
+		utils.RespondError(c, http.StatusInternalServerError, "Failed to fetch webhook", err)
+		return
+	}
+	if webhook == nil {
+		utils.RespondError(c, http.StatusNotFound, "Webhook not found", nil)
+		return
+	}
+	if !s.authorizeWebhookOwner(c, webhook.Did, "webhook-deliveries", webhookID) {
+		return
+	}
+
+	deliveries, err := db.GetWebhookDeliveries(s.Storage, webhookID, limit)
+	if err != nil {
+		utils.LogInfo("Error fetching deliveries of webhook %s: %v", webhookID, err)
+		utils.RespondError(c, http.StatusInternalServerError, "Failed to fetch webhook deliveries", err)
+		return
+	}
+	if deliveries == nil {
+		deliveries = []*db.WebhookDelivery{}
+	}
+	utils.RespondSuccess(c, "Webhook deliveries fetched successfully", deliveries)
+}
+
+func validateWebhook(webhookReq *CreateWebhookReq) error {
+	parsed, err := url.Parse(webhookReq.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("url must be an absolute http or https URL, got %q", webhookReq.URL)
+	}
+
+	for _, event := range webhookReq.Events {
+		known := false
+		for _, webhookEvent := range webhookEvents {
+			if event == webhookEvent {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown event %q, must be one of %s", event, strings.Join(webhookEvents, ", "))
+		}
+	}
+	return nil
+}
+
+// authorizeWebhookOwner authorizes a request on the webhooks of a DID with authorizeOwner,
+// or responds with an error
+func (s *DepinServer) authorizeWebhookOwner(c *gin.Context, did string, action string, resourceID string) bool {
+	err := s.authorizeOwner(c, did, action, resourceID)
+	if errors.Is(err, errNotOwner) {
+		utils.RespondError(c, http.StatusForbidden, "Webhook belongs to another DID", nil)
+		return false
+	}
+	if err != nil {
+		utils.LogInfo("Authorization failed for %s of DID %q: %v", action, did, err)
+		utils.RespondError(c, http.StatusUnauthorized, "Webhook authorization failed", err)
+		return false
+	}
+	return true
+}
+
+// authorizeWebhook checks that a change to the webhooks of a DID was signed by the DID
+// over payload. The admin may change any webhook, and is the only one allowed to change
+// global webhooks, or the webhooks of a DID while signature verification is disabled.
+func (s *DepinServer) authorizeWebhook(c *gin.Context, did string, payload []byte, timestamp string, signature string) error {
+	if s.authorizeAdmin(c) == nil {
+		return nil
+	}
+	if did == "" {
+		return errors.New("global webhooks are restricted to the admin")
+	}
+	return s.verifySignedRequest(did, payload, timestamp, signature)
+}
+
+// emitEvent queues an event for the global webhooks and the webhooks of the DID it
+// concerns. Events are best effort, a failure to queue them is logged.
+func (s *DepinServer) emitEvent(event string, did string, data any) {
+	webhookEvent := &WebhookEvent{
+		ID:        uuid.New().String(),
+		Event:     event,
+		Did:       did,
+		CreatedAt: time.Now().Unix(),
+		Data:      data,
+	}
+
+	payload, err := json.Marshal(webhookEvent)
+	if err != nil {
+		utils.LogInfo("Error encoding %s event: %v", event, err)
+		return
+	}
+
+	queued, err := db.AddWebhookDeliveries(s.Storage, webhookEvent.ID, event, did, string(payload))
+	if err != nil {
+		utils.LogInfo("Error queueing %s event: %v", event, err)
+		return
+	}
+	if queued > 0 {
+		s.Webhooks.notify()
+	}
+}
+
+// emitSettlement is the settlement listener of the storage
+func (s *DepinServer) emitSettlement(assetID string, records []db.InferenceRecord, err error) {
+	data := &SettlementEventData{
+		AssetID:   assetID,
+		RecordIDs: make([]string, 0, len(records)),
+	}
+	for _, record := range records {
+		data.RecordIDs = append(data.RecordIDs, record.ID)
+	}
+
+	event := constants.WEBHOOK_EVENT_SETTLEMENT_EXECUTED
+	if err != nil {
+		event = constants.WEBHOOK_EVENT_SETTLEMENT_FAILED
+		data.Error = err.Error()
+	}
+	s.emitEvent(event, "", data)
+}
+
+// startWebhookDispatcher delivers queued events in the background
+func (s *DepinServer) startWebhookDispatcher() {
+	s.Storage.SetSettlementListener(s.emitSettlement)
+	go s.dispatchWebhooks()
+}
+
+func (s *DepinServer) dispatchWebhooks() {
+	for {
+		deliveries, webhooks, err := db.GetDueWebhookDeliveries(s.Storage, time.Now().Unix(), webhookBatchSize)
+		if err != nil {
+			utils.LogInfo("Error fetching webhook deliveries: %v", err)
+		}
+
+		var wg sync.WaitGroup
+		for i := range deliveries {
+			wg.Add(1)
+			go func(delivery *db.WebhookDelivery, webhook *db.Webhook) {
+				defer wg.Done()
+				s.deliverWebhook(delivery, webhook)
+			}(deliveries[i], webhooks[i])
+		}
+		wg.Wait()
+
+		if len(deliveries) < webhookBatchSize {
+			select {
+			case <-s.Webhooks.wake:
+			case <-time.After(webhookPollInterval):
+			}
+		}
+	}
+}
+
+// deliverWebhook makes a delivery attempt and stores its outcome in the delivery log
+func (s *DepinServer) deliverWebhook(delivery *db.WebhookDelivery, webhook *db.Webhook) {
+	now := time.Now()
+	delivery.Attempts++
+	delivery.UpdatedAt = now.Unix()
+
+	code, err := s.Webhooks.post(delivery, webhook, now)
+	delivery.ResponseCode = code
+	if err == nil {
+		delivery.Status = constants.WEBHOOK_DELIVERY_STATUS_DELIVERED
+		delivery.LastError = ""
+	} else {
+		delivery.LastError = err.Error()
+		if delivery.Attempts >= s.Webhooks.MaxAttempts {
+			utils.LogInfo("Giving up delivery %s to webhook %s after %d attempts: %v", delivery.ID, webhook.ID, delivery.Attempts, err)
+			delivery.Status = constants.WEBHOOK_DELIVERY_STATUS_FAILED
+		} else {
+			delivery.NextAttemptAt = now.Add(webhookRetryDelay(delivery.Attempts)).Unix()
+		}
+	}
+
+	if err := db.UpdateWebhookDelivery(s.Storage, delivery); err != nil {
+		utils.LogInfo("Error storing webhook delivery: %v", err)
+	}
+}
+
+// post sends a signed delivery to the webhook. Any 2xx response acknowledges it.
+func (d *WebhookDispatcher) post(delivery *db.WebhookDelivery, webhook *db.Webhook, now time.Time) (int, error) {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, strings.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, delivery.Event)
+	req.Header.Set(webhookDeliveryHeader, delivery.ID)
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader, "sha256="+signWebhookPayload(webhook.Secret, timestamp, []byte(delivery.Payload)))
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("webhook returned %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// signWebhookPayload returns the hex HMAC-SHA256 of timestamp "." payload, binding the
+// timestamp so that receivers can reject replayed deliveries
+func signWebhookPayload(secret string, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookRetryDelay is the backoff before the retry following the given number of attempts
+func webhookRetryDelay(attempts int) time.Duration {
+	delay := webhookRetryBase
+	for i := 1; i < attempts && delay < webhookRetryMax; i++ {
+		delay *= 2
+	}
+	if delay > webhookRetryMax {
+		delay = webhookRetryMax
+	}
+	return delay
+}
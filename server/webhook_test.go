@@ -0,0 +1,66 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"depin-server/constants"
+	"depin-server/db"
+)
+
+func TestWebhookOwnerAuthorization(t *testing.T) {
+	key := newTestECDSAKey(t)
+	s, router := newOwnerTestServer(t, key)
+	router.GET("/webhooks", s.HandleGetWebhooks)
+	router.GET("/webhooks/:webhookId/deliveries", s.HandleGetWebhookDeliveries)
+	router.DELETE("/webhooks/:webhookId", s.HandleDeleteWebhook)
+
+	for _, webhook := range []*db.Webhook{
+		{ID: "webhook-1", Did: testDid, URL: "http://127.0.0.1:1/hook", Secret: "secret", Events: []string{}, CreatedAt: time.Now().Unix()},
+		{ID: "webhook-global", URL: "http://127.0.0.1:1/global", Secret: "secret", Events: []string{}, CreatedAt: time.Now().Unix()},
+	} {
+		if err := db.AddWebhook(s.Storage, webhook); err != nil {
+			t.Fatalf("failed to add webhook: %v", err)
+		}
+	}
+	s.emitEvent(constants.WEBHOOK_EVENT_INFERENCE_COMPLETED, testDid, &db.InferenceRecord{ID: "record-1", Did: testDid, Query: "secret prompt"})
+
+	tests := []struct {
+		name     string
+		req      *http.Request
+		wantCode int
+		wantBody string
+	}{
+		{"list unsigned", httptest.NewRequest(http.MethodGet, "/webhooks?did="+testDid, nil), http.StatusForbidden, ""},
+		{"list by another DID", ownerRequest(t, key, http.MethodGet, "/webhooks?did="+testDid, "bafyother", "webhook-list", testDid), http.StatusForbidden, ""},
+		{"list by the DID", ownerRequest(t, key, http.MethodGet, "/webhooks?did="+testDid, testDid, "webhook-list", testDid), http.StatusOK, "webhook-1"},
+		{"list global", ownerRequest(t, key, http.MethodGet, "/webhooks", "", "webhook-list", ""), http.StatusUnauthorized, ""},
+		{"list global by the admin", adminRequest(http.MethodGet, "/webhooks"), http.StatusOK, "webhook-global"},
+		{"deliveries unsigned", httptest.NewRequest(http.MethodGet, "/webhooks/webhook-1/deliveries", nil), http.StatusForbidden, ""},
+		{"deliveries signed for listing", ownerRequest(t, key, http.MethodGet, "/webhooks/webhook-1/deliveries", testDid, "webhook-list", "webhook-1"), http.StatusUnauthorized, ""},
+		{"deliveries by the DID", ownerRequest(t, key, http.MethodGet, "/webhooks/webhook-1/deliveries", testDid, "webhook-deliveries", "webhook-1"), http.StatusOK, "secret prompt"},
+		{"global deliveries", ownerRequest(t, key, http.MethodGet, "/webhooks/webhook-global/deliveries", testDid, "webhook-deliveries", "webhook-global"), http.StatusUnauthorized, ""},
+		{"global deliveries by the admin", adminRequest(http.MethodGet, "/webhooks/webhook-global/deliveries"), http.StatusOK, "secret prompt"},
+		{"delete by another DID", ownerRequest(t, key, http.MethodDelete, "/webhooks/webhook-1", "bafyother", "webhook-delete", "webhook-1"), http.StatusForbidden, ""},
+		{"delete by the DID", ownerRequest(t, key, http.MethodDelete, "/webhooks/webhook-1", testDid, "webhook-delete", "webhook-1"), http.StatusOK, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, tt.req)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			if w.Code != http.StatusOK && strings.Contains(w.Body.String(), "secret prompt") {
+				t.Errorf("rejected response leaks the event payload: %s", w.Body.String())
+			}
+			if !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("response does not hold %q: %s", tt.wantBody, w.Body.String())
+			}
+		})
+	}
+}